@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+// newDNSServer builds the DNS server from the dns section; queries for
+// tunneled domains go through dialTunnel, the others through direct
+func newDNSServer(dc config.DNSConfig, rt *router.Router, dialTunnel dns.DialFunc, direct *tunnel.Direct) (*dns.Server, error) {
+	opts := dns.Options{Listen: dc.Listen, Router: rt, Strategy: direct.Strategy()}
+
+	upstream := dc.Upstream
+	if upstream == "" {
+		upstream = "tcp://1.1.1.1"
+	}
+	var err error
+	if opts.Upstream, err = dns.NewUpstream(upstream, dialTunnel, false); err != nil {
+		return nil, err
+	}
+	if dc.DirectUpstream != "" {
+		if opts.Direct, err = dns.NewUpstream(dc.DirectUpstream, direct.Dial, true); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case dc.CacheSize == 0:
+		opts.Cache = dns.NewCache(4096)
+	case dc.CacheSize > 0:
+		opts.Cache = dns.NewCache(dc.CacheSize)
+	}
+
+	if dc.FakeIP {
+		fakeRange := dc.FakeIPRange
+		if fakeRange == "" {
+			fakeRange = "198.19.0.0/16"
+		}
+		if opts.FakeIP, err = dns.NewFakeIPPool(fakeRange); err != nil {
+			return nil, err
+		}
+		direct.SetFakeIPPool(opts.FakeIP)
+	}
+	return dns.NewServer(opts), nil
+}
+
+// dialTunnel opens a stream through one of the servers as a net.Conn
+func (c *XPClient) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	return tunnel.DialStream(ctx, c.selector, network, addr)
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"flag"
 	"fmt"
 	"net"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -15,19 +15,29 @@ import (
 
 	"github.com/abbasnazari-0/xp-proto/pkg/config"
 	"github.com/abbasnazari-0/xp-proto/pkg/crypto"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
 	"github.com/abbasnazari-0/xp-proto/pkg/obfs"
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
 	xtls "github.com/abbasnazari-0/xp-proto/pkg/tls"
+	"github.com/abbasnazari-0/xp-proto/pkg/transport"
 	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+	"github.com/abbasnazari-0/xp-proto/pkg/uri"
 )
 
 var (
-	configPath = flag.String("c", "config.yaml", "Path to config file")
+	configPath = flag.String("c", "config.yaml", "Path to config file, empty = defaults and XP_* variables only")
 	configURI  = flag.String("uri", "", "XP Protocol URI (xp://...)")
+	subURL     = flag.String("sub", "", "Subscription URL to take the servers from")
 	genKey     = flag.Bool("genkey", false, "Generate a new key")
 	genConfig  = flag.Bool("genconfig", false, "Generate example config")
+	checkOnly  = flag.Bool("check", false, "Check the config (or -uri link) and exit")
+	tproxyCmd  = flag.String("transparent-rules", "", "Print, install or remove the transparent proxy firewall rules (print, install, remove)")
+	printCfg   = flag.Bool("print-config", false, "Print the effective config with secrets redacted and exit")
+	overrides  config.Overrides
 )
 
 func main() {
+	flag.Var(&overrides, "set", "Override a config field, e.g. -set client.socks_addr=0.0.0.0:1080 (repeatable)")
 	flag.Parse()
 
 	if *genKey {
@@ -50,13 +60,20 @@ func main() {
 
 	// Check if URI is provided
 	if *configURI != "" {
-		cfg, err = parseXPURI(*configURI)
+		cfg, err = uri.Decode(*configURI)
 		if err != nil {
 			fmt.Printf("❌ Failed to parse URI: %v\n", err)
 			os.Exit(1)
 		}
+		fmt.Printf("📡 Connecting to: %s\n", cfg.Client.ServerAddr)
+		fmt.Printf("🎭 SNI: %s\n", cfg.Client.FakeSNI)
+		fmt.Printf("🔧 Fragment: %v | Padding: %v\n", cfg.Obfuscation.FragmentEnabled(), cfg.Obfuscation.PaddingEnabled())
+	} else if *subURL != "" {
+		c := config.DefaultClientConfig()
+		c.Client.Subscription.URL = *subURL
+		cfg = &c
 	} else {
-		cfg, err = config.LoadConfig(*configPath)
+		cfg, err = config.Load(*configPath, config.DefaultClientConfig())
 		if err != nil {
 			fmt.Printf("❌ Failed to load config: %v\n", err)
 			fmt.Println("💡 Run with -genconfig to generate example config")
@@ -64,6 +81,58 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	// XP_* variables and -set flags go over the file, link or subscription
+	if err := cfg.Override(os.Environ(), overrides); err != nil {
+		fmt.Printf("❌ Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Mode == "server" {
+		fmt.Printf("❌ %s is a server config, run it with xp-server\n", *configPath)
+		os.Exit(1)
+	}
+	for _, key := range cfg.Deprecated {
+		fmt.Printf("⚠️  %s is deprecated, move it to the obfuscation section\n", key)
+	}
+	if len(cfg.Migrated) > 0 {
+		fmt.Printf("⚠️  %s is an old config version, read it as:\n", *configPath)
+		for _, note := range cfg.Migrated {
+			fmt.Printf("   • %s\n", note)
+		}
+		fmt.Printf("💡 Upgrade the file with: xp-server config migrate -c %s\n", *configPath)
+	}
+	if *printCfg {
+		data, err := cfg.Redacted()
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(string(data))
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("❌ Invalid config:")
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("   • %s\n", problem)
+		}
+		os.Exit(1)
+	}
+	if *checkOnly {
+		// Routing reads its geoip and geosite files, so check those too
+		if _, err := router.FromConfig(cfg.Client.Routing); err != nil {
+			fmt.Printf("❌ Invalid routing: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("✅ Config is valid")
+		return
+	}
+
+	if *tproxyCmd != "" {
+		if err := runTransparentRules(cfg, *tproxyCmd); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	fmt.Println("╔═══════════════════════════════════════════╗")
 	fmt.Println("║       XP Protocol Client v1.0             ║")
@@ -89,158 +158,298 @@ func main() {
 	}
 }
 
-// parseXPURI parses xp:// URI format
-// Format: xp://KEY@SERVER:PORT?transport=tls&sni=example.com&fragment=true#Name
-func parseXPURI(uri string) (*config.Config, error) {
-	// Remove xp:// prefix
-	if !strings.HasPrefix(uri, "xp://") {
-		return nil, fmt.Errorf("invalid URI scheme, expected xp://")
-	}
-
-	// Parse as URL
-	u, err := url.Parse(uri)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse URI: %w", err)
-	}
-
-	// Extract key from userinfo
-	key := ""
-	if u.User != nil {
-		key = u.User.Username()
-	}
-	if key == "" {
-		return nil, fmt.Errorf("key not found in URI")
-	}
-
-	// Extract server and port
-	host := u.Hostname()
-	portStr := u.Port()
-	if portStr == "" {
-		portStr = "443"
-	}
+type XPClient struct {
+	config      *config.Config
+	selector    *selector
+	socks5      *tunnel.SOCKS5Server
+	http        *tunnel.HTTPProxyServer
+	transparent *tunnel.TransparentProxy
+	tun         *tunnel.TUNProxy
+	router      *router.Router
+	dns         *dns.Server
+	obfs        tunnel.Obfuscation
+	fragmenter  *obfs.Fragmenter
+	ipStrategy  dns.Strategy
+	direct      *tunnel.Direct
+	sub         *subscription
+	stop        chan struct{}
+
+	// excluded has the server addresses kept out of TUN and transparent
+	// routing at startup, nil when neither is in use
+	excluded map[string]bool
+
+	statusListener net.Listener
+}
 
-	// Parse query parameters
-	params := u.Query()
-	transport := params.Get("transport")
-	if transport == "" {
-		transport = "tls"
+func NewXPClient(cfg *config.Config) *XPClient {
+	for _, spec := range cfg.Client.Endpoints() {
+		if _, err := newEndpoint(cfg, spec); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			os.Exit(1)
+		}
 	}
-	sni := params.Get("sni")
-	if sni == "" {
-		sni = "www.microsoft.com"
+	var sub *subscription
+	if cfg.Client.Subscription.URL != "" {
+		sub = newSubscription(cfg.Client.Subscription)
+	} else if len(cfg.Client.Endpoints()) == 0 {
+		fmt.Println("⚠️  No server: set client.server_addr, client.servers or client.subscription.url")
+		os.Exit(1)
 	}
-	fragment := params.Get("fragment") == "true"
-	padding := params.Get("padding") == "true"
-	fingerprint := params.Get("fingerprint")
-	if fingerprint == "" {
-		fingerprint = "chrome"
+	sel, err := newSelector(cfg.Client.Selection.Strategy, nil)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+		os.Exit(1)
 	}
 
-	// Build config
-	cfg := config.DefaultClientConfig()
-	cfg.Client.ServerAddr = fmt.Sprintf("%s:%s", host, portStr)
-	cfg.Client.Key = key
-	cfg.Client.FakeSNI = sni
-	cfg.Client.Fragment = fragment
-	cfg.Client.Padding = padding
-	cfg.Client.Fingerprint = fingerprint
-	cfg.Transport.Mode = transport
-
-	fmt.Printf("📡 Connecting to: %s:%s\n", host, portStr)
-	fmt.Printf("🎭 SNI: %s\n", sni)
-	fmt.Printf("🔧 Fragment: %v | Padding: %v\n", fragment, padding)
-
-	return &cfg, nil
-}
-
-type XPClient struct {
-	config     *config.Config
-	key        []byte
-	socks5     *tunnel.SOCKS5Server
-	fragmenter *obfs.Fragmenter
-}
-
-func NewXPClient(cfg *config.Config) *XPClient {
-	key, err := cfg.Client.GetKey()
+	strategy, err := dns.ParseStrategy(cfg.Client.IPStrategy)
 	if err != nil {
-		fmt.Printf("⚠️  Invalid key\n")
+		fmt.Printf("⚠️  %v\n", err)
 		os.Exit(1)
 	}
+	direct := tunnel.NewDirect(strategy)
 
-	fragConfig := obfs.DefaultFragmentConfig()
-	fragConfig.Enabled = cfg.Client.Fragment
+	var rt *router.Router
+	if len(cfg.Client.Routing.Rules) > 0 || cfg.Client.Routing.Final != "" {
+		if rt, err = router.FromConfig(cfg.Client.Routing); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			os.Exit(1)
+		}
+		// IP rules look domains up the way direct connections do
+		rt.SetResolver(direct.LookupIP)
+	}
 
-	return &XPClient{
+	obfuscation := tunnel.ObfuscationFromConfig(cfg.Obfuscation)
+
+	client := &XPClient{
 		config:     cfg,
-		key:        key,
+		selector:   sel,
 		socks5:     tunnel.NewSOCKS5Server(cfg.Client.SOCKSAddr),
-		fragmenter: obfs.NewFragmenter(fragConfig),
+		router:     rt,
+		obfs:       obfuscation,
+		fragmenter: obfs.NewFragmenter(obfuscation.Fragment),
+		ipStrategy: strategy,
+		direct:     direct,
+		sub:        sub,
+		stop:       make(chan struct{}),
+	}
+	// Direct dialing is set up above, so the subscription can be fetched
+	servers := initialServers(cfg, sub, direct)
+	client.setServers(servers, false)
+	users := cfg.Client.ProxyUsers()
+	client.socks5.SetSession(sel)
+	client.socks5.SetUsers(users)
+	client.socks5.SetRouter(rt)
+	client.socks5.SetDirect(direct)
+	if cfg.Client.HTTPAddr != "" {
+		client.http = tunnel.NewHTTPProxyServer(cfg.Client.HTTPAddr)
+		client.http.SetSession(sel)
+		client.http.SetUsers(users)
+		client.http.SetRouter(rt)
+		client.http.SetDirect(direct)
+	}
+	if cfg.Client.Transparent.Listen != "" || (cfg.Client.TUN.Enabled && cfg.Client.TUN.AutoRoute) {
+		client.excluded = make(map[string]bool)
+		for _, s := range servers {
+			client.excluded[s.Address] = true
+		}
+	}
+	if cfg.Client.Transparent.Listen != "" {
+		client.transparent = tunnel.NewTransparentProxy(transparentOptions(cfg.Client.Transparent))
+		client.transparent.SetSession(sel)
+		client.transparent.SetRouter(rt)
+		client.transparent.SetDirect(direct)
+	}
+	if cfg.Client.TUN.Enabled {
+		opts, err := tunOptions(cfg, servers)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			os.Exit(1)
+		}
+		client.tun = tunnel.NewTUNProxy(opts)
+		client.tun.SetSession(sel)
+		client.tun.SetRouter(rt)
+		client.tun.SetDirect(direct)
+	}
+	if cfg.Client.DNS.Listen != "" {
+		if client.dns, err = newDNSServer(cfg.Client.DNS, rt, client.dialTunnel, direct); err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			os.Exit(1)
+		}
+		// Real answers for routing decisions and direct connections
+		direct.SetResolver(client.dns.LookupIP)
+		if client.tun != nil {
+			client.tun.SetDNS(client.dns)
+		}
 	}
+	return client
 }
 
 func (c *XPClient) Start() error {
-	fmt.Printf("🔗 Connecting to %s\n", c.config.Client.ServerAddr)
-	fmt.Printf("🎭 SNI: %s\n", c.config.Client.FakeSNI)
+	for _, ep := range c.selector.list() {
+		fmt.Printf("🔗 Connecting to %s (SNI: %s)\n", ep.name, ep.sni)
+	}
+	if c.sub != nil {
+		fmt.Printf("📰 Subscription: refreshed every %s\n", c.sub.interval)
+	}
+	if len(c.selector.list()) > 1 || c.sub != nil {
+		fmt.Printf("⚖️  Server selection: %s\n", c.selector.strategy)
+	}
 	fmt.Printf("🧦 SOCKS5 proxy: %s\n", c.config.Client.SOCKSAddr)
-	fmt.Printf("🔧 Fragmentation: %v | Fingerprint: %s\n",
-		c.config.Client.Fragment, c.config.Client.Fingerprint)
-	fmt.Println()
-
-	conn, err := c.connectToServer()
-	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+	if c.http != nil {
+		fmt.Printf("🌐 HTTP proxy: %s\n", c.config.Client.HTTPAddr)
 	}
-
-	fmt.Println("✅ Connected to server!")
+	if c.transparent != nil {
+		fmt.Printf("🪞 Transparent proxy: %s (%s)\n", c.config.Client.Transparent.Listen,
+			transparentOptions(c.config.Client.Transparent).Mode)
+	}
+	if c.tun != nil {
+		fmt.Printf("🕳️  TUN mode: auto route %v\n", c.config.Client.TUN.AutoRoute)
+	}
+	if c.router != nil {
+		fmt.Printf("🧭 Routing: %d rule(s), default %s\n", c.router.Rules(), c.router.Final())
+	}
+	if c.dns != nil {
+		fmt.Printf("🔎 DNS: %s (fake-IP: %v)\n", c.config.Client.DNS.Listen, c.config.Client.DNS.FakeIP)
+	}
+	if len(c.config.Client.Users) > 0 {
+		fmt.Printf("🔐 Proxy authentication: %d user(s)\n", len(c.config.Client.Users))
+	}
+	if c.config.Client.FastOpen {
+		fmt.Println("⚡ Fast open: streams connect in 0-RTT")
+	}
+	fmt.Printf("🔧 Fragmentation: %v | Padding: %v | Timing: %v | Fingerprint: %s\n",
+		c.obfs.Fragment.Enabled, c.obfs.Padding.Enabled, c.obfs.Timing.Enabled, c.config.Client.Fingerprint)
 	fmt.Println()
 
-	tun, err := tunnel.NewTunnel(conn, c.key)
-	if err != nil {
-		return fmt.Errorf("failed to create tunnel: %w", err)
+	for _, ep := range c.selector.list() {
+		c.launch(ep)
+	}
+	if c.sub != nil {
+		go c.refreshSubscription()
+	}
+	if c.config.Client.StatusAddr != "" {
+		if err := c.startStatus(c.config.Client.StatusAddr); err != nil {
+			fmt.Printf("❌ %v\n", err)
+		}
 	}
 
-	c.socks5.SetTunnel(tun)
+	if c.http != nil {
+		go func() {
+			if err := c.http.Start(); err != nil {
+				fmt.Printf("❌ %v\n", err)
+			}
+		}()
+	}
+	if c.transparent != nil {
+		go func() {
+			if err := c.transparent.Start(); err != nil {
+				fmt.Printf("❌ %v\n", err)
+			}
+		}()
+	}
+	if c.tun != nil {
+		go func() {
+			if err := c.tun.Start(); err != nil {
+				fmt.Printf("❌ %v\n", err)
+			}
+		}()
+	}
+	if c.dns != nil {
+		go func() {
+			if err := c.dns.Start(); err != nil {
+				fmt.Printf("❌ %v\n", err)
+			}
+		}()
+	}
 
 	fmt.Printf("🚀 SOCKS5 proxy ready on %s\n", c.config.Client.SOCKSAddr)
 	fmt.Println()
 	fmt.Println("💡 Configure your browser/apps to use:")
 	fmt.Printf("   SOCKS5: %s\n", c.config.Client.SOCKSAddr)
+	if c.http != nil {
+		fmt.Printf("   HTTP:   %s\n", c.config.Client.HTTPAddr)
+	}
 	fmt.Println()
 
 	return c.socks5.Start()
 }
 
-func (c *XPClient) connectToServer() (net.Conn, error) {
-	_ = xtls.NewClientHelloBuilder(c.config.Client.FakeSNI)
+// serverDialTimeout bounds the TCP connect and the TLS handshake together,
+// so a server that accepts but never answers can't stall a pool slot
+var serverDialTimeout = 10 * time.Second
+
+func (c *XPClient) connectToServer(ep *endpoint) (net.Conn, error) {
+	switch transport.Mode(ep.transport.Mode) {
+	case transport.ModeKCP, transport.ModeQUIC, transport.ModeRaw:
+		return c.dialTransport(ep)
+	}
+
+	_ = xtls.NewClientHelloBuilder(ep.sni)
 
 	tlsConfig := &tls.Config{
-		ServerName:         c.config.Client.FakeSNI,
+		ServerName:         ep.sni,
 		InsecureSkipVerify: true,
 		MinVersion:         tls.VersionTLS12,
 		MaxVersion:         tls.VersionTLS13,
 	}
 
-	if c.config.Client.Fragment {
-		return c.dialWithFragmentation(c.config.Client.ServerAddr, tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), serverDialTimeout)
+	defer cancel()
+	if c.obfs.Fragment.Enabled {
+		return c.dialWithFragmentation(ctx, ep.addr, tlsConfig)
 	}
 
-	// Force IPv4 - IPv6 doesn't work in Iran
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
-	conn, err := dialer.Dial("tcp4", c.config.Client.ServerAddr)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.ipStrategy.Network("tcp"), ep.addr)
 	if err != nil {
 		return nil, fmt.Errorf("TCP connection failed: %w", err)
 	}
 	tlsConn := tls.Client(conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("TLS handshake failed: %w", err)
 	}
 	return tlsConn, nil
 }
 
-func (c *XPClient) dialWithFragmentation(addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
-	// Force IPv4 - IPv6 doesn't work in Iran
-	tcpConn, err := net.DialTimeout("tcp4", addr, 10*time.Second)
+// dialTransport connects over a non-TLS transport (kcp, quic or raw)
+func (c *XPClient) dialTransport(ep *endpoint) (net.Conn, error) {
+	tcfg, err := transport.FromConfig(ep.transport, ep.keyString)
+	if err != nil {
+		return nil, err
+	}
+	if tcfg.SNI == "" {
+		tcfg.SNI = ep.sni
+	}
+	tcfg.IPStrategy = c.ipStrategy
+	tr, err := transport.NewTransport(tcfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s transport: %w", ep.transport.Mode, err)
+	}
+	conn, err := tr.Dial(ep.addr)
+	if err != nil {
+		tr.Close()
+		return nil, fmt.Errorf("%s dial failed: %w", ep.transport.Mode, err)
+	}
+	return &transportConn{Conn: transport.NetConn(conn), tr: tr}, nil
+}
+
+// transportConn closes its transport along with the connection, so
+// reconnecting doesn't leak raw-mode capture handles
+type transportConn struct {
+	net.Conn
+	tr transport.Transport
+}
+
+func (c *transportConn) Close() error {
+	err := c.Conn.Close()
+	c.tr.Close()
+	return err
+}
+
+func (c *XPClient) dialWithFragmentation(ctx context.Context, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	var dialer net.Dialer
+	tcpConn, err := dialer.DialContext(ctx, c.ipStrategy.Network("tcp"), addr)
 	if err != nil {
 		return nil, err
 	}
@@ -252,7 +461,7 @@ func (c *XPClient) dialWithFragmentation(addr string, tlsConfig *tls.Config) (*t
 	}
 
 	tlsConn := tls.Client(fragConn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		tcpConn.Close()
 		return nil, fmt.Errorf("TLS handshake failed: %w", err)
 	}
@@ -280,5 +489,24 @@ func (fc *fragmentingConn) Write(b []byte) (int, error) {
 }
 
 func (c *XPClient) Stop() {
+	close(c.stop)
+	if c.statusListener != nil {
+		c.statusListener.Close()
+	}
+	for _, ep := range c.selector.list() {
+		ep.shutdown()
+	}
 	c.socks5.Stop()
+	if c.http != nil {
+		c.http.Stop()
+	}
+	if c.transparent != nil {
+		c.transparent.Stop()
+	}
+	if c.tun != nil {
+		c.tun.Stop()
+	}
+	if c.dns != nil {
+		c.dns.Stop()
+	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/obfs"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+func TestConnectToServerHandshakeTimeout(t *testing.T) {
+	// A server that accepts the connection and never answers the hello
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	defer func(d time.Duration) { serverDialTimeout = d }(serverDialTimeout)
+	serverDialTimeout = 200 * time.Millisecond
+
+	for _, fragment := range []bool{false, true} {
+		obfuscation := tunnel.Obfuscation{Fragment: obfs.DefaultFragmentConfig()}
+		obfuscation.Fragment.Enabled = fragment
+		c := &XPClient{obfs: obfuscation, fragmenter: obfs.NewFragmenter(obfuscation.Fragment)}
+		start := time.Now()
+		conn, err := c.connectToServer(&endpoint{addr: ln.Addr().String(), sni: "example.com"})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("fragment %v: handshake with a silent server succeeded", fragment)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("fragment %v: gave up after %v, want about %v", fragment, elapsed, serverDialTimeout)
+		}
+	}
+}
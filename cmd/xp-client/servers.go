@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+// Server selection strategies
+const (
+	selectFailover   = "failover"
+	selectLatency    = "latency"
+	selectRoundRobin = "round_robin"
+	selectSticky     = "sticky"
+)
+
+var (
+	errNotConnected = errors.New("tunnel not connected")
+	errPoolFull     = errors.New("all tunnels are at max_streams")
+)
+
+// endpoint is one server and the state of the pool of tunnels to it
+type endpoint struct {
+	spec       config.ServerEndpoint
+	name       string
+	addr       string
+	sni        string
+	key        []byte
+	keyString  string
+	transport  config.TransportConfig
+	maxStreams int
+	stop       chan struct{}
+	stopOnce   sync.Once
+
+	mu sync.Mutex
+	// tunnels has one session per pool slot, nil while the slot is down
+	tunnels     []*tunnel.Session
+	state       connState
+	connectedAt time.Time
+	reconnects  int
+	lastErr     error
+	rtt         time.Duration
+}
+
+// newEndpoint checks a server from the config or a subscription, whose
+// defaults are already filled in
+func newEndpoint(cfg *config.Config, spec config.ServerEndpoint) (*endpoint, error) {
+	if spec.Address == "" {
+		return nil, fmt.Errorf("server %s: address is required", spec.Name)
+	}
+	key, err := spec.GetKey()
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid key for server %s", spec.Name)
+	}
+	poolSize := cfg.Client.Pool.Size
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	ep := &endpoint{
+		spec:       spec,
+		name:       spec.Name,
+		addr:       spec.Address,
+		sni:        spec.FakeSNI,
+		key:        key,
+		keyString:  spec.Key,
+		transport:  cfg.Transport,
+		maxStreams: cfg.Client.Pool.MaxStreams,
+		stop:       make(chan struct{}),
+		tunnels:    make([]*tunnel.Session, poolSize),
+		state:      stateConnecting,
+	}
+	if spec.Transport != nil {
+		ep.transport = *spec.Transport
+	}
+	return ep, nil
+}
+
+// shutdown stops the supervisors of the endpoint and closes its tunnels
+func (e *endpoint) shutdown() {
+	e.stopOnce.Do(func() { close(e.stop) })
+	e.setState(stateStopped, nil)
+	e.closeAll()
+}
+
+// pick returns the least loaded tunnel with room for another stream, nil
+// if none is up or all are full. Streams opened concurrently may take a
+// tunnel slightly past max_streams.
+func (e *endpoint) pick() (*tunnel.Session, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var best *tunnel.Session
+	bestLoad := 0
+	for _, session := range e.tunnels {
+		if session == nil {
+			continue
+		}
+		load := session.NumStreams()
+		if e.maxStreams > 0 && load >= e.maxStreams {
+			continue
+		}
+		if best == nil || load < bestLoad {
+			best, bestLoad = session, load
+		}
+	}
+	return best, e.rtt
+}
+
+// closeAll closes every tunnel in the pool
+func (e *endpoint) closeAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, session := range e.tunnels {
+		if session != nil {
+			session.Close()
+		}
+	}
+}
+
+// selector spreads new streams over the connected servers following the
+// selection strategy. It is the Opener every inbound uses.
+type selector struct {
+	strategy string
+	next     atomic.Uint64
+
+	mu        sync.RWMutex
+	endpoints []*endpoint
+}
+
+func newSelector(strategy string, endpoints []*endpoint) (*selector, error) {
+	switch strategy {
+	case "":
+		strategy = selectFailover
+	case selectFailover, selectLatency, selectRoundRobin, selectSticky:
+	default:
+		return nil, fmt.Errorf("unknown selection strategy: %s", strategy)
+	}
+	return &selector{strategy: strategy, endpoints: endpoints}, nil
+}
+
+// list returns the current servers
+func (s *selector) list() []*endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.endpoints
+}
+
+// replace swaps in a new server list, e.g. after a subscription refresh
+func (s *selector) replace(endpoints []*endpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints = endpoints
+}
+
+func (s *selector) OpenStream(target string) (*tunnel.Stream, error) {
+	var lastErr error
+	for _, session := range s.sessions(target) {
+		stream, err := session.OpenStream(target)
+		if err == nil {
+			return stream, nil
+		}
+		// The server answered, so another one won't do better
+		var streamErr *tunnel.StreamError
+		if errors.As(err, &streamErr) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = s.noSession()
+	}
+	return nil, lastErr
+}
+
+func (s *selector) OpenPacketStream() (*tunnel.Stream, error) {
+	var lastErr error
+	for _, session := range s.sessions("") {
+		ps, err := session.OpenPacketStream()
+		if err == nil {
+			return ps, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = s.noSession()
+	}
+	return nil, lastErr
+}
+
+// noSession tells why no tunnel could be picked
+func (s *selector) noSession() error {
+	for _, ep := range s.list() {
+		if ep.connected() {
+			return errPoolFull
+		}
+	}
+	return errNotConnected
+}
+
+// sessions returns the connected servers' sessions for target, best
+// choice first and the others as fallbacks
+func (s *selector) sessions(target string) []*tunnel.Session {
+	type candidate struct {
+		session *tunnel.Session
+		rtt     time.Duration
+		score   uint64
+	}
+	var cands []candidate
+	for _, ep := range s.list() {
+		session, rtt := ep.pick()
+		if session == nil {
+			continue
+		}
+		c := candidate{session: session, rtt: rtt}
+		if s.strategy == selectSticky {
+			c.score = stickyScore(target, ep.name)
+		}
+		cands = append(cands, c)
+	}
+	if len(cands) == 0 {
+		return nil
+	}
+
+	switch s.strategy {
+	case selectLatency:
+		// An unmeasured server (pings off) keeps its place behind the others
+		sort.SliceStable(cands, func(i, j int) bool {
+			if cands[i].rtt == 0 || cands[j].rtt == 0 {
+				return cands[j].rtt == 0 && cands[i].rtt != 0
+			}
+			return cands[i].rtt < cands[j].rtt
+		})
+	case selectRoundRobin:
+		n := int((s.next.Add(1) - 1) % uint64(len(cands)))
+		rotated := make([]candidate, 0, len(cands))
+		cands = append(append(rotated, cands[n:]...), cands[:n]...)
+	case selectSticky:
+		if target != "" {
+			sort.SliceStable(cands, func(i, j int) bool { return cands[i].score > cands[j].score })
+		}
+	}
+
+	sessions := make([]*tunnel.Session, len(cands))
+	for i, c := range cands {
+		sessions[i] = c.session
+	}
+	return sessions
+}
+
+// stickyScore ranks servers for a destination host (rendezvous hashing),
+// so a host keeps its server and only moves when that server goes down
+func stickyScore(target, name string) uint64 {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return h.Sum64()
+}
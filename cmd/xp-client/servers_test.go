@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+// testSession returns the client end of a session over an in-memory
+// tunnel. Streams open without waiting for the server, so tests can load
+// a session without serving it.
+func testSession(t *testing.T) *tunnel.Session {
+	t.Helper()
+	key := bytes.Repeat([]byte{3}, 32)
+	c1, c2 := net.Pipe()
+	ct, err := tunnel.NewTunnel(c1, key, tunnel.Obfuscation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := tunnel.NewTunnel(c2, key, tunnel.Obfuscation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := tunnel.NewClientSession(ct), tunnel.NewServerSession(st)
+	client.SetFastOpen(true)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+// testEndpoints returns connected servers named after names, each with
+// a pool of size tunnels
+func testEndpoints(t *testing.T, size, maxStreams int, names ...string) ([]*endpoint, map[*tunnel.Session]string) {
+	t.Helper()
+	cfg := config.DefaultClientConfig()
+	cfg.Client.Pool.Size, cfg.Client.Pool.MaxStreams = size, maxStreams
+	owner := map[*tunnel.Session]string{}
+	var eps []*endpoint
+	for i, name := range names {
+		ep, err := newEndpoint(&cfg, config.ServerEndpoint{Name: name, Address: fmt.Sprintf("10.0.0.%d:443", i+1), Key: testKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for slot := 0; slot < size; slot++ {
+			session := testSession(t)
+			ep.setTunnel(slot, session)
+			owner[session] = name
+		}
+		eps = append(eps, ep)
+	}
+	return eps, owner
+}
+
+// order names the servers of sessions in the order the selector gave them
+func order(sessions []*tunnel.Session, owner map[*tunnel.Session]string) string {
+	var b bytes.Buffer
+	for _, s := range sessions {
+		b.WriteString(owner[s])
+	}
+	return b.String()
+}
+
+func TestSelectorStrategies(t *testing.T) {
+	eps, owner := testEndpoints(t, 1, 0, "a", "b", "c", "d")
+	// d is down, b is the fastest and a was never measured
+	eps[3].setTunnel(0, nil)
+	eps[1].rtt, eps[2].rtt = 10*time.Millisecond, 20*time.Millisecond
+
+	sel := func(strategy string) *selector {
+		s, err := newSelector(strategy, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if got := order(sel("").sessions("example.com:443"), owner); got != "abc" {
+		t.Errorf("failover order %s, want abc", got)
+	}
+	if got := order(sel(selectLatency).sessions("example.com:443"), owner); got != "bca" {
+		t.Errorf("latency order %s, want bca", got)
+	}
+	rr := sel(selectRoundRobin)
+	for _, want := range []string{"abc", "bca", "cab", "abc"} {
+		if got := order(rr.sessions("example.com:443"), owner); got != want {
+			t.Errorf("round robin order %s, want %s", got, want)
+		}
+	}
+
+	// Sticky keeps a host on one server whatever the port, and spreads hosts
+	sticky := sel(selectSticky)
+	firsts := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		first := order(sticky.sessions(host+":443"), owner)[:1]
+		if again := order(sticky.sessions(host+":80"), owner)[:1]; again != first {
+			t.Errorf("sticky moved %s from %s to %s", host, first, again)
+		}
+		firsts[first] = true
+	}
+	if len(firsts) < 2 {
+		t.Errorf("sticky sent 32 hosts to %d servers", len(firsts))
+	}
+	// A host only moves off its server when that server goes down
+	host := "moving.example.com:443"
+	first := order(sticky.sessions(host), owner)
+	for _, ep := range eps[:3] {
+		if ep.name == first[:1] {
+			ep.setTunnel(0, nil)
+			if got := order(sticky.sessions(host), owner); got != first[1:] {
+				t.Errorf("sticky order without %s: %s, want %s", first[:1], got, first[1:])
+			}
+		}
+	}
+
+	if _, err := newSelector("random", eps); err == nil {
+		t.Error("newSelector accepted an unknown strategy")
+	}
+}
+
+func TestEndpointPool(t *testing.T) {
+	eps, _ := testEndpoints(t, 3, 2, "a")
+	ep := eps[0]
+	sel, err := newSelector(selectFailover, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streams go to the least loaded tunnel until every one is full
+	for i := 0; i < 6; i++ {
+		session, _ := ep.pick()
+		if session == nil {
+			t.Fatalf("no tunnel for stream %d", i)
+		}
+		for _, other := range ep.tunnels {
+			if other.NumStreams() < session.NumStreams() {
+				t.Fatalf("stream %d: picked a tunnel with %d streams over one with %d", i, session.NumStreams(), other.NumStreams())
+			}
+		}
+		if _, err := sel.OpenStream("example.com:443"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, session := range ep.tunnels {
+		if session.NumStreams() != 2 {
+			t.Errorf("tunnel has %d streams, want 2", session.NumStreams())
+		}
+	}
+	if _, err := sel.OpenStream("example.com:443"); !errors.Is(err, errPoolFull) {
+		t.Errorf("OpenStream on a full pool: %v, want errPoolFull", err)
+	}
+
+	for slot := range ep.tunnels {
+		ep.setTunnel(slot, nil)
+	}
+	if _, err := sel.OpenStream("example.com:443"); !errors.Is(err, errNotConnected) {
+		t.Errorf("OpenStream without tunnels: %v, want errNotConnected", err)
+	}
+}
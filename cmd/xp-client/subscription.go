@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+	"github.com/abbasnazari-0/xp-proto/pkg/uri"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultSubscriptionInterval = time.Hour
+	subscriptionRetry           = time.Minute
+	subscriptionTimeout         = 30 * time.Second
+	maxSubscriptionSize         = 1 << 20
+)
+
+// subscription keeps track of the servers fetched from the subscription URL
+type subscription struct {
+	url      string
+	interval time.Duration
+
+	mu      sync.Mutex
+	servers []config.ServerEndpoint
+	updated time.Time
+	lastErr error
+}
+
+// subscriptionStatus is the subscription part of the status output
+type subscriptionStatus struct {
+	URL       string     `json:"url"`
+	Servers   int        `json:"servers"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func newSubscription(sc config.SubscriptionConfig) *subscription {
+	interval := time.Duration(sc.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultSubscriptionInterval
+	}
+	return &subscription{url: sc.URL, interval: interval}
+}
+
+// fetch downloads the subscription with hc and returns its servers with
+// their defaults filled in
+func (s *subscription) fetch(hc *http.Client, cc *config.ClientConfig, base config.TransportConfig) ([]config.ServerEndpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), subscriptionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "xp-client/1.0")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("subscription returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize))
+	if err != nil {
+		return nil, err
+	}
+	servers, skipped, err := parseSubscription(body, base)
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		fmt.Printf("⚠️  Subscription: skipped %d entr(ies) that aren't valid xp:// links\n", skipped)
+	}
+	return cc.Complete(servers), nil
+}
+
+// record saves the outcome of a fetch for the status output
+func (s *subscription) record(servers []config.ServerEndpoint, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	if err == nil {
+		s.servers = servers
+		s.updated = time.Now()
+	}
+}
+
+func (s *subscription) status() *subscriptionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &subscriptionStatus{URL: s.url, Servers: len(s.servers)}
+	if !s.updated.IsZero() {
+		updated := s.updated
+		st.UpdatedAt = &updated
+	}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	return st
+}
+
+// parseSubscription reads a list of xp:// links, plain or base64, or a
+// Subscription document in YAML or JSON. Links take their transport
+// settings from base with the mode of the link; entries that aren't
+// valid links are counted in skipped.
+func parseSubscription(body []byte, base config.TransportConfig) (servers []config.ServerEndpoint, skipped int, err error) {
+	text := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(text, "xp://") {
+		if decoded, err := decodeBase64(text); err == nil {
+			if d := strings.TrimSpace(string(decoded)); strings.HasPrefix(d, "xp://") {
+				text = d
+			}
+		}
+	}
+
+	if strings.HasPrefix(text, "xp://") {
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			server, err := linkEndpoint(line, base)
+			if err != nil {
+				skipped++
+				continue
+			}
+			servers = append(servers, server)
+		}
+		if len(servers) == 0 {
+			return nil, skipped, fmt.Errorf("subscription has no valid xp:// links")
+		}
+		return servers, skipped, nil
+	}
+
+	var doc config.Subscription
+	if err := yaml.Unmarshal([]byte(text), &doc); err != nil || len(doc.Servers) == 0 {
+		return nil, 0, fmt.Errorf("subscription is neither a list of xp:// links nor a servers document")
+	}
+	return doc.Servers, 0, nil
+}
+
+// linkEndpoint turns one xp:// link into a server, named after its
+// #fragment. The raw interface settings of this host come from base, as
+// does everything but the mode for links of older servers.
+func linkEndpoint(link string, base config.TransportConfig) (config.ServerEndpoint, error) {
+	l, err := uri.Parse(link)
+	if err != nil {
+		return config.ServerEndpoint{}, err
+	}
+	tc := *l.Server.Transport
+	if l.Version == 0 {
+		tc = base
+		tc.Mode = l.Server.Transport.Mode
+	}
+	tc.Raw.Interface, tc.Raw.LocalIP = base.Raw.Interface, base.Raw.LocalIP
+	tc.Raw.RouterMAC, tc.Raw.LocalMAC = base.Raw.RouterMAC, base.Raw.LocalMAC
+	l.Server.Transport = &tc
+	return l.Server, nil
+}
+
+// decodeBase64 accepts the padded, unpadded and URL-safe alphabets that
+// subscription providers use, with line breaks anywhere
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		var b []byte
+		if b, err = enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// directHTTPClient fetches outside the tunnel, for the first fetch and
+// when the tunnel can't reach the subscription
+func directHTTPClient(direct *tunnel.Direct) *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: direct.Dial}}
+}
+
+// initialServers returns the configured servers followed by those of the
+// subscription, fetched directly. A failed fetch is reported and left to
+// the background refresh.
+func initialServers(cfg *config.Config, sub *subscription, direct *tunnel.Direct) []config.ServerEndpoint {
+	servers := cfg.Client.Endpoints()
+	if sub == nil {
+		return servers
+	}
+	fmt.Printf("📰 Fetching subscription %s\n", sub.url)
+	subServers, err := sub.fetch(directHTTPClient(direct), &cfg.Client, cfg.Transport)
+	sub.record(subServers, err)
+	if err != nil {
+		fmt.Printf("⚠️  Subscription failed: %v (retrying in %s)\n", err, subscriptionRetry)
+		return servers
+	}
+	fmt.Printf("📰 Subscription: %d server(s)\n", len(subServers))
+	return append(servers, subServers...)
+}
+
+// refreshSubscription fetches the subscription every interval, through the
+// tunnel when possible, and updates the servers until Stop
+func (c *XPClient) refreshSubscription() {
+	tunneled := &http.Client{Transport: &http.Transport{DialContext: c.dialTunnel}}
+	wait := c.sub.interval
+	if c.sub.status().UpdatedAt == nil {
+		wait = subscriptionRetry
+	}
+	for {
+		select {
+		case <-time.After(wait):
+		case <-c.stop:
+			return
+		}
+		servers, err := c.sub.fetch(tunneled, &c.config.Client, c.config.Transport)
+		if err != nil {
+			servers, err = c.sub.fetch(directHTTPClient(c.direct), &c.config.Client, c.config.Transport)
+		}
+		c.sub.record(servers, err)
+		if err != nil {
+			fmt.Printf("⚠️  Subscription refresh failed: %v (retrying in %s)\n", err, subscriptionRetry)
+			wait = subscriptionRetry
+			continue
+		}
+		wait = c.sub.interval
+		c.setServers(append(c.config.Client.Endpoints(), servers...), true)
+	}
+}
+
+// setServers replaces the server list. Servers that didn't change keep
+// their tunnels, removed ones are shut down and, with launch, new ones
+// start connecting.
+func (c *XPClient) setServers(servers []config.ServerEndpoint, launch bool) {
+	old := c.selector.list()
+	var next []*endpoint
+	var added []*endpoint
+	for _, spec := range servers {
+		var ep *endpoint
+		for _, o := range old {
+			if reflect.DeepEqual(o.spec, spec) && !contains(next, o) {
+				ep = o
+				break
+			}
+		}
+		if ep == nil {
+			var err error
+			if ep, err = newEndpoint(c.config, spec); err != nil {
+				fmt.Printf("⚠️  Skipping server: %v\n", err)
+				continue
+			}
+			added = append(added, ep)
+		}
+		next = append(next, ep)
+	}
+	c.selector.replace(next)
+
+	removed := 0
+	for _, o := range old {
+		if !contains(next, o) {
+			o.shutdown()
+			removed++
+		}
+	}
+	if !launch {
+		return
+	}
+	for _, ep := range added {
+		if c.excluded != nil && !c.excluded[ep.addr] {
+			fmt.Printf("⚠️  %s was added after startup and isn't excluded from TUN/transparent routing; restart to exclude it\n", ep.name)
+		}
+		c.launch(ep)
+	}
+	if len(added) > 0 || removed > 0 {
+		fmt.Printf("📰 Servers updated: %d added, %d removed, %d total\n", len(added), removed, len(next))
+	}
+}
+
+// launch starts the supervisors of every pool slot of ep
+func (c *XPClient) launch(ep *endpoint) {
+	for slot := range ep.tunnels {
+		go c.supervise(ep, slot)
+	}
+}
+
+func contains(eps []*endpoint, ep *endpoint) bool {
+	for _, e := range eps {
+		if e == ep {
+			return true
+		}
+	}
+	return false
+}
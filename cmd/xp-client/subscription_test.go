@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/uri"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+
+// testLink is an xp:// link to addr in the current format
+func testLink(addr, name string) string {
+	tc := config.DefaultClientConfig().Transport
+	tc.Mode = "kcp"
+	return (&uri.Link{Server: config.ServerEndpoint{Name: name, Address: addr, Key: testKey, Transport: &tc}}).String()
+}
+
+func TestParseSubscription(t *testing.T) {
+	base := config.DefaultClientConfig().Transport
+	base.KCP.Mode = "fast2"
+	base.Raw.Interface = "eth9"
+
+	links := testLink("a.example.com:443", "A") + "\n" + testLink("b.example.com:8443", "B") + "\n"
+	wrapped := base64.RawURLEncoding.EncodeToString([]byte(links))
+	wrapped = wrapped[:40] + "\n" + wrapped[40:]
+
+	tests := []struct {
+		name    string
+		body    string
+		names   []string
+		skipped int
+		err     bool
+	}{
+		{"plain links", links, []string{"A", "B"}, 0, false},
+		{"base64", base64.StdEncoding.EncodeToString([]byte(links)) + "\n", []string{"A", "B"}, 0, false},
+		{"wrapped url-safe base64", wrapped, []string{"A", "B"}, 0, false},
+		{"invalid link skipped", links + "xp://no-key-here\n", []string{"A", "B"}, 1, false},
+		{"yaml document", "servers:\n  - name: Y\n    address: y.example.com:443\n", []string{"Y"}, 0, false},
+		{"json document", `{"servers": [{"name": "J", "address": "j.example.com:443"}]}`, []string{"J"}, 0, false},
+		{"only invalid links", "xp://no-key-here\n", nil, 1, true},
+		{"html", "<html><body>Not Found</body></html>", nil, 0, true},
+		{"empty", "", nil, 0, true},
+		{"document without servers", "servers: []\n", nil, 0, true},
+	}
+	for _, tt := range tests {
+		servers, skipped, err := parseSubscription([]byte(tt.body), base)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if skipped != tt.skipped {
+			t.Errorf("%s: skipped %d, want %d", tt.name, skipped, tt.skipped)
+		}
+		var names []string
+		for _, s := range servers {
+			names = append(names, s.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+			t.Errorf("%s: servers %v, want %v", tt.name, names, tt.names)
+		}
+	}
+}
+
+func TestLinkEndpointTransport(t *testing.T) {
+	base := config.DefaultClientConfig().Transport
+	base.KCP.Mode = "fast2"
+	base.Raw.Interface = "eth9"
+
+	// Current links carry their transport; this host's interface is kept
+	ep, err := linkEndpoint(testLink("a.example.com:443", "A"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Transport.Mode != "kcp" || ep.Transport.KCP.Mode != config.DefaultClientConfig().Transport.KCP.Mode || ep.Transport.Raw.Interface != "eth9" {
+		t.Errorf("v1 link transport %+v", ep.Transport)
+	}
+
+	// Links of older servers only say the mode
+	ep, err = linkEndpoint("xp://"+testKey+"@old.example.com:443?transport=kcp", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Transport.Mode != "kcp" || ep.Transport.KCP.Mode != "fast2" || ep.Transport.Raw.Interface != "eth9" {
+		t.Errorf("old link transport %+v", ep.Transport)
+	}
+}
+
+// subServer serves a subscription the test may change at /sub/token
+type subServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+func newSubServer(t *testing.T, body string) *subServer {
+	s := &subServer{status: http.StatusOK, body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.URL.Path != "/sub/token" || r.UserAgent() == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *subServer) set(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body = status, body
+}
+
+func TestSubscriptionFetch(t *testing.T) {
+	srv := newSubServer(t, base64.StdEncoding.EncodeToString([]byte(testLink("a.example.com:443", ""))))
+	cfg := config.DefaultClientConfig()
+	cfg.Client.FakeSNI = "cdn.example.com"
+	sub := newSubscription(config.SubscriptionConfig{URL: srv.URL + "/sub/token"})
+
+	servers, err := sub.fetch(directHTTPClient(nil), &cfg.Client, cfg.Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Name != "a.example.com:443" || servers[0].Key != testKey {
+		t.Fatalf("servers %+v", servers)
+	}
+	sub.record(servers, nil)
+	if st := sub.status(); st.Servers != 1 || st.UpdatedAt == nil || st.LastError != "" {
+		t.Errorf("status after a fetch %+v", st)
+	}
+
+	// Failures are reported and keep the last good servers
+	for _, tt := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusForbidden, "no"},
+		{http.StatusOK, "garbage"},
+	} {
+		srv.set(tt.status, tt.body)
+		servers, err := sub.fetch(directHTTPClient(nil), &cfg.Client, cfg.Transport)
+		if err == nil {
+			t.Errorf("status %d body %.20q: got %d servers, want an error", tt.status, tt.body, len(servers))
+		}
+		sub.record(servers, err)
+		if st := sub.status(); st.Servers != 1 || st.LastError == "" {
+			t.Errorf("status after a failed fetch %+v", st)
+		}
+	}
+}
+
+func TestRefreshSubscription(t *testing.T) {
+	srv := newSubServer(t, testLink("127.0.0.1:1", "one"))
+	cfg := config.DefaultClientConfig()
+	cfg.Client.Reconnect.PingInterval = -1
+	sel, err := newSelector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &XPClient{config: &cfg, selector: sel, stop: make(chan struct{})}
+	c.sub = newSubscription(config.SubscriptionConfig{URL: srv.URL + "/sub/token"})
+	c.sub.interval = 20 * time.Millisecond
+	defer func() {
+		close(c.stop)
+		for _, ep := range c.selector.list() {
+			ep.shutdown()
+		}
+	}()
+
+	c.setServers(initialServers(&cfg, c.sub, nil), false)
+	first := c.selector.list()
+	if len(first) != 1 || first[0].name != "one" {
+		t.Fatalf("initial servers %d", len(first))
+	}
+
+	// The next refresh adds a server and keeps the unchanged one
+	srv.set(http.StatusOK, testLink("127.0.0.1:1", "one")+"\n"+testLink("127.0.0.1:2", "two"))
+	go c.refreshSubscription()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.selector.list()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("servers after refresh: %d, want 2", len(c.selector.list()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.selector.list()[0] != first[0] {
+		t.Error("refresh replaced an unchanged server")
+	}
+}
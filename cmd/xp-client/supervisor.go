@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+const (
+	minBackoff          = time.Second
+	defaultMaxBackoff   = time.Minute
+	defaultPingInterval = 15 * time.Second
+	defaultPingTimeout  = 10 * time.Second
+
+	// preDialLead is how long before max_lifetime a replacement tunnel is
+	// dialed, and drainTimeout how long a replaced one is kept for its
+	// streams to finish
+	preDialLead  = 10 * time.Second
+	drainTimeout = 5 * time.Minute
+)
+
+// errExpiring makes monitor return when a tunnel is due for replacement
+var errExpiring = errors.New("tunnel reached max_lifetime")
+
+// connState is where the tunnel to the server stands
+type connState string
+
+const (
+	stateConnecting   connState = "connecting"
+	stateConnected    connState = "connected"
+	stateReconnecting connState = "reconnecting"
+	stateStopped      connState = "stopped"
+)
+
+// clientStatus is what the status endpoint reports
+type clientStatus struct {
+	Selection    string              `json:"selection"`
+	Servers      []serverStatus      `json:"servers"`
+	Subscription *subscriptionStatus `json:"subscription,omitempty"`
+}
+
+type serverStatus struct {
+	Name           string     `json:"name"`
+	Address        string     `json:"address"`
+	State          connState  `json:"state"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	Reconnects     int        `json:"reconnects"`
+	LastError      string     `json:"last_error,omitempty"`
+	RTTMillis      int64      `json:"rtt_ms,omitempty"`
+	Tunnels        int        `json:"tunnels"`
+	Streams        int        `json:"streams"`
+}
+
+// supervise keeps one tunnel of a server's pool up: it connects, watches
+// the session with keepalive pings, replaces it ahead of max_lifetime and
+// reconnects with exponential backoff and jitter until Stop
+func (c *XPClient) supervise(ep *endpoint, slot int) {
+	rc := c.config.Client.Reconnect
+	retry := newBackoff(time.Duration(rc.MaxBackoff) * time.Second)
+	label := ep.name
+	if len(ep.tunnels) > 1 {
+		label = fmt.Sprintf("%s #%d", ep.name, slot+1)
+	}
+
+	for {
+		session, err := c.connect(ep)
+		if err != nil {
+			ep.setState(stateReconnecting, err)
+			wait := retry.next()
+			fmt.Printf("⚠️  [%s] Connection failed: %v (retrying in %s)\n", label, err, wait.Round(100*time.Millisecond))
+			select {
+			case <-time.After(wait):
+			case <-ep.stop:
+				return
+			}
+			continue
+		}
+
+		connected := time.Now()
+		ep.setTunnel(slot, session)
+		fmt.Printf("✅ Connected to %s\n", label)
+
+		rotate := c.rotateAt()
+		for {
+			err = c.monitor(ep, session, rotate)
+			if err != errExpiring {
+				break
+			}
+			// The old tunnel keeps working until the new one is up
+			next, dialErr := c.connect(ep)
+			if dialErr != nil {
+				fmt.Printf("⚠️  [%s] Replacement failed: %v\n", label, dialErr)
+				rotate = time.After(preDialLead)
+				continue
+			}
+			ep.setTunnel(slot, next)
+			fmt.Printf("🔄 [%s] Tunnel replaced, draining %d stream(s)\n", label, session.NumStreams())
+			go c.retire(ep, session)
+			session, rotate = next, c.rotateAt()
+		}
+		ep.setTunnel(slot, nil)
+		session.Close()
+		if isClosed(ep.stop) {
+			return
+		}
+		retry.held(time.Since(connected))
+		ep.mu.Lock()
+		ep.reconnects++
+		ep.mu.Unlock()
+		ep.setState(stateReconnecting, err)
+		fmt.Printf("⚠️  [%s] Tunnel lost: %v, reconnecting...\n", label, err)
+	}
+}
+
+// backoff is the wait between connection attempts of one pool slot
+type backoff struct {
+	cur, max time.Duration
+}
+
+// newBackoff starts at minBackoff; max <= 0 means defaultMaxBackoff
+func newBackoff(max time.Duration) *backoff {
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	return &backoff{cur: minBackoff, max: max}
+}
+
+// next returns the wait before the next attempt and doubles the backoff up
+// to max. The wait is between half and all of the backoff so clients that
+// lost the server together don't come back in lockstep.
+func (b *backoff) next() time.Duration {
+	wait := b.cur/2 + time.Duration(rand.Int63n(int64(b.cur/2)+1))
+	b.cur = min(b.cur*2, b.max)
+	return wait
+}
+
+// held resets the backoff after a connection that lasted longer than max.
+// Only a connection that held up for a while resets it, so a server that
+// drops us right away isn't hammered.
+func (b *backoff) held(lasted time.Duration) {
+	if lasted > b.max {
+		b.cur = minBackoff
+	}
+}
+
+// rotateAt returns when to start replacing a tunnel that was just set up,
+// nil without max_lifetime. Lifetimes vary by up to a tenth so the tunnels
+// of a pool aren't replaced together.
+func (c *XPClient) rotateAt() <-chan time.Time {
+	lifetime := time.Duration(c.config.Client.Pool.MaxLifetime) * time.Second
+	if lifetime <= 0 {
+		return nil
+	}
+	lifetime -= time.Duration(rand.Int63n(int64(lifetime/10) + 1))
+	lead := min(preDialLead, lifetime/2)
+	return time.After(lifetime - lead)
+}
+
+// retire closes a replaced tunnel once its streams have finished
+func (c *XPClient) retire(ep *endpoint, session *tunnel.Session) {
+	defer session.Close()
+	deadline := time.After(drainTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for session.NumStreams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-session.Done():
+			return
+		case <-ep.stop:
+			return
+		}
+	}
+}
+
+// connect dials the server and starts a session on the new tunnel
+func (c *XPClient) connect(ep *endpoint) (*tunnel.Session, error) {
+	conn, err := c.connectToServer(ep)
+	if err != nil {
+		return nil, err
+	}
+	tun, err := tunnel.NewTunnel(conn, ep.key, c.obfs)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create tunnel: %w", err)
+	}
+	session := tunnel.NewClientSession(tun)
+	session.SetFastOpen(c.config.Client.FastOpen)
+
+	// UDP transports "connect" without a handshake, so a first ping
+	// confirms the server is really there
+	if c.config.Client.Reconnect.PingInterval >= 0 {
+		rtt, err := session.Ping(c.pingTimeout())
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("server did not answer: %w", err)
+		}
+		ep.mu.Lock()
+		ep.rtt = rtt
+		ep.mu.Unlock()
+	}
+	return session, nil
+}
+
+func (c *XPClient) pingTimeout() time.Duration {
+	if t := c.config.Client.Reconnect.PingTimeout; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+	return defaultPingTimeout
+}
+
+// monitor blocks until the session fails, a keepalive ping goes
+// unanswered, rotate fires (errExpiring) or the client stops. Ping times
+// feed latency selection.
+func (c *XPClient) monitor(ep *endpoint, session *tunnel.Session, rotate <-chan time.Time) error {
+	rc := c.config.Client.Reconnect
+	var tick <-chan time.Time
+	if rc.PingInterval >= 0 {
+		interval := time.Duration(rc.PingInterval) * time.Second
+		if interval == 0 {
+			interval = defaultPingInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-session.Done():
+			return session.Err()
+		case <-ep.stop:
+			return nil
+		case <-rotate:
+			return errExpiring
+		case <-tick:
+			rtt, err := session.Ping(c.pingTimeout())
+			if err != nil {
+				return fmt.Errorf("keepalive failed: %w", err)
+			}
+			ep.mu.Lock()
+			ep.rtt = rtt
+			ep.mu.Unlock()
+		}
+	}
+}
+
+// setTunnel puts a new session (or nil while disconnected) in a pool slot,
+// where the selector finds it
+func (e *endpoint) setTunnel(slot int, session *tunnel.Session) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	wasUp := e.up()
+	e.tunnels[slot] = session
+	switch {
+	case session != nil && !wasUp:
+		e.state = stateConnected
+		e.connectedAt = time.Now()
+		e.lastErr = nil
+	case session == nil && !e.up():
+		e.rtt = 0
+	}
+}
+
+// connected reports whether any tunnel of the pool is up
+func (e *endpoint) connected() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.up()
+}
+
+func (e *endpoint) up() bool {
+	for _, session := range e.tunnels {
+		if session != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *endpoint) setState(state connState, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// One slot failing doesn't make a server with other live tunnels down
+	if state == stateReconnecting && e.up() {
+		state = stateConnected
+	}
+	e.state = state
+	if err != nil {
+		e.lastErr = err
+	}
+}
+
+func (e *endpoint) status() serverStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := serverStatus{
+		Name:       e.name,
+		Address:    e.addr,
+		State:      e.state,
+		Reconnects: e.reconnects,
+		RTTMillis:  e.rtt.Milliseconds(),
+	}
+	for _, session := range e.tunnels {
+		if session != nil {
+			st.Tunnels++
+			st.Streams += session.NumStreams()
+		}
+	}
+	if st.Tunnels > 0 {
+		since := e.connectedAt
+		st.ConnectedSince = &since
+	}
+	if e.lastErr != nil {
+		st.LastError = e.lastErr.Error()
+	}
+	return st
+}
+
+// status returns a snapshot of the connection state of every server
+func (c *XPClient) status() clientStatus {
+	st := clientStatus{Selection: c.selector.strategy}
+	for _, ep := range c.selector.list() {
+		st.Servers = append(st.Servers, ep.status())
+	}
+	if c.sub != nil {
+		st.Subscription = c.sub.status()
+	}
+	return st
+}
+
+// startStatus serves GET /status with the connection state as JSON
+func (c *XPClient) startStatus(addr string) error {
+	listener, err := net.Listen(c.direct.Network("tcp"), addr)
+	if err != nil {
+		return fmt.Errorf("failed to start status endpoint: %w", err)
+	}
+	c.statusListener = listener
+	fmt.Printf("📊 Status endpoint on http://%s/status\n", addr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(c.status())
+	})
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
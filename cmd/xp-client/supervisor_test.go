@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(10 * time.Second)
+	for _, cur := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		cur *= time.Second
+		if wait := b.next(); wait < cur/2 || wait > cur {
+			t.Errorf("wait %v at backoff %v", wait, cur)
+		}
+	}
+	// A connection that dropped quickly keeps the backoff
+	b.held(10 * time.Second)
+	if b.cur != 10*time.Second {
+		t.Errorf("backoff %v after a short connection, want 10s", b.cur)
+	}
+	b.held(11 * time.Second)
+	if b.cur != minBackoff {
+		t.Errorf("backoff %v after a connection that held up, want %v", b.cur, minBackoff)
+	}
+
+	if b := newBackoff(0); b.max != defaultMaxBackoff {
+		t.Errorf("default max backoff %v", b.max)
+	}
+}
+
+// testServer is a TLS tunnel server. Sessions answer pings until stall is
+// called, and new connections wait for delay before being served.
+type testServer struct {
+	addr     string
+	key      []byte
+	mu       sync.Mutex
+	conns    int
+	delay    time.Duration
+	stalled  chan struct{}
+	sessions []*tunnel.Session
+}
+
+func startTestServer(t *testing.T, key []byte) *testServer {
+	t.Helper()
+	// httptest has a certificate at hand; the client doesn't verify it
+	hs := httptest.NewUnstartedServer(nil)
+	hs.StartTLS()
+	cert := hs.TLS.Certificates[0]
+	hs.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{addr: ln.Addr().String(), key: key, stalled: make(chan struct{})}
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, session := range s.sessions {
+			session.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			delay, stalled := s.delay, s.stalled
+			s.mu.Unlock()
+			go func() {
+				time.Sleep(delay)
+				tun, _ := tunnel.NewTunnel(&stallConn{Conn: conn, stalled: stalled}, s.key, tunnel.Obfuscation{})
+				session := tunnel.NewServerSession(tun)
+				s.mu.Lock()
+				s.sessions = append(s.sessions, session)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+	return s
+}
+
+// stall stops the sessions so far from reading, so pings go unanswered
+func (s *testServer) stall() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.stalled)
+	s.stalled = make(chan struct{})
+}
+
+func (s *testServer) accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *testServer) setDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// stallConn stops reading once stalled is closed, until it is closed
+type stallConn struct {
+	net.Conn
+	stalled <-chan struct{}
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	c.once.Do(func() { c.closed = make(chan struct{}) })
+	select {
+	case <-c.stalled:
+		<-c.closed
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { c.closed = make(chan struct{}) })
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.Conn.Close()
+}
+
+// superviseTest supervises one tunnel to a test server until the test ends
+func superviseTest(t *testing.T, cfg config.Config) (*testServer, *endpoint) {
+	t.Helper()
+	ep, err := newEndpoint(&cfg, config.ServerEndpoint{Name: "test", Address: "127.0.0.1:1", Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTestServer(t, ep.key)
+	ep.addr = s.addr
+	c := &XPClient{config: &cfg, stop: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		c.supervise(ep, 0)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		ep.shutdown()
+		<-done
+	})
+	return s, ep
+}
+
+// waitFor polls cond for up to 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func (e *endpoint) slot(i int) *tunnel.Session {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tunnels[i]
+}
+
+func TestSuperviseKeepaliveReconnects(t *testing.T) {
+	cfg := config.DefaultClientConfig()
+	cfg.Client.Reconnect.PingInterval, cfg.Client.Reconnect.PingTimeout = 1, 1
+	s, ep := superviseTest(t, cfg)
+
+	waitFor(t, "the first tunnel", func() bool { return ep.slot(0) != nil })
+	first := ep.slot(0)
+	s.stall()
+	// The next keepalive ping goes unanswered and the tunnel is replaced
+	waitFor(t, "a reconnect", func() bool {
+		session := ep.slot(0)
+		return session != nil && session != first
+	})
+	select {
+	case <-first.Done():
+	default:
+		t.Error("stalled tunnel still open")
+	}
+	if st := ep.status(); st.Reconnects != 1 || st.State != stateConnected {
+		t.Errorf("status after a keepalive failure: %+v", st)
+	}
+	if n := s.accepted(); n != 2 {
+		t.Errorf("server accepted %d connections, want 2", n)
+	}
+}
+
+func TestSuperviseMaxLifetime(t *testing.T) {
+	cfg := config.DefaultClientConfig()
+	cfg.Client.Reconnect.PingInterval = -1
+	cfg.Client.Pool.MaxLifetime = 1
+	// Streams open without waiting for the server, which doesn't serve them
+	cfg.Client.FastOpen = true
+	s, ep := superviseTest(t, cfg)
+
+	waitFor(t, "the first tunnel", func() bool { return ep.slot(0) != nil })
+	old := ep.slot(0)
+	stream, err := old.OpenStream("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replacement takes a while to come up; the old tunnel serves
+	// until it does
+	s.setDelay(300 * time.Millisecond)
+	waitFor(t, "the replacement dial", func() bool { return s.accepted() == 2 })
+	if ep.slot(0) != old {
+		t.Fatal("old tunnel left the pool before its replacement was up")
+	}
+	waitFor(t, "the replacement", func() bool { return ep.slot(0) != old && ep.slot(0) != nil })
+
+	// The old tunnel drains its stream before it is closed
+	select {
+	case <-old.Done():
+		t.Fatal("old tunnel closed with a stream open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	stream.Close()
+	select {
+	case <-old.Done():
+	case <-time.After(3 * time.Second):
+		t.Error("drained tunnel not closed")
+	}
+	if st := ep.status(); st.Reconnects != 0 {
+		t.Errorf("replacement counted as %d reconnects", st.Reconnects)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+// transparentOptions fills in defaults for the transparent proxy section
+func transparentOptions(tc config.TransparentConfig) tunnel.TransparentOptions {
+	opts := tunnel.TransparentOptions{
+		Listen:  tc.Listen,
+		Mode:    tc.Mode,
+		Mark:    tc.Mark,
+		Table:   tc.Table,
+		Exclude: tc.Exclude,
+	}
+	if opts.Mode == "" {
+		opts.Mode = tunnel.TransparentRedirect
+	}
+	if opts.Mark == 0 {
+		opts.Mark = 1
+	}
+	if opts.Table == 0 {
+		opts.Table = 100
+	}
+	return opts
+}
+
+// serverIPs resolves the server addresses so their traffic bypasses the
+// proxy
+func serverIPs(servers []config.ServerEndpoint) ([]string, error) {
+	var out []string
+	for _, ep := range servers {
+		host, _, err := net.SplitHostPort(ep.Address)
+		if err != nil {
+			host = ep.Address
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve server %s: %w", host, err)
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				out = append(out, ip4.String())
+			}
+		}
+	}
+	return out, nil
+}
+
+// runTransparentRules prints, installs or removes the firewall rules for
+// the transparent proxy
+func runTransparentRules(cfg *config.Config, action string) error {
+	if cfg.Client.Transparent.Listen == "" {
+		return fmt.Errorf("client.transparent.listen is not set")
+	}
+	var sub *subscription
+	if cfg.Client.Subscription.URL != "" {
+		sub = newSubscription(cfg.Client.Subscription)
+	}
+	strategy, err := dns.ParseStrategy(cfg.Client.IPStrategy)
+	if err != nil {
+		return err
+	}
+	ips, err := serverIPs(initialServers(cfg, sub, tunnel.NewDirect(strategy)))
+	if err != nil {
+		return err
+	}
+	install, remove, err := tunnel.TransparentRules(transparentOptions(cfg.Client.Transparent), ips)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "print":
+		fmt.Println("# install")
+		for _, cmd := range install {
+			fmt.Println(cmd)
+		}
+		fmt.Println("# remove")
+		for _, cmd := range remove {
+			fmt.Println(cmd)
+		}
+		return nil
+	case "install":
+		// Start from a clean slate so install can be re-run
+		runShell(remove, true)
+		return runShell(install, false)
+	case "remove":
+		return runShell(remove, true)
+	default:
+		return fmt.Errorf("unknown action %q (use print, install or remove)", action)
+	}
+}
+
+func runShell(cmds []string, ignoreErrors bool) error {
+	for _, cmd := range cmds {
+		c := exec.Command("sh", "-c", cmd)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil && !ignoreErrors {
+			return fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+// tunOptions fills in defaults for the TUN section; the server addresses are
+// always excluded from auto routing so the tunnel does not loop into itself
+func tunOptions(cfg *config.Config, servers []config.ServerEndpoint) (tunnel.TUNOptions, error) {
+	tc := cfg.Client.TUN
+	opts := tunnel.TUNOptions{
+		Name:      tc.Name,
+		Address:   tc.Address,
+		MTU:       tc.MTU,
+		AutoRoute: tc.AutoRoute,
+	}
+	if opts.Name == "" {
+		opts.Name = "xp0"
+	}
+	if opts.Address == "" {
+		opts.Address = "198.18.0.1/30"
+	}
+	if opts.MTU == 0 {
+		opts.MTU = 1500
+	}
+	if opts.AutoRoute {
+		ips, err := serverIPs(servers)
+		if err != nil {
+			return opts, err
+		}
+		opts.Exclude = append(ips, tc.Exclude...)
+	}
+	return opts, nil
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 )
 
@@ -24,6 +25,7 @@ var (
 	listenAddr = flag.String("l", "0.0.0.0:443", "Listen address")
 	targetAddr = flag.String("t", "", "Target XP server address (required)")
 	mode       = flag.String("m", "tcp", "Mode: tcp, ws, or sni")
+	checkOnly  = flag.Bool("check", false, "Check the flags and exit")
 )
 
 func main() {
@@ -40,6 +42,17 @@ func main() {
 		fmt.Println("")
 		os.Exit(1)
 	}
+	if problems := checkFlags(); len(problems) > 0 {
+		fmt.Println("❌ Invalid flags:")
+		for _, problem := range problems {
+			fmt.Printf("   • %s\n", problem)
+		}
+		os.Exit(1)
+	}
+	if *checkOnly {
+		fmt.Println("✅ Flags are valid")
+		return
+	}
 
 	fmt.Println("╔═══════════════════════════════════════════╗")
 	fmt.Println("║       XP Protocol Relay Server            ║")
@@ -72,6 +85,24 @@ func main() {
 	}
 }
 
+// checkFlags returns every problem with the listen and target addresses
+// and the mode
+func checkFlags() []string {
+	var problems []string
+	for _, f := range []struct{ name, addr string }{{"-l", *listenAddr}, {"-t", *targetAddr}} {
+		_, port, err := net.SplitHostPort(f.addr)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			problems = append(problems, fmt.Sprintf("%s: must be host:port, got %q", f.name, f.addr))
+		}
+	}
+	switch *mode {
+	case "tcp", "ws", "sni":
+	default:
+		problems = append(problems, fmt.Sprintf("-m: unknown mode %q (use tcp, ws or sni)", *mode))
+	}
+	return problems
+}
+
 func startTCPRelay() {
 	listener, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
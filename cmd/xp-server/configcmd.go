@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+// runConfigCommand handles "xp-server config migrate [-c FILE]", which
+// upgrades a server or client config file to the current version
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Println("Usage: xp-server config migrate [-c config.yaml]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "Path to config file")
+	fs.Parse(args[1:])
+
+	from, backup, notes, err := config.MigrateFile(*path)
+	if err != nil {
+		fmt.Printf("❌ Failed to migrate %s: %v\n", *path, err)
+		os.Exit(1)
+	}
+	if backup == "" {
+		fmt.Printf("✅ %s is already version %d\n", *path, config.Version)
+		return
+	}
+	fmt.Printf("📝 %s: version %d → %d\n", *path, from, config.Version)
+	for _, note := range notes {
+		fmt.Printf("   • %s\n", note)
+	}
+	fmt.Printf("💾 Original saved as %s (comments are only kept there)\n", backup)
+
+	// The file may still need hand edits the migration can't make
+	cfg, err := config.LoadConfig(*path)
+	if err == nil {
+		cfg, err = config.Load(*path, config.Defaults(cfg.Mode))
+	}
+	if err == nil {
+		err = cfg.Override(nil, nil)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Println("⚠️  Still to fix by hand:")
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("   • %s\n", problem)
+		}
+		return
+	}
+	fmt.Printf("✅ Migrated %s\n", *path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/uri"
+)
+
+// printLinks prints the client link of every user, with qr under a name
+// header and followed by a terminal QR code. With pngPath the QR codes
+// are also written as images, named after the user when there are
+// several.
+func (s *XPServer) printLinks(qr bool, pngPath string) error {
+	if _, _, err := s.subscriptionAddress(); err != nil {
+		return err
+	}
+	for _, u := range s.users {
+		link := s.subscriptionLink(u).String()
+		name := u.name
+		if name == "" {
+			name = "default"
+		}
+		if !qr {
+			fmt.Println(link)
+		} else {
+			code, err := uri.TerminalQR(link)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Printf("🔗 %s\n%s\n%s\n", name, link, code)
+		}
+		if pngPath != "" {
+			path := pngPath
+			if len(s.users) > 1 {
+				ext := filepath.Ext(pngPath)
+				path = strings.TrimSuffix(pngPath, ext) + "-" + name + ext
+			}
+			png, err := uri.PNG(link)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if err := os.WriteFile(path, png, 0600); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "🖼️  QR code of %s written to %s\n", name, path)
+		}
+	}
+	return nil
+}
@@ -1,29 +1,49 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/abbasnazari-0/xp-proto/pkg/config"
 	"github.com/abbasnazari-0/xp-proto/pkg/crypto"
-	"github.com/abbasnazari-0/xp-proto/pkg/obfs"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+	"github.com/abbasnazari-0/xp-proto/pkg/transport"
 	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
 )
 
 var (
-	configPath = flag.String("c", "config.yaml", "Path to config file")
+	configPath = flag.String("c", "config.yaml", "Path to config file, empty = defaults and XP_* variables only")
 	genKey     = flag.Bool("genkey", false, "Generate a new key")
 	genConfig  = flag.Bool("genconfig", false, "Generate example config")
+	showLink   = flag.Bool("link", false, "Print the xp:// link of every user and exit")
+	showQR     = flag.Bool("qr", false, "Like -link, with a QR code for each link")
+	qrPNG      = flag.String("qr-png", "", "Write the QR code of each link to this PNG file")
+	checkOnly  = flag.Bool("check", false, "Check the config and exit")
+	printCfg   = flag.Bool("print-config", false, "Print the effective config with secrets redacted and exit")
+	overrides  config.Overrides
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfigCommand(os.Args[2:])
+		return
+	}
+
+	flag.Var(&overrides, "set", "Override a config field, e.g. -set server.listen=0.0.0.0:8443 (repeatable)")
 	flag.Parse()
 
 	if *genKey {
@@ -41,12 +61,64 @@ func main() {
 		return
 	}
 
-	cfg, err := config.LoadConfig(*configPath)
+	// Defaults, then the file, then XP_* variables and -set flags
+	cfg, err := config.Load(*configPath, config.DefaultServerConfig())
 	if err != nil {
 		fmt.Printf("❌ Failed to load config: %v\n", err)
 		fmt.Println("💡 Run with -genconfig to generate example config")
 		os.Exit(1)
 	}
+	if err := cfg.Override(os.Environ(), overrides); err != nil {
+		fmt.Printf("❌ Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Mode == "client" {
+		fmt.Printf("❌ %s is a client config, run it with xp-client\n", *configPath)
+		os.Exit(1)
+	}
+	for _, key := range cfg.Deprecated {
+		fmt.Fprintf(os.Stderr, "⚠️  %s is deprecated, move it to the obfuscation section\n", key)
+	}
+	if len(cfg.Migrated) > 0 {
+		fmt.Fprintf(os.Stderr, "⚠️  %s is an old config version, read it as:\n", *configPath)
+		for _, note := range cfg.Migrated {
+			fmt.Fprintf(os.Stderr, "   • %s\n", note)
+		}
+		fmt.Fprintf(os.Stderr, "💡 Upgrade the file with: xp-server config migrate -c %s\n", *configPath)
+	}
+	if *printCfg {
+		data, err := cfg.Redacted()
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(string(data))
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("❌ Invalid config %s:\n", *configPath)
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("   • %s\n", problem)
+		}
+		os.Exit(1)
+	}
+	server, err := newServerState(cfg)
+	if err != nil {
+		fmt.Printf("❌ Invalid config %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	if *checkOnly {
+		fmt.Printf("✅ Config %s is valid\n", *configPath)
+		return
+	}
+
+	if *showLink || *showQR || *qrPNG != "" {
+		if err := server.printLinks(*showQR, *qrPNG); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	fmt.Println("╔═══════════════════════════════════════════╗")
 	fmt.Println("║       XP Protocol Server v1.0             ║")
@@ -54,8 +126,6 @@ func main() {
 	fmt.Println("╚═══════════════════════════════════════════╝")
 	fmt.Println()
 
-	server := NewXPServer(cfg)
-
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -73,51 +143,81 @@ func main() {
 }
 
 type XPServer struct {
-	config     *config.Config
-	listener   net.Listener
-	key        []byte
-	fragmenter *obfs.Fragmenter
-	padder     *obfs.Padder
+	config   *config.Config
+	key      []byte
+	obfs     tunnel.Obfuscation
+	resolver *dns.Resolver
+	users    []*serverUser
+	subTLS   *tls.Config
+
+	// mu guards the listeners, which Stop closes from another goroutine
+	mu                sync.Mutex
+	listener          net.Listener
+	transport         transport.Transport
+	transportListener transport.Listener
+	subListener       net.Listener
 }
 
-func NewXPServer(cfg *config.Config) *XPServer {
+// newServerState builds everything the server needs from cfg without
+// starting it, so -check and -link see the same errors as a real start
+func newServerState(cfg *config.Config) (*XPServer, error) {
 	key, err := cfg.Server.GetKey()
-	if err != nil {
-		fmt.Printf("⚠️  Invalid key, generating new one\n")
-		key, _ = crypto.GenerateKey()
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("server.key must be 32 bytes of base64 (generate one with -genkey)")
 	}
 
-	fragConfig := obfs.DefaultFragmentConfig()
-	fragConfig.Enabled = cfg.Server.Fragment
-
-	padConfig := obfs.DefaultPaddingConfig()
-	padConfig.Enabled = cfg.Server.Padding
+	resolver, err := newResolver(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS settings: %w", err)
+	}
+	users, err := newServerUsers(cfg.Server, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid users or outbound policy: %w", err)
+	}
+	subTLS, err := subscriptionTLS(cfg.Server.Subscription)
+	if err != nil {
+		return nil, err
+	}
 
 	return &XPServer{
-		config:     cfg,
-		key:        key,
-		fragmenter: obfs.NewFragmenter(fragConfig),
-		padder:     obfs.NewPadder(padConfig),
-	}
+		config:   cfg,
+		key:      key,
+		obfs:     tunnel.ObfuscationFromConfig(cfg.Obfuscation),
+		resolver: resolver,
+		users:    users,
+		subTLS:   subTLS,
+	}, nil
 }
 
 func (s *XPServer) Start() error {
+	if s.config.Server.Subscription.Listen != "" {
+		if err := s.startSubscription(); err != nil {
+			return err
+		}
+	}
+
+	switch transport.Mode(s.config.Transport.Mode) {
+	case transport.ModeKCP, transport.ModeQUIC, transport.ModeRaw:
+		return s.startTransport()
+	}
+
 	tlsConfig, err := s.createTLSConfig()
 	if err != nil {
 		return fmt.Errorf("failed to create TLS config: %w", err)
 	}
 
-	// Force IPv4 - IPv6 doesn't work in Iran
-	listener, err := tls.Listen("tcp4", s.config.Server.Listen, tlsConfig)
+	listener, err := tls.Listen(s.resolver.Strategy().Network("tcp"), s.config.Server.Listen, tlsConfig)
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %w", err)
 	}
+	s.mu.Lock()
 	s.listener = listener
+	s.mu.Unlock()
 
 	fmt.Printf("🚀 Server listening on %s\n", s.config.Server.Listen)
 	fmt.Printf("🎭 Fake site: %s\n", s.config.Server.FakeSite)
 	fmt.Printf("🔧 Fragmentation: %v | Padding: %v | Timing: %v\n",
-		s.config.Server.Fragment, s.config.Server.Padding, s.config.Server.TimingJitter)
+		s.obfs.Fragment.Enabled, s.obfs.Padding.Enabled, s.obfs.Timing.Enabled)
 	fmt.Println()
 	fmt.Println("📡 Waiting for connections...")
 	fmt.Println()
@@ -125,12 +225,66 @@ func (s *XPServer) Start() error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			continue
 		}
 		go s.handleConnection(conn)
 	}
 }
 
+// startTransport serves tunnels over a non-TLS transport (kcp, quic or raw)
+func (s *XPServer) startTransport() error {
+	tcfg, err := transport.FromConfig(s.config.Transport, s.config.Server.Key)
+	if err != nil {
+		return err
+	}
+	tcfg.IPStrategy = s.resolver.Strategy()
+	tr, err := transport.NewTransport(tcfg)
+	if err != nil {
+		return fmt.Errorf("failed to create %s transport: %w", s.config.Transport.Mode, err)
+	}
+	listener, err := tr.Listen(s.config.Server.Listen)
+	if err != nil {
+		tr.Close()
+		return fmt.Errorf("failed to start listener: %w", err)
+	}
+	s.mu.Lock()
+	s.transport = tr
+	s.transportListener = listener
+	s.mu.Unlock()
+
+	fmt.Printf("🚀 Server listening on %s (%s)\n", s.config.Server.Listen, s.config.Transport.Mode)
+	if hop := tcfg.PortHop; hop != nil {
+		fmt.Printf("🔀 Port hopping: %s\n", s.config.Transport.KCP.PortHop.Ports)
+		if hop.Redirect {
+			_, portStr, _ := net.SplitHostPort(s.config.Server.Listen)
+			port, _ := strconv.Atoi(portStr)
+			fmt.Println("💡 Redirect the hop range to the listen port with:")
+			for _, rule := range transport.PortHopNFTRules(port, hop.Ports) {
+				fmt.Printf("   %s\n", rule)
+			}
+		}
+	}
+	fmt.Printf("🔧 Fragmentation: %v | Padding: %v | Timing: %v\n",
+		s.obfs.Fragment.Enabled, s.obfs.Padding.Enabled, s.obfs.Timing.Enabled)
+	fmt.Println()
+	fmt.Println("📡 Waiting for connections...")
+	fmt.Println()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			continue
+		}
+		go s.handleConnection(transport.NetConn(conn))
+	}
+}
+
 func (s *XPServer) createTLSConfig() (*tls.Config, error) {
 	cert, err := generateSelfSignedCert()
 	if err != nil {
@@ -158,7 +312,11 @@ func (s *XPServer) handleConnection(conn net.Conn) {
 	remoteAddr := conn.RemoteAddr().String()
 	fmt.Printf("📥 New connection from %s\n", remoteAddr)
 
-	tun, err := tunnel.NewTunnel(conn, s.key)
+	keys := make([][]byte, len(s.users))
+	for i, u := range s.users {
+		keys[i] = u.key
+	}
+	tun, idx, err := tunnel.AcceptTunnel(conn, keys, s.obfs)
 	if err != nil {
 		fmt.Printf("❌ [%s] Failed to create tunnel: %v\n", remoteAddr, err)
 		if s.config.Server.ProbeResist {
@@ -166,81 +324,160 @@ func (s *XPServer) handleConnection(conn net.Conn) {
 		}
 		return
 	}
+	user := s.users[idx]
+	if user.name != "" {
+		fmt.Printf("👤 [%s] User %s\n", remoteAddr, user.name)
+	}
+
+	session := tunnel.NewServerSession(tun)
+	defer session.Close()
 
 	for {
-		buf := make([]byte, 65536)
-		n, err := tun.Read(buf)
+		stream, err := session.Accept()
 		if err != nil {
-			if err != io.EOF {
+			if err := session.Err(); err != io.EOF && err != io.ErrClosedPipe {
 				fmt.Printf("⚠️  [%s] Read error: %v\n", remoteAddr, err)
 			}
 			return
 		}
 
-		if n < 1 {
-			continue
-		}
-
-		cmd := buf[0]
-		switch cmd {
-		case 0x01:
-			target := string(buf[1:n])
-			fmt.Printf("🔗 [%s] Connecting to %s\n", remoteAddr, target)
-			s.handleConnect(tun, target, remoteAddr)
-			return
+		switch stream.Network() {
+		case "udp":
+			fmt.Printf("📦 [%s] UDP associate\n", remoteAddr)
+			go s.handleUDPAssociate(stream, remoteAddr, user)
 		default:
-			fmt.Printf("⚠️  [%s] Unknown command: %d\n", remoteAddr, cmd)
+			fmt.Printf("🔗 [%s] Connecting to %s\n", remoteAddr, stream.Target())
+			go s.handleConnect(stream, remoteAddr, user)
 		}
 	}
 }
 
-func (s *XPServer) handleConnect(tun *tunnel.Tunnel, target string, clientAddr string) {
-	// Force IPv4 - IPv6 doesn't work in Iran
-	targetConn, err := net.Dial("tcp4", target)
+func (s *XPServer) handleConnect(stream *tunnel.Stream, clientAddr string, user *serverUser) {
+	defer stream.Close()
+	target := stream.Target()
+
+	if err := user.policy.checkTarget(target); err != nil {
+		fmt.Printf("🚫 [%s] Refused %s: %v\n", clientAddr, target, err)
+		stream.Reply(tunnel.RepNotAllowed, nil)
+		return
+	}
+	targetConn, err := s.resolver.DialChecked(context.Background(), "tcp", target, user.policy.checkIP)
 	if err != nil {
-		fmt.Printf("❌ [%s] Failed to connect to %s: %v\n", clientAddr, target, err)
-		tun.Write([]byte{0x01})
+		if errors.Is(err, errDenied) {
+			fmt.Printf("🚫 [%s] Refused %s: %v\n", clientAddr, target, err)
+		} else {
+			fmt.Printf("❌ [%s] Failed to connect to %s: %v\n", clientAddr, target, err)
+		}
+		stream.Reply(replyCode(err), nil)
 		return
 	}
 	defer targetConn.Close()
 
-	tun.Write([]byte{0x00})
+	local := targetConn.LocalAddr().(*net.TCPAddr)
+	stream.Reply(tunnel.RepSuccess, tunnel.SOCKSAddr(local.IP, local.Port))
 	fmt.Printf("✅ [%s] Connected to %s\n", clientAddr, target)
 
-	done := make(chan bool, 2)
+	tunnel.Relay(targetConn, stream)
+	fmt.Printf("🔌 [%s] Disconnected from %s\n", clientAddr, target)
+}
+
+// handleUDPAssociate is the server end of a UDP association: one NAT
+// socket that sends to whatever destinations the client asks for and
+// returns replies tagged with their source, until it has been idle for
+// udp_timeout
+func (s *XPServer) handleUDPAssociate(stream *tunnel.Stream, clientAddr string, user *serverUser) {
+	defer stream.Close()
+
+	natConn, err := net.ListenUDP(s.resolver.Strategy().Network("udp"), nil)
+	if err != nil {
+		fmt.Printf("❌ [%s] Failed to open UDP socket: %v\n", clientAddr, err)
+		return
+	}
+	defer natConn.Close()
+
+	idleTimeout := time.Duration(s.config.Server.UDPTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = 60 * time.Second
+	}
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
 
 	go func() {
-		buf := make([]byte, 32*1024)
+		defer natConn.Close()
+		resolved := make(map[string]*net.UDPAddr)
+		denied := make(map[string]bool)
 		for {
-			n, err := targetConn.Read(buf)
+			addr, data, err := stream.ReadPacket()
 			if err != nil {
-				done <- true
 				return
 			}
-			if _, err := tun.Write(buf[:n]); err != nil {
-				done <- true
-				return
+			target, err := tunnel.ParseSOCKSAddr(addr)
+			if err != nil || denied[target] {
+				continue
+			}
+			dst := resolved[target]
+			if dst == nil {
+				if dst, err = s.resolveUDP(target, user.policy); err != nil {
+					if errors.Is(err, errDenied) {
+						fmt.Printf("🚫 [%s] Refused UDP to %s: %v\n", clientAddr, target, err)
+						denied[target] = true
+					} else {
+						fmt.Printf("❌ [%s] Failed to resolve %s: %v\n", clientAddr, target, err)
+					}
+					continue
+				}
+				resolved[target] = dst
 			}
+			lastActive.Store(time.Now().UnixNano())
+			natConn.WriteToUDP(data, dst)
 		}
 	}()
 
-	go func() {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := tun.Read(buf)
-			if err != nil {
-				done <- true
-				return
-			}
-			if _, err := targetConn.Write(buf[:n]); err != nil {
-				done <- true
-				return
+	buf := make([]byte, 65535)
+	for {
+		natConn.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, src, err := natConn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(time.Unix(0, lastActive.Load())) < idleTimeout {
+				continue
 			}
+			break
 		}
-	}()
+		lastActive.Store(time.Now().UnixNano())
+		if err := stream.WritePacket(tunnel.SOCKSAddr(src.IP, src.Port), buf[:n]); err != nil {
+			break
+		}
+	}
+	fmt.Printf("🔌 [%s] UDP associate closed\n", clientAddr)
+}
 
-	<-done
-	fmt.Printf("🔌 [%s] Disconnected from %s\n", clientAddr, target)
+// resolveUDP resolves a UDP destination to its preferred address the
+// policy allows
+func (s *XPServer) resolveUDP(target string, policy *outboundPolicy) (*net.UDPAddr, error) {
+	if err := policy.checkTarget(target); err != nil {
+		return nil, err
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := s.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if err = policy.checkIP(ip); err == nil {
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+	}
+	return nil, err
 }
 
 func (s *XPServer) proxyToFakeSite(clientConn net.Conn) {
@@ -250,11 +487,11 @@ func (s *XPServer) proxyToFakeSite(clientConn net.Conn) {
 	}
 	fmt.Printf("🎭 Proxying probe to fake site: %s\n", fakeSite)
 
-	// Force IPv4 - IPv6 doesn't work in Iran
-	targetConn, err := tls.Dial("tcp4", fakeSite+":443", &tls.Config{ServerName: fakeSite})
+	rawConn, err := s.resolver.DialContext(context.Background(), "tcp", net.JoinHostPort(fakeSite, "443"))
 	if err != nil {
 		return
 	}
+	targetConn := tls.Client(rawConn, &tls.Config{ServerName: fakeSite})
 	defer targetConn.Close()
 
 	go io.Copy(targetConn, clientConn)
@@ -262,9 +499,20 @@ func (s *XPServer) proxyToFakeSite(clientConn net.Conn) {
 }
 
 func (s *XPServer) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	if s.transportListener != nil {
+		s.transportListener.Close()
+	}
+	if s.transport != nil {
+		s.transport.Close()
+	}
+	if s.subListener != nil {
+		s.subListener.Close()
+	}
 }
 
 func generateSelfSignedCert() (tls.Certificate, error) {
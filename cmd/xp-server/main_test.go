@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+func TestNewServerState(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	tests := []struct {
+		name   string
+		modify func(c *config.Config)
+		err    string // "" for success
+	}{
+		{"valid", func(c *config.Config) {}, ""},
+		{"users", func(c *config.Config) {
+			c.Server.Users = []config.ServerUser{{Name: "alice", Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))}}
+		}, ""},
+		{"short key", func(c *config.Config) { c.Server.Key = "c2hvcnQ=" }, "server.key"},
+		{"missing key file", func(c *config.Config) {
+			c.Server.Key = ""
+			c.Server.KeyFile = filepath.Join(t.TempDir(), "missing")
+		}, "server.key"},
+		{"ip strategy", func(c *config.Config) { c.Server.IPStrategy = "ipv5_only" }, "invalid DNS settings"},
+		{"dns server", func(c *config.Config) { c.Server.DNS.Servers = []string{"ftp://1.1.1.1"} }, "invalid DNS settings"},
+		{"outbound", func(c *config.Config) { c.Server.Outbound.DenyCIDR = []string{"10.0.0.0/33"} }, "invalid users or outbound policy"},
+		{"user key", func(c *config.Config) {
+			c.Server.Users = []config.ServerUser{{Name: "bob", Key: "nope"}}
+		}, "users[0] (bob)"},
+		{"user outbound", func(c *config.Config) {
+			c.Server.Users = []config.ServerUser{{Name: "carol", Key: key, Outbound: &config.OutboundConfig{AllowPorts: []string{"http"}}}}
+		}, "users[0] (carol)"},
+	}
+	for _, tt := range tests {
+		cfg := config.DefaultServerConfig()
+		cfg.Server.Key = key
+		tt.modify(&cfg)
+		s, err := newServerState(&cfg)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if len(s.users) != 1+len(cfg.Server.Users) {
+				t.Errorf("%s: %d users, want %d", tt.name, len(s.users), 1+len(cfg.Server.Users))
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one mentioning %q", tt.name, err, tt.err)
+		}
+	}
+}
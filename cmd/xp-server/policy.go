@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+// errDenied is wrapped by every outbound policy refusal
+var errDenied = errors.New("denied by outbound policy")
+
+// specialNets are not covered by the net.IP helpers but are just as
+// internal: "this network", CGNAT, benchmarking and reserved space
+var specialNets = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "198.18.0.0/15", "240.0.0.0/4")
+
+// outboundPolicy decides which destinations a client may reach. Private
+// addresses are refused unless allowed, so the key can't be used to reach
+// the server itself, its LAN or cloud metadata endpoints.
+type outboundPolicy struct {
+	allowPrivate bool
+	allowNets    []*net.IPNet
+	denyNets     []*net.IPNet
+	allowPorts   router.PortRanges
+	denyPorts    router.PortRanges
+	allowDomains []string
+	denyDomains  []string
+}
+
+func newOutboundPolicy(oc config.OutboundConfig) (*outboundPolicy, error) {
+	p := &outboundPolicy{
+		allowPrivate: oc.AllowPrivate,
+		allowDomains: normalizeDomains(oc.AllowDomains),
+		denyDomains:  normalizeDomains(oc.DenyDomains),
+	}
+	var err error
+	if p.allowNets, err = parseCIDRs(oc.AllowCIDR); err != nil {
+		return nil, fmt.Errorf("outbound.allow_cidr: %w", err)
+	}
+	if p.denyNets, err = parseCIDRs(oc.DenyCIDR); err != nil {
+		return nil, fmt.Errorf("outbound.deny_cidr: %w", err)
+	}
+	if p.allowPorts, err = router.ParsePorts(oc.AllowPorts); err != nil {
+		return nil, fmt.Errorf("outbound.allow_ports: %w", err)
+	}
+	if p.denyPorts, err = router.ParsePorts(oc.DenyPorts); err != nil {
+		return nil, fmt.Errorf("outbound.deny_ports: %w", err)
+	}
+	return p, nil
+}
+
+// checkTarget checks host:port before it is resolved; an IP host is also
+// checked as an address
+func (p *outboundPolicy) checkTarget(target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+	if len(p.denyPorts) > 0 && p.denyPorts.Match(port) {
+		return fmt.Errorf("%w: port %d", errDenied, port)
+	}
+	if !p.allowPorts.Match(port) {
+		return fmt.Errorf("%w: port %d is not allowed", errDenied, port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	domain := strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchDomain(p.denyDomains, domain) {
+		return fmt.Errorf("%w: domain %s", errDenied, domain)
+	}
+	if len(p.allowDomains) > 0 && !matchDomain(p.allowDomains, domain) {
+		return fmt.Errorf("%w: domain %s is not allowed", errDenied, domain)
+	}
+	return nil
+}
+
+// checkIP checks a destination address, including every address a domain
+// resolves to
+func (p *outboundPolicy) checkIP(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if containsIP(p.denyNets, ip) {
+		return fmt.Errorf("%w: address %s", errDenied, ip)
+	}
+	if !p.allowPrivate && isPrivate(ip) && !containsIP(p.allowNets, ip) {
+		return fmt.Errorf("%w: %s is a private address", errDenied, ip)
+	}
+	return nil
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		ip.Equal(net.IPv4bcast) || containsIP(specialNets, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether domain is one of domains or a subdomain
+func matchDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomains(domains []string) []string {
+	out := make([]string, 0, len(domains))
+	for _, d := range domains {
+		out = append(out, strings.ToLower(strings.Trim(d, ".")))
+	}
+	return out
+}
+
+func parseCIDRs(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			// A bare address is a single-host range
+			if ip := net.ParseIP(spec); ip != nil && ip.To4() != nil {
+				spec += "/32"
+			} else {
+				spec += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", spec)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(specs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(specs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// serverUser is a tunnel key and the outbound policy its connections follow
+type serverUser struct {
+	name   string
+	key    []byte
+	policy *outboundPolicy
+}
+
+// newServerUsers returns the server key's user followed by server.users
+func newServerUsers(sc config.ServerConfig, key []byte) ([]*serverUser, error) {
+	policy, err := newOutboundPolicy(sc.Outbound)
+	if err != nil {
+		return nil, err
+	}
+	users := []*serverUser{{key: key, policy: policy}}
+	for i, u := range sc.Users {
+		userKey, err := u.GetKey()
+		if err != nil || len(userKey) != 32 {
+			return nil, fmt.Errorf("users[%d] (%s): key must be 32 bytes of base64", i, u.Name)
+		}
+		user := &serverUser{name: u.Name, key: userKey, policy: policy}
+		if u.Outbound != nil {
+			if user.policy, err = newOutboundPolicy(*u.Outbound); err != nil {
+				return nil, fmt.Errorf("users[%d] (%s): %w", i, u.Name, err)
+			}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// replyCode is tunnel.ReplyCode with policy refusals reported as such
+func replyCode(err error) byte {
+	if errors.Is(err, errDenied) {
+		return tunnel.RepNotAllowed
+	}
+	return tunnel.ReplyCode(err)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/tunnel"
+)
+
+func TestOutboundPolicy(t *testing.T) {
+	strict := config.OutboundConfig{
+		AllowCIDR:    []string{"10.1.2.3", "fd00:1::/64"},
+		DenyCIDR:     []string{"203.0.113.0/24", "2001:db8:bad::1"},
+		AllowPorts:   []string{"80", "443", "8000-9000"},
+		DenyPorts:    []string{"8080"},
+		AllowDomains: []string{"Example.com."},
+		DenyDomains:  []string{"bad.example.com"},
+	}
+	tests := []struct {
+		oc      config.OutboundConfig
+		target  string
+		allowed bool
+	}{
+		// Default policy: any public destination, no internal ones
+		{config.OutboundConfig{}, "example.org:25", true},
+		{config.OutboundConfig{}, "8.8.8.8:53", true},
+		{config.OutboundConfig{}, "[2606:4700::1111]:443", true},
+		{config.OutboundConfig{}, "127.0.0.1:22", false},
+		{config.OutboundConfig{}, "[::1]:22", false},
+		{config.OutboundConfig{}, "[::ffff:127.0.0.1]:22", false},
+		{config.OutboundConfig{}, "169.254.169.254:80", false},
+		{config.OutboundConfig{}, "192.168.1.1:80", false},
+		{config.OutboundConfig{}, "100.64.0.1:80", false},
+		{config.OutboundConfig{}, "0.0.0.0:80", false},
+		{config.OutboundConfig{}, "255.255.255.255:80", false},
+		{config.OutboundConfig{}, "[fe80::1]:80", false},
+		{config.OutboundConfig{}, "[fd12::1]:80", false},
+		{config.OutboundConfig{}, "224.0.0.1:80", false},
+		{config.OutboundConfig{AllowPrivate: true}, "192.168.1.1:80", true},
+
+		{strict, "example.com:443", true},
+		{strict, "WWW.example.com.:443", true},
+		{strict, "notexample.com:443", false},
+		{strict, "bad.example.com:443", false},
+		{strict, "x.bad.example.com:443", false},
+		{strict, "example.com:22", false},
+		{strict, "example.com:8500", true},
+		{strict, "example.com:8080", false},
+		{strict, "10.1.2.3:80", true},
+		{strict, "10.1.2.4:80", false},
+		{strict, "[fd00:1::5]:80", true},
+		{strict, "203.0.113.9:443", false},
+		{strict, "[2001:db8:bad::1]:443", false},
+		// IP destinations only answer to the address rules
+		{strict, "1.1.1.1:443", true},
+	}
+	for _, tt := range tests {
+		p, err := newOutboundPolicy(tt.oc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.checkTarget(tt.target)
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkTarget(%s) with %+v: %v, want allowed %v", tt.target, tt.oc, err, tt.allowed)
+		}
+		if err != nil && !errors.Is(err, errDenied) {
+			t.Errorf("checkTarget(%s): %v does not wrap errDenied", tt.target, err)
+		}
+	}
+
+	p, _ := newOutboundPolicy(config.OutboundConfig{})
+	for _, target := range []string{"example.com", "example.com:http"} {
+		if err := p.checkTarget(target); err == nil || errors.Is(err, errDenied) {
+			t.Errorf("checkTarget(%s): %v, want a parse error", target, err)
+		}
+	}
+	// Addresses a domain resolves to are checked as well
+	if err := p.checkIP(net.ParseIP("10.0.0.1")); !errors.Is(err, errDenied) {
+		t.Errorf("checkIP(10.0.0.1): %v", err)
+	}
+}
+
+func TestNewOutboundPolicyErrors(t *testing.T) {
+	for _, oc := range []config.OutboundConfig{
+		{AllowCIDR: []string{"10.0.0.0/33"}},
+		{DenyCIDR: []string{"not an address"}},
+		{AllowPorts: []string{"http"}},
+		{DenyPorts: []string{"9000-8000"}},
+	} {
+		if _, err := newOutboundPolicy(oc); err == nil {
+			t.Errorf("newOutboundPolicy(%+v) succeeded", oc)
+		}
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	denied := fmt.Errorf("%w: port 25", errDenied)
+	if got := replyCode(denied); got != tunnel.RepNotAllowed {
+		t.Errorf("replyCode(denied) = %d, want %d", got, tunnel.RepNotAllowed)
+	}
+	if got := replyCode(errors.New("boom")); got == tunnel.RepNotAllowed {
+		t.Error("replyCode of another error reports a refusal")
+	}
+}
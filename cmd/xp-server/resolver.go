@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+)
+
+// newResolver builds the resolver used for every outbound dial from the
+// ip_strategy and dns sections
+func newResolver(sc config.ServerConfig) (*dns.Resolver, error) {
+	strategy, err := dns.ParseStrategy(sc.IPStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upstreams are reached directly, in the allowed IP family
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch network {
+		case "tcp", "udp":
+			network = strategy.Network(network)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	var upstreams []dns.Upstream
+	for _, server := range sc.DNS.Servers {
+		u, err := dns.NewUpstream(server, dial, true)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	var cache *dns.Cache
+	switch {
+	case sc.DNS.CacheSize == 0:
+		cache = dns.NewCache(4096)
+	case sc.DNS.CacheSize > 0:
+		cache = dns.NewCache(sc.DNS.CacheSize)
+	}
+	return dns.NewResolver(upstreams, cache, strategy), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/transport"
+	"github.com/abbasnazari-0/xp-proto/pkg/uri"
+	"gopkg.in/yaml.v3"
+)
+
+// subscriptionToken is the secret path of a user's subscription. It is
+// derived from the key, so it needs no config and changes with the key.
+func subscriptionToken(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("xp-subscription"))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// startSubscription serves each user's subscription at /sub/<token>: a
+// base64 xp:// link list, or a servers document with ?format=yaml
+func (s *XPServer) startSubscription() error {
+	sc := s.config.Server.Subscription
+	if _, _, err := s.subscriptionAddress(); err != nil {
+		return err
+	}
+	listener, err := net.Listen(s.resolver.Strategy().Network("tcp"), sc.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start subscription server: %w", err)
+	}
+	s.mu.Lock()
+	s.subListener = listener
+	s.mu.Unlock()
+
+	scheme := "http"
+	if s.subTLS != nil {
+		listener = tls.NewListener(listener, s.subTLS)
+		scheme = "https"
+	}
+	fmt.Printf("📰 Subscription server on %s://%s\n", scheme, sc.Listen)
+	for _, u := range s.users {
+		name := u.name
+		if name == "" {
+			name = "default"
+		}
+		fmt.Printf("   %s: /sub/%s\n", name, subscriptionToken(u.key))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sub/", s.serveSubscription)
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// subscriptionTLS loads the certificate of the subscription server; nil
+// without one
+func subscriptionTLS(sc config.SubscriptionServerConfig) (*tls.Config, error) {
+	if sc.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(sc.TLSCert, sc.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load subscription certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func (s *XPServer) serveSubscription(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/sub/")
+	var user *serverUser
+	for _, u := range s.users {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(subscriptionToken(u.key))) == 1 {
+			user = u
+		}
+	}
+	if user == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "yaml" {
+		out, err := yaml.Marshal(config.Subscription{Servers: []config.ServerEndpoint{s.subscriptionServer(user)}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(out)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, base64.StdEncoding.EncodeToString([]byte(s.subscriptionLink(user).String()+"\n")))
+}
+
+// subscriptionAddress returns the address and name clients see. The
+// listen address only does when it names a host.
+func (s *XPServer) subscriptionAddress() (addr, name string, err error) {
+	sc := s.config.Server.Subscription
+	addr = sc.Address
+	if addr == "" {
+		host, _, _ := net.SplitHostPort(s.config.Server.Listen)
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			return "", "", fmt.Errorf("server.subscription.address is required when listening on %s", s.config.Server.Listen)
+		}
+		addr = s.config.Server.Listen
+	}
+	name = sc.Name
+	if name == "" {
+		name = addr
+	}
+	return addr, name, nil
+}
+
+// subscriptionLink is the xp:// link of this server for user
+func (s *XPServer) subscriptionLink(user *serverUser) *uri.Link {
+	return &uri.Link{
+		Server:       s.subscriptionServer(user),
+		Fragment:     s.obfs.Fragment.Enabled,
+		Padding:      s.obfs.Padding.Enabled,
+		TimingJitter: s.obfs.Timing.Enabled,
+	}
+}
+
+// subscriptionServer is this server for user as a subscription entry. It
+// carries the transport settings, minus what only applies to this host.
+// Sections the mode doesn't use and unset KCP values are left at the
+// client defaults so links stay short.
+func (s *XPServer) subscriptionServer(user *serverUser) config.ServerEndpoint {
+	addr, name, _ := s.subscriptionAddress()
+	defaults := config.DefaultClientConfig().Transport
+	tc := s.config.Transport
+	tc.Raw.Interface, tc.Raw.LocalIP, tc.Raw.RouterMAC, tc.Raw.LocalMAC = "", "", "", ""
+	tc.KCP.PortHop.Redirect = false
+
+	tc.TLS = defaults.TLS
+	switch transport.Mode(tc.Mode) {
+	case transport.ModeKCP:
+		tc.QUIC, tc.Raw = defaults.QUIC, defaults.Raw
+	case transport.ModeQUIC:
+		tc.Raw = defaults.Raw
+	case transport.ModeRaw:
+		tc.QUIC = defaults.QUIC
+	default:
+		tc.KCP, tc.QUIC, tc.Raw = defaults.KCP, defaults.QUIC, defaults.Raw
+	}
+	if tc.KCP.Crypt == "" {
+		tc.KCP.Crypt = defaults.KCP.Crypt
+	}
+	if tc.KCP.Mode == "" {
+		tc.KCP.Mode = defaults.KCP.Mode
+	}
+	if tc.KCP.DataShards == 0 {
+		tc.KCP.DataShards = defaults.KCP.DataShards
+	}
+	if tc.KCP.ParityShards == 0 {
+		tc.KCP.ParityShards = defaults.KCP.ParityShards
+	}
+	return config.ServerEndpoint{
+		Name:      name,
+		Address:   addr,
+		Key:       base64.StdEncoding.EncodeToString(user.key),
+		FakeSNI:   s.config.Server.FakeSite,
+		Transport: &tc,
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/transport"
+	"github.com/abbasnazari-0/xp-proto/pkg/uri"
+	"gopkg.in/yaml.v3"
+)
+
+// testServer returns a server with the default key's user and alice
+func testServer(t *testing.T) *XPServer {
+	t.Helper()
+	cfg := config.DefaultServerConfig()
+	cfg.Server.Key = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	cfg.Server.Users = []config.ServerUser{{Name: "alice", Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))}}
+	cfg.Server.Subscription = config.SubscriptionServerConfig{Listen: "127.0.0.1:0", Address: "vpn.example.com:443", Name: "Test"}
+	s, err := newServerState(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServeSubscription(t *testing.T) {
+	s := testServer(t)
+
+	for _, u := range s.users {
+		path := "/sub/" + subscriptionToken(u.key)
+
+		rec := httptest.NewRecorder()
+		s.serveSubscription(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", u.name, rec.Code)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(rec.Body.String())
+		if err != nil {
+			t.Fatalf("%s: body isn't base64: %v", u.name, err)
+		}
+		l, err := uri.Parse(strings.TrimSpace(string(decoded)))
+		if err != nil {
+			t.Fatalf("%s: %v", u.name, err)
+		}
+		if l.Server.Key != base64.StdEncoding.EncodeToString(u.key) || l.Server.Address != "vpn.example.com:443" || l.Server.Name != "Test" {
+			t.Errorf("%s: link for %s (%s) with another user's key", u.name, l.Server.Address, l.Server.Name)
+		}
+
+		rec = httptest.NewRecorder()
+		s.serveSubscription(rec, httptest.NewRequest(http.MethodGet, path+"?format=yaml", nil))
+		var doc config.Subscription
+		if err := yaml.Unmarshal(rec.Body.Bytes(), &doc); err != nil || len(doc.Servers) != 1 {
+			t.Fatalf("%s: yaml document %q: %v", u.name, rec.Body, err)
+		}
+		if doc.Servers[0].Key != l.Server.Key {
+			t.Errorf("%s: yaml and link keys differ", u.name)
+		}
+	}
+
+	for _, path := range []string{"/sub/", "/sub/0123456789abcdef0123456789abcdef", "/sub/" + subscriptionToken(s.key) + "x"} {
+		rec := httptest.NewRecorder()
+		s.serveSubscription(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "sub.crt"), filepath.Join(dir, "sub.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestSubscriptionTLS(t *testing.T) {
+	cfg := testServer(t).config
+	sc := &cfg.Server.Subscription
+	sc.TLSCert, sc.TLSKey = writeTestCert(t)
+	s, err := newServerState(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.startSubscription(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.subListener.Close()
+	addr := s.subListener.Addr().String()
+	path := "/sub/" + subscriptionToken(s.key)
+
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := hc.Get("https://" + addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Errorf("HTTPS fetch: %s %q", resp.Status, body)
+	}
+
+	// The token never crosses the wire in clear text
+	if resp, err := http.Get("http://" + addr + path); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("plain HTTP fetch succeeded")
+		}
+	}
+
+	// A bad certificate is a config error, reported by -check too
+	sc.TLSKey = sc.TLSCert
+	if _, err := newServerState(cfg); err == nil {
+		t.Error("accepted a certificate as the key")
+	}
+}
+
+func TestSubscriptionLinkKCPKey(t *testing.T) {
+	cfg := config.DefaultServerConfig()
+	cfg.Server.Key = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	cfg.Server.Users = []config.ServerUser{{Name: "alice", Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))}}
+	cfg.Server.Subscription.Address = "vpn.example.com:443"
+	cfg.Transport.Mode = "kcp"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("users under kcp without transport.kcp.key passed validation")
+	}
+	cfg.Transport.KCP.Key = "shared kcp key"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServerState(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := transport.FromConfig(cfg.Transport, cfg.Server.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every user's client ends up with the server's KCP key
+	for _, u := range s.users {
+		l, err := uri.Parse(s.subscriptionLink(u).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := transport.FromConfig(*l.Server.Transport, l.Server.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Key != server.Key {
+			t.Errorf("%s: client KCP key %q, server %q", u.name, client.Key, server.Key)
+		}
+	}
+}
@@ -268,6 +268,10 @@ services:
       - ./data:/var/lib/xp-protocol
     environment:
       - TZ=UTC
+      # Any config field can be overridden here without editing server.yaml,
+      # e.g. XP_SERVER_LISTEN for server.listen (xp config shows the result)
+      # - XP_TRANSPORT_MODE=kcp
+      # - XP_SERVER_KEY_FILE=/run/secrets/xp_key
     networks:
       - xp-network
     cap_drop:
@@ -298,33 +302,37 @@ EOF
 
 create_server_config() {
     log_info "ایجاد فایل کانفیگ سرور..."
+    SERVER_IP=$(curl -s ifconfig.me 2>/dev/null || curl -s icanhazip.com 2>/dev/null || echo "YOUR_SERVER_IP")
     
     cat > $XP_DIR/config/server.yaml << EOF
 # XP Protocol Server Configuration
 # Generated by installer on $(date)
 
+version: 2
 mode: server
 
 transport:
   mode: ${TRANSPORT_MODE}
-  tls:
-    fragment: true
-    padding: true
-    timing_jitter: true
   kcp:
     mode: fast2
     data_shards: 10
     parity_shards: 3
 
+obfuscation:
+  fragment: true
+  padding: true
+  timing_jitter: true
+
 server:
   listen: "0.0.0.0:443"
   key: "${SECRET_KEY}"
   fake_site: "${FAKE_SITE}"
   probe_resist: true
   fallback_site: "${FAKE_SITE}"
-  fragment: true
-  padding: true
-  timing_jitter: true
+  # Address and name in the client links (xp-server -link)
+  subscription:
+    address: "${SERVER_IP}:${SERVER_PORT}"
+    name: "XP-Server"
 EOF
 
     chmod 600 $XP_DIR/config/server.yaml
@@ -477,14 +485,17 @@ case "$1" in
         grep "key:" $XP_DIR/config/server.yaml | awk '{print $2}'
         ;;
     config)
-        cat $XP_DIR/config/server.yaml
+        cd $XP_DIR && docker compose run --rm -T xp-server -c /etc/xp-protocol/server.yaml -print-config
+        ;;
+    migrate)
+        # The config is mounted read-only, so mount it again writable
+        cd $XP_DIR && docker compose run --rm -T --user 0 -v "$XP_DIR/config:/migrate" xp-server config migrate -c /migrate/server.yaml
         ;;
     link)
         echo ""
         echo "🔗 لینک کانفیگ XP Protocol:"
         echo ""
-        cat $XP_DIR/config-link.txt
-        echo ""
+        cd $XP_DIR && docker compose run --rm -T xp-server -c /etc/xp-protocol/server.yaml -qr
         echo "📋 این لینک رو کپی کن و توی کلاینت import کن"
         echo ""
         ;;
@@ -516,6 +527,7 @@ case "$1" in
         echo "  key        نمایش کلید"
         echo "  link       نمایش لینک کانفیگ"
         echo "  config     نمایش تنظیمات"
+        echo "  migrate    ارتقای کانفیگ به نسخه جدید"
         echo "  update     آپدیت"
         echo "  uninstall  حذف"
         ;;
@@ -533,23 +545,22 @@ generate_client_config() {
 # XP Protocol Client Configuration
 # کانفیگ کلاینت - این فایل رو به سیستم خودت منتقل کن
 
+version: 2
 mode: client
 
 transport:
   mode: ${TRANSPORT_MODE}
-  tls:
-    fragment: true
-    padding: true
-    timing_jitter: true
+
+obfuscation:
+  fragment: true
+  padding: true
+  timing_jitter: true
 
 client:
   server_addr: "${SERVER_IP}:${SERVER_PORT}"
   key: "${SECRET_KEY}"
   fake_sni: "${FAKE_SITE}"
   socks_addr: "127.0.0.1:1080"
-  fragment: true
-  padding: true
-  timing_jitter: true
   fingerprint: "chrome"
 EOF
 
@@ -559,13 +570,8 @@ EOF
 print_summary() {
     SERVER_IP=$(curl -s ifconfig.me 2>/dev/null || curl -s icanhazip.com 2>/dev/null || echo "YOUR_SERVER_IP")
     
-    # Generate XP URI (like vless://)
-    # Format: xp://KEY@SERVER:PORT?transport=MODE&sni=SITE&fragment=true#NAME
-    XP_URI="xp://${SECRET_KEY}@${SERVER_IP}:${SERVER_PORT}?transport=${TRANSPORT_MODE}&sni=${FAKE_SITE}&fragment=true&padding=true&fingerprint=chrome#XP-Server"
-    
-    # Also generate base64 version for QR code compatibility
-    CONFIG_JSON="{\"server\":\"${SERVER_IP}\",\"port\":${SERVER_PORT},\"key\":\"${SECRET_KEY}\",\"transport\":\"${TRANSPORT_MODE}\",\"sni\":\"${FAKE_SITE}\",\"fragment\":true,\"padding\":true,\"fingerprint\":\"chrome\"}"
-    XP_BASE64=$(echo -n "$CONFIG_JSON" | base64 | tr -d '\n')
+    # XP URI (like vless://), built by the server from its config
+    XP_URI=$(cd $XP_DIR && docker compose run --rm -T xp-server -c /etc/xp-protocol/server.yaml -link | head -n 1)
     
     echo ""
     echo -e "${GREEN}╔═══════════════════════════════════════════════════════════════════╗${NC}"
@@ -579,6 +585,7 @@ print_summary() {
     echo ""
     echo -e "${YELLOW}${XP_URI}${NC}"
     echo ""
+    (cd $XP_DIR && docker compose run --rm -T xp-server -c /etc/xp-protocol/server.yaml -qr | tail -n +3)
     
     # Save URI to file
     echo "$XP_URI" > $XP_DIR/config-link.txt
@@ -1,43 +1,106 @@
 package config
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Mode      string          `yaml:"mode"`
-	Transport TransportConfig `yaml:"transport"`
-	Server    ServerConfig    `yaml:"server"`
-	Client    ClientConfig    `yaml:"client"`
+	Version     int               `yaml:"version"` // schema version, see Version
+	Mode        string            `yaml:"mode"`
+	Transport   TransportConfig   `yaml:"transport"`
+	Obfuscation ObfuscationConfig `yaml:"obfuscation"`
+	Server      ServerConfig      `yaml:"server"`
+	Client      ClientConfig      `yaml:"client"`
+
+	// Deprecated keys LoadConfig found and moved, e.g. "server.padding"
+	Deprecated []string `yaml:"-"`
+	// Changes LoadConfig made to read a file of an older version
+	Migrated []string `yaml:"-"`
+}
+
+// ObfuscationConfig shapes the tunnel traffic. The server advertises it
+// in its links, so clients use the same profile. Unset toggles are on.
+type ObfuscationConfig struct {
+	Fragment     *bool `yaml:"fragment,omitempty"`      // split the TLS ClientHello (client, tls mode)
+	Padding      *bool `yaml:"padding,omitempty"`       // random bytes in every tunnel packet
+	TimingJitter *bool `yaml:"timing_jitter,omitempty"` // HTTP-like pauses between tunnel writes
+	FragmentMin  int   `yaml:"fragment_min,omitempty"`  // bytes, default 10
+	FragmentMax  int   `yaml:"fragment_max,omitempty"`  // bytes, default 50
+	PaddingMin   int   `yaml:"padding_min,omitempty"`   // bytes, default 16
+	PaddingMax   int   `yaml:"padding_max,omitempty"`   // bytes, default 256
 }
 
 // TransportConfig configures the transport layer
 type TransportConfig struct {
-	Mode string    `yaml:"mode"` // "tls", "kcp", "raw" (raw = ultimate stealth!)
-	TLS  TLSConfig `yaml:"tls"`
-	KCP  KCPConfig `yaml:"kcp"`
-	Raw  RawConfig `yaml:"raw"`
+	Mode string     `yaml:"mode"` // "tls", "kcp", "quic", "raw" (raw = ultimate stealth!)
+	TLS  TLSConfig  `yaml:"tls"`
+	KCP  KCPConfig  `yaml:"kcp"`
+	QUIC QUICConfig `yaml:"quic"`
+	Raw  RawConfig  `yaml:"raw"`
 }
 
 // TLSConfig for TLS-based transport (default)
 type TLSConfig struct {
-	Fragment     bool `yaml:"fragment"`
-	Padding      bool `yaml:"padding"`
-	TimingJitter bool `yaml:"timing_jitter"`
+	// Deprecated: use obfuscation, LoadConfig moves these there
+	Fragment     *bool `yaml:"fragment,omitempty"`
+	Padding      *bool `yaml:"padding,omitempty"`
+	TimingJitter *bool `yaml:"timing_jitter,omitempty"`
 }
 
 // KCPConfig for KCP-based transport
 type KCPConfig struct {
-	Key          string `yaml:"key"`
-	Salt         string `yaml:"salt"`
-	Mode         string `yaml:"mode"` // normal, fast, fast2, fast3
+	Key          string `yaml:"key"`   // Empty = use the server/client key
+	Salt         string `yaml:"salt"`  // Key derivation salt, must match on both sides
+	Crypt        string `yaml:"crypt"` // aes (default), salsa20, none (tunnel AEAD only)
+	Mode         string `yaml:"mode"`  // normal, fast, fast2, fast3, custom
 	DataShards   int    `yaml:"data_shards"`
 	ParityShards int    `yaml:"parity_shards"`
+
+	// Tuning profile, applied identically on dial and accept.
+	// nodelay/interval/resend/nc are only used in custom mode;
+	// zero values elsewhere fall back to the defaults.
+	NoDelay          int `yaml:"nodelay"`
+	Interval         int `yaml:"interval"` // ms
+	Resend           int `yaml:"resend"`
+	NoCongestion     int `yaml:"nc"`
+	SndWnd           int `yaml:"sndwnd"`
+	RcvWnd           int `yaml:"rcvwnd"`
+	MTU              int `yaml:"mtu"`
+	SockBuf          int `yaml:"sockbuf"`           // bytes, read and write
+	KeepAlive        int `yaml:"keepalive"`         // smux keepalive interval, seconds
+	KeepAliveTimeout int `yaml:"keepalive_timeout"` // seconds
+	DSCP             int `yaml:"dscp"`
+
+	Obfs    UDPObfsConfig `yaml:"obfs"`
+	PortHop PortHopConfig `yaml:"port_hopping"`
+}
+
+// PortHopConfig for UDP port hopping in kcp and quic modes
+type PortHopConfig struct {
+	Ports         string  `yaml:"ports"`          // "20000-20100" or "443,8443,20000-20010", empty = off
+	Interval      int     `yaml:"interval"`       // Client: seconds between hops, 0 = only on loss
+	LossThreshold float64 `yaml:"loss_threshold"` // Client: retransmit ratio that triggers a hop (e.g. 0.3), 0 = off
+	Redirect      bool    `yaml:"redirect"`       // Server: one socket + nftables redirect instead of a socket per port
+}
+
+// UDPObfsConfig for per-packet obfuscation of KCP/UDP traffic
+type UDPObfsConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Mimic      string `yaml:"mimic"`                 // none, quic, dtls, wireguard, srtp
+	MaxPadding *int   `yaml:"max_padding,omitempty"` // random bytes per packet, unset = 64, 0 = off
+}
+
+// QUICConfig for the QUIC-disguised transport (KCP inside QUIC packets).
+// KCP key, crypt and tuning come from the kcp section.
+type QUICConfig struct {
+	SNI string `yaml:"sni"` // Server name shown in the Initial, defaults to client.fake_sni
 }
 
 // RawConfig for raw packet transport (bypasses OS TCP stack!)
@@ -53,37 +116,224 @@ type RawConfig struct {
 type ServerConfig struct {
 	Listen       string `yaml:"listen"`
 	Key          string `yaml:"key"`
+	KeyFile      string `yaml:"key_file,omitempty"` // read the key from this file, e.g. a Docker secret
 	FakeSite     string `yaml:"fake_site"`
 	ProbeResist  bool   `yaml:"probe_resist"`
 	FallbackSite string `yaml:"fallback_site"`
-	Fragment     bool   `yaml:"fragment"`
-	Padding      bool   `yaml:"padding"`
-	TimingJitter bool   `yaml:"timing_jitter"`
+	UDPTimeout   int    `yaml:"udp_timeout"` // seconds an idle UDP association is kept, default 60
+	IPStrategy   string `yaml:"ip_strategy"` // ipv4_only (default), ipv6_only, prefer_ipv4, prefer_ipv6
+
+	// Deprecated: use obfuscation, LoadConfig moves these there
+	Fragment     *bool `yaml:"fragment,omitempty"`
+	Padding      *bool `yaml:"padding,omitempty"`
+	TimingJitter *bool `yaml:"timing_jitter,omitempty"`
+
+	DNS ServerDNSConfig `yaml:"dns"`
+
+	// Where clients may connect; loopback and private ranges are denied by default
+	Outbound OutboundConfig `yaml:"outbound"`
+
+	// Extra tunnel keys, each with its own outbound policy if set
+	Users []ServerUser `yaml:"users"`
+
+	Subscription SubscriptionServerConfig `yaml:"subscription"`
+}
+
+// SubscriptionServerConfig serves every user a subscription with their
+// link at /sub/<token>. Address and name also go into xp-server -link.
+// The tokens are secret, so listening beyond loopback needs a certificate.
+type SubscriptionServerConfig struct {
+	Listen  string `yaml:"listen"`   // e.g. "127.0.0.1:8080" behind a TLS reverse proxy, empty = off
+	Address string `yaml:"address"`  // host:port clients connect to, default server.listen
+	Name    string `yaml:"name"`     // link name shown in clients, default the address
+	TLSCert string `yaml:"tls_cert"` // PEM certificate chain to serve HTTPS with
+	TLSKey  string `yaml:"tls_key"`  // PEM private key of tls_cert
+}
+
+// OutboundConfig restricts the destinations of client connections. Lists
+// of domains match the domain and its subdomains.
+type OutboundConfig struct {
+	AllowPrivate bool     `yaml:"allow_private"` // loopback, private, link-local and CGNAT addresses
+	AllowCIDR    []string `yaml:"allow_cidr"`    // reachable even if private, e.g. one LAN service
+	DenyCIDR     []string `yaml:"deny_cidr"`
+	AllowPorts   []string `yaml:"allow_ports"` // e.g. "80", "443", "8000-9000", empty = all
+	DenyPorts    []string `yaml:"deny_ports"`
+	AllowDomains []string `yaml:"allow_domains"` // empty = all
+	DenyDomains  []string `yaml:"deny_domains"`
+}
+
+// ServerUser is an additional tunnel key
+type ServerUser struct {
+	Name     string          `yaml:"name"`
+	Key      string          `yaml:"key"`
+	KeyFile  string          `yaml:"key_file,omitempty"`
+	Outbound *OutboundConfig `yaml:"outbound"` // replaces server.outbound for this user
+}
+
+// ServerDNSConfig controls how the server resolves destinations
+type ServerDNSConfig struct {
+	Servers   []string `yaml:"servers"`    // udp://, tcp://, tls:// or https:// upstreams, empty = system resolver
+	CacheSize int      `yaml:"cache_size"` // entries, default 4096, -1 = off
 }
 
 type ClientConfig struct {
-	ServerAddr   string `yaml:"server_addr"`
-	Key          string `yaml:"key"`
-	FakeSNI      string `yaml:"fake_sni"`
-	SOCKSAddr    string `yaml:"socks_addr"`
-	HTTPAddr     string `yaml:"http_addr"`
-	Fragment     bool   `yaml:"fragment"`
-	Padding      bool   `yaml:"padding"`
-	TimingJitter bool   `yaml:"timing_jitter"`
-	Fingerprint  string `yaml:"fingerprint"`
+	ServerAddr  string `yaml:"server_addr"`
+	Key         string `yaml:"key"`
+	KeyFile     string `yaml:"key_file,omitempty"` // read the key from this file
+	FakeSNI     string `yaml:"fake_sni"`
+	SOCKSAddr   string `yaml:"socks_addr"`
+	HTTPAddr    string `yaml:"http_addr"`
+	Fingerprint string `yaml:"fingerprint"`
+	IPStrategy  string `yaml:"ip_strategy"` // for the server and direct connections, default ipv4_only
+
+	// Deprecated: use obfuscation, LoadConfig moves these there
+	Fragment     *bool `yaml:"fragment,omitempty"`
+	Padding      *bool `yaml:"padding,omitempty"`
+	TimingJitter *bool `yaml:"timing_jitter,omitempty"`
+
+	// Several servers to choose from; empty uses server_addr, key and fake_sni
+	Servers   []ServerEndpoint `yaml:"servers"`
+	Selection SelectionConfig  `yaml:"selection"`
+
+	// More servers from a subscription URL, refreshed in the background
+	Subscription SubscriptionConfig `yaml:"subscription"`
+
+	// Local proxy access control (SOCKS5 and HTTP), empty = no authentication
+	Users []ProxyUser `yaml:"users"`
+
+	Transparent TransparentConfig `yaml:"transparent"`
+
+	TUN TUNConfig `yaml:"tun"`
+
+	Routing RoutingConfig `yaml:"routing"`
+
+	DNS DNSConfig `yaml:"dns"`
+
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+
+	Pool PoolConfig `yaml:"pool"`
+
+	// Tell apps they are connected right away and send their first bytes
+	// with the connect request, saving a round trip (needs an updated server)
+	FastOpen bool `yaml:"fast_open"`
+
+	// Connection status as JSON over HTTP, e.g. "127.0.0.1:9090", empty = off
+	StatusAddr string `yaml:"status_addr"`
+}
+
+// ServerEndpoint is one server the client can use. Empty fields fall back
+// to the client section and the top-level transport.
+type ServerEndpoint struct {
+	Name      string           `yaml:"name"`
+	Address   string           `yaml:"address"`
+	Key       string           `yaml:"key"`
+	FakeSNI   string           `yaml:"fake_sni"`
+	Transport *TransportConfig `yaml:"transport"`
+}
+
+// SubscriptionConfig fetches servers from a URL serving a base64 list of
+// xp:// links or a Subscription document in YAML or JSON
+type SubscriptionConfig struct {
+	URL      string `yaml:"url"`
+	Interval int    `yaml:"interval"` // seconds between refreshes, default 3600
+}
+
+// Subscription is the YAML/JSON form of a subscription
+type Subscription struct {
+	Servers []ServerEndpoint `yaml:"servers"`
+}
+
+// SelectionConfig chooses between servers
+type SelectionConfig struct {
+	// failover (default): first server that is up, in order
+	// latency: lowest keepalive round-trip time
+	// round_robin: each new connection on the next server
+	// sticky: the same destination always on the same server
+	Strategy string `yaml:"strategy"`
+}
+
+// ReconnectConfig controls tunnel health checks and reconnection
+type ReconnectConfig struct {
+	PingInterval int `yaml:"ping_interval"` // seconds between keepalive pings, default 15, -1 = off
+	PingTimeout  int `yaml:"ping_timeout"`  // seconds to wait for the answer, default 10
+	MaxBackoff   int `yaml:"max_backoff"`   // longest wait between attempts in seconds, default 60
+}
+
+// PoolConfig keeps several tunnels to each server so streams are spread
+// over more than one connection
+type PoolConfig struct {
+	Size        int `yaml:"size"`         // tunnels per server, default 1
+	MaxStreams  int `yaml:"max_streams"`  // streams per tunnel, 0 = unlimited
+	MaxLifetime int `yaml:"max_lifetime"` // seconds before a tunnel is replaced, 0 = never
+}
+
+// TransparentConfig for the router-style transparent proxy (Linux only)
+type TransparentConfig struct {
+	Listen  string   `yaml:"listen"`  // e.g. "0.0.0.0:12345", empty = off
+	Mode    string   `yaml:"mode"`    // redirect (TCP only) or tproxy (TCP and UDP)
+	Mark    int      `yaml:"mark"`    // tproxy fwmark, default 1
+	Table   int      `yaml:"table"`   // tproxy routing table, default 100
+	Exclude []string `yaml:"exclude"` // extra CIDRs to bypass; LAN ranges and the server are always bypassed
+}
+
+// TUNConfig for whole-system routing through a TUN device (Linux only)
+type TUNConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Name      string   `yaml:"name"`       // interface name, default xp0
+	Address   string   `yaml:"address"`    // interface address, default 198.18.0.1/30
+	MTU       int      `yaml:"mtu"`        // default 1500
+	AutoRoute bool     `yaml:"auto_route"` // route all IPv4 traffic into the device; the server is always excluded
+	Exclude   []string `yaml:"exclude"`    // extra CIDRs that keep their current route
+}
+
+// RoutingConfig decides per connection whether to use the tunnel, connect
+// directly or refuse. Rules are tried in order; the first match wins.
+type RoutingConfig struct {
+	Final          string        `yaml:"final"`           // action when no rule matches, default proxy
+	ResolveDomains bool          `yaml:"resolve_domains"` // resolve domains locally to match cidr/geoip rules
+	GeoIP          string        `yaml:"geoip"`           // MaxMind country database (.mmdb)
+	GeoSiteDir     string        `yaml:"geosite_dir"`     // directory of domain lists named <list>.txt
+	Rules          []RoutingRule `yaml:"rules"`
+}
+
+// RoutingRule matches when any of its destination conditions matches and,
+// if ports are given, the port is one of them
+type RoutingRule struct {
+	Domain        []string `yaml:"domain"`         // exact names
+	DomainSuffix  []string `yaml:"domain_suffix"`  // the name or any subdomain
+	DomainKeyword []string `yaml:"domain_keyword"` // substring of the name
+	DomainRegex   []string `yaml:"domain_regex"`
+	GeoSite       []string `yaml:"geosite"` // lists from geosite_dir
+	CIDR          []string `yaml:"cidr"`
+	GeoIP         []string `yaml:"geoip"`  // country codes, or "private"
+	Port          []string `yaml:"port"`   // "443" or "6881-6889"
+	Action        string   `yaml:"action"` // proxy, direct or block
+}
+
+// DNSConfig for the built-in DNS server. Domains the routing rules send
+// direct use direct_upstream, blocked domains get NXDOMAIN.
+type DNSConfig struct {
+	Listen         string `yaml:"listen"`          // e.g. "127.0.0.1:5353", empty = off
+	Upstream       string `yaml:"upstream"`        // through the tunnel: tcp://, tls:// or https://
+	DirectUpstream string `yaml:"direct_upstream"` // udp://, tcp://, tls:// or https://, empty = upstream
+	CacheSize      int    `yaml:"cache_size"`      // entries, default 4096, -1 = off
+	FakeIP         bool   `yaml:"fake_ip"`         // answer tunneled domains with fake IPs (transparent/TUN)
+	FakeIPRange    string `yaml:"fake_ip_range"`   // default 198.19.0.0/16
+}
+
+type ProxyUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 func DefaultServerConfig() Config {
 	return Config{
-		Mode: "server",
+		Version: Version,
+		Mode:    "server",
 		Transport: TransportConfig{
 			Mode: "tls",
-			TLS: TLSConfig{
-				Fragment:     true,
-				Padding:      true,
-				TimingJitter: true,
-			},
 			KCP: KCPConfig{
+				Crypt:        "aes",
 				Mode:         "fast2",
 				DataShards:   10,
 				ParityShards: 3,
@@ -98,24 +348,19 @@ func DefaultServerConfig() Config {
 			FakeSite:     "www.microsoft.com",
 			ProbeResist:  true,
 			FallbackSite: "www.microsoft.com",
-			Fragment:     true,
-			Padding:      true,
-			TimingJitter: true,
+			UDPTimeout:   60,
 		},
 	}
 }
 
 func DefaultClientConfig() Config {
 	return Config{
-		Mode: "client",
+		Version: Version,
+		Mode:    "client",
 		Transport: TransportConfig{
 			Mode: "tls",
-			TLS: TLSConfig{
-				Fragment:     true,
-				Padding:      true,
-				TimingJitter: true,
-			},
 			KCP: KCPConfig{
+				Crypt:        "aes",
 				Mode:         "fast2",
 				DataShards:   10,
 				ParityShards: 3,
@@ -126,30 +371,70 @@ func DefaultClientConfig() Config {
 			},
 		},
 		Client: ClientConfig{
-			FakeSNI:      "www.microsoft.com",
-			SOCKSAddr:    "127.0.0.1:1080",
-			Fragment:     true,
-			Padding:      true,
-			TimingJitter: true,
-			Fingerprint:  "chrome",
+			FakeSNI:     "www.microsoft.com",
+			SOCKSAddr:   "127.0.0.1:1080",
+			Fingerprint: "chrome",
 		},
 	}
 }
 
+// Defaults returns the defaults of a mode, the zero config for others
+func Defaults(mode string) Config {
+	switch mode {
+	case "server":
+		return DefaultServerConfig()
+	case "client":
+		return DefaultClientConfig()
+	}
+	return Config{}
+}
+
 func LoadConfig(path string) (*Config, error) {
+	return Load(path, Config{})
+}
+
+// Load reads the YAML file at path over defaults; an empty path gives
+// the defaults. Files of an older version are upgraded in memory, see
+// MigrateFile. Environment and flag overrides come after, see Override.
+func Load(path string, defaults Config) (*Config, error) {
+	config := defaults
+	if path == "" {
+		return &config, nil
+	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	// Unknown fields are errors, so a misspelled setting isn't silently
+	// left at its default. The file as written is checked, so the line
+	// numbers match.
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse config:\n%w", decodeError(err))
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	from, notes, err := migrate(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if from < Version {
+		config = defaults
+		if err := doc.Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to migrate config: %w", err)
+		}
+		config.Migrated = notes
+	}
+	config.Deprecated = config.migrateObfuscation()
 	return &config, nil
 }
 
+// SaveConfig writes the config in canonical form, see Marshal
 func SaveConfig(config *Config, path string) error {
-	data, err := yaml.Marshal(config)
+	data, err := config.Marshal()
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
@@ -163,10 +448,100 @@ func (c *ServerConfig) GetKey() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(c.Key)
 }
 
+func (u *ServerUser) GetKey() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(u.Key)
+}
+
+func (e *ServerEndpoint) GetKey() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(e.Key)
+}
+
 func (c *ClientConfig) GetKey() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(c.Key)
 }
 
+// Endpoints returns the configured servers, or the single server given by
+// server_addr, key and fake_sni
+func (c *ClientConfig) Endpoints() []ServerEndpoint {
+	if len(c.Servers) == 0 {
+		if c.ServerAddr == "" {
+			return nil
+		}
+		return []ServerEndpoint{{Name: c.ServerAddr, Address: c.ServerAddr, Key: c.Key, FakeSNI: c.FakeSNI}}
+	}
+	return c.Complete(c.Servers)
+}
+
+// Complete fills in the defaults of servers from the client section
+func (c *ClientConfig) Complete(servers []ServerEndpoint) []ServerEndpoint {
+	eps := make([]ServerEndpoint, len(servers))
+	for i, ep := range servers {
+		if ep.Name == "" {
+			ep.Name = ep.Address
+		}
+		if ep.Key == "" {
+			ep.Key = c.Key
+		}
+		if ep.FakeSNI == "" {
+			ep.FakeSNI = c.FakeSNI
+		}
+		eps[i] = ep
+	}
+	return eps
+}
+
+func (c *ClientConfig) ProxyUsers() map[string]string {
+	if len(c.Users) == 0 {
+		return nil
+	}
+	users := make(map[string]string, len(c.Users))
+	for _, u := range c.Users {
+		users[u.Username] = u.Password
+	}
+	return users
+}
+
+func (o ObfuscationConfig) FragmentEnabled() bool { return o.Fragment == nil || *o.Fragment }
+func (o ObfuscationConfig) PaddingEnabled() bool  { return o.Padding == nil || *o.Padding }
+func (o ObfuscationConfig) TimingEnabled() bool   { return o.TimingJitter == nil || *o.TimingJitter }
+
+// migrateObfuscation moves the old fragment, padding and timing_jitter
+// keys into the obfuscation section and returns the ones that were set.
+// obfuscation wins over the server or client section of the mode, which
+// wins over transport.tls.
+func (c *Config) migrateObfuscation() []string {
+	type legacy struct {
+		section                         string
+		fragment, padding, timingJitter **bool
+	}
+	var sources []legacy
+	switch c.Mode {
+	case "server":
+		sources = append(sources, legacy{"server", &c.Server.Fragment, &c.Server.Padding, &c.Server.TimingJitter})
+	case "client":
+		sources = append(sources, legacy{"client", &c.Client.Fragment, &c.Client.Padding, &c.Client.TimingJitter})
+	}
+	sources = append(sources, legacy{"transport.tls", &c.Transport.TLS.Fragment, &c.Transport.TLS.Padding, &c.Transport.TLS.TimingJitter})
+	var found []string
+	move := func(section, key string, from, to **bool) {
+		if *from == nil {
+			return
+		}
+		found = append(found, section+"."+key)
+		if *to == nil {
+			*to = *from
+		}
+		*from = nil
+	}
+	o := &c.Obfuscation
+	for _, src := range sources {
+		move(src.section, "fragment", src.fragment, &o.Fragment)
+		move(src.section, "padding", src.padding, &o.Padding)
+		move(src.section, "timing_jitter", src.timingJitter, &o.TimingJitter)
+	}
+	return found
+}
+
 func GenerateKeyString() (string, error) {
 	key := make([]byte, 32)
 	if _, err := rand.Read(key); err != nil {
@@ -178,6 +553,7 @@ func GenerateKeyString() (string, error) {
 func GenerateExampleConfig(mode string) string {
 	if mode == "server" {
 		return `# XP Protocol Server Configuration
+version: 2
 mode: server
 
 server:
@@ -186,12 +562,15 @@ server:
   fake_site: "www.microsoft.com"
   probe_resist: true
   fallback_site: "www.microsoft.com"
+
+obfuscation:
   fragment: true
   padding: true
   timing_jitter: true
 `
 	}
 	return `# XP Protocol Client Configuration
+version: 2
 mode: client
 
 client:
@@ -200,9 +579,11 @@ client:
   fake_sni: "www.microsoft.com"
   socks_addr: "127.0.0.1:1080"
   http_addr: "127.0.0.1:8080"
+  fingerprint: "chrome"
+
+obfuscation:
   fragment: true
   padding: true
   timing_jitter: true
-  fingerprint: "chrome"
 `
 }
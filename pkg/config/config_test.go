@@ -0,0 +1,101 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestObfuscationPrecedence(t *testing.T) {
+	tests := []struct {
+		name                      string
+		text                      string
+		fragment, padding, timing bool
+		deprecated                []string
+	}{
+		{
+			"defaults",
+			"version: 2\nmode: client\n",
+			true, true, true, nil,
+		},
+		{
+			"obfuscation only",
+			"version: 2\nmode: server\nobfuscation:\n  padding: false\n  timing_jitter: false\n",
+			true, false, false, nil,
+		},
+		{
+			"old server keys",
+			"version: 2\nmode: server\nserver:\n  padding: false\ntransport:\n  tls:\n    timing_jitter: false\n",
+			true, false, false, []string{"server.padding", "transport.tls.timing_jitter"},
+		},
+		{
+			"obfuscation wins over the old keys",
+			"version: 2\nmode: client\nobfuscation:\n  fragment: true\n  padding: true\nclient:\n  fragment: false\ntransport:\n  tls:\n    padding: false\n",
+			true, true, true, []string{"client.fragment", "transport.tls.padding"},
+		},
+		{
+			"the mode's section wins over transport.tls",
+			"version: 2\nmode: server\nserver:\n  padding: true\ntransport:\n  tls:\n    padding: false\n    fragment: false\n",
+			false, true, true, []string{"server.padding", "transport.tls.fragment", "transport.tls.padding"},
+		},
+		{
+			"the other mode's section is left alone",
+			"version: 2\nmode: client\nserver:\n  padding: false\n",
+			true, true, true, nil,
+		},
+	}
+	for _, tt := range tests {
+		mode := "client"
+		if strings.Contains(tt.text, "mode: server") {
+			mode = "server"
+		}
+		c, err := Load(writeConfig(t, tt.text), Defaults(mode))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		o := c.Obfuscation
+		if o.FragmentEnabled() != tt.fragment || o.PaddingEnabled() != tt.padding || o.TimingEnabled() != tt.timing {
+			t.Errorf("%s: fragment %v padding %v timing %v, want %v %v %v", tt.name,
+				o.FragmentEnabled(), o.PaddingEnabled(), o.TimingEnabled(), tt.fragment, tt.padding, tt.timing)
+		}
+		if strings.Join(c.Deprecated, " ") != strings.Join(tt.deprecated, " ") {
+			t.Errorf("%s: deprecated %v, want %v", tt.name, c.Deprecated, tt.deprecated)
+		}
+		// The old keys are cleared, so they are never saved again
+		if (mode == "server" && (c.Server.Fragment != nil || c.Server.Padding != nil || c.Server.TimingJitter != nil)) ||
+			(mode == "client" && (c.Client.Fragment != nil || c.Client.Padding != nil || c.Client.TimingJitter != nil)) ||
+			c.Transport.TLS.Fragment != nil || c.Transport.TLS.Padding != nil || c.Transport.TLS.TimingJitter != nil {
+			t.Errorf("%s: old keys left set", tt.name)
+		}
+		data, err := c.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, err := Load(writeConfig(t, string(data)), Defaults(mode))
+		if err != nil {
+			t.Errorf("%s: reading the saved config: %v", tt.name, err)
+		} else if len(saved.Deprecated) != 0 {
+			t.Errorf("%s: saved config keeps %v", tt.name, saved.Deprecated)
+		}
+	}
+}
+
+func TestMigrateFileObfuscation(t *testing.T) {
+	// A version 1 file with the old keys migrates to the obfuscation section
+	path := writeConfig(t, "mode: client\nclient:\n  server_addr: vpn.example.com:443\n  key: "+testKey+"\n  padding: false\ntransport:\n  tls:\n    timing_jitter: false\n")
+	if _, _, _, err := MigrateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path, DefaultClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Deprecated) != 0 || len(c.Migrated) != 0 {
+		t.Errorf("migrated file still has old keys: deprecated %v migrated %v", c.Deprecated, c.Migrated)
+	}
+	o := c.Obfuscation
+	// Version 1 clients didn't fragment by default, and keep not doing so
+	if o.FragmentEnabled() || o.PaddingEnabled() || o.TimingEnabled() {
+		t.Errorf("obfuscation after migrating: %+v", o)
+	}
+}
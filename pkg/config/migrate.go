@@ -0,0 +1,221 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the config schema this build reads and SaveConfig writes.
+// Files without a version key are version 1.
+const Version = 2
+
+// migrations[i] upgrades a document from version i+1 to i+2. Each one
+// works on the YAML tree, where it can still tell unset keys from zero
+// values, and returns what it changed.
+var migrations = []func(root *yaml.Node) []string{
+	migrateV1,
+}
+
+// migrate upgrades the document to the current version and returns the
+// version it had with the changes made
+func migrate(doc *yaml.Node) (int, []string, error) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return Version, nil, nil
+	}
+	root := doc.Content[0]
+	version := 1
+	if v := mapValue(root, "version"); v != nil {
+		n, err := strconv.Atoi(v.Value)
+		if err != nil || n < 1 {
+			return 0, nil, fmt.Errorf("line %d: invalid version %q", v.Line, v.Value)
+		}
+		if n > Version {
+			return 0, nil, fmt.Errorf("config version %d needs a newer xp-server/xp-client (this one reads up to %d)", n, Version)
+		}
+		version = n
+	}
+	var notes []string
+	for v := version; v < Version; v++ {
+		notes = append(notes, migrations[v-1](root)...)
+	}
+	if version < Version {
+		mapSet(root, "version", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(Version)})
+	}
+	return version, notes, nil
+}
+
+// migrateV1 upgrades the layout from before the obfuscation section and
+// the defaults layer. The obfuscation toggles move out of the server,
+// client and transport.tls sections. Version 1 read unset keys as zero
+// values, so the ones whose default is no longer zero are written out.
+func migrateV1(root *yaml.Node) []string {
+	var notes []string
+	mode := ""
+	if v := mapValue(root, "mode"); v != nil {
+		mode = v.Value
+	}
+
+	obfs := mapValue(root, "obfuscation")
+	hadObfs := obfs != nil
+	if obfs == nil {
+		obfs = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	sections := []string{"server", "client"}
+	if mode == "client" {
+		sections = []string{"client", "server"}
+	}
+	type source struct {
+		path string
+		node *yaml.Node
+	}
+	var sources []source
+	for _, name := range sections {
+		sources = append(sources, source{name, mapValue(root, name)})
+	}
+	sources = append(sources, source{"transport.tls", mapValue(mapValue(root, "transport"), "tls")})
+	for _, key := range []string{"fragment", "padding", "timing_jitter"} {
+		for _, src := range sources {
+			v := mapDelete(src.node, key)
+			switch {
+			case v == nil:
+			case src.path != mode && src.path != "transport.tls":
+				notes = append(notes, fmt.Sprintf("%s.%s removed, it had no effect in a %s config", src.path, key, mode))
+			case mapValue(obfs, key) != nil:
+				notes = append(notes, fmt.Sprintf("%s.%s removed, obfuscation.%s is set", src.path, key, key))
+			default:
+				mapSet(obfs, key, v)
+				notes = append(notes, fmt.Sprintf("%s.%s moved to obfuscation.%s", src.path, key, key))
+			}
+		}
+	}
+	if tls := mapValue(root, "transport"); tls != nil {
+		if t := mapValue(tls, "tls"); t != nil && len(t.Content) == 0 {
+			mapDelete(tls, "tls")
+		}
+	}
+	// Unset, the client didn't fragment; the tunnel always padded and
+	// jittered whatever the config said
+	if mode == "client" && !hadObfs && mapValue(obfs, "fragment") == nil {
+		mapSet(obfs, "fragment", boolNode(false))
+		notes = append(notes, "obfuscation.fragment set to false, the old default")
+	}
+	if len(obfs.Content) > 0 && !hadObfs {
+		mapSet(root, "obfuscation", obfs)
+	}
+
+	if raw := mapValue(mapValue(root, "transport"), "raw"); raw != nil && mapValue(raw, "use_kcp") == nil {
+		mapSet(raw, "use_kcp", boolNode(false))
+		notes = append(notes, "transport.raw.use_kcp set to false, the old default")
+	}
+	// max_padding 0 used to mean the default, now it turns padding off
+	transports := []source{{"transport", mapValue(root, "transport")}}
+	if servers := mapValue(mapValue(root, "client"), "servers"); servers != nil && servers.Kind == yaml.SequenceNode {
+		for i, s := range servers.Content {
+			transports = append(transports, source{fmt.Sprintf("client.servers[%d].transport", i), mapValue(s, "transport")})
+		}
+	}
+	for _, t := range transports {
+		obfs := mapValue(mapValue(t.node, "kcp"), "obfs")
+		if v := mapValue(obfs, "max_padding"); v != nil {
+			if n, err := strconv.Atoi(v.Value); err == nil && n <= 0 {
+				mapDelete(obfs, "max_padding")
+				notes = append(notes, t.path+".kcp.obfs.max_padding removed, 0 meant the default of 64")
+			}
+		}
+	}
+	if server := mapValue(root, "server"); mode == "server" && server != nil && mapValue(server, "probe_resist") == nil {
+		mapSet(server, "probe_resist", boolNode(false))
+		notes = append(notes, "server.probe_resist set to false, the old default")
+	}
+	return notes
+}
+
+// MigrateFile upgrades the config file at path to the current version in
+// place, first copying it to path.v<version>.bak. An up-to-date file is
+// left alone and the backup path is empty.
+func MigrateFile(path string) (from int, backup string, notes []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if from, _, err = migrate(&doc); err != nil || from == Version {
+		return from, "", nil, err
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return from, "", nil, err
+	}
+	if cfg, err = Load(path, Defaults(cfg.Mode)); err != nil {
+		return from, "", nil, err
+	}
+	backup = fmt.Sprintf("%s.v%d.bak", path, from)
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return from, "", nil, fmt.Errorf("backup %s already exists, move it away first", backup)
+	}
+	if err != nil {
+		return from, "", nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return from, "", nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+	return from, backup, cfg.Migrated, SaveConfig(cfg, path)
+}
+
+func boolNode(b bool) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(b)}
+}
+
+// mapValue returns the value of key in the mapping m, nil if m is nil
+// or has no such key
+func mapValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mapDelete removes key from the mapping m and returns its value
+func mapDelete(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			v := m.Content[i+1]
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return v
+		}
+	}
+	return nil
+}
+
+// mapSet sets key in the mapping m, adding it at the end if missing
+func mapSet(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
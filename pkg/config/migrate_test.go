@@ -0,0 +1,149 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadMigrates(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		check func(c *Config) bool
+		notes []string // prefixes of the notes, in order
+	}{
+		{
+			"server toggles move",
+			"mode: server\nserver:\n  listen: :443\n  padding: false\n  probe_resist: true\nclient:\n  fragment: true\n",
+			func(c *Config) bool {
+				return !c.Obfuscation.PaddingEnabled() && c.Obfuscation.Fragment == nil && c.Server.ProbeResist
+			},
+			[]string{"client.fragment removed", "server.padding moved"},
+		},
+		{
+			"obfuscation wins over transport.tls",
+			"mode: client\nobfuscation:\n  fragment: true\ntransport:\n  tls:\n    fragment: false\n",
+			func(c *Config) bool { return c.Obfuscation.FragmentEnabled() && c.Transport.TLS.Fragment == nil },
+			[]string{"transport.tls.fragment removed"},
+		},
+		{
+			"old client defaults kept",
+			"mode: client\ntransport:\n  raw:\n    interface: eth0\n",
+			func(c *Config) bool { return !c.Obfuscation.FragmentEnabled() && !c.Transport.Raw.UseKCP },
+			[]string{"obfuscation.fragment set to false", "transport.raw.use_kcp set to false"},
+		},
+		{
+			"old server defaults kept",
+			"mode: server\nserver:\n  listen: :443\n",
+			func(c *Config) bool { return !c.Server.ProbeResist },
+			[]string{"server.probe_resist set to false"},
+		},
+		{
+			"max_padding 0 was the default",
+			"mode: client\nobfuscation:\n  fragment: true\ntransport:\n  kcp:\n    obfs:\n      max_padding: 0\nclient:\n  servers:\n    - address: a.example.com:443\n      transport:\n        kcp:\n          obfs:\n            max_padding: 32\n    - address: b.example.com:443\n      transport:\n        kcp:\n          obfs:\n            max_padding: 0\n",
+			func(c *Config) bool {
+				s := c.Client.Servers
+				return c.Transport.KCP.Obfs.MaxPadding == nil && *s[0].Transport.KCP.Obfs.MaxPadding == 32 && s[1].Transport.KCP.Obfs.MaxPadding == nil
+			},
+			[]string{"transport.kcp.obfs.max_padding removed", "client.servers[1].transport.kcp.obfs.max_padding removed"},
+		},
+		{
+			"current version untouched",
+			"version: 2\nmode: server\nserver:\n  listen: :443\n",
+			func(c *Config) bool { return c.Server.ProbeResist },
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		mode := "client"
+		if strings.Contains(tt.text, "mode: server") {
+			mode = "server"
+		}
+		c, err := Load(writeConfig(t, tt.text), Defaults(mode))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(c) {
+			t.Errorf("%s: unexpected config %+v", tt.name, c)
+		}
+		if len(c.Migrated) != len(tt.notes) {
+			t.Errorf("%s: notes %q, want %d", tt.name, c.Migrated, len(tt.notes))
+			continue
+		}
+		for i, note := range tt.notes {
+			if !strings.HasPrefix(c.Migrated[i], note) {
+				t.Errorf("%s: note %q, want %q", tt.name, c.Migrated[i], note)
+			}
+		}
+	}
+}
+
+func TestLoadVersion(t *testing.T) {
+	for _, text := range []string{"version: 3\nmode: server\n", "version: two\nmode: server\n", "version: 0\nmode: server\n"} {
+		if _, err := LoadConfig(writeConfig(t, text)); err == nil {
+			t.Errorf("Load(%q) succeeded", text)
+		}
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	const v1 = "mode: server\nserver:\n  listen: :8443\n  key: KEY\n  padding: false\ntransport:\n  mode: kcp\n"
+	path := writeConfig(t, strings.Replace(v1, "KEY", testKey, 1))
+	before, err := Load(path, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, backup, notes, err := MigrateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 || backup != path+".v1.bak" || len(notes) == 0 {
+		t.Errorf("MigrateFile = %d %s %q", from, backup, notes)
+	}
+	if data, _ := os.ReadFile(backup); !strings.Contains(string(data), "padding: false") {
+		t.Errorf("backup holds %q", data)
+	}
+
+	// The file now reads as the same config without migrating
+	after, err := Load(path, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Migrated) != 0 {
+		t.Errorf("migrated file needs migrating: %q", after.Migrated)
+	}
+	before.Migrated, before.Deprecated, after.Deprecated = nil, nil, nil
+	before.Version = Version
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("migrated file reads as\n%+v\nwant\n%+v", after, before)
+	}
+
+	from, backup, _, err = MigrateFile(path)
+	if err != nil || from != Version || backup != "" {
+		t.Errorf("second MigrateFile = %d %q %v, want nothing done", from, backup, err)
+	}
+
+	// An existing backup is never overwritten
+	path = writeConfig(t, v1)
+	os.WriteFile(path+".v1.bak", []byte("keep"), 0o600)
+	if _, _, _, err := MigrateFile(path); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("MigrateFile over a backup: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != v1 {
+		t.Error("MigrateFile changed the file after failing")
+	}
+}
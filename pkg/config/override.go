@@ -0,0 +1,309 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variables that override config
+// fields: the YAML path in upper case with _ between the parts, e.g.
+// XP_SERVER_LISTEN for server.listen or XP_CLIENT_SERVERS_0_KEY for
+// client.servers[0].key
+const EnvPrefix = "XP_"
+
+// Overrides collects path=value overrides from a repeated flag
+type Overrides []string
+
+func (o *Overrides) String() string { return strings.Join(*o, " ") }
+
+func (o *Overrides) Set(s string) error {
+	*o = append(*o, s)
+	return nil
+}
+
+// Override applies the XP_* variables of environ, then overrides, over
+// the config and reads the key files. Deprecated keys set this way are
+// moved like those of a file.
+func (c *Config) Override(environ []string, overrides []string) error {
+	// Sorted, so the result doesn't depend on the order of the environment
+	var env []string
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, EnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		path, ok := envPath(reflect.TypeOf(*c), strings.TrimPrefix(name, EnvPrefix))
+		if !ok {
+			return fmt.Errorf("%s: unknown config variable", name)
+		}
+		if err := c.Set(path, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for _, o := range overrides {
+		path, value, ok := strings.Cut(o, "=")
+		if !ok {
+			return fmt.Errorf("invalid override %q, expected path=value", o)
+		}
+		if err := c.Set(path, value); err != nil {
+			return err
+		}
+	}
+	c.Deprecated = append(c.Deprecated, c.migrateObfuscation()...)
+	return c.readKeyFiles()
+}
+
+// Set changes the field at a YAML path such as server.listen or
+// client.servers[0].key. Lists take comma-separated values, and lists of
+// sections grow to the index. Setting key clears the key_file next to it
+// and the other way round, so the later layer wins.
+func (c *Config) Set(path, value string) error {
+	parts := strings.Split(strings.NewReplacer("[", ".", "]", "").Replace(path), ".")
+	v := reflect.ValueOf(c).Elem()
+	var parent reflect.Value
+	for _, part := range parts {
+		if v.Kind() == reflect.Pointer && v.Type().Elem().Kind() == reflect.Struct {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		switch {
+		case v.Kind() == reflect.Struct:
+			f, ok := yamlField(v, part)
+			if !ok {
+				return fmt.Errorf("%s: unknown field %q", path, part)
+			}
+			parent, v = v, f
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 {
+				return fmt.Errorf("%s: %q is not a list index", path, part)
+			}
+			for v.Len() <= i {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			v = v.Index(i)
+		default:
+			return fmt.Errorf("%s: %q is not a section", path, part)
+		}
+	}
+	if err := setField(v, value); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	switch parts[len(parts)-1] {
+	case "key":
+		if f, ok := yamlField(parent, "key_file"); ok {
+			f.SetString("")
+		}
+	case "key_file":
+		if f, ok := yamlField(parent, "key"); ok {
+			f.SetString("")
+		}
+	}
+	return nil
+}
+
+// readKeyFiles reads the keys given as files, e.g. Docker secrets
+func (c *Config) readKeyFiles() error {
+	type keyFile struct {
+		path      string
+		file, key *string
+	}
+	files := []keyFile{
+		{"server.key_file", &c.Server.KeyFile, &c.Server.Key},
+		{"client.key_file", &c.Client.KeyFile, &c.Client.Key},
+	}
+	for i := range c.Server.Users {
+		u := &c.Server.Users[i]
+		files = append(files, keyFile{fmt.Sprintf("server.users[%d].key_file", i), &u.KeyFile, &u.Key})
+	}
+	for _, kf := range files {
+		if *kf.file == "" {
+			continue
+		}
+		if *kf.key != "" {
+			return fmt.Errorf("%s: set key or key_file, not both", kf.path)
+		}
+		data, err := os.ReadFile(*kf.file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", kf.path, err)
+		}
+		*kf.key = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// Redacted returns the config as YAML with keys, passwords and
+// subscription tokens hidden, without the section of the other mode
+func (c *Config) Redacted() ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(c); err != nil {
+		return nil, err
+	}
+	other := map[string]string{"server": "client", "client": "server"}[c.Mode]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == other {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			break
+		}
+	}
+	redact(&node)
+	return yaml.Marshal(&node)
+}
+
+func redact(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if v.Kind != yaml.ScalarNode || v.Value == "" {
+				continue
+			}
+			switch k.Value {
+			case "key", "password":
+				v.Value, v.Style = "<redacted>", 0
+			case "url":
+				// Subscription URLs end in the user's token
+				if u, err := url.Parse(v.Value); err == nil && u.Host != "" {
+					v.Value = u.Scheme + "://" + u.Host + "/<redacted>"
+				}
+			}
+		}
+	}
+	for _, child := range n.Content {
+		redact(child)
+	}
+}
+
+// envPath finds the YAML path of an environment variable name without
+// the prefix, trying every field whose name starts it since names
+// contain underscores themselves
+func envPath(t reflect.Type, name string) (string, bool) {
+	switch t.Kind() {
+	case reflect.Pointer:
+		if t.Elem().Kind() == reflect.Struct {
+			return envPath(t.Elem(), name)
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Struct {
+			index, rest, _ := strings.Cut(name, "_")
+			if _, err := strconv.Atoi(index); err == nil {
+				if p, ok := envPath(t.Elem(), rest); ok {
+					return "[" + index + "]." + p, true
+				}
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			yname := yamlName(field)
+			if yname == "" {
+				continue
+			}
+			upper := strings.ToUpper(yname)
+			if name == upper && isLeaf(field.Type) {
+				return yname, true
+			}
+			if rest, ok := strings.CutPrefix(name, upper+"_"); ok {
+				if p, ok := envPath(field.Type, rest); ok {
+					if strings.HasPrefix(p, "[") {
+						return yname + p, true
+					}
+					return yname + "." + p, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "-" || !f.IsExported() {
+		return ""
+	}
+	return name
+}
+
+func yamlField(v reflect.Value, name string) (reflect.Value, bool) {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if yamlName(v.Type().Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// isLeaf reports whether a field holds a value rather than a section
+func isLeaf(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	case reflect.Pointer:
+		return t.Elem().Kind() == reflect.Bool || t.Elem().Kind() == reflect.Int
+	}
+	return false
+}
+
+func setField(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected true or false", value)
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected a number", value)
+		}
+		f.SetInt(int64(n))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected a number", value)
+		}
+		f.SetFloat(x)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("is a list of sections, set the fields of one like [0].name")
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	case reflect.Pointer:
+		if !isLeaf(f.Type()) {
+			return fmt.Errorf("is a section, set one of its fields")
+		}
+		v := reflect.New(f.Type().Elem())
+		if err := setField(v.Elem(), value); err != nil {
+			return err
+		}
+		f.Set(v)
+	default:
+		return fmt.Errorf("is a section, set one of its fields")
+	}
+	return nil
+}
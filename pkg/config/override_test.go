@@ -0,0 +1,155 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		path, value string
+		get         func(c *Config) any
+		want        any
+		err         string
+	}{
+		{path: "server.listen", value: ":8443", get: func(c *Config) any { return c.Server.Listen }, want: ":8443"},
+		{path: "server.probe_resist", value: "false", get: func(c *Config) any { return c.Server.ProbeResist }, want: false},
+		{path: "transport.kcp.mtu", value: "1200", get: func(c *Config) any { return c.Transport.KCP.MTU }, want: 1200},
+		{path: "transport.kcp.port_hopping.loss_threshold", value: "0.3", get: func(c *Config) any { return c.Transport.KCP.PortHop.LossThreshold }, want: 0.3},
+		{path: "transport.raw.tcp_flags", value: "PA, A,", get: func(c *Config) any { return c.Transport.Raw.TCPFlags }, want: []string{"PA", "A"}},
+		{path: "transport.kcp.obfs.max_padding", value: "0", get: func(c *Config) any { return *c.Transport.KCP.Obfs.MaxPadding }, want: 0},
+		{path: "obfuscation.fragment", value: "true", get: func(c *Config) any { return *c.Obfuscation.Fragment }, want: true},
+		{path: "client.servers[1].address", value: "b.example.com:443", get: func(c *Config) any { return len(c.Client.Servers) }, want: 2},
+		{path: "client.servers[0].transport.mode", value: "kcp", get: func(c *Config) any { return c.Client.Servers[0].Transport.Mode }, want: "kcp"},
+		{path: "server.sni", value: "x", err: `server.sni: unknown field "sni"`},
+		{path: "server.listen.port", value: "1", err: `"port" is not a section`},
+		{path: "server.users[x].key", value: "k", err: `"x" is not a list index`},
+		{path: "server.users[-1].key", value: "k", err: `"-1" is not a list index`},
+		{path: "server.users", value: "a", err: "is a list of sections"},
+		{path: "server.dns", value: "a", err: "is a section"},
+		{path: "server.udp_timeout", value: "soon", err: "expected a number"},
+		{path: "server.probe_resist", value: "yes please", err: "expected true or false"},
+	}
+	for _, tt := range tests {
+		c := DefaultServerConfig()
+		err := c.Set(tt.path, tt.value)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Set(%s, %q): error %v, want %q", tt.path, tt.value, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%s, %q): %v", tt.path, tt.value, err)
+			continue
+		}
+		if got := tt.get(&c); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Set(%s, %q) gave %v, want %v", tt.path, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte(testKey+"\n"), 0o600)
+
+	c := DefaultServerConfig()
+	c.Server.Key = "from the file"
+	err := c.Override([]string{
+		"PATH=/usr/bin",
+		"XP_SERVER_LISTEN=:9000",
+		"XP_SERVER_KEY_FILE=" + keyFile,
+		"XP_SERVER_USERS_0_NAME=alice",
+		"XP_TRANSPORT_KCP_PORT_HOPPING_PORTS=20000-20100",
+		"XP_TRANSPORT_TLS_FRAGMENT=false",
+	}, []string{"server.listen=:9443", "server.users[0].key=" + testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags win over the environment, and key_file over the file's key
+	if c.Server.Listen != ":9443" || c.Server.Key != testKey || c.Server.KeyFile != keyFile {
+		t.Errorf("server listen %s key %q key_file %s", c.Server.Listen, c.Server.Key, c.Server.KeyFile)
+	}
+	if len(c.Server.Users) != 1 || c.Server.Users[0].Name != "alice" || c.Server.Users[0].Key != testKey {
+		t.Errorf("users %+v", c.Server.Users)
+	}
+	if c.Transport.KCP.PortHop.Ports != "20000-20100" {
+		t.Errorf("port hopping %q", c.Transport.KCP.PortHop.Ports)
+	}
+	// The deprecated key is moved like one in a file
+	if c.Obfuscation.FragmentEnabled() || c.Transport.TLS.Fragment != nil || len(c.Deprecated) == 0 {
+		t.Errorf("transport.tls.fragment not moved: obfuscation %+v, deprecated %v", c.Obfuscation, c.Deprecated)
+	}
+
+	for _, tt := range []struct {
+		env, overrides []string
+		err            string
+	}{
+		{[]string{"XP_SERVER_LISTN=:1"}, nil, "XP_SERVER_LISTN: unknown config variable"},
+		{[]string{"XP_SERVER_UDP_TIMEOUT=x"}, nil, "XP_SERVER_UDP_TIMEOUT: server.udp_timeout"},
+		{nil, []string{"server.listen"}, "expected path=value"},
+		{nil, []string{"server.key_file=" + filepath.Join(dir, "missing")}, "server.key_file"},
+		{nil, []string{"server.users[0].key=" + testKey, "server.users[0].key_file=" + keyFile, "server.users[0].key=" + testKey}, ""},
+	} {
+		c := DefaultServerConfig()
+		err := c.Override(tt.env, tt.overrides)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("Override(%v, %v): %v", tt.env, tt.overrides, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Override(%v, %v): error %v, want %q", tt.env, tt.overrides, err, tt.err)
+		}
+	}
+}
+
+func TestEnvPath(t *testing.T) {
+	tests := []struct {
+		name, path string
+	}{
+		{"SERVER_LISTEN", "server.listen"},
+		{"SERVER_KEY_FILE", "server.key_file"},
+		{"SERVER_KEY", "server.key"},
+		{"CLIENT_SERVERS_0_KEY", "client.servers[0].key"},
+		{"CLIENT_SERVERS_12_TRANSPORT_KCP_MODE", "client.servers[12].transport.kcp.mode"},
+		{"TRANSPORT_KCP_OBFS_MAX_PADDING", "transport.kcp.obfs.max_padding"},
+		{"CLIENT_DNS_FAKE_IP_RANGE", "client.dns.fake_ip_range"},
+		{"CLIENT_SERVERS_KEY", ""},
+		{"SERVER", ""},
+		{"SERVER_DNS", ""},
+	}
+	for _, tt := range tests {
+		path, ok := envPath(reflect.TypeOf(Config{}), tt.name)
+		if path != tt.path || ok != (tt.path != "") {
+			t.Errorf("envPath(%s) = %q %v, want %q", tt.name, path, ok, tt.path)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := DefaultClientConfig()
+	c.Client.Key = testKey
+	c.Client.Users = []ProxyUser{{Username: "bob", Password: "hunter2"}}
+	c.Client.Subscription.URL = "https://sub.example.com/sub/secret-token"
+	c.Server.Key = "server secret"
+
+	out, err := c.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(out)
+	for _, secret := range []string{testKey, "hunter2", "secret-token", "server secret", "\nserver:"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("redacted config contains %q", secret)
+		}
+	}
+	if !strings.Contains(s, "https://sub.example.com/<redacted>") || !strings.Contains(s, "username: bob") {
+		t.Errorf("redacted config lost too much:\n%s", s)
+	}
+}
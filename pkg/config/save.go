@@ -0,0 +1,194 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// comments are written above the sections and next to the fields of a
+// saved config, keyed by YAML path with list indexes left out
+var comments = map[string]string{
+	"version":                   "config schema, upgrade old files with: xp-server config migrate",
+	"mode":                      "server or client",
+	"transport":                 "How the tunnel travels, must match on both sides",
+	"transport.mode":            "tls, kcp, quic or raw",
+	"transport.kcp":             "KCP over UDP, also used by quic and by raw with use_kcp",
+	"transport.kcp.key":         "empty = use the server/client key, required with server.users",
+	"transport.kcp.crypt":       "aes, salsa20 or none (tunnel AEAD only)",
+	"transport.kcp.mode":        "normal, fast, fast2, fast3 or custom",
+	"transport.quic":            "QUIC over UDP",
+	"transport.raw":             "Raw TCP packets through libpcap, needs root",
+	"transport.raw.router_mac":  "gateway MAC, see: ip neigh show",
+	"transport.raw.use_kcp":     "reliable KCP over the raw packets",
+	"obfuscation":               "Traffic shaping against DPI, unset toggles are on",
+	"obfuscation.fragment":      "split the TLS ClientHello",
+	"obfuscation.padding":       "random bytes in every tunnel packet",
+	"obfuscation.timing_jitter": "HTTP-like pauses between tunnel writes",
+	"server":                    "Server side",
+	"server.key":                "base64, generate with: xp-server -genkey",
+	"server.key_file":           "read the key from this file, e.g. a Docker secret",
+	"server.fake_site":          "site shown to probes",
+	"server.probe_resist":       "answer probes with fake_site",
+	"server.dns":                "Resolver for client destinations",
+	"server.outbound":           "Destinations clients may reach",
+	"server.users":              "Extra tunnel keys, one per user",
+	"server.subscription":       "Subscription endpoint for the users' links",
+	"client":                    "Client side",
+	"client.server_addr":        "host:port of the server",
+	"client.key":                "the server's key",
+	"client.key_file":           "read the key from this file",
+	"client.fake_sni":           "server name shown in the TLS handshake",
+	"client.socks_addr":         "SOCKS5 proxy, empty = off",
+	"client.http_addr":          "HTTP proxy, empty = off",
+	"client.servers":            "Several servers to pick from, see selection",
+	"client.subscription":       "Servers fetched from a subscription URL",
+	"client.users":              "Proxy logins, empty = no authentication",
+	"client.transparent":        "Transparent proxy through iptables",
+	"client.tun":                "TUN device for system-wide routing",
+	"client.routing":            "Rules deciding proxy, direct or block",
+	"client.dns":                "Local DNS server",
+	"client.reconnect":          "Keepalive and reconnects",
+	"client.pool":               "Tunnels kept open per server",
+}
+
+// Marshal returns the config in canonical form: the current version, the
+// sections of its mode in schema order with comments, and no fields that
+// are empty in the config and in the defaults of its mode, so the output
+// reads back as the same config. Keys read from key files are left out.
+func (c *Config) Marshal() ([]byte, error) {
+	out := *c
+	out.Version = Version
+	if out.Server.KeyFile != "" {
+		out.Server.Key = ""
+	}
+	if out.Client.KeyFile != "" {
+		out.Client.Key = ""
+	}
+	out.Server.Users = append([]ServerUser(nil), c.Server.Users...)
+	for i := range out.Server.Users {
+		if out.Server.Users[i].KeyFile != "" {
+			out.Server.Users[i].Key = ""
+		}
+	}
+
+	var node, defaults yaml.Node
+	if err := node.Encode(&out); err != nil {
+		return nil, err
+	}
+	d := Defaults(c.Mode)
+	if err := defaults.Encode(&d); err != nil {
+		return nil, err
+	}
+	if other := map[string]string{"server": "client", "client": "server"}[c.Mode]; other != "" {
+		mapDelete(&node, other)
+	}
+	prune(&node, &defaults)
+	annotate(&node, "")
+
+	var buf bytes.Buffer
+	switch c.Mode {
+	case "server":
+		buf.WriteString("# XP Protocol Server Configuration\n\n")
+	case "client":
+		buf.WriteString("# XP Protocol Client Configuration\n\n")
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// prune drops the fields of n that are empty there and in the defaults d.
+// A field missing from d is omitempty, so if it was encoded it is set,
+// like a toggle turned off.
+func prune(n, d *yaml.Node) {
+	if n.Kind == yaml.SequenceNode {
+		for _, item := range n.Content {
+			prune(item, nil)
+		}
+		return
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	var kept []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		dv := mapValue(d, k.Value)
+		prune(v, dv)
+		if isEmpty(v) && (d == nil || dv != nil && isZero(dv)) {
+			continue
+		}
+		kept = append(kept, k, v)
+	}
+	n.Content = kept
+}
+
+// isZero reports whether n holds only empty values
+func isZero(n *yaml.Node) bool {
+	if n.Kind == yaml.MappingNode {
+		for i := 1; i < len(n.Content); i += 2 {
+			if !isZero(n.Content[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return isEmpty(n)
+}
+
+func isEmpty(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(n.Content) == 0
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!null":
+			return true
+		case "!!str":
+			return n.Value == ""
+		case "!!int", "!!float":
+			return n.Value == "0"
+		case "!!bool":
+			return n.Value == "false"
+		}
+	}
+	return false
+}
+
+// annotate adds the comments and writes lists of plain values on one line
+func annotate(n *yaml.Node, path string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			p := strings.TrimPrefix(path+"."+k.Value, ".")
+			annotate(v, p)
+			if comment, ok := comments[p]; ok {
+				if v.Kind == yaml.ScalarNode || v.Style == yaml.FlowStyle {
+					v.LineComment = comment
+				} else {
+					k.HeadComment = comment
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		flow := true
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				flow = false
+			}
+			annotate(item, path)
+		}
+		if flow && len(n.Content) > 0 {
+			n.Style = yaml.FlowStyle
+		}
+	}
+}
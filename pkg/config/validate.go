@@ -0,0 +1,564 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError is one problem in a config, at its YAML path
+type FieldError struct {
+	Path string // e.g. transport.raw.interface or client.servers[1].key
+	Msg  string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ValidationError is every problem Validate found, one per line
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	lines := make([]string, len(e))
+	for i, fe := range e {
+		lines[i] = fe.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks the settings of the config's mode and returns every
+// problem as a ValidationError, nil if there are none
+func (c *Config) Validate() error {
+	v := &validator{}
+	switch c.Mode {
+	case "server":
+		v.transport("transport", c.Transport)
+		v.obfuscation(c.Obfuscation)
+		v.server(c.Server)
+		if len(c.Server.Users) > 0 && c.Transport.KCP.Key == "" && usesKCPKey(c.Transport) {
+			v.add("transport.kcp.key", "is required with server.users in %s mode; the users' clients derive the KCP key from their own key and couldn't connect", c.Transport.Mode)
+		}
+	case "client":
+		v.transport("transport", c.Transport)
+		v.obfuscation(c.Obfuscation)
+		v.client(c.Client)
+	case "":
+		v.add("mode", "is required (server or client)")
+	default:
+		v.add("mode", "unknown mode %q (use server or client)", c.Mode)
+	}
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) add(path, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) transport(path string, tc TransportConfig) {
+	v.oneOf(path+".mode", tc.Mode, "", "tls", "kcp", "quic", "raw")
+
+	if tc.Mode == "raw" {
+		raw := path + ".raw"
+		if tc.Raw.Interface == "" {
+			v.add(raw+".interface", "is required in raw mode (e.g. eth0)")
+		}
+		if ip := net.ParseIP(tc.Raw.LocalIP); ip == nil || ip.To4() == nil {
+			v.add(raw+".local_ip", "must be the IPv4 address of the interface in raw mode, got %q", tc.Raw.LocalIP)
+		}
+		if _, err := net.ParseMAC(tc.Raw.RouterMAC); err != nil {
+			v.add(raw+".router_mac", "must be the gateway MAC address in raw mode (see arp -a), got %q", tc.Raw.RouterMAC)
+		}
+	}
+	if tc.Raw.LocalMAC != "" {
+		if _, err := net.ParseMAC(tc.Raw.LocalMAC); err != nil {
+			v.add(path+".raw.local_mac", "invalid MAC address %q", tc.Raw.LocalMAC)
+		}
+	}
+	for i, f := range tc.Raw.TCPFlags {
+		if f == "" || strings.Trim(f, "FSRPAUEC") != "" {
+			v.add(fmt.Sprintf("%s.raw.tcp_flags[%d]", path, i), "invalid TCP flags %q (letters of FSRPAUEC, e.g. PA)", f)
+		}
+	}
+
+	kcp := path + ".kcp"
+	k := tc.KCP
+	v.oneOf(kcp+".crypt", k.Crypt, "", "aes", "salsa20", "none")
+	v.oneOf(kcp+".mode", k.Mode, "", "normal", "fast", "fast2", "fast3", "custom")
+	v.atLeast(kcp+".data_shards", k.DataShards, 0)
+	v.atLeast(kcp+".parity_shards", k.ParityShards, 0)
+	v.between(kcp+".nodelay", k.NoDelay, 0, 1)
+	v.atLeast(kcp+".interval", k.Interval, 0)
+	v.atLeast(kcp+".resend", k.Resend, 0)
+	v.between(kcp+".nc", k.NoCongestion, 0, 1)
+	v.atLeast(kcp+".sndwnd", k.SndWnd, 0)
+	v.atLeast(kcp+".rcvwnd", k.RcvWnd, 0)
+	v.between(kcp+".mtu", k.MTU, 0, 1500)
+	v.atLeast(kcp+".sockbuf", k.SockBuf, 0)
+	v.atLeast(kcp+".keepalive", k.KeepAlive, 0)
+	v.atLeast(kcp+".keepalive_timeout", k.KeepAliveTimeout, 0)
+	v.between(kcp+".dscp", k.DSCP, 0, 63)
+	keepAlive, keepAliveTimeout := k.KeepAlive, k.KeepAliveTimeout
+	if keepAlive == 0 {
+		keepAlive = 10
+	}
+	if keepAliveTimeout == 0 {
+		keepAliveTimeout = 30
+	}
+	if keepAliveTimeout <= keepAlive {
+		v.add(kcp+".keepalive_timeout", "must be longer than keepalive (%ds), got %ds", keepAlive, keepAliveTimeout)
+	}
+	v.oneOf(kcp+".obfs.mimic", k.Obfs.Mimic, "", "none", "quic", "dtls", "wireguard", "srtp")
+	if k.Obfs.MaxPadding != nil {
+		v.atLeast(kcp+".obfs.max_padding", *k.Obfs.MaxPadding, 0)
+	}
+	if k.PortHop.Ports != "" {
+		v.portList(kcp+".port_hopping.ports", k.PortHop.Ports)
+	}
+	v.atLeast(kcp+".port_hopping.interval", k.PortHop.Interval, 0)
+	if k.PortHop.LossThreshold < 0 || k.PortHop.LossThreshold > 1 {
+		v.add(kcp+".port_hopping.loss_threshold", "must be between 0 and 1, got %g", k.PortHop.LossThreshold)
+	}
+}
+
+func (v *validator) obfuscation(o ObfuscationConfig) {
+	v.between("obfuscation.fragment_min", o.FragmentMin, 0, 1500)
+	v.between("obfuscation.fragment_max", o.FragmentMax, 0, 1500)
+	v.between("obfuscation.padding_min", o.PaddingMin, 0, 4096)
+	v.between("obfuscation.padding_max", o.PaddingMax, 0, 4096)
+	// Unset sizes are the defaults, so check against those
+	fragMin, fragMax := o.FragmentMin, o.FragmentMax
+	if fragMin == 0 {
+		fragMin = 10
+	}
+	if fragMax == 0 {
+		fragMax = 50
+	}
+	if fragMax < fragMin {
+		v.add("obfuscation.fragment_max", "must be at least fragment_min (%d), got %d", fragMin, fragMax)
+	}
+	padMin, padMax := o.PaddingMin, o.PaddingMax
+	if padMin == 0 {
+		padMin = 16
+	}
+	if padMax == 0 {
+		padMax = 256
+	}
+	if padMax < padMin {
+		v.add("obfuscation.padding_max", "must be at least padding_min (%d), got %d", padMin, padMax)
+	}
+}
+
+func (v *validator) server(sc ServerConfig) {
+	v.address("server.listen", sc.Listen, true)
+	if sc.Key == "" {
+		v.add("server.key", "is required (generate one with xp-server -genkey)")
+	} else {
+		v.key("server.key", sc.Key)
+	}
+	v.atLeast("server.udp_timeout", sc.UDPTimeout, 0)
+	v.ipStrategy("server.ip_strategy", sc.IPStrategy)
+	for i, s := range sc.DNS.Servers {
+		v.upstream(fmt.Sprintf("server.dns.servers[%d]", i), s, true)
+	}
+	v.atLeast("server.dns.cache_size", sc.DNS.CacheSize, -1)
+	v.outbound("server.outbound", sc.Outbound)
+
+	keys := map[string]string{sc.Key: "server.key"}
+	for i, u := range sc.Users {
+		path := fmt.Sprintf("server.users[%d]", i)
+		if u.Key == "" {
+			v.add(path+".key", "is required (generate one with xp-server -genkey)")
+		} else if v.key(path+".key", u.Key) {
+			if other, ok := keys[u.Key]; ok {
+				v.add(path+".key", "is the same as %s", other)
+			}
+			keys[u.Key] = path + ".key"
+		}
+		if u.Outbound != nil {
+			v.outbound(path+".outbound", *u.Outbound)
+		}
+	}
+
+	sub := sc.Subscription
+	v.address("server.subscription.listen", sub.Listen, false)
+	v.address("server.subscription.address", sub.Address, false)
+	switch {
+	case sub.TLSCert != "" && sub.TLSKey == "":
+		v.add("server.subscription.tls_key", "is required with tls_cert")
+	case sub.TLSKey != "" && sub.TLSCert == "":
+		v.add("server.subscription.tls_cert", "is required with tls_key")
+	case sub.Listen != "" && sub.TLSCert == "" && !isLoopback(sub.Listen):
+		v.add("server.subscription.listen", "would send the subscription tokens in clear text; set tls_cert and tls_key, or listen on loopback behind a TLS reverse proxy")
+	}
+}
+
+// usesKCPKey reports whether the transport encrypts its packets with the
+// KCP key, which is the same for every user
+func usesKCPKey(tc TransportConfig) bool {
+	return tc.Mode == "kcp" || tc.Mode == "quic" || tc.Mode == "raw" && tc.Raw.UseKCP
+}
+
+// isLoopback reports whether a host:port address only accepts local
+// connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (v *validator) outbound(path string, o OutboundConfig) {
+	v.cidrs(path+".allow_cidr", o.AllowCIDR)
+	v.cidrs(path+".deny_cidr", o.DenyCIDR)
+	v.ports(path+".allow_ports", o.AllowPorts)
+	v.ports(path+".deny_ports", o.DenyPorts)
+}
+
+func (v *validator) client(cc ClientConfig) {
+	if len(cc.Servers) == 0 {
+		switch {
+		case cc.ServerAddr != "":
+			v.address("client.server_addr", cc.ServerAddr, true)
+			v.clientKey(cc.Key)
+		case cc.Subscription.URL == "":
+			v.add("client.server_addr", "is required (or client.servers, or client.subscription.url)")
+		}
+	}
+	inherited := false
+	for i, s := range cc.Servers {
+		path := fmt.Sprintf("client.servers[%d]", i)
+		if s.Address == "" {
+			v.add(path+".address", "is required")
+		} else {
+			v.address(path+".address", s.Address, true)
+		}
+		if s.Key != "" {
+			v.key(path+".key", s.Key)
+		} else {
+			inherited = true
+		}
+		if s.Transport != nil {
+			v.transport(path+".transport", *s.Transport)
+		}
+	}
+	if inherited {
+		v.clientKey(cc.Key)
+	}
+
+	if cc.Subscription.URL != "" {
+		if u, err := url.Parse(cc.Subscription.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("client.subscription.url", "must be an http:// or https:// URL, got %q", cc.Subscription.URL)
+		}
+	}
+	v.atLeast("client.subscription.interval", cc.Subscription.Interval, 0)
+	v.oneOf("client.selection.strategy", cc.Selection.Strategy, "", "failover", "latency", "round_robin", "sticky")
+
+	v.address("client.socks_addr", cc.SOCKSAddr, false)
+	v.address("client.http_addr", cc.HTTPAddr, false)
+	v.address("client.status_addr", cc.StatusAddr, false)
+	v.oneOf("client.fingerprint", cc.Fingerprint, "", "chrome", "firefox", "safari")
+	v.ipStrategy("client.ip_strategy", cc.IPStrategy)
+	for i, u := range cc.Users {
+		if u.Username == "" {
+			v.add(fmt.Sprintf("client.users[%d].username", i), "is required")
+		}
+	}
+
+	t := cc.Transparent
+	v.address("client.transparent.listen", t.Listen, false)
+	v.oneOf("client.transparent.mode", t.Mode, "", "redirect", "tproxy")
+	v.atLeast("client.transparent.mark", t.Mark, 0)
+	v.atLeast("client.transparent.table", t.Table, 0)
+	v.cidrs("client.transparent.exclude", t.Exclude)
+
+	tun := cc.TUN
+	if len(tun.Name) > 15 {
+		v.add("client.tun.name", "must be at most 15 characters, got %q", tun.Name)
+	}
+	if tun.Address != "" {
+		if _, _, err := net.ParseCIDR(tun.Address); err != nil {
+			v.add("client.tun.address", "must be an address with prefix length like 198.18.0.1/30, got %q", tun.Address)
+		}
+	}
+	if tun.MTU != 0 {
+		v.between("client.tun.mtu", tun.MTU, 576, 65535)
+	}
+	v.cidrs("client.tun.exclude", tun.Exclude)
+
+	v.routing(cc.Routing)
+
+	d := cc.DNS
+	v.address("client.dns.listen", d.Listen, false)
+	if d.Upstream != "" {
+		v.upstream("client.dns.upstream", d.Upstream, false)
+	}
+	if d.DirectUpstream != "" {
+		v.upstream("client.dns.direct_upstream", d.DirectUpstream, true)
+	}
+	v.atLeast("client.dns.cache_size", d.CacheSize, -1)
+	if d.FakeIPRange != "" {
+		if _, _, err := net.ParseCIDR(d.FakeIPRange); err != nil {
+			v.add("client.dns.fake_ip_range", "invalid CIDR %q", d.FakeIPRange)
+		}
+	}
+
+	v.atLeast("client.reconnect.ping_interval", cc.Reconnect.PingInterval, -1)
+	v.atLeast("client.reconnect.ping_timeout", cc.Reconnect.PingTimeout, 0)
+	v.atLeast("client.reconnect.max_backoff", cc.Reconnect.MaxBackoff, 0)
+	v.atLeast("client.pool.size", cc.Pool.Size, 0)
+	v.atLeast("client.pool.max_streams", cc.Pool.MaxStreams, 0)
+	v.atLeast("client.pool.max_lifetime", cc.Pool.MaxLifetime, 0)
+}
+
+// clientKey checks client.key, which servers without a key of their own use
+func (v *validator) clientKey(key string) {
+	if key == "" {
+		v.add("client.key", "is required (the key of the server)")
+		return
+	}
+	v.key("client.key", key)
+}
+
+func (v *validator) routing(rc RoutingConfig) {
+	v.oneOf("client.routing.final", strings.ToLower(rc.Final), "", "proxy", "direct", "block")
+	for i, r := range rc.Rules {
+		path := fmt.Sprintf("client.routing.rules[%d]", i)
+		if r.Action == "" {
+			v.add(path+".action", "is required (proxy, direct or block)")
+		} else {
+			v.oneOf(path+".action", strings.ToLower(r.Action), "proxy", "direct", "block")
+		}
+		for j, expr := range r.DomainRegex {
+			if _, err := regexp.Compile(expr); err != nil {
+				v.add(fmt.Sprintf("%s.domain_regex[%d]", path, j), "%v", err)
+			}
+		}
+		if len(r.GeoSite) > 0 && rc.GeoSiteDir == "" {
+			v.add(path+".geosite", "needs client.routing.geosite_dir")
+		}
+		for _, cc := range r.GeoIP {
+			if !strings.EqualFold(cc, "private") && rc.GeoIP == "" {
+				v.add(path+".geoip", "needs the client.routing.geoip database for %q", cc)
+				break
+			}
+		}
+		v.cidrs(path+".cidr", r.CIDR)
+		v.ports(path+".port", r.Port)
+		if len(r.Domain)+len(r.DomainSuffix)+len(r.DomainKeyword)+len(r.DomainRegex)+len(r.GeoSite)+len(r.CIDR)+len(r.GeoIP)+len(r.Port) == 0 {
+			v.add(path, "has no conditions")
+		}
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	var names []string
+	for _, a := range allowed {
+		if a != "" {
+			names = append(names, a)
+		}
+	}
+	v.add(path, "unknown value %q (use %s)", value, strings.Join(names, ", "))
+}
+
+func (v *validator) atLeast(path string, n, min int) {
+	if n < min {
+		v.add(path, "must be at least %d, got %d", min, n)
+	}
+}
+
+func (v *validator) between(path string, n, min, max int) {
+	if n < min || n > max {
+		v.add(path, "must be between %d and %d, got %d", min, max, n)
+	}
+}
+
+// address checks a host:port; empty is only an error when required
+func (v *validator) address(path, addr string, required bool) {
+	if addr == "" {
+		if required {
+			v.add(path, "is required (host:port)")
+		}
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.add(path, "must be host:port, got %q", addr)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		v.add(path, "invalid port in %q", addr)
+	}
+}
+
+// key checks a tunnel key and reports whether it is valid
+func (v *validator) key(path, key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		v.add(path, "must be 32 bytes of base64 (generate one with xp-server -genkey)")
+		return false
+	}
+	return true
+}
+
+func (v *validator) ipStrategy(path, s string) {
+	v.oneOf(path, s, "", "ipv4_only", "ipv6_only", "prefer_ipv4", "prefer_ipv6")
+}
+
+// upstream checks a DNS upstream URL; udp:// only where it is dialed directly
+func (v *validator) upstream(path, raw string, udp bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		v.add(path, "invalid DNS upstream %q (e.g. tls://1.1.1.1)", raw)
+		return
+	}
+	switch u.Scheme {
+	case "tcp", "tls", "https":
+	case "udp":
+		if !udp {
+			v.add(path, "udp is only supported for direct_upstream, got %q", raw)
+		}
+	default:
+		v.add(path, "unsupported scheme in %q (use tcp, tls, https or udp)", raw)
+	}
+}
+
+// cidrs checks a list of CIDRs or bare addresses
+func (v *validator) cidrs(path string, list []string) {
+	for i, c := range list {
+		if net.ParseIP(c) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			v.add(fmt.Sprintf("%s[%d]", path, i), "invalid CIDR %q", c)
+		}
+	}
+}
+
+// ports checks a list of ports and ranges like "443" and "8000-9000"
+func (v *validator) ports(path string, list []string) {
+	for i, p := range list {
+		if !validPortRange(p) {
+			v.add(fmt.Sprintf("%s[%d]", path, i), "invalid port %q (e.g. 443 or 8000-9000)", p)
+		}
+	}
+}
+
+// portList checks a comma separated list like "443,20000-20100"
+func (v *validator) portList(path, list string) {
+	for _, p := range strings.Split(list, ",") {
+		if strings.TrimSpace(p) != "" && !validPortRange(p) {
+			v.add(path, "invalid port %q in %q", strings.TrimSpace(p), list)
+		}
+	}
+}
+
+func validPortRange(spec string) bool {
+	loStr, hiStr, isRange := strings.Cut(spec, "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+	hi := lo
+	if err == nil && isRange {
+		hi, err = strconv.Atoi(strings.TrimSpace(hiStr))
+	}
+	return err == nil && lo >= 1 && hi <= 65535 && lo <= hi
+}
+
+var unknownField = regexp.MustCompile(`^line (\d+): field (\S+) not found in type config\.(\w+)$`)
+
+// decodeError rewrites the unknown field errors of the YAML decoder to
+// suggest the closest known field
+func decodeError(err error) error {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) {
+		return err
+	}
+	fields := knownFields(reflect.TypeOf(Config{}), map[string][]string{})
+	msgs := make([]string, len(te.Errors))
+	for i, e := range te.Errors {
+		m := unknownField.FindStringSubmatch(e)
+		if m == nil {
+			msgs[i] = e
+			continue
+		}
+		msgs[i] = fmt.Sprintf("line %s: unknown field %q", m[1], m[2])
+		if s := closest(m[2], fields[m[3]]); s != "" {
+			msgs[i] += fmt.Sprintf(" (did you mean %q?)", s)
+		}
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// knownFields maps the config struct types under t to their YAML names
+func knownFields(t reflect.Type, fields map[string][]string) map[string][]string {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || fields[t.Name()] != nil {
+		return fields
+	}
+	names := []string{}
+	fields[t.Name()] = names
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0])
+		knownFields(t.Field(i).Type, fields)
+	}
+	fields[t.Name()] = names
+	return fields
+}
+
+// closest returns the name nearest to s by edit distance, if near enough
+// to be a typo
+func closest(s string, names []string) string {
+	best, bestDist := "", len(s)/3+2
+	for _, name := range names {
+		if d := editDistance(s, name); d < bestDist {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+func testServerConfig() Config {
+	c := DefaultServerConfig()
+	c.Server.Key = testKey
+	return c
+}
+
+func testClientConfig() Config {
+	c := DefaultClientConfig()
+	c.Client.ServerAddr = "vpn.example.com:443"
+	c.Client.Key = testKey
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   func() Config
+		paths []string // the paths of the errors, in order
+	}{
+		{"server defaults", testServerConfig, nil},
+		{"client defaults", testClientConfig, nil},
+		{"no mode", func() Config { return Config{} }, []string{"mode"}},
+		{"unknown mode", func() Config { c := testServerConfig(); c.Mode = "relay"; return c }, []string{"mode"}},
+		{"server key", func() Config {
+			c := testServerConfig()
+			c.Server.Key = "short"
+			return c
+		}, []string{"server.key"}},
+		{"duplicate user key", func() Config {
+			c := testServerConfig()
+			c.Server.Users = []ServerUser{{Name: "a", Key: testKey}, {Name: "b"}}
+			return c
+		}, []string{"server.users[0].key", "server.users[1].key"}},
+		{"users under kcp without a kcp key", func() Config {
+			c := testServerConfig()
+			c.Transport.Mode = "quic"
+			c.Server.Users = []ServerUser{{Name: "a", Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))}}
+			return c
+		}, []string{"transport.kcp.key"}},
+		{"users under kcp with a kcp key", func() Config {
+			c := testServerConfig()
+			c.Transport.Mode = "kcp"
+			c.Transport.KCP.Key = "shared"
+			c.Server.Users = []ServerUser{{Name: "a", Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))}}
+			return c
+		}, nil},
+		{"raw without interface", func() Config {
+			c := testServerConfig()
+			c.Transport.Mode = "raw"
+			c.Transport.Raw.TCPFlags = []string{"PA", "X"}
+			return c
+		}, []string{"transport.raw.interface", "transport.raw.local_ip", "transport.raw.router_mac", "transport.raw.tcp_flags[1]"}},
+		{"kcp ranges", func() Config {
+			c := testServerConfig()
+			c.Transport.KCP.MTU = 9000
+			c.Transport.KCP.KeepAlive = 60
+			c.Transport.KCP.PortHop.Ports = "20100-20000"
+			return c
+		}, []string{"transport.kcp.mtu", "transport.kcp.keepalive_timeout", "transport.kcp.port_hopping.ports"}},
+		{"obfuscation sizes against defaults", func() Config {
+			c := testServerConfig()
+			c.Obfuscation.FragmentMin = 100
+			c.Obfuscation.PaddingMax = 8
+			return c
+		}, []string{"obfuscation.fragment_max", "obfuscation.padding_max"}},
+		{"outbound policy", func() Config {
+			c := testServerConfig()
+			c.Server.Outbound.DenyCIDR = []string{"10.0.0.0/33"}
+			c.Server.Outbound.AllowPorts = []string{"80-"}
+			return c
+		}, []string{"server.outbound.deny_cidr[0]", "server.outbound.allow_ports[0]"}},
+		{"subscription on loopback", func() Config {
+			c := testServerConfig()
+			c.Server.Subscription.Listen = "127.0.0.1:8080"
+			return c
+		}, nil},
+		{"subscription in clear text", func() Config {
+			c := testServerConfig()
+			c.Server.Subscription.Listen = ":8080"
+			return c
+		}, []string{"server.subscription.listen"}},
+		{"subscription over TLS", func() Config {
+			c := testServerConfig()
+			c.Server.Subscription.Listen = ":8443"
+			c.Server.Subscription.TLSCert = "cert.pem"
+			c.Server.Subscription.TLSKey = "key.pem"
+			return c
+		}, nil},
+		{"subscription certificate without key", func() Config {
+			c := testServerConfig()
+			c.Server.Subscription.Listen = ":8443"
+			c.Server.Subscription.TLSCert = "cert.pem"
+			return c
+		}, []string{"server.subscription.tls_key"}},
+		{"client without server", func() Config {
+			c := testClientConfig()
+			c.Client.ServerAddr = ""
+			return c
+		}, []string{"client.server_addr"}},
+		{"client subscription only", func() Config {
+			c := testClientConfig()
+			c.Client.ServerAddr, c.Client.Key = "", ""
+			c.Client.Subscription.URL = "https://sub.example.com/sub/token"
+			return c
+		}, nil},
+		{"client servers", func() Config {
+			c := testClientConfig()
+			c.Client.Key = ""
+			tc := c.Transport
+			tc.Mode = "carrier-pigeon"
+			c.Client.Servers = []ServerEndpoint{{Address: "a.example.com"}, {Address: "b.example.com:443", Key: testKey, Transport: &tc}}
+			return c
+		}, []string{"client.servers[0].address", "client.servers[1].transport.mode", "client.key"}},
+		{"client sections", func() Config {
+			c := testClientConfig()
+			c.Client.Subscription.URL = "ftp://sub.example.com"
+			c.Client.TUN.Name = "a-very-long-tun-name"
+			c.Client.DNS.FakeIPRange = "198.19.0.0"
+			c.Client.IPStrategy = "ipv5"
+			return c
+		}, []string{"client.subscription.url", "client.ip_strategy", "client.tun.name", "client.dns.fake_ip_range"}},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg()
+		err := cfg.Validate()
+		var paths []string
+		var ve ValidationError
+		if errors.As(err, &ve) {
+			for _, fe := range ve {
+				paths = append(paths, fe.Path)
+			}
+		} else if err != nil {
+			t.Errorf("%s: error %v is not a ValidationError", tt.name, err)
+		}
+		if strings.Join(paths, " ") != strings.Join(tt.paths, " ") {
+			t.Errorf("%s: errors at %v, want %v\n%v", tt.name, paths, tt.paths, err)
+		}
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("version: 2\nmode: server\nserver:\n  listen: :443\n  fake_sit: www.example.com\n"), 0o600)
+	_, err := Load(path, DefaultServerConfig())
+	if err == nil || !strings.Contains(err.Error(), `line 5: unknown field "fake_sit" (did you mean "fake_site"?)`) {
+		t.Errorf("Load with a misspelled field: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	minCacheTTL = 5 * time.Second
+	maxCacheTTL = time.Hour
+	// negativeTTL applies to NXDOMAIN and empty answers without an SOA
+	negativeTTL = 30 * time.Second
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     dnsmessage.Message
+	expires time.Time
+}
+
+// Cache holds responses until their smallest TTL runs out, evicting the
+// least recently used entry when full
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+func NewCache(size int) *Cache {
+	return &Cache{size: size, entries: make(map[cacheKey]*list.Element), lru: list.New(), now: time.Now}
+}
+
+// Get returns a copy of a cached response with TTLs counted down
+func (c *Cache) Get(q dnsmessage.Question) (dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{q.Name.String(), q.Type}
+	el := c.entries[key]
+	if el == nil {
+		return dnsmessage.Message{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	left := e.expires.Sub(c.now())
+	if left <= 0 {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return dnsmessage.Message{}, false
+	}
+	c.lru.MoveToFront(el)
+
+	msg := e.msg
+	ttl := uint32((left + time.Second - 1) / time.Second)
+	msg.Answers = withTTL(e.msg.Answers, ttl)
+	msg.Authorities = withTTL(e.msg.Authorities, ttl)
+	msg.Additionals = withTTL(e.msg.Additionals, ttl)
+	return msg, true
+}
+
+// Put stores a response; failures other than NXDOMAIN are not cached
+func (c *Cache) Put(q dnsmessage.Question, msg dnsmessage.Message) {
+	if c.size <= 0 || msg.Truncated {
+		return
+	}
+	var ttl time.Duration
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+		ttl = messageTTL(msg)
+	case dnsmessage.RCodeNameError:
+		ttl = negativeTTL
+	default:
+		return
+	}
+	if ttl < minCacheTTL {
+		ttl = minCacheTTL
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{q.Name.String(), q.Type}
+	e := &cacheEntry{key: key, msg: msg, expires: c.now().Add(ttl)}
+	if el := c.entries[key]; el != nil {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// messageTTL is the smallest TTL in the answer, or the SOA TTL for an
+// empty answer
+func messageTTL(msg dnsmessage.Message) time.Duration {
+	records := msg.Answers
+	if len(records) == 0 {
+		records = msg.Authorities
+	}
+	if len(records) == 0 {
+		return negativeTTL
+	}
+	ttl := records[0].Header.TTL
+	for _, r := range records[1:] {
+		if r.Header.TTL < ttl {
+			ttl = r.Header.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func withTTL(records []dnsmessage.Resource, ttl uint32) []dnsmessage.Resource {
+	if len(records) == 0 {
+		return nil
+	}
+	out := make([]dnsmessage.Resource, len(records))
+	for i, r := range records {
+		out[i] = r
+		// OPT pseudo-records keep their header (the TTL field holds flags)
+		if r.Header.Type != dnsmessage.TypeOPT && r.Header.TTL > ttl {
+			out[i].Header.TTL = ttl
+		}
+	}
+	return out
+}
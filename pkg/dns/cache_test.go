@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testClock is a settable clock for Cache.now
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func question(t *testing.T, name string) dnsmessage.Question {
+	t.Helper()
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dnsmessage.Question{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+}
+
+func answer(q dnsmessage.Question, ip net.IP, ttl uint32) dnsmessage.Message {
+	var a dnsmessage.AResource
+	copy(a.A[:], ip.To4())
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+			Body:   &a,
+		}},
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	clock := &testClock{time.Unix(1000, 0)}
+	c := NewCache(16)
+	c.now = clock.now
+
+	q := question(t, "example.com.")
+	c.Put(q, answer(q, net.IPv4(192, 0, 2, 1), 60))
+	clock.t = clock.t.Add(45 * time.Second)
+	msg, ok := c.Get(q)
+	if !ok {
+		t.Fatal("entry gone before its TTL")
+	}
+	if ttl := msg.Answers[0].Header.TTL; ttl != 15 {
+		t.Errorf("TTL counted down to %d, want 15", ttl)
+	}
+	clock.t = clock.t.Add(15 * time.Second)
+	if _, ok := c.Get(q); ok {
+		t.Error("entry outlived its TTL")
+	}
+
+	// TTLs are kept between minCacheTTL and maxCacheTTL
+	c.Put(q, answer(q, net.IPv4(192, 0, 2, 1), 0))
+	clock.t = clock.t.Add(minCacheTTL - time.Second)
+	if _, ok := c.Get(q); !ok {
+		t.Error("TTL 0 not raised to minCacheTTL")
+	}
+	c.Put(q, answer(q, net.IPv4(192, 0, 2, 1), 86400))
+	clock.t = clock.t.Add(maxCacheTTL)
+	if _, ok := c.Get(q); ok {
+		t.Error("TTL not capped at maxCacheTTL")
+	}
+
+	// NXDOMAIN is cached for negativeTTL, other failures not at all
+	c.Put(q, dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError}})
+	clock.t = clock.t.Add(negativeTTL - time.Second)
+	if msg, ok := c.Get(q); !ok || msg.RCode != dnsmessage.RCodeNameError {
+		t.Error("NXDOMAIN not cached")
+	}
+	clock.t = clock.t.Add(time.Second)
+	if _, ok := c.Get(q); ok {
+		t.Error("NXDOMAIN outlived negativeTTL")
+	}
+	c.Put(q, dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure}})
+	if _, ok := c.Get(q); ok {
+		t.Error("SERVFAIL cached")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(2)
+	a, b, d := question(t, "a.example."), question(t, "b.example."), question(t, "d.example.")
+	c.Put(a, answer(a, net.IPv4(192, 0, 2, 1), 60))
+	c.Put(b, answer(b, net.IPv4(192, 0, 2, 2), 60))
+	c.Get(a)
+	c.Put(d, answer(d, net.IPv4(192, 0, 2, 3), 60))
+	if _, ok := c.Get(b); ok {
+		t.Error("least recently used entry kept")
+	}
+	if _, ok := c.Get(a); !ok {
+		t.Error("recently used entry evicted")
+	}
+
+	// A cache of size 0 stores nothing
+	c = NewCache(0)
+	c.Put(a, answer(a, net.IPv4(192, 0, 2, 1), 60))
+	if _, ok := c.Get(a); ok {
+		t.Error("cache of size 0 stored an entry")
+	}
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// FakeIPPool hands out addresses from a reserved range so domains can be
+// answered instantly and resolved on the server instead. Connections to a
+// fake address are mapped back to the domain with Lookup. When the range
+// is used up the oldest mapping is reused.
+type FakeIPPool struct {
+	mu       sync.Mutex
+	network  *net.IPNet
+	first    uint32
+	size     uint32
+	next     uint32
+	byDomain map[string]uint32
+	byIP     map[uint32]string
+}
+
+// NewFakeIPPool creates a pool over an IPv4 CIDR such as 198.19.0.0/16
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake IP range %q: %w", cidr, err)
+	}
+	ones, bits := network.Mask.Size()
+	if network.IP.To4() == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake IP range %q must be IPv4 and at least a /30", cidr)
+	}
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	return &FakeIPPool{
+		network: network,
+		// Skip the network and broadcast addresses
+		first:    base + 1,
+		size:     1<<(32-ones) - 2,
+		byDomain: make(map[string]uint32),
+		byIP:     make(map[uint32]string),
+	}, nil
+}
+
+// Allocate returns the fake address for domain, assigning one if needed
+func (p *FakeIPPool) Allocate(domain string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ip, ok := p.byDomain[domain]; ok {
+		return uint32ToIP(ip)
+	}
+	ip := p.first + p.next
+	p.next = (p.next + 1) % p.size
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byDomain, old)
+	}
+	p.byIP[ip] = domain
+	p.byDomain[domain] = ip
+	return uint32ToIP(ip)
+}
+
+// Lookup returns the domain behind a fake address
+func (p *FakeIPPool) Lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byIP[binary.BigEndian.Uint32(ip4)]
+	return domain, ok
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
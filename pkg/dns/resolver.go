@@ -0,0 +1,340 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// happyEyeballsDelay is how long a connection attempt gets before the
+// next address is tried in parallel (RFC 8305)
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// systemTTL is how long answers of the system resolver are cached, as it
+// doesn't tell their TTL
+const systemTTL = time.Minute
+
+// Resolver resolves and dials destinations for outbound connections,
+// following an IP strategy. Without upstreams it uses the system resolver.
+// Answers are cached either way.
+type Resolver struct {
+	upstreams []Upstream
+	cache     *Cache
+	strategy  Strategy
+	dialer    net.Dialer
+	// system looks up addresses without upstreams, net.Resolver.LookupIP
+	system func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+func NewResolver(upstreams []Upstream, cache *Cache, strategy Strategy) *Resolver {
+	return &Resolver{
+		upstreams: upstreams,
+		cache:     cache,
+		strategy:  strategy,
+		dialer:    net.Dialer{Timeout: 10 * time.Second},
+		system:    net.DefaultResolver.LookupIP,
+	}
+}
+
+// Strategy returns the IP strategy in use
+func (r *Resolver) Strategy() Strategy { return r.strategy }
+
+// LookupIP returns the usable addresses of host, preferred family first
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !r.strategy.Allows(ip) {
+			return nil, fmt.Errorf("%s is not allowed by ip_strategy %s", host, r.strategy)
+		}
+		return []net.IP{ip}, nil
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	var types []dnsmessage.Type
+	if r.strategy.wantsIPv4() {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if r.strategy.wantsIPv6() {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	results := make(chan result, len(types))
+	for _, t := range types {
+		go func(t dnsmessage.Type) {
+			ips, err := r.query(ctx, host, t)
+			results <- result{ips, err}
+		}(t)
+	}
+	var ips []net.IP
+	var lastErr error
+	for range types {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	ips = r.strategy.Sort(ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no usable address for ip_strategy " + string(r.strategy), Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// query looks up one record type in the cache, then with the upstreams
+// or the system resolver
+func (r *Resolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+
+	msg, ok := dnsmessage.Message{}, false
+	if r.cache != nil {
+		msg, ok = r.cache.Get(q)
+	}
+	if !ok {
+		if len(r.upstreams) == 0 {
+			msg, err = r.lookupSystem(ctx, q)
+		} else {
+			msg, err = r.exchange(ctx, q)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.cache != nil {
+			r.cache.Put(q, msg)
+		}
+	}
+
+	if msg.RCode == dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, &net.DNSError{Err: "server failure: " + msg.RCode.String(), Name: host}
+	}
+	var ips []net.IP
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
+
+// exchange asks the upstreams in order
+func (r *Resolver) exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Message, error) {
+	var id [2]byte
+	rand.Read(id[:])
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}).Pack()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var lastErr error
+	for _, u := range r.upstreams {
+		var msg dnsmessage.Message
+		raw, err := u.Exchange(ctx, query)
+		if err == nil {
+			err = msg.Unpack(raw)
+		}
+		if err == nil {
+			return msg, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", u, err)
+	}
+	return dnsmessage.Message{}, lastErr
+}
+
+// lookupSystem asks the system resolver and shapes the answer as a
+// response with systemTTL, so it is cached like one. A name without
+// records of the type is NXDOMAIN, as the system resolver tells no more.
+func (r *Resolver) lookupSystem(ctx context.Context, q dnsmessage.Question) (dnsmessage.Message, error) {
+	network := "ip4"
+	if q.Type == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Questions: []dnsmessage.Question{q}}
+	ips, err := r.system(ctx, network, strings.TrimSuffix(q.Name.String(), "."))
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		msg.RCode = dnsmessage.RCodeNameError
+		return msg, nil
+	}
+	if err != nil {
+		return msg, err
+	}
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: uint32(systemTTL / time.Second)}
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			a := dnsmessage.AResource{}
+			copy(a.A[:], ip4)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &a})
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil:
+			aaaa := dnsmessage.AAAAResource{}
+			copy(aaaa.AAAA[:], ip.To16())
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &aaaa})
+		}
+	}
+	return msg, nil
+}
+
+// DialContext resolves addr and connects. TCP races the addresses with
+// happy eyeballs, alternating families; UDP uses the first address.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.DialChecked(ctx, network, addr, nil)
+}
+
+// DialChecked is DialContext that skips the addresses check rejects, so a
+// domain can't lead to an address the caller refuses
+func (r *Resolver) DialChecked(ctx context.Context, network, addr string, check func(net.IP) error) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		if ips, err = filterIPs(ips, check); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return r.dialer.DialContext(ctx, familyNetwork(network, ips[0]), net.JoinHostPort(ips[0].String(), port))
+	}
+	return r.race(ctx, network, interleave(ips), port)
+}
+
+func (r *Resolver) race(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next := 0
+	pending := 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := r.dialer.DialContext(ctx, familyNetwork(network, ip), net.JoinHostPort(ip.String(), port))
+			results <- result{conn, err}
+		}()
+	}
+	start()
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections that finish after the winner
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// A failure starts the next attempt right away
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+// filterIPs keeps the addresses check accepts; with none left it returns
+// the first rejection
+func filterIPs(ips []net.IP, check func(net.IP) error) ([]net.IP, error) {
+	var allowed []net.IP
+	var firstErr error
+	for _, ip := range ips {
+		if err := check(ip); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		return nil, firstErr
+	}
+	return allowed, nil
+}
+
+// interleave alternates families, starting with the first address
+func interleave(ips []net.IP) []net.IP {
+	var first, other []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out
+}
+
+func familyNetwork(network string, ip net.IP) string {
+	base := strings.TrimRight(network, "46")
+	if ip.To4() != nil {
+		return base + "4"
+	}
+	return base + "6"
+}
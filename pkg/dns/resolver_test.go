@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// systemStub stands in for the system resolver and counts its lookups
+type systemStub struct {
+	mu    sync.Mutex
+	hosts map[string][]net.IP
+	fail  error
+	calls int
+}
+
+func (s *systemStub) lookup(ctx context.Context, network, host string) ([]net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.fail != nil {
+		return nil, s.fail
+	}
+	var ips []net.IP
+	for _, ip := range s.hosts[host] {
+		if (ip.To4() != nil) == (network == "ip4") {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (s *systemStub) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestResolverCachesSystem(t *testing.T) {
+	stub := &systemStub{hosts: map[string][]net.IP{
+		"example.com": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+	}}
+	clock := &testClock{time.Unix(1000, 0)}
+	cache := NewCache(16)
+	cache.now = clock.now
+	r := NewResolver(nil, cache, PreferIPv4)
+	r.system = stub.lookup
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ips, err := r.LookupIP(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 || ips[0].String() != "192.0.2.1" || ips[1].String() != "2001:db8::1" {
+			t.Errorf("LookupIP = %v", ips)
+		}
+	}
+	if n := stub.count(); n != 2 {
+		t.Errorf("%d system lookups for 3 resolutions, want 2 (A and AAAA)", n)
+	}
+	clock.t = clock.t.Add(systemTTL)
+	if _, err := r.LookupIP(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := stub.count(); n != 4 {
+		t.Errorf("%d system lookups after systemTTL, want 4", n)
+	}
+
+	// Unknown names are cached as NXDOMAIN
+	for i := 0; i < 2; i++ {
+		var dnsErr *net.DNSError
+		if _, err := r.LookupIP(ctx, "missing.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("LookupIP(missing) = %v, want not found", err)
+		}
+	}
+	if n := stub.count(); n != 6 {
+		t.Errorf("%d system lookups after a missing name twice, want 6", n)
+	}
+
+	// Other failures are not cached
+	stub.fail = errors.New("resolver down")
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIP(ctx, "down.example.com"); err == nil || !strings.Contains(err.Error(), "resolver down") {
+			t.Errorf("LookupIP with a failing resolver: %v", err)
+		}
+	}
+	if n := stub.count(); n != 10 {
+		t.Errorf("%d system lookups after failures, want 10", n)
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	var got []string
+	for _, ip := range interleave(ips) {
+		got = append(got, ip.String())
+	}
+	if want := "2001:db8::1 192.0.2.1 2001:db8::2 2001:db8::3"; strings.Join(got, " ") != want {
+		t.Errorf("interleave = %v, want %s", got, want)
+	}
+}
+
+func TestRace(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	good, refused, stuck := net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")
+
+	// stuck hangs until its attempt is cancelled
+	cancelled := make(chan struct{})
+	r := NewResolver(nil, nil, IPv4Only)
+	r.dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if strings.HasPrefix(address, stuck.String()+":") {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	// A failure starts the next address at once
+	start := time.Now()
+	conn, err := r.race(context.Background(), "tcp", []net.IP{refused, good}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d >= happyEyeballsDelay {
+		t.Errorf("fallback after a refusal took %v", d)
+	}
+
+	// A hanging address gets happyEyeballsDelay, then loses the race
+	start = time.Now()
+	conn, err = r.race(context.Background(), "tcp", []net.IP{stuck, good}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d < happyEyeballsDelay {
+		t.Errorf("second address tried after %v, before happyEyeballsDelay", d)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("losing attempt not cancelled")
+	}
+
+	// With every address failing the first error is returned
+	if _, err := r.race(context.Background(), "tcp", []net.IP{refused, net.ParseIP("127.0.0.4")}, port); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("race over refusing addresses: %v", err)
+	}
+}
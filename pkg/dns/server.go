@@ -0,0 +1,259 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+const (
+	queryTimeout = 5 * time.Second
+	fakeIPTTL    = 1
+)
+
+// Options configures a DNS server
+type Options struct {
+	Listen   string         // UDP and TCP address, e.g. 127.0.0.1:5353
+	Upstream Upstream       // through the tunnel
+	Direct   Upstream       // for domains the router sends direct; nil uses Upstream
+	Router   *router.Router // split DNS and blocking; nil tunnels everything
+	Cache    *Cache         // nil disables caching
+	FakeIP   *FakeIPPool    // nil disables fake-IP answers
+	Strategy Strategy       // IP family of the listeners and LookupIP; empty is IPv4 only
+}
+
+// Server answers local DNS queries. Domains routed through the tunnel are
+// resolved by the tunnel upstream (or get a fake IP), domains routed
+// direct by the direct upstream, and blocked domains get NXDOMAIN.
+type Server struct {
+	opts Options
+	udp  *net.UDPConn
+	tcp  net.Listener
+}
+
+func NewServer(opts Options) *Server {
+	return &Server{opts: opts}
+}
+
+func (s *Server) Start() error {
+	udp, err := net.ListenPacket(s.opts.Strategy.Network("udp"), s.opts.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start DNS server: %w", err)
+	}
+	tcp, err := net.Listen(s.opts.Strategy.Network("tcp"), s.opts.Listen)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to start DNS server: %w", err)
+	}
+	s.udp = udp.(*net.UDPConn)
+	s.tcp = tcp
+	fmt.Printf("🔎 DNS server listening on %s\n", s.opts.Listen)
+
+	go s.serveTCP()
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.Handle(query, true); resp != nil {
+				s.udp.WriteToUDP(resp, src)
+			}
+		}()
+	}
+}
+
+func (s *Server) Stop() error {
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	if s.udp != nil {
+		return s.udp.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := s.Handle(query, false)
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Handle answers one query in wire format; nil means drop it. Responses
+// for UDP are truncated to the size the client accepts.
+func (s *Server) Handle(query []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	p.SkipAllQuestions()
+	p.SkipAllAnswers()
+	p.SkipAllAuthorities()
+	maxSize := 512
+	if opt, err := p.AdditionalHeader(); err == nil && opt.Type == dnsmessage.TypeOPT && int(opt.Class) > maxSize {
+		maxSize = int(opt.Class)
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	action := s.opts.Router.RouteDomain(domain)
+	var msg dnsmessage.Message
+	switch {
+	case action == router.Block:
+		msg = reply(header, q, dnsmessage.RCodeNameError)
+	case s.opts.FakeIP != nil && action == router.Proxy && q.Class == dnsmessage.ClassINET &&
+		(q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA):
+		msg = reply(header, q, dnsmessage.RCodeSuccess)
+		if q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], s.opts.FakeIP.Allocate(domain))
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fakeIPTTL},
+				Body:   &a,
+			}}
+		}
+		// AAAA stays empty so apps fall back to the fake IPv4 address
+	default:
+		msg, err = s.resolve(q, query, action)
+		if err != nil {
+			fmt.Printf("⚠️  DNS %s: %v\n", domain, err)
+			msg = reply(header, q, dnsmessage.RCodeServerFailure)
+		}
+		msg.ID = header.ID
+		msg.Questions = []dnsmessage.Question{q}
+	}
+
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	if udp && len(resp) > maxSize {
+		msg = reply(header, q, msg.RCode)
+		msg.Truncated = true
+		resp, _ = msg.Pack()
+	}
+	return resp
+}
+
+// resolve answers from the cache or the upstream the route selects
+func (s *Server) resolve(q dnsmessage.Question, query []byte, action router.Action) (dnsmessage.Message, error) {
+	if s.opts.Cache != nil {
+		if msg, ok := s.opts.Cache.Get(q); ok {
+			return msg, nil
+		}
+	}
+	upstream := s.opts.Upstream
+	if action == router.Direct && s.opts.Direct != nil {
+		upstream = s.opts.Direct
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	raw, err := upstream.Exchange(ctx, query)
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("%s: %w", upstream, err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("%s: bad response: %w", upstream, err)
+	}
+	if s.opts.Cache != nil {
+		s.opts.Cache.Put(q, msg)
+	}
+	return msg, nil
+}
+
+// LookupIP resolves a domain to a real address of a family Strategy
+// allows, bypassing fake IPs. It is used for routing decisions and direct
+// connections.
+func (s *Server) LookupIP(ctx context.Context, domain string) (net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(domain, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	var types []dnsmessage.Type
+	if s.opts.Strategy.wantsIPv4() {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if s.opts.Strategy.wantsIPv6() {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	action := s.opts.Router.RouteDomain(domain)
+	var ips []net.IP
+	for _, t := range types {
+		q := dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}
+		query, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true},
+			Questions: []dnsmessage.Question{q},
+		}).Pack()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := s.resolve(q, query, action)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range msg.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if ips = s.opts.Strategy.Sort(ips); len(ips) == 0 {
+		return nil, fmt.Errorf("no address for %s allowed by ip_strategy %s", domain, s.opts.Strategy)
+	}
+	return ips[0], nil
+}
+
+// reply builds an empty response to a query
+func reply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+}
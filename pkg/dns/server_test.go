@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+// stubUpstream answers A queries over UDP from answers and counts them
+func stubUpstream(t *testing.T, answers map[string]net.IP) (Upstream, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			queries.Add(1)
+			q := msg.Questions[0]
+			msg.Response = true
+			if ip := answers[q.Name.String()]; ip != nil && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &a,
+				}}
+			} else if ip == nil {
+				msg.RCode = dnsmessage.RCodeNameError
+			}
+			resp, _ := msg.Pack()
+			conn.WriteToUDP(resp, from)
+		}
+	}()
+	var d net.Dialer
+	u, err := NewUpstream("udp://"+conn.LocalAddr().String(), d.DialContext, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, &queries
+}
+
+func query(t *testing.T, s *Server, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	q, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(s.Handle(q, true)); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 42 || !msg.Response {
+		t.Fatalf("%s: response header %+v", name, msg.Header)
+	}
+	return msg
+}
+
+func TestServerFakeIP(t *testing.T) {
+	upstream, queries := stubUpstream(t, map[string]net.IP{
+		"proxied.test.": net.IPv4(203, 0, 113, 1),
+		"direct.test.":  net.IPv4(203, 0, 113, 2),
+	})
+	rt, err := router.FromConfig(config.RoutingConfig{Rules: []config.RoutingRule{
+		{Domain: []string{"direct.test"}, Action: "direct"},
+		{Domain: []string{"ads.test"}, Action: "block"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewFakeIPPool("198.19.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Upstream: upstream, Router: rt, Cache: NewCache(16), FakeIP: pool})
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answer  net.IP // nil for no answer, 0.0.0.0 for a fake one
+		queried bool   // the upstream was asked
+	}{
+		{"proxied.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, net.IPv4zero, false},
+		{"proxied.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil, false},
+		{"direct.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, net.IPv4(203, 0, 113, 2), true},
+		{"ads.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, false},
+	}
+	for _, tt := range tests {
+		before := queries.Load()
+		msg := query(t, s, tt.name, tt.qtype)
+		if msg.RCode != tt.rcode {
+			t.Errorf("%s %v: rcode %v, want %v", tt.name, tt.qtype, msg.RCode, tt.rcode)
+		}
+		if got := queries.Load() != before; got != tt.queried {
+			t.Errorf("%s %v: upstream queried %v, want %v", tt.name, tt.qtype, got, tt.queried)
+		}
+		if tt.answer == nil {
+			if len(msg.Answers) != 0 {
+				t.Errorf("%s %v: answers %v, want none", tt.name, tt.qtype, msg.Answers)
+			}
+			continue
+		}
+		if len(msg.Answers) != 1 {
+			t.Fatalf("%s %v: %d answers, want 1", tt.name, tt.qtype, len(msg.Answers))
+		}
+		ip := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:])
+		if tt.answer.Equal(net.IPv4zero) {
+			if domain, ok := pool.Lookup(ip); !ok || domain+"." != tt.name {
+				t.Errorf("%s: fake %s maps back to %q", tt.name, ip, domain)
+			}
+		} else if !ip.Equal(tt.answer) {
+			t.Errorf("%s: answer %s, want %s", tt.name, ip, tt.answer)
+		}
+	}
+
+	// Direct connections and routing need the real address
+	ip, err := s.LookupIP(context.Background(), "proxied.test")
+	if err != nil || !ip.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Errorf("LookupIP(proxied.test) = %v, %v, want the upstream's answer", ip, err)
+	}
+	// IPv6 only can't use the A record
+	v6 := NewServer(Options{Upstream: upstream, Strategy: IPv6Only})
+	if ip, err := v6.LookupIP(context.Background(), "direct.test"); err == nil {
+		t.Errorf("LookupIP(direct.test) with %s = %v, want an error", IPv6Only, ip)
+	}
+	// Answered from the cache the second time
+	before := queries.Load()
+	query(t, s, "direct.test.", dnsmessage.TypeA)
+	if queries.Load() != before {
+		t.Error("cached answer was asked upstream again")
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	upstream, _ := stubUpstream(t, nil)
+
+	// Addresses of the family the strategy rules out are refused
+	for _, tt := range []struct {
+		strategy Strategy
+		listen   string
+	}{
+		{IPv6Only, "127.0.0.1:0"},
+		{IPv4Only, "[::1]:0"},
+	} {
+		s := NewServer(Options{Listen: tt.listen, Upstream: upstream, Strategy: tt.strategy})
+		if err := s.Start(); err == nil {
+			t.Errorf("%s: listening on %s, want an error", tt.strategy, tt.listen)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+)
+
+// Strategy decides which IP versions one side of the tunnel uses, for its
+// listeners, lookups and dials. The default is IPv4 only, as IPv6 is often
+// unusable on censored networks; hosts with working IPv6 can opt in.
+type Strategy string
+
+const (
+	IPv4Only   Strategy = "ipv4_only"
+	IPv6Only   Strategy = "ipv6_only"
+	PreferIPv4 Strategy = "prefer_ipv4"
+	PreferIPv6 Strategy = "prefer_ipv6"
+)
+
+// ParseStrategy validates a configured strategy; empty means IPv4 only
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case "":
+		return IPv4Only, nil
+	case IPv4Only, IPv6Only, PreferIPv4, PreferIPv6:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown ip_strategy %q (use ipv4_only, ipv6_only, prefer_ipv4 or prefer_ipv6)", s)
+}
+
+// Network narrows "tcp" or "udp" to the allowed family
+func (s Strategy) Network(base string) string {
+	switch s {
+	case IPv6Only:
+		return base + "6"
+	case PreferIPv4, PreferIPv6:
+		return base
+	default:
+		return base + "4"
+	}
+}
+
+// Allows reports whether ip may be used
+func (s Strategy) Allows(ip net.IP) bool {
+	switch s {
+	case IPv6Only:
+		return ip.To4() == nil
+	case PreferIPv4, PreferIPv6:
+		return true
+	default:
+		return ip.To4() != nil
+	}
+}
+
+// Sort drops addresses of a disallowed family and puts the preferred
+// family first, keeping the resolver's order otherwise
+func (s Strategy) Sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if !s.Allows(ip) {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if s == PreferIPv6 || s == IPv6Only {
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+// wantsIPv4 and wantsIPv6 tell which record types to query
+func (s Strategy) wantsIPv4() bool { return s != IPv6Only }
+func (s Strategy) wantsIPv6() bool { return s == IPv6Only || s == PreferIPv4 || s == PreferIPv6 }
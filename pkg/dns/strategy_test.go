@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseStrategy(t *testing.T) {
+	if s, err := ParseStrategy(""); s != IPv4Only || err != nil {
+		t.Errorf("ParseStrategy(\"\") = %s %v, want ipv4_only", s, err)
+	}
+	for _, s := range []Strategy{IPv4Only, IPv6Only, PreferIPv4, PreferIPv6} {
+		if got, err := ParseStrategy(string(s)); got != s || err != nil {
+			t.Errorf("ParseStrategy(%s) = %s %v", s, got, err)
+		}
+	}
+	if _, err := ParseStrategy("ipv5"); err == nil {
+		t.Error("ParseStrategy accepted ipv5")
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	mapped := net.ParseIP("::ffff:192.0.2.2")
+	mixed := []net.IP{v6, v4, net.ParseIP("2001:db8::2"), mapped}
+	tests := []struct {
+		s        Strategy
+		network  string
+		allows4  bool
+		allows6  bool
+		sorted   string
+		wantA    bool
+		wantAAAA bool
+	}{
+		{IPv4Only, "tcp4", true, false, "192.0.2.1 192.0.2.2", true, false},
+		{IPv6Only, "tcp6", false, true, "2001:db8::1 2001:db8::2", false, true},
+		{PreferIPv4, "tcp", true, true, "192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2", true, true},
+		{PreferIPv6, "tcp", true, true, "2001:db8::1 2001:db8::2 192.0.2.1 192.0.2.2", true, true},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Network("tcp"); got != tt.network {
+			t.Errorf("%s: Network(tcp) = %s, want %s", tt.s, got, tt.network)
+		}
+		if got := tt.s.Allows(v4); got != tt.allows4 {
+			t.Errorf("%s: Allows(%s) = %v", tt.s, v4, got)
+		}
+		// An IPv4-mapped address counts as IPv4
+		if got := tt.s.Allows(mapped); got != tt.allows4 {
+			t.Errorf("%s: Allows(%s) = %v", tt.s, mapped, got)
+		}
+		if got := tt.s.Allows(v6); got != tt.allows6 {
+			t.Errorf("%s: Allows(%s) = %v", tt.s, v6, got)
+		}
+		var sorted []string
+		for _, ip := range tt.s.Sort(mixed) {
+			sorted = append(sorted, ip.String())
+		}
+		if got := strings.Join(sorted, " "); got != tt.sorted {
+			t.Errorf("%s: Sort = %s, want %s", tt.s, got, tt.sorted)
+		}
+		if tt.s.wantsIPv4() != tt.wantA || tt.s.wantsIPv6() != tt.wantAAAA {
+			t.Errorf("%s: queries A %v AAAA %v", tt.s, tt.s.wantsIPv4(), tt.s.wantsIPv6())
+		}
+	}
+}
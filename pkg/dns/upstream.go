@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DialFunc connects like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Upstream sends a query in wire format and returns the response
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// NewUpstream parses an upstream URL: tcp://host[:53], tls://host[:853]
+// (DoT), https://host/path (DoH) or udp://host[:53]. TCP-based upstreams
+// connect through dial; UDP is only for direct use and needs allowUDP.
+func NewUpstream(rawURL string, dial DialFunc, allowUDP bool) (Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid DNS upstream %q", rawURL)
+	}
+	switch u.Scheme {
+	case "tcp":
+		return &streamUpstream{url: rawURL, addr: withPort(u.Host, "53"), dial: dial}, nil
+	case "tls":
+		addr := withPort(u.Host, "853")
+		return &streamUpstream{url: rawURL, addr: addr, dial: dial, tls: &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}}, nil
+	case "https":
+		addr := withPort(u.Host, "443")
+		return &httpsUpstream{url: rawURL, client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dial(ctx, "tcp", addr)
+				},
+				TLSClientConfig:     &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}}, nil
+	case "udp":
+		if !allowUDP {
+			return nil, fmt.Errorf("DNS upstream %q: udp is only supported for direct_upstream", rawURL)
+		}
+		return &udpUpstream{url: rawURL, addr: withPort(u.Host, "53"), dial: dial}, nil
+	}
+	return nil, fmt.Errorf("DNS upstream %q: unsupported scheme (use tcp, tls, https or udp)", rawURL)
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// streamUpstream is DNS over TCP (RFC 7766) or TLS (RFC 7858), one
+// connection per query
+type streamUpstream struct {
+	url  string
+	addr string
+	dial DialFunc
+	tls  *tls.Config
+}
+
+func (u *streamUpstream) String() string { return u.url }
+
+func (u *streamUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if u.tls != nil {
+		tlsConn := tls.Client(conn, u.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", u.addr, err)
+		}
+		conn = tlsConn
+	}
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+// httpsUpstream is DNS over HTTPS (RFC 8484) with POST
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// udpUpstream is plain DNS over UDP, used for domestic (direct) queries
+type udpUpstream struct {
+	url  string
+	addr string
+	dial DialFunc
+}
+
+func (u *udpUpstream) String() string { return u.url }
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dial(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray answers to other queries
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -44,7 +44,7 @@ func (t *TimingObfuscator) JitterRange(min, max time.Duration) {
 }
 
 func (t *TimingObfuscator) SimulateHTTPTiming() {
-	if !t.config.BurstMode {
+	if !t.config.Enabled || !t.config.BurstMode {
 		return
 	}
 	n, _ := rand.Int(rand.Reader, big.NewInt(100))
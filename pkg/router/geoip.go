@@ -0,0 +1,279 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// GeoIP looks up countries in a MaxMind DB file (GeoLite2-Country and
+// compatible databases). Only the parts of the format needed to read the
+// country ISO code are implemented.
+type GeoIP struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	treeSize   uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// LoadGeoIP reads a .mmdb database into memory
+func LoadGeoIP(path string) (*GeoIP, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind database", path)
+	}
+	d := mmdbDecoder{data: data[i+len(mmdbMetadataMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata in %s: %w", path, err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("bad metadata in %s", path)
+	}
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d in %s", recordSize, path)
+	}
+
+	g := &GeoIP{data: data, nodeCount: uint(nodeCount), recordSize: uint(recordSize), ipVersion: uint(ipVersion)}
+	g.treeSize = g.nodeCount * g.recordSize / 4
+	if g.treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("truncated search tree in %s", path)
+	}
+	// IPv4 lives under ::/96 in IPv6 databases
+	if g.ipVersion == 6 {
+		for bit := 0; bit < 96 && g.ipv4Start < g.nodeCount; bit++ {
+			g.ipv4Start = g.record(g.ipv4Start, 0)
+		}
+	}
+	return g, nil
+}
+
+// Country returns the lower-case ISO code for ip, or "" when unknown
+func (g *GeoIP) Country(ip net.IP) string {
+	node := g.ipv4Start
+	addr := ip.To4()
+	if addr == nil {
+		if addr = ip.To16(); addr == nil || g.ipVersion != 6 {
+			return ""
+		}
+		node = 0
+	}
+	for bit := 0; bit < len(addr)*8 && node < g.nodeCount; bit++ {
+		node = g.record(node, uint(addr[bit/8]>>(7-bit%8))&1)
+	}
+	if node <= g.nodeCount {
+		return ""
+	}
+	d := mmdbDecoder{data: g.data[g.treeSize+16:]}
+	v, _, err := d.decode(node - g.nodeCount - 16)
+	if err != nil {
+		return ""
+	}
+	rec, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return strings.ToLower(code)
+			}
+		}
+	}
+	return ""
+}
+
+// record reads the left (0) or right (1) pointer of a search tree node
+func (g *GeoIP) record(node, side uint) uint {
+	b := g.data[node*g.recordSize/4:]
+	switch g.recordSize {
+	case 24:
+		b = b[side*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if side == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[side*4:]))
+	}
+}
+
+// mmdbDecoder reads values from the MaxMind DB data section. Maps become
+// map[string]any, all unsigned integers uint64.
+type mmdbDecoder struct {
+	data  []byte
+	depth int
+}
+
+// mmdbMaxDepth bounds nesting and pointer chains, so a corrupt database
+// with a pointer loop fails instead of overflowing the stack
+const mmdbMaxDepth = 64
+
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbDouble  = 3
+	mmdbBytes   = 4
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbInt32   = 8
+	mmdbUint64  = 9
+	mmdbUint128 = 10
+	mmdbArray   = 11
+	mmdbBool    = 14
+	mmdbFloat   = 15
+)
+
+// decode returns the value at offset and the offset after it
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	if d.depth >= mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("data nested deeper than %d", mmdbMaxDepth)
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	if offset >= uint(len(d.data)) {
+		return nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		if offset+ss+1 > uint(len(d.data)) {
+			return nil, 0, fmt.Errorf("truncated pointer")
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(d.data[offset])
+		case 1:
+			ptr = (vvv<<16 | uint(d.data[offset])<<8 | uint(d.data[offset+1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(d.data[offset])<<16 | uint(d.data[offset+1])<<8 | uint(d.data[offset+2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(d.data[offset:]))
+		}
+		v, _, err := d.decode(ptr)
+		return v, offset + ss + 1, err
+	}
+
+	if typ == 0 {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, fmt.Errorf("truncated type")
+		}
+		typ = 7 + uint(d.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return nil, 0, fmt.Errorf("truncated size")
+		}
+		var ext uint
+		for _, b := range d.data[offset : offset+n] {
+			ext = ext<<8 | uint(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + ext
+		case 30:
+			size = 285 + ext
+		default:
+			size = 65821 + ext
+		}
+	}
+
+	// Every map entry and array element takes at least a byte
+	if (typ == mmdbMap || typ == mmdbArray) && size > uint(len(d.data))-offset {
+		return nil, 0, fmt.Errorf("truncated container")
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, fmt.Errorf("truncated value")
+	}
+	b := d.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("bad double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("bad float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case mmdbInt32:
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
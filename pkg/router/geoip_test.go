@@ -0,0 +1,171 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbStr, mmdbUint and mmdbMapHeader encode data section values
+func mmdbStr(s string) []byte {
+	return append([]byte{mmdbString<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(typ byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{typ<<5 | 4}, v)
+}
+
+func mmdbMapHeader(n int) []byte {
+	return []byte{mmdbMap<<5 | byte(n)}
+}
+
+// mmdbCountry encodes {"country": {"iso_code": code}}
+func mmdbCountry(code string) []byte {
+	b := append(mmdbMapHeader(1), mmdbStr("country")...)
+	b = append(b, mmdbMapHeader(1)...)
+	b = append(b, mmdbStr("iso_code")...)
+	return append(b, mmdbStr(code)...)
+}
+
+// buildMMDB writes an IPv6 database with 24-bit records mapping each
+// prefix to the data section value at the given offset
+func buildMMDB(t *testing.T, data []byte, prefixes map[string]uint) string {
+	t.Helper()
+	const empty = -1
+	type node [2]int // child node index, empty, or -2-offset for data
+	nodes := []node{{empty, empty}}
+	for cidr, offset := range prefixes {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		addr := ipnet.IP.To16()
+		if ipnet.IP.To4() != nil {
+			// IPv4 lives under ::/96
+			addr = append(make(net.IP, 12), ipnet.IP.To4()...)
+			ones += 96
+		}
+		n := 0
+		for bit := 0; bit < ones; bit++ {
+			side := addr[bit/8] >> (7 - bit%8) & 1
+			if bit == ones-1 {
+				nodes[n][side] = -2 - int(offset)
+				break
+			}
+			if nodes[n][side] < 0 {
+				nodes = append(nodes, node{empty, empty})
+				nodes[n][side] = len(nodes) - 1
+			}
+			n = nodes[n][side]
+		}
+	}
+
+	var db []byte
+	for _, nd := range nodes {
+		for _, rec := range nd {
+			v := uint(len(nodes)) // not found
+			switch {
+			case rec >= 0:
+				v = uint(rec)
+			case rec <= -2:
+				v = uint(len(nodes)) + 16 + uint(-2-rec)
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, mmdbMetadataMarker...)
+	db = append(db, mmdbMapHeader(3)...)
+	db = append(db, mmdbStr("node_count")...)
+	db = append(db, mmdbUint(mmdbUint32, uint32(len(nodes)))...)
+	db = append(db, mmdbStr("record_size")...)
+	db = append(db, mmdbUint(mmdbUint16, 24)...)
+	db = append(db, mmdbStr("ip_version")...)
+	db = append(db, mmdbUint(mmdbUint16, 6)...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	ir := mmdbCountry("IR")
+	de := mmdbCountry("DE")
+	data := append(append([]byte{}, ir...), de...)
+	// A pointer to DE's record, as databases share repeated values
+	shared := uint(len(data))
+	data = append(data, mmdbPointer<<5, byte(len(ir)))
+
+	g, err := LoadGeoIP(buildMMDB(t, data, map[string]uint{
+		"5.160.0.0/14":   0,
+		"2.16.0.0/13":    shared,
+		"2a01:5ec0::/29": 0,
+		"2a01:4f8::/32":  uint(len(ir)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"5.160.1.1", "ir"},
+		{"5.163.255.255", "ir"},
+		{"5.164.0.1", ""},
+		{"2.17.0.1", "de"},
+		{"::ffff:5.160.1.1", "ir"},
+		{"2a01:5ec0::1", "ir"},
+		{"2a01:4f8:1::1", "de"},
+		{"2a02::1", ""},
+		{"8.8.8.8", ""},
+	}
+	for _, tt := range tests {
+		if got := g.Country(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Country(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGeoIPCorruptData(t *testing.T) {
+	// Pointer loops and oversized containers must fail, not hang or panic
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"self pointer", []byte{mmdbPointer << 5, 0}},
+		{"pointer cycle", []byte{mmdbPointer << 5, 2, mmdbPointer << 5, 0}},
+		{"map through pointer", append(append(mmdbMapHeader(1), mmdbStr("k")...), mmdbPointer<<5, 0)},
+		{"huge map", []byte{mmdbMap<<5 | 31, 0xff, 0xff, 0xff}},
+		{"truncated string", []byte{mmdbString<<5 | 10, 'a'}},
+	}
+	for _, tt := range tests {
+		d := mmdbDecoder{data: tt.data}
+		if v, _, err := d.decode(0); err == nil {
+			t.Errorf("%s: decoded %v, want an error", tt.name, v)
+		}
+	}
+
+	g, err := LoadGeoIP(buildMMDB(t, []byte{mmdbPointer << 5, 0}, map[string]uint{"10.0.0.0/8": 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := g.Country(net.ParseIP("10.1.2.3")); got != "" {
+		t.Errorf("Country with a looping record = %q, want none", got)
+	}
+
+	if _, err := LoadGeoIP(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+	junk := filepath.Join(t.TempDir(), "junk.mmdb")
+	os.WriteFile(junk, []byte("not a database"), 0o644)
+	if _, err := LoadGeoIP(junk); err == nil {
+		t.Error("loading a file without metadata succeeded")
+	}
+}
@@ -0,0 +1,71 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// loadGeoSite reads a domain list in the domain-list-community source
+// format from dir/<name>.txt. Each line is a suffix ("example.com" or
+// "domain:example.com"), "full:", "keyword:", "regexp:" or "include:"
+// another list; "@attr" tags and "#" comments are ignored.
+func loadGeoSite(dir, name string, m *domainMatcher) error {
+	return loadGeoSiteList(dir, strings.ToLower(name), m, map[string]bool{})
+}
+
+func loadGeoSiteList(dir, name string, m *domainMatcher, seen map[string]bool) error {
+	if seen[name] {
+		return nil
+	}
+	seen[name] = true
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid geosite list %q", name)
+	}
+
+	f, err := os.Open(filepath.Join(dir, name+".txt"))
+	if err != nil {
+		return fmt.Errorf("geosite %s: %w", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		kind, value, found := strings.Cut(fields[0], ":")
+		if !found {
+			kind, value = "domain", kind
+		}
+		switch kind {
+		case "domain":
+			m.suffix = append(m.suffix, strings.ToLower(value))
+		case "full":
+			m.exact[strings.ToLower(value)] = true
+		case "keyword":
+			m.keyword = append(m.keyword, strings.ToLower(value))
+		case "regexp":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return fmt.Errorf("geosite %s line %d: %w", name, lineNo, err)
+			}
+			m.regex = append(m.regex, re)
+		case "include":
+			if err := loadGeoSiteList(dir, strings.ToLower(value), m, seen); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("geosite %s line %d: unknown entry %q", name, lineNo, fields[0])
+		}
+	}
+	return scanner.Err()
+}
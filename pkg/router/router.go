@@ -0,0 +1,355 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+// Action is what to do with a connection
+type Action string
+
+const (
+	Proxy  Action = "proxy"  // through the tunnel
+	Direct Action = "direct" // straight from this machine
+	Block  Action = "block"  // refuse
+)
+
+func parseAction(s string) (Action, error) {
+	switch a := Action(strings.ToLower(s)); a {
+	case Proxy, Direct, Block:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown action %q (want proxy, direct or block)", s)
+}
+
+// Router picks an action for each destination from an ordered rule list
+type Router struct {
+	rules    []*rule
+	final    Action
+	resolve  bool
+	resolver func(ctx context.Context, domain string) (net.IP, error)
+}
+
+// FromConfig compiles the routing section. GeoIP and geosite files are
+// read here, so a bad path fails at startup rather than per connection.
+func FromConfig(cfg config.RoutingConfig) (*Router, error) {
+	r := &Router{final: Proxy, resolve: cfg.ResolveDomains}
+	if cfg.Final != "" {
+		final, err := parseAction(cfg.Final)
+		if err != nil {
+			return nil, fmt.Errorf("routing.final: %w", err)
+		}
+		r.final = final
+	}
+
+	var geoip *GeoIP
+	for i, rc := range cfg.Rules {
+		if len(rc.GeoIP) > 0 && geoip == nil && needsDatabase(rc.GeoIP) {
+			if cfg.GeoIP == "" {
+				return nil, fmt.Errorf("routing rule %d: geoip needs routing.geoip", i+1)
+			}
+			var err error
+			if geoip, err = LoadGeoIP(cfg.GeoIP); err != nil {
+				return nil, fmt.Errorf("routing.geoip: %w", err)
+			}
+		}
+		rl, err := compileRule(rc, geoip, cfg.GeoSiteDir)
+		if err != nil {
+			return nil, fmt.Errorf("routing rule %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, rl)
+	}
+	return r, nil
+}
+
+// Rules returns the number of rules
+func (r *Router) Rules() int { return len(r.rules) }
+
+// Final returns the action used when no rule matches
+func (r *Router) Final() Action { return r.final }
+
+// SetResolver replaces the system resolver used by resolve_domains, e.g.
+// with the built-in DNS server so fake IPs and poisoned answers are avoided
+func (r *Router) SetResolver(resolve func(ctx context.Context, domain string) (net.IP, error)) {
+	r.resolver = resolve
+}
+
+// Route decides what to do with a connection to target (host:port). A nil
+// Router sends everything through the tunnel.
+func (r *Router) Route(target string) Action {
+	if r == nil {
+		return Proxy
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return r.final
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var domain string
+	ip := net.ParseIP(host)
+	if ip == nil {
+		domain = host
+	}
+	resolved := ip != nil
+	for _, rl := range r.rules {
+		if !rl.ports.Match(port) {
+			continue
+		}
+		if domain != "" && rl.domains.match(domain) {
+			return rl.action
+		}
+		if !rl.matchesIP() {
+			if rl.domains.empty() {
+				return rl.action // port-only rule
+			}
+			continue
+		}
+		if !resolved && r.resolve {
+			ip = r.resolveIP(domain)
+			resolved = true
+		}
+		if ip != nil && rl.matchIP(ip) {
+			return rl.action
+		}
+	}
+	return r.final
+}
+
+// RouteDomain decides for a domain without a port or address, as DNS
+// needs: only domain conditions of rules without ports are considered
+func (r *Router) RouteDomain(domain string) Action {
+	if r == nil {
+		return Proxy
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, rl := range r.rules {
+		if len(rl.ports) == 0 && rl.domains.match(domain) {
+			return rl.action
+		}
+	}
+	return r.final
+}
+
+// resolveIP looks up a domain for IP rules
+func (r *Router) resolveIP(domain string) net.IP {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if r.resolver != nil {
+		ip, err := r.resolver(ctx, domain)
+		if err != nil {
+			return nil
+		}
+		return ip
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", domain)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	return ips[0]
+}
+
+type rule struct {
+	action    Action
+	domains   *domainMatcher
+	cidrs     []*net.IPNet
+	countries map[string]bool
+	geoip     *GeoIP
+	ports     PortRanges
+}
+
+func compileRule(rc config.RoutingRule, geoip *GeoIP, geositeDir string) (*rule, error) {
+	action, err := parseAction(rc.Action)
+	if err != nil {
+		return nil, err
+	}
+	rl := &rule{action: action, domains: newDomainMatcher(), geoip: geoip}
+
+	for _, d := range rc.Domain {
+		rl.domains.exact[strings.ToLower(d)] = true
+	}
+	for _, d := range rc.DomainSuffix {
+		rl.domains.suffix = append(rl.domains.suffix, strings.ToLower(strings.TrimPrefix(d, ".")))
+	}
+	for _, d := range rc.DomainKeyword {
+		rl.domains.keyword = append(rl.domains.keyword, strings.ToLower(d))
+	}
+	for _, expr := range rc.DomainRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("domain_regex %q: %w", expr, err)
+		}
+		rl.domains.regex = append(rl.domains.regex, re)
+	}
+	for _, name := range rc.GeoSite {
+		if geositeDir == "" {
+			return nil, fmt.Errorf("geosite needs routing.geosite_dir")
+		}
+		if err := loadGeoSite(geositeDir, name, rl.domains); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range rc.CIDR {
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("cidr %q: %w", c, err)
+		}
+		rl.cidrs = append(rl.cidrs, ipnet)
+	}
+	if len(rc.GeoIP) > 0 {
+		rl.countries = make(map[string]bool)
+		for _, cc := range rc.GeoIP {
+			rl.countries[strings.ToLower(cc)] = true
+		}
+	}
+
+	if rl.ports, err = ParsePorts(rc.Port); err != nil {
+		return nil, err
+	}
+	if rl.domains.empty() && !rl.matchesIP() && len(rl.ports) == 0 {
+		return nil, fmt.Errorf("rule has no conditions")
+	}
+	return rl, nil
+}
+
+func (rl *rule) matchesIP() bool {
+	return len(rl.cidrs) > 0 || len(rl.countries) > 0
+}
+
+func (rl *rule) matchIP(ip net.IP) bool {
+	for _, n := range rl.cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if len(rl.countries) == 0 {
+		return false
+	}
+	if rl.countries["private"] && isPrivate(ip) {
+		return true
+	}
+	return rl.geoip != nil && rl.countries[rl.geoip.Country(ip)]
+}
+
+// needsDatabase reports whether the codes need the GeoIP file ("private"
+// is built in)
+func needsDatabase(codes []string) bool {
+	for _, cc := range codes {
+		if !strings.EqualFold(cc, "private") {
+			return true
+		}
+	}
+	return false
+}
+
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4",
+		"fc00::/7", "fe80::/10", "::1/128",
+	} {
+		_, n, _ := net.ParseCIDR(c)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatcher holds the domain conditions of one rule
+type domainMatcher struct {
+	exact   map[string]bool
+	suffix  []string
+	keyword []string
+	regex   []*regexp.Regexp
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{exact: make(map[string]bool)}
+}
+
+func (m *domainMatcher) empty() bool {
+	return len(m.exact) == 0 && len(m.suffix) == 0 && len(m.keyword) == 0 && len(m.regex) == 0
+}
+
+func (m *domainMatcher) match(domain string) bool {
+	if m.exact[domain] {
+		return true
+	}
+	for _, s := range m.suffix {
+		if domain == s || strings.HasSuffix(domain, "."+s) {
+			return true
+		}
+	}
+	for _, k := range m.keyword {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+	for _, re := range m.regex {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+type portRange struct{ lo, hi int }
+
+// PortRanges is a list of ports and port ranges such as "443" or "8000-9000"
+type PortRanges []portRange
+
+// ParsePorts parses port specs like "443" and "8000-9000"
+func ParsePorts(specs []string) (PortRanges, error) {
+	var pr PortRanges
+	for _, spec := range specs {
+		loStr, hiStr, isRange := strings.Cut(spec, "-")
+		lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.Atoi(strings.TrimSpace(hiStr))
+		}
+		if err != nil || lo < 1 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("invalid port %q", spec)
+		}
+		pr = append(pr, portRange{lo, hi})
+	}
+	return pr, nil
+}
+
+// Match reports whether port is in the ranges; no ranges match any port
+func (pr PortRanges) Match(port int) bool {
+	if len(pr) == 0 {
+		return true
+	}
+	for _, r := range pr {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+func TestRoute(t *testing.T) {
+	r, err := FromConfig(config.RoutingConfig{
+		Final: "direct",
+		Rules: []config.RoutingRule{
+			{Domain: []string{"Exact.example.com"}, Action: "block"},
+			{DomainSuffix: []string{".suffix.org"}, Action: "proxy"},
+			{DomainKeyword: []string{"tracker"}, Action: "block"},
+			{DomainRegex: []string{`^cdn\d+\.`}, Action: "proxy"},
+			// Ports narrow a rule, so 443 of ads.net proxies while 80 falls through
+			{DomainSuffix: []string{"ads.net"}, Port: []string{"443"}, Action: "proxy"},
+			{DomainSuffix: []string{"ads.net"}, Action: "block"},
+			{CIDR: []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"}, Action: "block"},
+			{Port: []string{"6881-6889", "25"}, Action: "block"},
+			// Never reached for suffix.org: the earlier rule matches first
+			{DomainSuffix: []string{"suffix.org"}, Action: "block"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rules() != 9 || r.Final() != Direct {
+		t.Errorf("router has %d rules, final %s", r.Rules(), r.Final())
+	}
+
+	tests := []struct {
+		target string
+		want   Action
+	}{
+		{"exact.example.com:443", Block},
+		{"EXACT.example.com.:443", Block},
+		{"sub.exact.example.com:443", Direct},
+		{"suffix.org:443", Proxy},
+		{"a.b.suffix.org:80", Proxy},
+		{"notsuffix.org:443", Direct},
+		{"my-tracker-host.com:443", Block},
+		{"cdn12.example.com:443", Proxy},
+		{"x.cdn12.example.com:443", Direct},
+		{"ads.net:443", Proxy},
+		{"ads.net:80", Block},
+		{"10.1.2.3:443", Block},
+		{"192.0.2.7:443", Block},
+		{"192.0.2.8:443", Direct},
+		{"[2001:db8::5]:443", Block},
+		{"[2001:db9::5]:443", Direct},
+		{"example.com:6885", Block},
+		{"example.com:6890", Direct},
+		{"192.0.2.8:25", Block},
+		// Domains don't match CIDR rules without resolve_domains
+		{"example.com:443", Direct},
+		{"not a target", Direct},
+	}
+	for _, tt := range tests {
+		if got := r.Route(tt.target); got != tt.want {
+			t.Errorf("Route(%s) = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+
+	// DNS only sees rules without ports
+	for domain, want := range map[string]Action{"ads.net": Block, "suffix.org.": Proxy, "example.com": Direct} {
+		if got := r.RouteDomain(domain); got != want {
+			t.Errorf("RouteDomain(%s) = %s, want %s", domain, got, want)
+		}
+	}
+
+	var none *Router
+	if none.Route("example.com:443") != Proxy || none.RouteDomain("example.com") != Proxy {
+		t.Error("nil router does not proxy")
+	}
+}
+
+func TestRouteResolveDomains(t *testing.T) {
+	r, err := FromConfig(config.RoutingConfig{
+		ResolveDomains: true,
+		Rules: []config.RoutingRule{
+			{GeoIP: []string{"private"}, Action: "direct"},
+			{CIDR: []string{"198.51.100.0/24"}, Action: "block"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookups := 0
+	r.SetResolver(func(ctx context.Context, domain string) (net.IP, error) {
+		lookups++
+		switch domain {
+		case "nas.lan":
+			return net.ParseIP("192.168.1.10"), nil
+		case "bad.example.com":
+			return net.ParseIP("198.51.100.1"), nil
+		}
+		return nil, errors.New("no such host")
+	})
+	for target, want := range map[string]Action{
+		"nas.lan:445":         Direct,
+		"bad.example.com:443": Block,
+		"unknown.example:443": Proxy,
+	} {
+		lookups = 0
+		if got := r.Route(target); got != want {
+			t.Errorf("Route(%s) = %s, want %s", target, got, want)
+		}
+		if lookups != 1 {
+			t.Errorf("Route(%s) resolved %d times, want once", target, lookups)
+		}
+	}
+}
+
+func TestFromConfigErrors(t *testing.T) {
+	for _, cfg := range []config.RoutingConfig{
+		{Final: "reject"},
+		{Rules: []config.RoutingRule{{Action: "proxy"}}},
+		{Rules: []config.RoutingRule{{Domain: []string{"a.com"}, Action: "drop"}}},
+		{Rules: []config.RoutingRule{{DomainRegex: []string{"("}, Action: "block"}}},
+		{Rules: []config.RoutingRule{{CIDR: []string{"10.0.0.0/33"}, Action: "block"}}},
+		{Rules: []config.RoutingRule{{Port: []string{"0"}, Action: "block"}}},
+		{Rules: []config.RoutingRule{{GeoIP: []string{"ir"}, Action: "direct"}}},
+		{Rules: []config.RoutingRule{{GeoSite: []string{"ads"}, Action: "block"}}},
+	} {
+		if _, err := FromConfig(cfg); err == nil {
+			t.Errorf("FromConfig(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestGeoSite(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ads.txt"), []byte("# ad hosts\nadserver.com @ads\nfull:exact.example\nkeyword:doubleclick\nregexp:^ad\\d+\\.\ninclude:more\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "more.txt"), []byte("domain:tracking.net\ninclude:ads\n"), 0o644)
+	r, err := FromConfig(config.RoutingConfig{
+		GeoSiteDir: dir,
+		Rules:      []config.RoutingRule{{GeoSite: []string{"ADS"}, Action: "block"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]Action{
+		"x.adserver.com":    Block,
+		"exact.example":     Block,
+		"sub.exact.example": Proxy,
+		"g.doubleclick.io":  Block,
+		"ad7.example.com":   Block,
+		"a.tracking.net":    Block,
+		"example.com":       Proxy,
+	} {
+		if got := r.RouteDomain(domain); got != want {
+			t.Errorf("RouteDomain(%s) = %s, want %s", domain, got, want)
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, "bad.txt"), []byte("bogus:entry\n"), 0o644)
+	for _, name := range []string{"bad", "missing", "../ads"} {
+		if _, err := FromConfig(config.RoutingConfig{GeoSiteDir: dir, Rules: []config.RoutingRule{{GeoSite: []string{name}, Action: "block"}}}); err == nil {
+			t.Errorf("geosite %s loaded", name)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	pr, err := ParsePorts([]string{"443", " 8000 - 9000 ", "1", "65535"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, want := range map[int]bool{443: true, 8000: true, 8500: true, 9000: true, 1: true, 65535: true, 444: false, 9001: false, 0: false} {
+		if got := pr.Match(port); got != want {
+			t.Errorf("Match(%d) = %v, want %v", port, got, want)
+		}
+	}
+	if !PortRanges(nil).Match(22) {
+		t.Error("empty port list does not match every port")
+	}
+
+	for _, spec := range []string{"", "http", "0", "65536", "9000-8000", "80-", "-80", "1-2-3", "80-65536"} {
+		if _, err := ParsePorts([]string{spec}); err == nil {
+			t.Errorf("ParsePorts(%q) succeeded", spec)
+		}
+	}
+}
@@ -20,12 +20,31 @@ var (
 type ClientHelloBuilder struct {
 	serverName string
 	sessionID  []byte
+	alpn       []string
+	quicParams []byte
 }
 
 func NewClientHelloBuilder(serverName string) *ClientHelloBuilder {
 	sessionID := make([]byte, 32)
 	rand.Read(sessionID)
-	return &ClientHelloBuilder{serverName: serverName, sessionID: sessionID}
+	return &ClientHelloBuilder{serverName: serverName, sessionID: sessionID, alpn: []string{"h2", "http/1.1"}}
+}
+
+// NewQUICClientHelloBuilder builds the ClientHello carried in a QUIC Initial:
+// h3 ALPN, no legacy session ID and a quic_transport_parameters extension.
+// scid is the source connection ID of the Initial packet.
+func NewQUICClientHelloBuilder(serverName string, scid []byte) *ClientHelloBuilder {
+	return &ClientHelloBuilder{
+		serverName: serverName,
+		alpn:       []string{"h3"},
+		quicParams: chromeQUICTransportParams(scid),
+	}
+}
+
+// HandshakeMessage returns the ClientHello without the TLS record header,
+// as carried in QUIC CRYPTO frames
+func (b *ClientHelloBuilder) HandshakeMessage() []byte {
+	return b.Build()[5:]
 }
 
 func (b *ClientHelloBuilder) Build() []byte {
@@ -80,10 +99,38 @@ func (b *ClientHelloBuilder) buildExtensions() []byte {
 	ext = append(ext, 0x00, 0x2b, 0x00, 0x05, 0x04, 0x03, 0x04, 0x03, 0x03)
 	ext = append(ext, 0x00, 0x2d, 0x00, 0x02, 0x01, 0x01)
 	ext = append(ext, b.buildKeyShare()...)
+	if b.quicParams != nil {
+		ext = append(ext, b.buildQUICTransportParams()...)
+		return ext
+	}
 	ext = append(ext, b.buildPadding(len(ext))...)
 	return ext
 }
 
+func (b *ClientHelloBuilder) buildQUICTransportParams() []byte {
+	ext := make([]byte, 4+len(b.quicParams))
+	binary.BigEndian.PutUint16(ext[0:2], 0x0039)
+	binary.BigEndian.PutUint16(ext[2:4], uint16(len(b.quicParams)))
+	copy(ext[4:], b.quicParams)
+	return ext
+}
+
+// chromeQUICTransportParams mirrors the transport parameters Chrome sends
+func chromeQUICTransportParams(scid []byte) []byte {
+	params := []byte{
+		0x01, 0x04, 0x80, 0x00, 0x75, 0x30, // max_idle_timeout 30000
+		0x03, 0x02, 0x45, 0xc0, // max_udp_payload_size 1472
+		0x04, 0x04, 0x80, 0xf0, 0x00, 0x00, // initial_max_data
+		0x05, 0x04, 0x80, 0x60, 0x00, 0x00, // initial_max_stream_data_bidi_local
+		0x06, 0x04, 0x80, 0x60, 0x00, 0x00, // initial_max_stream_data_bidi_remote
+		0x07, 0x04, 0x80, 0x60, 0x00, 0x00, // initial_max_stream_data_uni
+		0x08, 0x02, 0x40, 0x64, // initial_max_streams_bidi 100
+		0x09, 0x02, 0x40, 0x67, // initial_max_streams_uni 103
+		0x0f, byte(len(scid)), // initial_source_connection_id
+	}
+	return append(params, scid...)
+}
+
 func (b *ClientHelloBuilder) buildSNI() []byte {
 	nameLen := len(b.serverName)
 	listLen := nameLen + 3
@@ -123,9 +170,8 @@ func (b *ClientHelloBuilder) buildSignatureAlgorithms() []byte {
 }
 
 func (b *ClientHelloBuilder) buildALPN() []byte {
-	protocols := []string{"h2", "http/1.1"}
 	var listData []byte
-	for _, p := range protocols {
+	for _, p := range b.alpn {
 		listData = append(listData, byte(len(p)))
 		listData = append(listData, []byte(p)...)
 	}
@@ -2,95 +2,313 @@ package transport
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+)
+
+// Block ciphers supported for KCP packet encryption
+const (
+	KCPCryptAES     = "aes"
+	KCPCryptSalsa20 = "salsa20"
+	// KCPCryptNone disables KCP encryption; the tunnel's XChaCha20-Poly1305
+	// layer still authenticates and encrypts every payload.
+	KCPCryptNone = "none"
 )
 
+// defaultKCPSalt is used when no salt is configured
+const defaultKCPSalt = "xp-protocol-kcp-salt"
+
+// KCPProfile holds the KCP and smux tuning shared by every KCP code path
+// (dial and accept, UDP and raw). Both sides should use the same profile.
+type KCPProfile struct {
+	Mode             string // normal, fast, fast2, fast3, custom
+	NoDelay          int    // custom mode only
+	Interval         int    // custom mode only, milliseconds
+	Resend           int    // custom mode only
+	NoCongestion     int    // custom mode only
+	SndWnd           int
+	RcvWnd           int
+	MTU              int
+	ReadBuffer       int
+	WriteBuffer      int
+	KeepAlive        time.Duration
+	KeepAliveTimeout time.Duration
+	DSCP             int
+	DataShards       int
+	ParityShards     int
+}
+
+// DefaultKCPProfile returns the fast2 profile used when nothing is configured
+func DefaultKCPProfile() KCPProfile {
+	return KCPProfile{
+		Mode:             "fast2",
+		SndWnd:           1024,
+		RcvWnd:           1024,
+		MTU:              1350,
+		ReadBuffer:       4 * 1024 * 1024,
+		WriteBuffer:      4 * 1024 * 1024,
+		KeepAlive:        10 * time.Second,
+		KeepAliveTimeout: 30 * time.Second,
+		DataShards:       10,
+		ParityShards:     3,
+	}
+}
+
+// withDefaults fills unset fields from DefaultKCPProfile
+func (p KCPProfile) withDefaults() KCPProfile {
+	def := DefaultKCPProfile()
+	if p.Mode == "" {
+		p.Mode = def.Mode
+	}
+	if p.Mode == "custom" && p.Interval == 0 {
+		p.Interval = 20
+	}
+	if p.SndWnd == 0 {
+		p.SndWnd = def.SndWnd
+	}
+	if p.RcvWnd == 0 {
+		p.RcvWnd = def.RcvWnd
+	}
+	if p.MTU == 0 {
+		p.MTU = def.MTU
+	}
+	if p.ReadBuffer == 0 {
+		p.ReadBuffer = def.ReadBuffer
+	}
+	if p.WriteBuffer == 0 {
+		p.WriteBuffer = def.WriteBuffer
+	}
+	if p.KeepAlive == 0 {
+		p.KeepAlive = def.KeepAlive
+	}
+	if p.KeepAliveTimeout == 0 {
+		p.KeepAliveTimeout = def.KeepAliveTimeout
+	}
+	if p.DataShards == 0 {
+		p.DataShards = def.DataShards
+	}
+	if p.ParityShards == 0 {
+		p.ParityShards = def.ParityShards
+	}
+	return p
+}
+
+// noDelay returns the SetNoDelay parameters for the profile's mode
+func (p *KCPProfile) noDelay() (nodelay, interval, resend, nc int) {
+	switch p.Mode {
+	case "normal":
+		return 0, 40, 0, 0
+	case "fast":
+		return 0, 30, 2, 1
+	case "fast3":
+		return 1, 10, 2, 1
+	case "custom":
+		return p.NoDelay, p.Interval, p.Resend, p.NoCongestion
+	default: // fast2
+		return 1, 20, 2, 1
+	}
+}
+
+// apply tunes a KCP session (dialed or accepted)
+func (p *KCPProfile) apply(conn *kcp.UDPSession) {
+	conn.SetNoDelay(p.noDelay())
+	conn.SetWindowSize(p.SndWnd, p.RcvWnd)
+	conn.SetMtu(p.MTU)
+	conn.SetACKNoDelay(true)
+	conn.SetStreamMode(true)
+}
+
+// applySocket tunes the UDP socket under a KCP session or listener.
+// Raw fake sockets have no kernel socket and are left alone.
+func (p *KCPProfile) applySocket(conn net.PacketConn) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	udpConn.SetReadBuffer(p.ReadBuffer)
+	udpConn.SetWriteBuffer(p.WriteBuffer)
+	if p.DSCP > 0 {
+		// Only the call matching the socket's family succeeds
+		ipv4.NewConn(udpConn).SetTOS(p.DSCP << 2)
+		ipv6.NewConn(udpConn).SetTrafficClass(p.DSCP << 2)
+	}
+}
+
+// smuxConfig returns the smux session config for the profile
+func (p *KCPProfile) smuxConfig() *smux.Config {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	smuxConfig.KeepAliveInterval = p.KeepAlive
+	smuxConfig.KeepAliveTimeout = p.KeepAliveTimeout
+	return smuxConfig
+}
+
+// deriveKCPKey derives a 32 byte key; purpose separates keys used for
+// different layers from the same passphrase
+func deriveKCPKey(key, salt, purpose string) []byte {
+	if salt == "" {
+		salt = defaultKCPSalt
+	}
+	return pbkdf2.Key([]byte(key), []byte(salt+purpose), 4096, 32, sha256.New)
+}
+
 // KCPTransport implements KCP-based transport with smux multiplexing
 type KCPTransport struct {
-	key          []byte
-	mode         string
-	dataShards   int
-	parityShards int
+	block   kcp.BlockCrypt
+	profile KCPProfile
+	obfs    *UDPObfsOptions
+	obfsKey []byte
+	// packetFilter wraps the raw UDP socket below the obfuscator
+	// (used by QUICTransport for handshake mimicry)
+	packetFilter func(conn net.PacketConn, dialer bool) net.PacketConn
+	portHop      *PortHopOptions
+	strategy     dns.Strategy
 }
 
 // KCPConnection wraps a smux stream
 type KCPConnection struct {
 	stream  *smux.Stream
 	session *smux.Session
+	conn    net.PacketConn
 }
 
 // KCPListener wraps KCP listener with smux
 type KCPListener struct {
 	listener *kcp.Listener
+	conn     net.PacketConn
+	profile  *KCPProfile
 	sessions map[string]*smux.Session
 }
 
-// NewKCPTransport creates a new KCP transport
-func NewKCPTransport(key string, mode string, dataShards, parityShards int) (*KCPTransport, error) {
-	// Generate encryption key from passphrase
-	salt := []byte("xp-protocol-kcp-salt")
-	derivedKey := pbkdf2.Key([]byte(key), salt, 4096, 32, sha256.New)
+// NewKCPTransport creates a new KCP transport.
+// obfs enables per-packet UDP obfuscation; nil sends plain KCP packets.
+func NewKCPTransport(key, salt, crypt string, profile KCPProfile, obfs *UDPObfsOptions) (*KCPTransport, error) {
+	block, err := newBlockCrypt(key, salt, crypt)
+	if err != nil {
+		return nil, err
+	}
 
-	if mode == "" {
-		mode = "fast2"
+	t := &KCPTransport{
+		block:   block,
+		profile: profile.withDefaults(),
 	}
-	if dataShards == 0 {
-		dataShards = 10
+	if obfs != nil {
+		if _, err := mimicHeaderLen(obfs.Mimic); err != nil {
+			return nil, err
+		}
+		t.obfs = obfs
+		t.obfsKey = deriveKCPKey(key, salt, "/udp-obfs")
 	}
-	if parityShards == 0 {
-		parityShards = 3
+	return t, nil
+}
+
+// EnablePortHopping makes the server listen on, and the client hop across,
+// every port in opts.Ports
+func (t *KCPTransport) EnablePortHopping(opts PortHopOptions) error {
+	if len(opts.Ports) == 0 {
+		return fmt.Errorf("port hopping needs at least one port")
 	}
+	t.portHop = &opts
+	return nil
+}
 
-	return &KCPTransport{
-		key:          derivedKey,
-		mode:         mode,
-		dataShards:   dataShards,
-		parityShards: parityShards,
-	}, nil
+// SetIPStrategy selects the IP family for dialing and listening
+func (t *KCPTransport) SetIPStrategy(strategy dns.Strategy) {
+	t.strategy = strategy
 }
 
-// createBlockCrypt creates AES encryption for KCP
-func (t *KCPTransport) createBlockCrypt() (kcp.BlockCrypt, error) {
-	return kcp.NewAESBlockCrypt(t.key)
+// wrapPacketConn applies the packet filter and UDP obfuscation when enabled
+func (t *KCPTransport) wrapPacketConn(conn net.PacketConn, dialer bool) (net.PacketConn, error) {
+	if t.packetFilter != nil {
+		conn = t.packetFilter(conn, dialer)
+	}
+	if t.obfs == nil {
+		return conn, nil
+	}
+	return NewUDPObfuscator(conn, t.obfsKey, *t.obfs)
+}
+
+// newBlockCrypt derives a packet key from the passphrase and salt and
+// creates the selected KCP block cipher
+func newBlockCrypt(key, salt, crypt string) (kcp.BlockCrypt, error) {
+	if key == "" {
+		return nil, fmt.Errorf("KCP key is not configured (set transport.kcp.key or the server/client key)")
+	}
+	derivedKey := deriveKCPKey(key, salt, "")
+
+	switch crypt {
+	case "", KCPCryptAES:
+		return kcp.NewAESBlockCrypt(derivedKey)
+	case KCPCryptSalsa20:
+		return kcp.NewSalsa20BlockCrypt(derivedKey)
+	case KCPCryptNone:
+		return kcp.NewNoneBlockCrypt(derivedKey)
+	default:
+		return nil, fmt.Errorf("unsupported KCP crypt: %s (use aes, salsa20 or none)", crypt)
+	}
 }
 
 // Dial connects to a KCP server
 func (t *KCPTransport) Dial(address string) (Connection, error) {
-	// Force IPv4 - IPv6 doesn't work in Iran
-	ipv4Addr, err := ResolveAddressIPv4(address)
+	resolved, err := ResolveAddress(address, t.strategy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve address: %w", err)
 	}
 
-	block, err := t.createBlockCrypt()
+	raddr, err := net.ResolveUDPAddr("udp", resolved)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create block crypt: %w", err)
+		return nil, fmt.Errorf("failed to resolve address: %w", err)
+	}
+	network := "udp6"
+	if raddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	udpConn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	t.profile.applySocket(udpConn)
+	var base net.PacketConn = udpConn
+	block := t.block
+	if t.portHop != nil {
+		// Measure the loss of this session only, the hop decision is per tunnel
+		loss := newLossMeter(t.block, t.profile.DataShards, t.profile.ParityShards)
+		block = loss
+		base = newHoppingPacketConn(udpConn, raddr, *t.portHop, loss)
+	}
+	pconn, err := t.wrapPacketConn(base, true)
+	if err != nil {
+		base.Close()
+		return nil, err
 	}
 
 	// Connect with FEC
-	conn, err := kcp.DialWithOptions(ipv4Addr, block, t.dataShards, t.parityShards)
+	conn, err := kcp.NewConn2(raddr, block, t.profile.DataShards, t.profile.ParityShards, pconn)
 	if err != nil {
+		pconn.Close()
 		return nil, fmt.Errorf("failed to dial KCP: %w", err)
 	}
 
 	// Apply KCP tuning
-	t.tuneKCP(conn)
+	t.profile.apply(conn)
 
 	// Create smux session
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveInterval = 10 * time.Second
-	smuxConfig.KeepAliveTimeout = 30 * time.Second
-
-	session, err := smux.Client(conn, smuxConfig)
+	session, err := smux.Client(conn, t.profile.smuxConfig())
 	if err != nil {
 		conn.Close()
+		pconn.Close()
 		return nil, fmt.Errorf("failed to create smux session: %w", err)
 	}
 
@@ -98,87 +316,92 @@ func (t *KCPTransport) Dial(address string) (Connection, error) {
 	stream, err := session.OpenStream()
 	if err != nil {
 		session.Close()
+		pconn.Close()
 		return nil, fmt.Errorf("failed to open stream: %w", err)
 	}
 
 	return &KCPConnection{
 		stream:  stream,
 		session: session,
+		conn:    pconn,
 	}, nil
 }
 
 // Listen creates a KCP listener
 func (t *KCPTransport) Listen(address string) (Listener, error) {
-	block, err := t.createBlockCrypt()
+	udpConn, err := t.listenPacket(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	pconn, err := t.wrapPacketConn(udpConn, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create block crypt: %w", err)
+		udpConn.Close()
+		return nil, err
 	}
 
-	listener, err := kcp.ListenWithOptions(address, block, t.dataShards, t.parityShards)
+	listener, err := kcp.ServeConn(t.block, t.profile.DataShards, t.profile.ParityShards, pconn)
 	if err != nil {
+		pconn.Close()
 		return nil, fmt.Errorf("failed to listen: %w", err)
 	}
 
 	return &KCPListener{
 		listener: listener,
+		conn:     pconn,
+		profile:  &t.profile,
 		sessions: make(map[string]*smux.Session),
 	}, nil
 }
 
-// Close closes the transport
-func (t *KCPTransport) Close() error {
-	return nil
-}
-
-// tuneKCP applies performance tuning based on mode
-func (t *KCPTransport) tuneKCP(conn *kcp.UDPSession) {
-	// Set buffer sizes
-	conn.SetReadBuffer(4 * 1024 * 1024)
-	conn.SetWriteBuffer(4 * 1024 * 1024)
+// listenPacket opens the server socket(s): one port normally, the whole
+// hop range when port hopping runs without nftables redirect
+func (t *KCPTransport) listenPacket(address string) (net.PacketConn, error) {
+	if t.portHop == nil || t.portHop.Redirect {
+		conn, err := net.ListenPacket(t.strategy.Network("udp"), address)
+		if err != nil {
+			return nil, err
+		}
+		t.profile.applySocket(conn)
+		return conn, nil
+	}
 
-	// Configure based on mode
-	switch t.mode {
-	case "normal":
-		conn.SetNoDelay(0, 40, 0, 0)
-	case "fast":
-		conn.SetNoDelay(0, 30, 2, 1)
-	case "fast2":
-		conn.SetNoDelay(1, 20, 2, 1)
-	case "fast3":
-		conn.SetNoDelay(1, 10, 2, 1)
-	default:
-		conn.SetNoDelay(1, 20, 2, 1)
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
 	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+	ports := []int{port}
+	for _, p := range t.portHop.Ports {
+		if p != port {
+			ports = append(ports, p)
+		}
+	}
+	return listenMultiPort(t.strategy.Network("udp"), host, ports, &t.profile)
+}
 
-	conn.SetWindowSize(1024, 1024)
-	conn.SetMtu(1350)
-	conn.SetACKNoDelay(true)
-	conn.SetStreamMode(true)
+// Close closes the transport
+func (t *KCPTransport) Close() error {
+	return nil
 }
 
 // Accept accepts a connection
 func (l *KCPListener) Accept() (Connection, error) {
 	conn, err := l.listener.AcceptKCP()
+	if errors.Is(err, io.ErrClosedPipe) {
+		return nil, net.ErrClosed
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Tune connection
-	conn.SetReadBuffer(4 * 1024 * 1024)
-	conn.SetWriteBuffer(4 * 1024 * 1024)
-	conn.SetNoDelay(1, 20, 2, 1)
-	conn.SetWindowSize(1024, 1024)
-	conn.SetMtu(1350)
-	conn.SetACKNoDelay(true)
-	conn.SetStreamMode(true)
+	// Tune connection with the same profile as the dialer
+	l.profile.apply(conn)
 
 	// Create smux session
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveInterval = 10 * time.Second
-	smuxConfig.KeepAliveTimeout = 30 * time.Second
-
-	session, err := smux.Server(conn, smuxConfig)
+	session, err := smux.Server(conn, l.profile.smuxConfig())
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to create smux session: %w", err)
@@ -199,7 +422,9 @@ func (l *KCPListener) Accept() (Connection, error) {
 
 // Close closes the listener
 func (l *KCPListener) Close() error {
-	return l.listener.Close()
+	err := l.listener.Close()
+	l.conn.Close()
+	return err
 }
 
 // Addr returns listener address
@@ -220,7 +445,12 @@ func (c *KCPConnection) Write(b []byte) (int, error) {
 // Close closes connection
 func (c *KCPConnection) Close() error {
 	c.stream.Close()
-	return c.session.Close()
+	err := c.session.Close()
+	if c.conn != nil {
+		// Dialed connections own their UDP socket
+		c.conn.Close()
+	}
+	return err
 }
 
 // LocalAddr returns local address
@@ -232,59 +462,3 @@ func (c *KCPConnection) LocalAddr() string {
 func (c *KCPConnection) RemoteAddr() string {
 	return c.stream.RemoteAddr().String()
 }
-
-// UDPObfuscator adds obfuscation to UDP packets
-type UDPObfuscator struct {
-	conn net.PacketConn
-}
-
-// NewUDPObfuscator creates an obfuscating UDP wrapper
-func NewUDPObfuscator(conn net.PacketConn) *UDPObfuscator {
-	return &UDPObfuscator{conn: conn}
-}
-
-// ReadFrom reads and deobfuscates
-func (o *UDPObfuscator) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = o.conn.ReadFrom(p)
-	if err == nil && n > 0 {
-		// XOR with simple key
-		for i := 0; i < n; i++ {
-			p[i] ^= byte(0x42 + i%256)
-		}
-	}
-	return
-}
-
-// WriteTo obfuscates and writes
-func (o *UDPObfuscator) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	obfuscated := make([]byte, len(p))
-	for i := 0; i < len(p); i++ {
-		obfuscated[i] = p[i] ^ byte(0x42+i%256)
-	}
-	return o.conn.WriteTo(obfuscated, addr)
-}
-
-// Close closes the connection
-func (o *UDPObfuscator) Close() error {
-	return o.conn.Close()
-}
-
-// LocalAddr returns local address
-func (o *UDPObfuscator) LocalAddr() net.Addr {
-	return o.conn.LocalAddr()
-}
-
-// SetDeadline sets deadline
-func (o *UDPObfuscator) SetDeadline(t time.Time) error {
-	return o.conn.SetDeadline(t)
-}
-
-// SetReadDeadline sets read deadline
-func (o *UDPObfuscator) SetReadDeadline(t time.Time) error {
-	return o.conn.SetReadDeadline(t)
-}
-
-// SetWriteDeadline sets write deadline
-func (o *UDPObfuscator) SetWriteDeadline(t time.Time) error {
-	return o.conn.SetWriteDeadline(t)
-}
@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+func TestNewBlockCrypt(t *testing.T) {
+	key := deriveKCPKey("secret", "salt", "")
+	aes, _ := kcp.NewAESBlockCrypt(key)
+	salsa, _ := kcp.NewSalsa20BlockCrypt(key)
+	plain := bytes.Repeat([]byte("kcp segment "), 8)
+	seal := func(b kcp.BlockCrypt) []byte {
+		out := make([]byte, len(plain))
+		b.Encrypt(out, plain)
+		return out
+	}
+
+	tests := []struct {
+		crypt string
+		want  []byte
+	}{
+		{"", seal(aes)},
+		{KCPCryptAES, seal(aes)},
+		{KCPCryptSalsa20, seal(salsa)},
+		{KCPCryptNone, plain},
+	}
+	for _, tt := range tests {
+		b, err := newBlockCrypt("secret", "salt", tt.crypt)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.crypt, err)
+		}
+		if got := seal(b); !bytes.Equal(got, tt.want) {
+			t.Errorf("crypt %q does not encrypt as expected", tt.crypt)
+		}
+	}
+
+	if _, err := newBlockCrypt("", "salt", KCPCryptAES); err == nil {
+		t.Error("newBlockCrypt accepted an empty key")
+	}
+	if _, err := newBlockCrypt("secret", "salt", "blowfish"); err == nil {
+		t.Error("newBlockCrypt accepted an unknown crypt")
+	}
+}
+
+func TestDeriveKCPKey(t *testing.T) {
+	base := deriveKCPKey("secret", "salt", "")
+	if len(base) != 32 {
+		t.Fatalf("key of %d bytes", len(base))
+	}
+	if !bytes.Equal(base, deriveKCPKey("secret", "salt", "")) {
+		t.Error("derivation is not deterministic")
+	}
+	// Each purpose, salt and passphrase gets its own key
+	for name, other := range map[string][]byte{
+		"purpose":    deriveKCPKey("secret", "salt", "/udp-obfs"),
+		"salt":       deriveKCPKey("secret", "salt2", ""),
+		"passphrase": deriveKCPKey("secret2", "salt", ""),
+	} {
+		if bytes.Equal(base, other) {
+			t.Errorf("another %s gives the same key", name)
+		}
+	}
+	if !bytes.Equal(deriveKCPKey("secret", "", ""), deriveKCPKey("secret", defaultKCPSalt, "")) {
+		t.Error("empty salt is not the default salt")
+	}
+}
+
+// kcpState reads the tuning kcp-go keeps unexported in a session
+func kcpState(sess *kcp.UDPSession) map[string]int64 {
+	k := reflect.ValueOf(sess).Elem().FieldByName("kcp").Elem()
+	state := map[string]int64{}
+	for _, f := range []string{"nodelay", "interval", "snd_wnd", "rcv_wnd", "mtu"} {
+		state[f] = int64(k.FieldByName(f).Uint())
+	}
+	for _, f := range []string{"fastresend", "nocwnd", "stream"} {
+		state[f] = k.FieldByName(f).Int()
+	}
+	return state
+}
+
+func TestKCPProfile(t *testing.T) {
+	def := DefaultKCPProfile()
+	tests := []struct {
+		name    string
+		profile KCPProfile
+		// nodelay, interval, resend, nc
+		noDelay [4]int
+		check   func(p KCPProfile) bool
+	}{
+		{"unset", KCPProfile{}, [4]int{1, 20, 2, 1}, func(p KCPProfile) bool { return p == def }},
+		{"normal", KCPProfile{Mode: "normal"}, [4]int{0, 40, 0, 0}, func(p KCPProfile) bool { return p.SndWnd == def.SndWnd }},
+		{"fast", KCPProfile{Mode: "fast"}, [4]int{0, 30, 2, 1}, func(p KCPProfile) bool { return p.MTU == def.MTU }},
+		{"fast2", KCPProfile{Mode: "fast2"}, [4]int{1, 20, 2, 1}, func(p KCPProfile) bool { return p.DataShards == def.DataShards }},
+		{"fast3", KCPProfile{Mode: "fast3"}, [4]int{1, 10, 2, 1}, func(p KCPProfile) bool { return p.ParityShards == def.ParityShards }},
+		{"custom", KCPProfile{Mode: "custom", NoDelay: 1, Interval: 15, Resend: 3}, [4]int{1, 15, 3, 0}, nil},
+		{"custom without interval", KCPProfile{Mode: "custom", Resend: 2, NoCongestion: 1}, [4]int{0, 20, 2, 1}, nil},
+		{"custom values kept", KCPProfile{
+			SndWnd: 256, RcvWnd: 512, MTU: 1200, ReadBuffer: 1 << 20, WriteBuffer: 2 << 20,
+			KeepAlive: 5 * time.Second, KeepAliveTimeout: 15 * time.Second, DSCP: 46, DataShards: 5, ParityShards: 1,
+		}, [4]int{1, 20, 2, 1}, func(p KCPProfile) bool {
+			return p.SndWnd == 256 && p.RcvWnd == 512 && p.MTU == 1200 && p.ReadBuffer == 1<<20 && p.WriteBuffer == 2<<20 &&
+				p.KeepAlive == 5*time.Second && p.KeepAliveTimeout == 15*time.Second && p.DSCP == 46 && p.DataShards == 5 && p.ParityShards == 1
+		}},
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, tt := range tests {
+		p := tt.profile.withDefaults()
+		if tt.check != nil && !tt.check(p) {
+			t.Errorf("%s: withDefaults = %+v", tt.name, p)
+		}
+		nd, interval, resend, nc := p.noDelay()
+		if got := [4]int{nd, interval, resend, nc}; got != tt.noDelay {
+			t.Errorf("%s: noDelay = %v, want %v", tt.name, got, tt.noDelay)
+		}
+
+		sc := p.smuxConfig()
+		if sc.Version != 2 || sc.KeepAliveInterval != p.KeepAlive || sc.KeepAliveTimeout != p.KeepAliveTimeout {
+			t.Errorf("%s: smux config %+v", tt.name, sc)
+		}
+
+		sess, err := kcp.NewConn3(1, conn.LocalAddr(), nil, p.DataShards, p.ParityShards, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// kcp-go starts at IKCP_MTU_DEF less its packet headers
+		overhead := kcp.IKCP_MTU_DEF - kcpState(sess)["mtu"]
+		p.apply(sess)
+		got := kcpState(sess)
+		want := map[string]int64{
+			"nodelay": int64(nd), "interval": int64(interval), "fastresend": int64(resend), "nocwnd": int64(nc),
+			"snd_wnd": int64(p.SndWnd), "rcv_wnd": int64(p.RcvWnd), "mtu": int64(p.MTU) - overhead, "stream": 1,
+		}
+		for f, v := range want {
+			if got[f] != v {
+				t.Errorf("%s: kcp %s = %d, want %d", tt.name, f, got[f], v)
+			}
+		}
+		sess.Close()
+	}
+}
+
+func TestKCPListenerClose(t *testing.T) {
+	// Accept reports net.ErrClosed so accept loops know to stop
+	tr, err := NewKCPTransport("secret", "", "aes", KCPProfile{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	l, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+}
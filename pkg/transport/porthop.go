@@ -0,0 +1,367 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// UDP port hopping for KCP
+//
+// The server accepts the same KCP session on every port of a range, either
+// with one socket per port or with a single socket behind an nftables
+// redirect. The client keeps one local socket (so the server sees the same
+// peer address and the KCP/smux session survives) and only changes the
+// destination port, on a timer and/or when retransmissions spike.
+
+// PortHopOptions configures port hopping
+type PortHopOptions struct {
+	Ports         []int         // destination/listen ports to hop across
+	Interval      time.Duration // client: hop period, 0 = only on loss
+	LossThreshold float64       // client: retransmit ratio that forces a hop, 0 = off
+	Redirect      bool          // server: single socket, ports redirected by nftables
+}
+
+// ParsePortRange parses "20000-20100" or "443,8443,20000-20010"
+func ParsePortRange(spec string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		start, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", lo)
+		}
+		end, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", hi)
+		}
+		if start < 1 || end > 65535 || start > end {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		for p := start; p <= end; p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("empty port range %q", spec)
+	}
+	return ports, nil
+}
+
+// PortHopNFTRules returns the nft commands that redirect the hop range to
+// the listen port, for servers running with Redirect
+func PortHopNFTRules(listenPort int, ports []int) []string {
+	var set []string
+	for _, p := range ports {
+		if p != listenPort {
+			set = append(set, strconv.Itoa(p))
+		}
+	}
+	return []string{
+		"nft add table ip xp",
+		"nft 'add chain ip xp prerouting { type nat hook prerouting priority dstnat; }'",
+		fmt.Sprintf("nft add rule ip xp prerouting udp dport '{ %s }' redirect to :%d", strings.Join(set, ", "), listenPort),
+	}
+}
+
+// fecTypeData marks a kcp-go FEC data shard, as opposed to parity
+const fecTypeData = 0xf1
+
+// lossMeter wraps the block cipher of one KCP session to count the data
+// segments it sends and how many of them are retransmissions, like
+// kcp.DefaultSnmp does for the whole process
+type lossMeter struct {
+	kcp.BlockCrypt
+	fec     bool
+	out     atomic.Uint64
+	retrans atomic.Uint64
+	maxSN   uint32 // only touched by the session's sender
+	started bool
+}
+
+func newLossMeter(block kcp.BlockCrypt, dataShards, parityShards int) *lossMeter {
+	return &lossMeter{BlockCrypt: block, fec: dataShards > 0 && parityShards > 0}
+}
+
+// Encrypt counts the segments of the plaintext packet, then encrypts it
+func (m *lossMeter) Encrypt(dst, src []byte) {
+	m.count(src)
+	m.BlockCrypt.Encrypt(dst, src)
+}
+
+// count parses a packet laid out as nonce (16), CRC (4), the FEC header
+// (6 + 2 size) when FEC is on, then KCP segments
+func (m *lossMeter) count(p []byte) {
+	if len(p) < 20 {
+		return
+	}
+	p = p[20:]
+	if m.fec {
+		if len(p) < 8 || binary.LittleEndian.Uint16(p[4:]) != fecTypeData {
+			return
+		}
+		p = p[8:]
+	}
+	for len(p) >= kcp.IKCP_OVERHEAD {
+		cmd := p[4]
+		sn := binary.LittleEndian.Uint32(p[12:])
+		length := int(binary.LittleEndian.Uint32(p[20:]))
+		if cmd == kcp.IKCP_CMD_PUSH {
+			m.out.Add(1)
+			if m.started && int32(sn-m.maxSN) <= 0 {
+				m.retrans.Add(1)
+			} else {
+				m.maxSN, m.started = sn, true
+			}
+		}
+		p = p[kcp.IKCP_OVERHEAD:]
+		if length > len(p) {
+			return
+		}
+		p = p[length:]
+	}
+}
+
+// hoppingPacketConn is the client side: it rewrites the destination port
+// of every write and reports every reply as coming from the canonical
+// remote address so KCP keeps accepting it
+type hoppingPacketConn struct {
+	*net.UDPConn
+	remote    *net.UDPAddr
+	ports     []int
+	opts      PortHopOptions
+	loss      *lossMeter
+	current   atomic.Pointer[net.UDPAddr]
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func newHoppingPacketConn(conn *net.UDPConn, remote *net.UDPAddr, opts PortHopOptions, loss *lossMeter) *hoppingPacketConn {
+	c := &hoppingPacketConn{
+		UDPConn: conn,
+		remote:  remote,
+		ports:   opts.Ports,
+		opts:    opts,
+		loss:    loss,
+		die:     make(chan struct{}),
+	}
+	c.hop()
+	if opts.Interval > 0 || opts.LossThreshold > 0 {
+		go c.monitor()
+	}
+	return c
+}
+
+// hop switches to a random port different from the current one
+func (c *hoppingPacketConn) hop() {
+	port := c.ports[rand.Intn(len(c.ports))]
+	if cur := c.current.Load(); cur != nil && len(c.ports) > 1 {
+		for port == cur.Port {
+			port = c.ports[rand.Intn(len(c.ports))]
+		}
+	}
+	c.current.Store(&net.UDPAddr{IP: c.remote.IP, Port: port, Zone: c.remote.Zone})
+}
+
+// monitor hops on schedule and when the session's retransmit ratio over
+// the last second exceeds the threshold
+func (c *hoppingPacketConn) monitor() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastHop := time.Now()
+	var lastOut, lastRetrans uint64
+	for {
+		select {
+		case <-c.die:
+			return
+		case <-ticker.C:
+		}
+
+		var out, retrans uint64
+		if c.loss != nil {
+			nowOut, nowRetrans := c.loss.out.Load(), c.loss.retrans.Load()
+			out, retrans = nowOut-lastOut, nowRetrans-lastRetrans
+			lastOut, lastRetrans = nowOut, nowRetrans
+		}
+
+		switch {
+		case c.opts.Interval > 0 && time.Since(lastHop) >= c.opts.Interval:
+		case c.opts.LossThreshold > 0 && out >= 20 && float64(retrans)/float64(out) >= c.opts.LossThreshold:
+		default:
+			continue
+		}
+		c.hop()
+		lastHop = time.Now()
+	}
+}
+
+func (c *hoppingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.UDPConn.WriteTo(p, c.current.Load())
+}
+
+func (c *hoppingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(p)
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && udpAddr.IP.Equal(c.remote.IP) {
+		addr = c.remote
+	}
+	return n, addr, err
+}
+
+func (c *hoppingPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.die) })
+	return c.UDPConn.Close()
+}
+
+// portRouteIdle is how long the server remembers the socket of a peer
+// that sends nothing; smux keepalives refresh live sessions long before
+const portRouteIdle = 5 * time.Minute
+
+// multiPortPacketConn is the server side: one socket per port merged into a
+// single PacketConn. Replies leave through the socket the peer last used.
+type multiPortPacketConn struct {
+	conns     []*net.UDPConn
+	packets   chan udpDatagram
+	mu        sync.Mutex
+	routes    map[string]portRoute
+	lastSweep time.Time
+	die       chan struct{}
+	closeOnce sync.Once
+	readErr   atomic.Value
+}
+
+type portRoute struct {
+	conn *net.UDPConn
+	seen time.Time
+}
+
+type udpDatagram struct {
+	data []byte
+	addr net.Addr
+	conn *net.UDPConn
+}
+
+// listenMultiPort opens a UDP socket on host for every port
+func listenMultiPort(network, host string, ports []int, profile *KCPProfile) (*multiPortPacketConn, error) {
+	m := &multiPortPacketConn{
+		packets: make(chan udpDatagram, 1024),
+		routes:  make(map[string]portRoute),
+		die:     make(chan struct{}),
+	}
+	for _, port := range ports {
+		addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		conn, err := net.ListenUDP(network, addr)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+		}
+		profile.applySocket(conn)
+		m.conns = append(m.conns, conn)
+	}
+	for _, conn := range m.conns {
+		go m.readLoop(conn)
+	}
+	return m, nil
+}
+
+func (m *multiPortPacketConn) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, udpObfsMaxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			m.readErr.Store(err)
+			m.Close()
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case m.packets <- udpDatagram{data: data, addr: addr, conn: conn}:
+		case <-m.die:
+			return
+		default:
+			// Drop like a full socket buffer would
+		}
+	}
+}
+
+func (m *multiPortPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-m.packets:
+		now := time.Now()
+		m.mu.Lock()
+		m.routes[pkt.addr.String()] = portRoute{conn: pkt.conn, seen: now}
+		if now.Sub(m.lastSweep) >= portRouteIdle {
+			m.sweep(now)
+		}
+		m.mu.Unlock()
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-m.die:
+		if err, ok := m.readErr.Load().(error); ok {
+			return 0, nil, err
+		}
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// sweep forgets the peers idle for portRouteIdle, so the table doesn't
+// grow with every address that ever sent a packet. Called with mu held.
+func (m *multiPortPacketConn) sweep(now time.Time) {
+	for addr, route := range m.routes {
+		if now.Sub(route.seen) >= portRouteIdle {
+			delete(m.routes, addr)
+		}
+	}
+	m.lastSweep = now
+}
+
+func (m *multiPortPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	m.mu.Lock()
+	conn := m.routes[addr.String()].conn
+	m.mu.Unlock()
+	if conn == nil {
+		conn = m.conns[0]
+	}
+	return conn.WriteTo(p, addr)
+}
+
+func (m *multiPortPacketConn) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.die)
+		for _, conn := range m.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+func (m *multiPortPacketConn) LocalAddr() net.Addr {
+	return m.conns[0].LocalAddr()
+}
+
+func (m *multiPortPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (m *multiPortPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *multiPortPacketConn) SetWriteDeadline(t time.Time) error { return nil }
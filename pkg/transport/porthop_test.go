@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{"443", []int{443}, false},
+		{"20000-20003", []int{20000, 20001, 20002, 20003}, false},
+		{"443, 8443,20000-20001", []int{443, 8443, 20000, 20001}, false},
+		{"443,443-444", []int{443, 444}, false},
+		{"", nil, true},
+		{"0-10", nil, true},
+		{"10-5", nil, true},
+		{"65535-65536", nil, true},
+		{"http", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortRange(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePortRange(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// kcpPacket builds the plaintext kcp-go hands to the block cipher: crypt
+// header, optional FEC data header, then one segment per sn
+func kcpPacket(fec bool, cmd byte, sns ...uint32) []byte {
+	p := make([]byte, 20)
+	if fec {
+		hdr := make([]byte, 8)
+		binary.LittleEndian.PutUint16(hdr[4:], fecTypeData)
+		p = append(p, hdr...)
+	}
+	for _, sn := range sns {
+		seg := make([]byte, kcp.IKCP_OVERHEAD+3)
+		seg[4] = cmd
+		binary.LittleEndian.PutUint32(seg[12:], sn)
+		binary.LittleEndian.PutUint32(seg[20:], 3)
+		p = append(p, seg...)
+	}
+	return p
+}
+
+func TestLossMeterCountsRetransmissions(t *testing.T) {
+	for _, fec := range []bool{false, true} {
+		block, _ := kcp.NewNoneBlockCrypt(make([]byte, 32))
+		shards := 0
+		if fec {
+			shards = 3
+		}
+		m := newLossMeter(block, shards, shards)
+
+		send := func(p []byte) { m.Encrypt(p, p) }
+		send(kcpPacket(fec, kcp.IKCP_CMD_PUSH, 0, 1, 2))
+		send(kcpPacket(fec, kcp.IKCP_CMD_ACK, 0, 1)) // acks aren't data
+		send(kcpPacket(fec, kcp.IKCP_CMD_PUSH, 1))   // retransmitted
+		send(kcpPacket(fec, kcp.IKCP_CMD_PUSH, 3, 2))
+		short := kcpPacket(fec, kcp.IKCP_CMD_PUSH, 9)
+		send(short[:len(short)-kcp.IKCP_OVERHEAD]) // truncated
+
+		if out, retrans := m.out.Load(), m.retrans.Load(); out != 6 || retrans != 2 {
+			t.Errorf("fec=%v: out=%d retrans=%d, want 6 and 2", fec, out, retrans)
+		}
+	}
+}
+
+func TestLossMeterSkipsParity(t *testing.T) {
+	block, _ := kcp.NewNoneBlockCrypt(make([]byte, 32))
+	m := newLossMeter(block, 10, 3)
+	p := kcpPacket(true, kcp.IKCP_CMD_PUSH, 1)
+	binary.LittleEndian.PutUint16(p[24:], 0xf2)
+	m.Encrypt(p, p)
+	if out := m.out.Load(); out != 0 {
+		t.Errorf("parity shard counted as %d segments", out)
+	}
+}
+
+func TestMultiPortRoutesExpire(t *testing.T) {
+	ports := freeUDPPorts(t, 2)
+	m, err := listenMultiPort("udp4", "127.0.0.1", ports, &KCPProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// The reply leaves through the port the peer wrote to last
+	for _, port := range ports {
+		if _, err := peer.WriteTo([]byte("hi"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		_, addr, err := m.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.WriteTo([]byte("ok"), addr); err != nil {
+			t.Fatal(err)
+		}
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, from, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := from.(*net.UDPAddr).Port; got != port {
+			t.Errorf("reply came from port %d, want %d", got, port)
+		}
+	}
+
+	m.mu.Lock()
+	if len(m.routes) != 1 {
+		t.Errorf("%d routes, want 1", len(m.routes))
+	}
+	m.sweep(time.Now().Add(portRouteIdle))
+	if len(m.routes) != 0 {
+		t.Errorf("%d routes left after the idle timeout, want 0", len(m.routes))
+	}
+	m.mu.Unlock()
+}
+
+func TestPortHoppingLocalhost(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hops once a second")
+	}
+	ports := freeUDPPorts(t, 3)
+	opts := PortHopOptions{Ports: ports, Interval: time.Second}
+	newTransport := func() *KCPTransport {
+		tr, err := NewKCPTransport("test-key", "test-salt", KCPCryptAES, KCPProfile{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.EnablePortHopping(opts); err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+
+	ln, err := newTransport().Listen(net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := newTransport().Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hopping := conn.(*KCPConnection).conn.(*hoppingPacketConn)
+
+	used := map[int]bool{}
+	deadline := time.Now().Add(3500 * time.Millisecond)
+	for i := 0; time.Now().Before(deadline); i++ {
+		used[hopping.current.Load().Port] = true
+		msg := []byte("ping " + strconv.Itoa(i))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("echo %d: %v", i, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("echo %d = %q, want %q", i, buf, msg)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(used) < 2 {
+		t.Errorf("used ports %v, want at least 2", used)
+	}
+	// Every ping is one data segment, none lost on loopback
+	if out := hopping.loss.out.Load(); out < 10 {
+		t.Errorf("loss meter saw %d data segments, want one per ping", out)
+	}
+}
+
+// freeUDPPorts returns n ports that were free a moment ago
+func freeUDPPorts(t *testing.T, n int) []int {
+	t.Helper()
+	var conns []net.PacketConn
+	var ports []int
+	for i := 0; i < n; i++ {
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+		ports = append(ports, c.LocalAddr().(*net.UDPAddr).Port)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	return ports
+}
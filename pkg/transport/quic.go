@@ -0,0 +1,296 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	xtls "github.com/abbasnazari-0/xp-proto/pkg/tls"
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUICTransport disguises KCP as QUIC v1
+//
+// The client opens every flow with a real, correctly protected QUIC Initial
+// carrying a TLS ClientHello, so a DPI box that decrypts Initials (the keys
+// are public) reads the configured SNI. The server answers with an Initial
+// of its own. All KCP segments then travel in short-header packets produced
+// by UDPObfuscator's QUIC mimicry, carrying the connection IDs the Initials
+// announced: the client's Initial DCID towards the server, which the server
+// also takes as its SCID, and the client's SCID towards the client.
+type QUICTransport struct {
+	*KCPTransport
+	sni string
+}
+
+// quicInitialSaltV1 is the RFC 9001 initial salt for QUIC version 1
+var quicInitialSaltV1 = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+const (
+	quicVersion1       = 0x00000001
+	quicConnIDLen      = 8
+	quicPacketNumLen   = 4
+	quicMinInitialSize = 1200
+)
+
+// NewQUICTransport creates a QUIC-disguised transport.
+// sni is only used by the dialing side.
+func NewQUICTransport(key, salt, crypt, sni string, profile KCPProfile, maxPadding int) (*QUICTransport, error) {
+	if sni == "" {
+		sni = "www.google.com"
+	}
+	kt, err := NewKCPTransport(key, salt, crypt, profile, &UDPObfsOptions{
+		Mimic:      MimicQUIC,
+		MaxPadding: maxPadding,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &QUICTransport{KCPTransport: kt, sni: sni}
+	kt.packetFilter = t.wrapConn
+	return t, nil
+}
+
+// wrapConn installs the QUIC handshake mimicry under the obfuscator
+func (t *QUICTransport) wrapConn(conn net.PacketConn, dialer bool) net.PacketConn {
+	return &quicPacketConn{
+		PacketConn: conn,
+		sni:        t.sni,
+		dialer:     dialer,
+		peers:      make(map[string][]byte),
+	}
+}
+
+// quicPacketConn sends a QUIC Initial before the first packet to each peer
+// (dial side) and answers Initials (listen side). Other long-header packets
+// are dropped, and short headers get the peer's connection ID.
+type quicPacketConn struct {
+	net.PacketConn
+	sni    string
+	dialer bool
+	mu     sync.Mutex
+	// peers holds the DCID of short-header packets to each address
+	peers map[string][]byte
+}
+
+func (c *quicPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		// Long header packets are handshake decoys, not KCP
+		if n > 0 && p[0]&0x80 != 0 {
+			if !c.dialer {
+				c.answerInitial(p[:n], addr)
+			}
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// answerInitial replies to a client Initial with a server Initial that
+// acknowledges it, and remembers the client's SCID for short headers
+func (c *quicPacketConn) answerInitial(p []byte, addr net.Addr) {
+	dcid, scid, ok := parseQUICInitial(p)
+	if !ok {
+		return
+	}
+	reply, err := sealQUICInitial(scid, dcid, quicAckFrame, true)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.peers[addr.String()] = scid
+	c.mu.Unlock()
+	c.PacketConn.WriteTo(reply, addr)
+}
+
+// WriteTo sends p, which the obfuscator built with a QUIC short header, so
+// the DCID in it may be replaced in place
+func (c *quicPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	cid, known := c.peers[addr.String()]
+	if !known && c.dialer {
+		dcid := make([]byte, quicConnIDLen)
+		scid := make([]byte, quicConnIDLen)
+		rand.Read(dcid)
+		rand.Read(scid)
+		initial, err := buildQUICInitial(dcid, scid, c.sni)
+		if err != nil {
+			c.mu.Unlock()
+			return 0, fmt.Errorf("failed to build QUIC Initial: %w", err)
+		}
+		cid = dcid
+		c.peers[addr.String()] = cid
+		c.mu.Unlock()
+		if _, err := c.PacketConn.WriteTo(initial, addr); err != nil {
+			return 0, err
+		}
+	} else {
+		c.mu.Unlock()
+	}
+	if cid != nil && len(p) > quicConnIDLen && p[0]&0x80 == 0 {
+		copy(p[1:1+quicConnIDLen], cid)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// quicAckFrame acknowledges packet number 0: ACK, largest 0, delay 0,
+// no extra ranges, first range 0
+var quicAckFrame = []byte{0x02, 0x00, 0x00, 0x00, 0x00}
+
+// buildQUICInitial builds a client Initial packet (RFC 9000 17.2.2) with a
+// CRYPTO frame holding a ClientHello for sni, padded to 1200 bytes
+func buildQUICInitial(dcid, scid []byte, sni string) ([]byte, error) {
+	hello := xtls.NewQUICClientHelloBuilder(sni, scid).HandshakeMessage()
+	payload := []byte{0x06, 0x00} // CRYPTO, offset 0
+	payload = appendQUICVarint(payload, uint64(len(hello)))
+	payload = append(payload, hello...)
+
+	headerLen := quicInitialHeaderLen(dcid, scid)
+	if minPayload := quicMinInitialSize - headerLen - 16; len(payload) < minPayload {
+		payload = append(payload, make([]byte, minPayload-len(payload))...)
+	}
+	return sealQUICInitial(dcid, scid, payload, false)
+}
+
+// quicInitialHeaderLen is the size of an Initial header without a token,
+// with a 2 byte length and a 4 byte packet number
+func quicInitialHeaderLen(dcid, scid []byte) int {
+	return 1 + 4 + 1 + len(dcid) + 1 + len(scid) + 1 + 2 + quicPacketNumLen
+}
+
+// sealQUICInitial builds Initial packet number 0 around payload, with
+// packet protection applied per RFC 9001 5. The keys derive from the DCID
+// of the client's first Initial, which is dcid for the client and scid
+// for the server.
+func sealQUICInitial(dcid, scid, payload []byte, server bool) ([]byte, error) {
+	headerLen := quicInitialHeaderLen(dcid, scid)
+	header := make([]byte, 0, headerLen)
+	header = append(header, 0xc0|byte(quicPacketNumLen-1)) // long header, Initial
+	header = binary.BigEndian.AppendUint32(header, quicVersion1)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, byte(len(scid)))
+	header = append(header, scid...)
+	header = append(header, 0x00) // token length
+	header = binary.BigEndian.AppendUint16(header, 0x4000|uint16(quicPacketNumLen+len(payload)+16))
+	pnOffset := len(header)
+	header = append(header, 0, 0, 0, 0) // packet number 0
+
+	secretCID := dcid
+	if server {
+		secretCID = scid
+	}
+	key, iv, hp, err := quicInitialKeys(secretCID, server)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// Packet number is 0, so the nonce is the IV itself
+	packet := aead.Seal(header, iv, payload, header)
+
+	// Header protection
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	sampleOffset := pnOffset + 4
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[sampleOffset:sampleOffset+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < quicPacketNumLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet, nil
+}
+
+// parseQUICInitial returns the connection IDs of a QUIC v1 Initial, which
+// header protection leaves in the clear
+func parseQUICInitial(p []byte) (dcid, scid []byte, ok bool) {
+	if len(p) < 7 || p[0]&0xf0 != 0xc0 || binary.BigEndian.Uint32(p[1:5]) != quicVersion1 {
+		return nil, nil, false
+	}
+	n := int(p[5])
+	if n > 20 || len(p) < 6+n+1 {
+		return nil, nil, false
+	}
+	dcid = p[6 : 6+n]
+	rest := p[6+n:]
+	m := int(rest[0])
+	if m > 20 || len(rest) < 1+m {
+		return nil, nil, false
+	}
+	return append([]byte(nil), dcid...), append([]byte(nil), rest[1:1+m]...), true
+}
+
+// quicInitialKeys derives the Initial key, IV and header protection key of
+// the client or the server from the client's first DCID
+func quicInitialKeys(dcid []byte, server bool) (key, iv, hp []byte, err error) {
+	label := "client in"
+	if server {
+		label = "server in"
+	}
+	initialSecret := hkdf.Extract(sha256.New, dcid, quicInitialSaltV1)
+	secret, err := hkdfExpandLabel(initialSecret, label, 32)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = hkdfExpandLabel(secret, "quic key", 16); err != nil {
+		return nil, nil, nil, err
+	}
+	if iv, err = hkdfExpandLabel(secret, "quic iv", 12); err != nil {
+		return nil, nil, nil, err
+	}
+	if hp, err = hkdfExpandLabel(secret, "quic hp", 16); err != nil {
+		return nil, nil, nil, err
+	}
+	return key, iv, hp, nil
+}
+
+// hkdfExpandLabel implements TLS 1.3 HKDF-Expand-Label with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// appendQUICVarint appends a QUIC variable-length integer (RFC 9000 16)
+func appendQUICVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, 0x4000|uint16(v))
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, 0x80000000|uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(b, 0xc000000000000000|v)
+	}
+}
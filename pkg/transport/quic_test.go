@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQUICInitialKeys(t *testing.T) {
+	// RFC 9001 Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	tests := []struct {
+		server      bool
+		key, iv, hp string
+	}{
+		{false, "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{true, "cf3a5331653c364c88f0f379b6067e37", "0ac1493ca1905853b0bba03e", "c206b8d9b9f0f37644430b490eeaa314"},
+	}
+	for _, tt := range tests {
+		key, iv, hp, err := quicInitialKeys(dcid, tt.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != tt.key || hex.EncodeToString(iv) != tt.iv || hex.EncodeToString(hp) != tt.hp {
+			t.Errorf("server %v: key %x iv %x hp %x", tt.server, key, iv, hp)
+		}
+	}
+}
+
+// openQUICInitial removes the protection of an Initial as an observer
+// would, with the public keys of the side that sent it
+func openQUICInitial(t *testing.T, packet []byte, server bool) (dcid, scid, payload []byte) {
+	t.Helper()
+	dcid, scid, ok := parseQUICInitial(packet)
+	if !ok {
+		t.Fatalf("not a QUIC Initial: % x", packet[:8])
+	}
+	p := append([]byte(nil), packet...)
+	off := 6 + len(dcid) + 1 + len(scid)
+	if p[off] != 0 {
+		t.Fatalf("token length %d", p[off])
+	}
+	off++
+	length := int(binary.BigEndian.Uint16(p[off:]) & 0x3fff)
+	pnOffset := off + 2
+	if pnOffset+length != len(p) {
+		t.Fatalf("length field %d, packet has %d bytes after it", length, len(p)-pnOffset)
+	}
+
+	secretCID := dcid
+	if server {
+		secretCID = scid
+	}
+	key, iv, hp, err := quicInitialKeys(secretCID, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpBlock, _ := aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, p[pnOffset+4:pnOffset+4+aes.BlockSize])
+	p[0] ^= mask[0] & 0x0f
+	pnLen := int(p[0]&0x03) + 1
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < pnLen; i++ {
+		p[pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-pnLen+i] ^= p[pnOffset+i]
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	hdr := p[:pnOffset+pnLen]
+	payload, err = aead.Open(nil, nonce, p[len(hdr):], hdr)
+	if err != nil {
+		t.Fatalf("decrypting the Initial: %v", err)
+	}
+	return dcid, scid, payload
+}
+
+func TestBuildQUICInitial(t *testing.T) {
+	dcid, scid := []byte("dcid0001"), []byte("scid0001")
+	packet, err := buildQUICInitial(dcid, scid, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) < quicMinInitialSize {
+		t.Errorf("Initial is %d bytes, want at least %d", len(packet), quicMinInitialSize)
+	}
+	gotD, gotS, payload := openQUICInitial(t, packet, false)
+	if !bytes.Equal(gotD, dcid) || !bytes.Equal(gotS, scid) {
+		t.Errorf("connection IDs %q %q", gotD, gotS)
+	}
+	// CRYPTO frame at offset 0 holding a ClientHello with the SNI
+	if payload[0] != 0x06 || payload[1] != 0x00 {
+		t.Fatalf("payload starts with % x, want a CRYPTO frame", payload[:2])
+	}
+	helloLen := int(binary.BigEndian.Uint16(payload[2:4]) & 0x3fff)
+	hello := payload[4 : 4+helloLen]
+	if hello[0] != 0x01 {
+		t.Errorf("handshake type %d, want ClientHello", hello[0])
+	}
+	if !bytes.Contains(hello, []byte("www.example.com")) {
+		t.Error("ClientHello lacks the SNI")
+	}
+	for _, b := range payload[4+helloLen:] {
+		if b != 0 {
+			t.Fatal("padding is not PADDING frames")
+		}
+	}
+}
+
+// recordConn keeps a copy of every packet written through it
+type recordConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (c *recordConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sent = append(c.sent, append([]byte(nil), p...))
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *recordConn) packets() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sent
+}
+
+func TestQUICPacketConnIDs(t *testing.T) {
+	qt, err := NewQUICTransport("secret", "", "", "www.example.com", KCPProfile{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := func() *recordConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return &recordConn{PacketConn: conn}
+	}
+	clientWire, serverWire := udp(), udp()
+	client, err := qt.wrapPacketConn(clientWire, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qt.wrapPacketConn(serverWire, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	for i := 0; i < 2; i++ {
+		if _, err := client.WriteTo([]byte("ping"), serverWire.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := server.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("server read %q %v", buf[:n], err)
+		}
+		if _, err := server.WriteTo([]byte("pong"), from); err != nil {
+			t.Fatal(err)
+		}
+		if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("client read %q %v", buf[:n], err)
+		}
+	}
+
+	// The client sent one Initial, then short headers to its DCID
+	sent := clientWire.packets()
+	if len(sent) != 3 {
+		t.Fatalf("client sent %d packets, want 3", len(sent))
+	}
+	dcid, scid, _ := openQUICInitial(t, sent[0], false)
+	for _, p := range sent[1:] {
+		if p[0]&0xc0 != 0x40 || !bytes.Equal(p[1:1+quicConnIDLen], dcid) {
+			t.Errorf("client short header % x, want DCID % x", p[:1+quicConnIDLen], dcid)
+		}
+	}
+
+	// The server answered with an Initial back to the client's SCID, then
+	// short headers to the same
+	sent = serverWire.packets()
+	if len(sent) != 3 {
+		t.Fatalf("server sent %d packets, want 3", len(sent))
+	}
+	replyD, replyS, payload := openQUICInitial(t, sent[0], true)
+	if !bytes.Equal(replyD, scid) || !bytes.Equal(replyS, dcid) {
+		t.Errorf("server Initial IDs % x % x, want % x % x", replyD, replyS, scid, dcid)
+	}
+	if !bytes.Equal(payload, quicAckFrame) {
+		t.Errorf("server Initial payload % x", payload)
+	}
+	for _, p := range sent[1:] {
+		if p[0]&0xc0 != 0x40 || !bytes.Equal(p[1:1+quicConnIDLen], scid) {
+			t.Errorf("server short header % x, want DCID % x", p[:1+quicConnIDLen], scid)
+		}
+	}
+}
@@ -98,7 +98,7 @@ func (t *RawTransport) Dial(address string) (Connection, error) {
 		return nil, err
 	}
 
-	// Resolve remote IP - Force IPv4 only (IPv6 doesn't work in Iran)
+	// Resolve remote IP - raw packets are built as IPv4 whatever ip_strategy says
 	ips, err := net.LookupIP(host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
@@ -409,12 +409,12 @@ func (c *RawConnection) RemoteAddr() string {
 // Accept accepts a connection
 func (l *RawListener) Accept() (Connection, error) {
 	if l.closed {
-		return nil, fmt.Errorf("listener closed")
+		return nil, net.ErrClosed
 	}
 
 	conn, ok := <-l.acceptCh
 	if !ok {
-		return nil, fmt.Errorf("listener closed")
+		return nil, net.ErrClosed
 	}
 
 	return conn, nil
@@ -1,8 +1,9 @@
 package transport
 
 import (
-	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
@@ -13,22 +14,20 @@ import (
 	"github.com/google/gopacket/pcap"
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 // RawKCPTransport combines raw packets with KCP for ultimate stealth
 // This bypasses the OS TCP/UDP stack entirely while providing reliable transport
 type RawKCPTransport struct {
-	handle       *pcap.Handle
-	iface        string
-	localIP      net.IP
-	localMAC     net.HardwareAddr
-	routerMAC    net.HardwareAddr
-	key          []byte
-	dataShards   int
-	parityShards int
-	mu           sync.Mutex
-	fakeConn     *FakeUDPConn
+	handle    *pcap.Handle
+	iface     string
+	localIP   net.IP
+	localMAC  net.HardwareAddr
+	routerMAC net.HardwareAddr
+	block     kcp.BlockCrypt
+	profile   KCPProfile
+	mu        sync.Mutex
+	fakeConn  *FakeUDPConn
 }
 
 // FakeUDPConn implements net.PacketConn over raw packets
@@ -63,7 +62,13 @@ type RawKCPListener struct {
 }
 
 // NewRawKCPTransport creates a raw packet transport with KCP
-func NewRawKCPTransport(iface, localIP, routerMAC string) (*RawKCPTransport, error) {
+func NewRawKCPTransport(iface, localIP, routerMAC, key, salt, crypt string, profile KCPProfile) (*RawKCPTransport, error) {
+	// Build packet cipher before touching the interface
+	block, err := newBlockCrypt(key, salt, crypt)
+	if err != nil {
+		return nil, err
+	}
+
 	// Open pcap handle
 	handle, err := pcap.OpenLive(iface, 65535, true, pcap.BlockForever)
 	if err != nil {
@@ -91,19 +96,14 @@ func NewRawKCPTransport(iface, localIP, routerMAC string) (*RawKCPTransport, err
 		return nil, fmt.Errorf("failed to get interface: %w", err)
 	}
 
-	// Generate encryption key
-	salt := []byte("xp-protocol-raw-kcp")
-	key := pbkdf2.Key([]byte("xp-proto"), salt, 4096, 32, sha256.New)
-
 	t := &RawKCPTransport{
-		handle:       handle,
-		iface:        iface,
-		localIP:      lip.To4(),
-		localMAC:     ifi.HardwareAddr,
-		routerMAC:    rmac,
-		key:          key,
-		dataShards:   10,
-		parityShards: 3,
+		handle:    handle,
+		iface:     iface,
+		localIP:   lip.To4(),
+		localMAC:  ifi.HardwareAddr,
+		routerMAC: rmac,
+		block:     block,
+		profile:   profile.withDefaults(),
 	}
 
 	return t, nil
@@ -145,31 +145,16 @@ func (t *RawKCPTransport) Dial(address string) (Connection, error) {
 	go t.receivePackets()
 
 	// Create KCP connection over fake UDP
-	block, err := kcp.NewAESBlockCrypt(t.key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create block crypt: %w", err)
-	}
-
-	kcpConn, err := kcp.NewConn2(fakeConn.remoteAddr, block, t.dataShards, t.parityShards, fakeConn)
+	kcpConn, err := kcp.NewConn2(fakeConn.remoteAddr, t.block, t.profile.DataShards, t.profile.ParityShards, fakeConn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create KCP connection: %w", err)
 	}
 
 	// Tune KCP
-	kcpConn.SetReadBuffer(4 * 1024 * 1024)
-	kcpConn.SetWriteBuffer(4 * 1024 * 1024)
-	kcpConn.SetNoDelay(1, 20, 2, 1)
-	kcpConn.SetWindowSize(1024, 1024)
-	kcpConn.SetMtu(1350)
-	kcpConn.SetACKNoDelay(true)
-	kcpConn.SetStreamMode(true)
+	t.profile.apply(kcpConn)
 
 	// Create smux session
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveInterval = 10 * time.Second
-
-	session, err := smux.Client(kcpConn, smuxConfig)
+	session, err := smux.Client(kcpConn, t.profile.smuxConfig())
 	if err != nil {
 		kcpConn.Close()
 		return nil, fmt.Errorf("failed to create smux session: %w", err)
@@ -213,12 +198,7 @@ func (t *RawKCPTransport) Listen(address string) (Listener, error) {
 	go t.receivePackets()
 
 	// Create KCP listener over fake UDP
-	block, err := kcp.NewAESBlockCrypt(t.key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create block crypt: %w", err)
-	}
-
-	listener, err := kcp.ServeConn(block, t.dataShards, t.parityShards, fakeConn)
+	listener, err := kcp.ServeConn(t.block, t.profile.DataShards, t.profile.ParityShards, fakeConn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create KCP listener: %w", err)
 	}
@@ -400,25 +380,18 @@ func (c *RawKCPConnection) RemoteAddr() string {
 
 func (l *RawKCPListener) Accept() (Connection, error) {
 	conn, err := l.listener.AcceptKCP()
+	if errors.Is(err, io.ErrClosedPipe) {
+		return nil, net.ErrClosed
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Tune KCP
-	conn.SetReadBuffer(4 * 1024 * 1024)
-	conn.SetWriteBuffer(4 * 1024 * 1024)
-	conn.SetNoDelay(1, 20, 2, 1)
-	conn.SetWindowSize(1024, 1024)
-	conn.SetMtu(1350)
-	conn.SetACKNoDelay(true)
-	conn.SetStreamMode(true)
+	// Tune KCP with the same profile as the dialer
+	l.transport.profile.apply(conn)
 
 	// Create smux session
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveInterval = 10 * time.Second
-
-	session, err := smux.Server(conn, smuxConfig)
+	session, err := smux.Server(conn, l.transport.profile.smuxConfig())
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to create smux session: %w", err)
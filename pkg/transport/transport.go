@@ -4,46 +4,32 @@ import (
 	"fmt"
 	"io"
 	"net"
-)
-
-// ResolveIPv4 resolves a hostname to IPv4 address only
-// IPv6 doesn't work in Iran, so we force IPv4 everywhere
-func ResolveIPv4(host string) (string, error) {
-	// Check if already an IP
-	if ip := net.ParseIP(host); ip != nil {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			return ipv4.String(), nil
-		}
-		return "", fmt.Errorf("IPv6 address not supported: %s", host)
-	}
-
-	// Resolve hostname to IPv4 only
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
-	}
+	"time"
 
-	for _, ip := range ips {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			return ipv4.String(), nil
-		}
-	}
-	return "", fmt.Errorf("no IPv4 address found for %s", host)
-}
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+)
 
-// ResolveAddressIPv4 resolves host:port to IPv4 address
-func ResolveAddressIPv4(address string) (string, error) {
+// ResolveAddress resolves host:port to a single address of the family the
+// strategy allows, preferred family first
+func ResolveAddress(address string, strategy dns.Strategy) (string, error) {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return "", err
 	}
 
-	ipv4, err := ResolveIPv4(host)
-	if err != nil {
-		return "", err
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = net.LookupIP(host); err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
 	}
 
-	return net.JoinHostPort(ipv4, port), nil
+	ips = strategy.Sort(ips)
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no address for %s allowed by ip_strategy %s", host, strategy)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
 }
 
 // Transport defines the interface for all transport modes
@@ -63,7 +49,8 @@ type Connection interface {
 	RemoteAddr() string
 }
 
-// Listener listens for incoming connections
+// Listener listens for incoming connections. Accept returns net.ErrClosed
+// once the listener is closed.
 type Listener interface {
 	Accept() (Connection, error)
 	Close() error
@@ -74,22 +61,30 @@ type Listener interface {
 type Mode string
 
 const (
-	ModeTLS Mode = "tls"
-	ModeKCP Mode = "kcp"
-	ModeRaw Mode = "raw"
+	ModeTLS  Mode = "tls"
+	ModeKCP  Mode = "kcp"
+	ModeRaw  Mode = "raw"
+	ModeQUIC Mode = "quic"
 )
 
 // Config holds transport configuration
 type Config struct {
-	Mode         Mode
-	Interface    string   // For raw mode
-	LocalIP      string   // For raw mode
-	RouterMAC    string   // For raw mode
-	TCPFlags     []string // For raw mode
-	UseKCP       bool     // Use KCP over raw
-	KCPMode      string   // KCP mode: normal, fast, fast2, fast3
-	DataShards   int      // Reed-Solomon data shards
-	ParityShards int      // Reed-Solomon parity shards
+	Mode      Mode
+	Interface string          // For raw mode
+	LocalIP   string          // For raw mode
+	RouterMAC string          // For raw mode
+	TCPFlags  []string        // For raw mode
+	UseKCP    bool            // Use KCP over raw
+	KCP       KCPProfile      // KCP/smux tuning, shared by kcp and raw+kcp
+	UDPObfs   *UDPObfsOptions // KCP over UDP packet obfuscation, nil = off
+	Key       string          // KCP passphrase (required for kcp and raw+kcp)
+	Salt      string          // KCP key derivation salt
+	Crypt     string          // KCP block cipher: aes, salsa20, none
+	SNI       string          // For quic mode: server name in the Initial
+	PortHop   *PortHopOptions // For kcp/quic: UDP port hopping, nil = off
+	// IPStrategy selects the IP family for dials and listeners; empty is
+	// IPv4 only. Raw mode always builds IPv4 packets.
+	IPStrategy dns.Strategy
 }
 
 // NetConnWrapper wraps net.Conn to implement Connection interface
@@ -123,15 +118,16 @@ func (w *NetListenerWrapper) Addr() string {
 }
 
 // TCPTransport implements standard TCP transport (for testing/fallback)
-type TCPTransport struct{}
+type TCPTransport struct {
+	strategy dns.Strategy
+}
 
-func NewTCPTransport() *TCPTransport {
-	return &TCPTransport{}
+func NewTCPTransport(strategy dns.Strategy) *TCPTransport {
+	return &TCPTransport{strategy: strategy}
 }
 
 func (t *TCPTransport) Dial(address string) (Connection, error) {
-	// Force IPv4 - IPv6 doesn't work in Iran
-	conn, err := net.Dial("tcp4", address)
+	conn, err := net.Dial(t.strategy.Network("tcp"), address)
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +135,7 @@ func (t *TCPTransport) Dial(address string) (Connection, error) {
 }
 
 func (t *TCPTransport) Listen(address string) (Listener, error) {
-	// Force IPv4 - IPv6 doesn't work in Iran
-	listener, err := net.Listen("tcp4", address)
+	listener, err := net.Listen(t.strategy.Network("tcp"), address)
 	if err != nil {
 		return nil, err
 	}
@@ -156,12 +151,145 @@ func NewTransport(cfg *Config) (Transport, error) {
 	switch cfg.Mode {
 	case ModeRaw:
 		if cfg.UseKCP {
-			return NewRawKCPTransport(cfg.Interface, cfg.LocalIP, cfg.RouterMAC)
+			return NewRawKCPTransport(cfg.Interface, cfg.LocalIP, cfg.RouterMAC, cfg.Key, cfg.Salt, cfg.Crypt, cfg.KCP)
 		}
 		return NewRawTransport(cfg.Interface, cfg.LocalIP, cfg.RouterMAC)
 	case ModeKCP:
-		return NewKCPTransport("", cfg.KCPMode, cfg.DataShards, cfg.ParityShards)
+		t, err := NewKCPTransport(cfg.Key, cfg.Salt, cfg.Crypt, cfg.KCP, cfg.UDPObfs)
+		if err != nil {
+			return nil, err
+		}
+		t.SetIPStrategy(cfg.IPStrategy)
+		if cfg.PortHop != nil {
+			if err := t.EnablePortHopping(*cfg.PortHop); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	case ModeQUIC:
+		maxPadding := defaultMaxPadding
+		if cfg.UDPObfs != nil {
+			maxPadding = cfg.UDPObfs.MaxPadding
+		}
+		t, err := NewQUICTransport(cfg.Key, cfg.Salt, cfg.Crypt, cfg.SNI, cfg.KCP, maxPadding)
+		if err != nil {
+			return nil, err
+		}
+		t.SetIPStrategy(cfg.IPStrategy)
+		if cfg.PortHop != nil {
+			if err := t.EnablePortHopping(*cfg.PortHop); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
 	default:
-		return NewTCPTransport(), nil
+		return NewTCPTransport(cfg.IPStrategy), nil
 	}
 }
+
+// FromConfig builds a transport Config from the YAML transport section.
+// fallbackKey (the server or client tunnel key) is used for KCP encryption
+// when transport.kcp.key is not set.
+func FromConfig(tc config.TransportConfig, fallbackKey string) (*Config, error) {
+	key := tc.KCP.Key
+	if key == "" {
+		key = fallbackKey
+	}
+	var udpObfs *UDPObfsOptions
+	if tc.KCP.Obfs.Enabled {
+		udpObfs = &UDPObfsOptions{
+			Mimic:      tc.KCP.Obfs.Mimic,
+			MaxPadding: defaultMaxPadding,
+		}
+		if tc.KCP.Obfs.MaxPadding != nil {
+			udpObfs.MaxPadding = *tc.KCP.Obfs.MaxPadding
+		}
+	}
+	var portHop *PortHopOptions
+	if tc.KCP.PortHop.Ports != "" {
+		ports, err := ParsePortRange(tc.KCP.PortHop.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kcp.port_hopping.ports: %w", err)
+		}
+		portHop = &PortHopOptions{
+			Ports:         ports,
+			Interval:      time.Duration(tc.KCP.PortHop.Interval) * time.Second,
+			LossThreshold: tc.KCP.PortHop.LossThreshold,
+			Redirect:      tc.KCP.PortHop.Redirect,
+		}
+	}
+	return &Config{
+		Mode:      Mode(tc.Mode),
+		Interface: tc.Raw.Interface,
+		LocalIP:   tc.Raw.LocalIP,
+		RouterMAC: tc.Raw.RouterMAC,
+		TCPFlags:  tc.Raw.TCPFlags,
+		UseKCP:    tc.Raw.UseKCP,
+		KCP: KCPProfile{
+			Mode:             tc.KCP.Mode,
+			NoDelay:          tc.KCP.NoDelay,
+			Interval:         tc.KCP.Interval,
+			Resend:           tc.KCP.Resend,
+			NoCongestion:     tc.KCP.NoCongestion,
+			SndWnd:           tc.KCP.SndWnd,
+			RcvWnd:           tc.KCP.RcvWnd,
+			MTU:              tc.KCP.MTU,
+			ReadBuffer:       tc.KCP.SockBuf,
+			WriteBuffer:      tc.KCP.SockBuf,
+			KeepAlive:        time.Duration(tc.KCP.KeepAlive) * time.Second,
+			KeepAliveTimeout: time.Duration(tc.KCP.KeepAliveTimeout) * time.Second,
+			DSCP:             tc.KCP.DSCP,
+			DataShards:       tc.KCP.DataShards,
+			ParityShards:     tc.KCP.ParityShards,
+		},
+		UDPObfs: udpObfs,
+		Key:     key,
+		Salt:    tc.KCP.Salt,
+		Crypt:   tc.KCP.Crypt,
+		SNI:     tc.QUIC.SNI,
+		PortHop: portHop,
+	}, nil
+}
+
+// NetConn adapts a transport Connection to net.Conn so it can carry a tunnel
+func NetConn(c Connection) net.Conn {
+	if w, ok := c.(*NetConnWrapper); ok {
+		return w.Conn
+	}
+	return &connAdapter{c}
+}
+
+// connAdapter implements net.Conn on top of a Connection
+type connAdapter struct {
+	Connection
+}
+
+func (a *connAdapter) LocalAddr() net.Addr  { return stringAddr(a.Connection.LocalAddr()) }
+func (a *connAdapter) RemoteAddr() net.Addr { return stringAddr(a.Connection.RemoteAddr()) }
+
+func (a *connAdapter) SetDeadline(t time.Time) error {
+	if d, ok := a.Connection.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+func (a *connAdapter) SetReadDeadline(t time.Time) error {
+	if d, ok := a.Connection.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (a *connAdapter) SetWriteDeadline(t time.Time) error {
+	if d, ok := a.Connection.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// stringAddr is a net.Addr for transports that only report string addresses
+type stringAddr string
+
+func (a stringAddr) Network() string { return "xp" }
+func (a stringAddr) String() string  { return string(a) }
@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+func TestFromConfig(t *testing.T) {
+	tc := config.DefaultServerConfig().Transport
+	tc.Mode = "quic"
+	tc.KCP.Salt, tc.KCP.Crypt = "salt", KCPCryptSalsa20
+	tc.KCP.MTU, tc.KCP.SockBuf, tc.KCP.KeepAlive = 1200, 1<<20, 5
+	tc.QUIC.SNI = "www.example.com"
+	tc.KCP.PortHop.Ports = "20000-20002"
+	tc.KCP.PortHop.Interval = 30
+
+	c, err := FromConfig(tc, "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mode != ModeQUIC || c.Key != "fallback" || c.Salt != "salt" || c.Crypt != KCPCryptSalsa20 || c.SNI != "www.example.com" {
+		t.Errorf("config %+v", c)
+	}
+	if c.KCP.MTU != 1200 || c.KCP.ReadBuffer != 1<<20 || c.KCP.WriteBuffer != 1<<20 || c.KCP.KeepAlive != 5*time.Second {
+		t.Errorf("profile %+v", c.KCP)
+	}
+	if c.PortHop == nil || len(c.PortHop.Ports) != 3 || c.PortHop.Interval != 30*time.Second {
+		t.Errorf("port hopping %+v", c.PortHop)
+	}
+
+	// transport.kcp.key wins over the fallback
+	tc.KCP.Key = "kcp key"
+	if c, _ := FromConfig(tc, "fallback"); c.Key != "kcp key" {
+		t.Errorf("key %q, want transport.kcp.key", c.Key)
+	}
+
+	// UDP obfuscation pads 64 bytes unless max_padding says otherwise
+	tc.KCP.Obfs.Enabled, tc.KCP.Obfs.Mimic = false, MimicDTLS
+	if c, _ := FromConfig(tc, ""); c.UDPObfs != nil {
+		t.Errorf("obfuscation %+v while disabled", c.UDPObfs)
+	}
+	tc.KCP.Obfs.Enabled = true
+	if c, _ := FromConfig(tc, ""); c.UDPObfs == nil || c.UDPObfs.Mimic != MimicDTLS || c.UDPObfs.MaxPadding != defaultMaxPadding {
+		t.Errorf("obfuscation %+v, want dtls with %d bytes of padding", c.UDPObfs, defaultMaxPadding)
+	}
+	zero := 0
+	tc.KCP.Obfs.MaxPadding = &zero
+	if c, _ := FromConfig(tc, ""); c.UDPObfs.MaxPadding != 0 {
+		t.Errorf("max_padding 0 gave %d", c.UDPObfs.MaxPadding)
+	}
+
+	tc.KCP.PortHop.Ports = "20002-20000"
+	if _, err := FromConfig(tc, ""); err == nil {
+		t.Error("FromConfig accepted a reversed port range")
+	}
+}
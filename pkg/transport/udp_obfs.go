@@ -0,0 +1,253 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// UDP packet obfuscation for KCP
+//
+// Every datagram on the wire looks like:
+//
+//	[mimic header][nonce 12][ChaCha20(payload length 2 | payload | random padding)]
+//
+// The nonce is random per packet so identical KCP segments never produce
+// identical bytes, and the padding hides KCP's segment sizes. The optional
+// mimic header makes the flow parse as a well-known UDP protocol.
+
+// Header mimicry modes
+const (
+	MimicNone      = "none"
+	MimicQUIC      = "quic"
+	MimicDTLS      = "dtls"
+	MimicWireGuard = "wireguard"
+	MimicSRTP      = "srtp"
+)
+
+const (
+	udpObfsNonceSize  = chacha20.NonceSize
+	udpObfsMaxPacket  = 65535
+	defaultMaxPadding = 64
+)
+
+// UDPObfsOptions configures the UDP obfuscation layer
+type UDPObfsOptions struct {
+	Mimic      string // none, quic, dtls, wireguard, srtp
+	MaxPadding int    // upper bound of random padding per packet, 0 = none
+}
+
+// UDPObfuscator wraps a PacketConn and obfuscates every datagram
+type UDPObfuscator struct {
+	conn       net.PacketConn
+	key        []byte
+	mimic      string
+	headerLen  int
+	maxPadding int
+	connID     [8]byte // QUIC DCID, WireGuard receiver index, SRTP SSRC
+	seq        atomic.Uint64
+	bufPool    sync.Pool
+}
+
+// NewUDPObfuscator creates an obfuscating UDP wrapper.
+// key must be 32 bytes and identical on both sides.
+func NewUDPObfuscator(conn net.PacketConn, key []byte, opts UDPObfsOptions) (*UDPObfuscator, error) {
+	if len(key) != chacha20.KeySize {
+		return nil, fmt.Errorf("UDP obfuscation key must be %d bytes", chacha20.KeySize)
+	}
+	headerLen, err := mimicHeaderLen(opts.Mimic)
+	if err != nil {
+		return nil, err
+	}
+	maxPadding := opts.MaxPadding
+	if maxPadding < 0 {
+		return nil, fmt.Errorf("UDP padding must not be negative")
+	}
+
+	o := &UDPObfuscator{
+		conn:       conn,
+		key:        key,
+		mimic:      opts.Mimic,
+		headerLen:  headerLen,
+		maxPadding: maxPadding,
+	}
+	rand.Read(o.connID[:])
+	var seq [2]byte
+	rand.Read(seq[:])
+	o.seq.Store(uint64(binary.BigEndian.Uint16(seq[:])))
+	o.bufPool.New = func() any {
+		b := make([]byte, udpObfsMaxPacket)
+		return &b
+	}
+	return o, nil
+}
+
+// mimicHeaderLen returns the size of the fake protocol header
+func mimicHeaderLen(mimic string) (int, error) {
+	switch mimic {
+	case "", MimicNone:
+		return 0, nil
+	case MimicQUIC:
+		return 9, nil // flags + 8 byte DCID
+	case MimicDTLS:
+		return 13, nil // DTLS 1.2 record header
+	case MimicWireGuard:
+		return 16, nil // transport data message header
+	case MimicSRTP:
+		return 12, nil // RTP fixed header
+	default:
+		return 0, fmt.Errorf("unsupported UDP mimic: %s (use none, quic, dtls, wireguard or srtp)", mimic)
+	}
+}
+
+// ReadFrom reads and deobfuscates, silently dropping packets that don't decode
+func (o *UDPObfuscator) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	bufp := o.bufPool.Get().(*[]byte)
+	defer o.bufPool.Put(bufp)
+	buf := *bufp
+
+	for {
+		n, addr, err = o.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		body := buf[:n]
+		if len(body) < o.headerLen+udpObfsNonceSize+2 {
+			continue
+		}
+		body = body[o.headerLen:]
+		nonce := body[:udpObfsNonceSize]
+		body = body[udpObfsNonceSize:]
+
+		cipher, err := chacha20.NewUnauthenticatedCipher(o.key, nonce)
+		if err != nil {
+			continue
+		}
+		cipher.XORKeyStream(body, body)
+
+		payloadLen := int(binary.BigEndian.Uint16(body[:2]))
+		if payloadLen > len(body)-2 {
+			continue
+		}
+		return copy(p, body[2:2+payloadLen]), addr, nil
+	}
+}
+
+// WriteTo obfuscates and writes
+func (o *UDPObfuscator) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if len(p) > udpObfsMaxPacket-o.headerLen-udpObfsNonceSize-2-o.maxPadding {
+		return 0, fmt.Errorf("packet too large: %d", len(p))
+	}
+
+	padLen := randomPadding(o.maxPadding)
+	bodyLen := udpObfsNonceSize + 2 + len(p) + padLen
+	if o.mimic == MimicWireGuard {
+		// WireGuard data messages are 16 byte aligned after the header
+		if rem := bodyLen % 16; rem != 0 {
+			padLen += 16 - rem
+			bodyLen += 16 - rem
+		}
+	}
+
+	packet := make([]byte, o.headerLen+bodyLen)
+	o.writeHeader(packet[:o.headerLen], bodyLen)
+
+	body := packet[o.headerLen:]
+	nonce := body[:udpObfsNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	plain := body[udpObfsNonceSize:]
+	binary.BigEndian.PutUint16(plain[:2], uint16(len(p)))
+	copy(plain[2:], p)
+	rand.Read(plain[2+len(p):])
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(o.key, nonce)
+	if err != nil {
+		return 0, err
+	}
+	cipher.XORKeyStream(plain, plain)
+
+	if _, err := o.conn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeHeader fills in the mimicked protocol header
+func (o *UDPObfuscator) writeHeader(h []byte, bodyLen int) {
+	if len(h) == 0 {
+		return
+	}
+	seq := o.seq.Add(1)
+	switch o.mimic {
+	case MimicQUIC:
+		// Short header: fixed bit set, rest is header-protected noise
+		var b [1]byte
+		rand.Read(b[:])
+		h[0] = 0x40 | (b[0] & 0x3f)
+		copy(h[1:9], o.connID[:])
+	case MimicDTLS:
+		// Application data record, DTLS 1.2, epoch 1
+		h[0] = 0x17
+		h[1], h[2] = 0xfe, 0xfd
+		binary.BigEndian.PutUint16(h[3:5], 1)
+		var seqBuf [8]byte
+		binary.BigEndian.PutUint64(seqBuf[:], seq)
+		copy(h[5:11], seqBuf[2:])
+		binary.BigEndian.PutUint16(h[11:13], uint16(bodyLen))
+	case MimicWireGuard:
+		// Type 4 (transport data), receiver index, little-endian counter
+		h[0] = 0x04
+		copy(h[4:8], o.connID[:4])
+		binary.LittleEndian.PutUint64(h[8:16], seq)
+	case MimicSRTP:
+		// RTP v2, dynamic payload type 96, 20ms audio frames
+		h[0] = 0x80
+		h[1] = 0x60
+		binary.BigEndian.PutUint16(h[2:4], uint16(seq))
+		binary.BigEndian.PutUint32(h[4:8], uint32(seq*960))
+		copy(h[8:12], o.connID[:4])
+	}
+}
+
+// randomPadding returns a random padding length in [0, max]
+func randomPadding(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	var b [2]byte
+	rand.Read(b[:])
+	return int(binary.BigEndian.Uint16(b[:])) % (max + 1)
+}
+
+// Close closes the connection
+func (o *UDPObfuscator) Close() error {
+	return o.conn.Close()
+}
+
+// LocalAddr returns local address
+func (o *UDPObfuscator) LocalAddr() net.Addr {
+	return o.conn.LocalAddr()
+}
+
+// SetDeadline sets deadline
+func (o *UDPObfuscator) SetDeadline(t time.Time) error {
+	return o.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets read deadline
+func (o *UDPObfuscator) SetReadDeadline(t time.Time) error {
+	return o.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets write deadline
+func (o *UDPObfuscator) SetWriteDeadline(t time.Time) error {
+	return o.conn.SetWriteDeadline(t)
+}
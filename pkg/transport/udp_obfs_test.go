@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// obfsPair returns two obfuscators over localhost UDP, recording what the
+// first one sends
+func obfsPair(t *testing.T, opts UDPObfsOptions) (*UDPObfuscator, *UDPObfuscator, *recordConn) {
+	t.Helper()
+	key := bytes.Repeat([]byte{5}, 32)
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	wire := &recordConn{PacketConn: listen()}
+	a, err := NewUDPObfuscator(wire, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewUDPObfuscator(listen(), key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, wire
+}
+
+func TestUDPObfuscatorRoundTrip(t *testing.T) {
+	for _, mimic := range []string{"", MimicNone, MimicQUIC, MimicDTLS, MimicWireGuard, MimicSRTP} {
+		for _, maxPadding := range []int{0, 64} {
+			a, b, wire := obfsPair(t, UDPObfsOptions{Mimic: mimic, MaxPadding: maxPadding})
+			headerLen, _ := mimicHeaderLen(mimic)
+			buf := make([]byte, udpObfsMaxPacket)
+			for _, size := range []int{0, 1, 100, 1400} {
+				msg := bytes.Repeat([]byte{byte(size)}, size)
+				if _, err := a.WriteTo(msg, b.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+				n, _, err := b.ReadFrom(buf)
+				if err != nil || !bytes.Equal(buf[:n], msg) {
+					t.Fatalf("%s padding %d: read %d bytes, %v", mimic, maxPadding, n, err)
+				}
+
+				sent := wire.packets()
+				p := sent[len(sent)-1]
+				body := len(p) - headerLen
+				min := headerLen + udpObfsNonceSize + 2 + size
+				switch {
+				case mimic == MimicWireGuard:
+					if body%16 != 0 || len(p) < min || len(p) > min+maxPadding+15 {
+						t.Errorf("wireguard packet of %d bytes for %d", len(p), size)
+					}
+				case maxPadding == 0 && len(p) != min:
+					t.Errorf("%s: %d bytes for %d without padding, want %d", mimic, len(p), size, min)
+				case len(p) < min || len(p) > min+maxPadding:
+					t.Errorf("%s: %d bytes for %d, want %d to %d", mimic, len(p), size, min, min+maxPadding)
+				}
+				checkMimicHeader(t, mimic, p[:headerLen], body)
+				if bytes.Contains(p, msg) && size > 1 {
+					t.Errorf("%s: payload in the clear", mimic)
+				}
+			}
+		}
+	}
+}
+
+// checkMimicHeader checks the fields a parser of the protocol looks at
+func checkMimicHeader(t *testing.T, mimic string, h []byte, bodyLen int) {
+	t.Helper()
+	switch mimic {
+	case MimicQUIC:
+		if len(h) != 9 || h[0]&0xc0 != 0x40 {
+			t.Errorf("quic header % x", h)
+		}
+	case MimicDTLS:
+		if len(h) != 13 || h[0] != 0x17 || h[1] != 0xfe || h[2] != 0xfd || int(binary.BigEndian.Uint16(h[11:])) != bodyLen {
+			t.Errorf("dtls header % x for %d bytes", h, bodyLen)
+		}
+	case MimicWireGuard:
+		if len(h) != 16 || h[0] != 0x04 || h[1]|h[2]|h[3] != 0 {
+			t.Errorf("wireguard header % x", h)
+		}
+	case MimicSRTP:
+		if len(h) != 12 || h[0] != 0x80 || h[1] != 0x60 {
+			t.Errorf("srtp header % x", h)
+		}
+	default:
+		if len(h) != 0 {
+			t.Errorf("header % x without mimic", h)
+		}
+	}
+}
+
+func TestUDPObfuscatorDropsBadPackets(t *testing.T) {
+	for _, mimic := range []string{MimicNone, MimicQUIC, MimicDTLS, MimicWireGuard, MimicSRTP} {
+		a, b, wire := obfsPair(t, UDPObfsOptions{Mimic: mimic})
+		if _, err := a.WriteTo([]byte("valid"), b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		good := wire.packets()[0]
+		headerLen, _ := mimicHeaderLen(mimic)
+
+		// Truncated packets, and one whose length field runs past its end
+		var bad [][]byte
+		for n := 1; n < headerLen+udpObfsNonceSize+2; n++ {
+			bad = append(bad, good[:n])
+		}
+		corrupt := append([]byte(nil), good...)
+		lenOffset := headerLen + udpObfsNonceSize
+		corrupt[lenOffset] ^= 0xff
+		corrupt[lenOffset+1] ^= 0xff
+		bad = append(bad, corrupt)
+
+		raw := a.conn
+		for _, p := range bad {
+			if _, err := raw.WriteTo(p, b.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		raw.WriteTo(good, b.LocalAddr())
+		buf := make([]byte, udpObfsMaxPacket)
+		n, _, err := b.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "valid" {
+			t.Errorf("%s: read %q %v, want the valid packet", mimic, buf[:n], err)
+		}
+	}
+}
+
+func TestNewUDPObfuscatorErrors(t *testing.T) {
+	key := bytes.Repeat([]byte{5}, 32)
+	if _, err := NewUDPObfuscator(nil, key[:16], UDPObfsOptions{}); err == nil {
+		t.Error("accepted a 16 byte key")
+	}
+	if _, err := NewUDPObfuscator(nil, key, UDPObfsOptions{Mimic: "openvpn"}); err == nil {
+		t.Error("accepted an unknown mimic")
+	}
+	if _, err := NewUDPObfuscator(nil, key, UDPObfsOptions{MaxPadding: -1}); err == nil {
+		t.Error("accepted negative padding")
+	}
+	o, _ := NewUDPObfuscator(nil, key, UDPObfsOptions{MaxPadding: 64})
+	if _, err := o.WriteTo(make([]byte, udpObfsMaxPacket), nil); err == nil {
+		t.Error("wrote an oversized packet")
+	}
+}
@@ -0,0 +1,149 @@
+package tun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device is a Linux TUN interface without packet information headers
+type Device struct {
+	*os.File
+	name string
+}
+
+// OpenDevice creates (or attaches to) the TUN interface name, assigns
+// address (CIDR) and brings it up
+func OpenDevice(name, address string, mtu int) (*Device, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/net/tun: %w", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device %s: %w", name, err)
+	}
+
+	dev := &Device{File: os.NewFile(uintptr(fd), "/dev/net/tun"), name: ifr.Name()}
+	err = runIP(
+		[]string{"addr", "replace", address, "dev", dev.name},
+		[]string{"link", "set", "dev", dev.name, "mtu", strconv.Itoa(mtu), "up"},
+	)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// Name returns the interface name
+func (d *Device) Name() string { return d.name }
+
+// Routes sends all IPv4 traffic into a TUN device except the excluded
+// ranges, which keep their current route
+type Routes struct {
+	dev      string
+	excluded []string
+}
+
+// SetupRoutes installs 0.0.0.0/1 and 128.0.0.0/1 through the device (more
+// specific than any default route, so the original default survives) and
+// pins every exclude range (the server address first) to the route it
+// uses right now
+func SetupRoutes(dev string, exclude []string) (*Routes, error) {
+	r := &Routes{dev: dev}
+	for _, cidr := range exclude {
+		if !strings.Contains(cidr, "/") {
+			cidr += "/32"
+		}
+		ip := strings.SplitN(cidr, "/", 2)[0]
+		via, link, err := currentRoute(ip)
+		if err != nil {
+			r.Remove()
+			return nil, err
+		}
+		args := []string{"route", "replace", cidr}
+		if via != "" {
+			args = append(args, "via", via)
+		}
+		args = append(args, "dev", link)
+		if err := runIP(args); err != nil {
+			r.Remove()
+			return nil, err
+		}
+		r.excluded = append(r.excluded, cidr)
+	}
+	err := runIP(
+		[]string{"route", "replace", "0.0.0.0/1", "dev", dev},
+		[]string{"route", "replace", "128.0.0.0/1", "dev", dev},
+	)
+	if err != nil {
+		r.Remove()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Remove deletes the routes SetupRoutes added
+func (r *Routes) Remove() {
+	exec.Command("ip", "route", "del", "0.0.0.0/1", "dev", r.dev).Run()
+	exec.Command("ip", "route", "del", "128.0.0.0/1", "dev", r.dev).Run()
+	for _, cidr := range r.excluded {
+		exec.Command("ip", "route", "del", cidr).Run()
+	}
+}
+
+// DefaultInterface returns the interface of the IPv4 default route
+func DefaultInterface() (string, error) {
+	out, err := exec.Command("ip", "-4", "route", "show", "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read default route: %w", err)
+	}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no default route")
+}
+
+// currentRoute asks the kernel how ip is reached now
+func currentRoute(ip string) (via, dev string, err error) {
+	out, err := exec.Command("ip", "-4", "route", "get", ip).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("no route to %s: %w", ip, err)
+	}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			via = fields[i+1]
+		case "dev":
+			dev = fields[i+1]
+		}
+	}
+	if dev == "" {
+		return "", "", fmt.Errorf("no route to %s", ip)
+	}
+	return via, dev, nil
+}
+
+func runIP(cmds ...[]string) error {
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
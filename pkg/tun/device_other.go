@@ -0,0 +1,31 @@
+//go:build !linux
+
+package tun
+
+import (
+	"fmt"
+	"os"
+)
+
+// Device is only implemented on Linux
+type Device struct {
+	*os.File
+}
+
+func OpenDevice(name, address string, mtu int) (*Device, error) {
+	return nil, fmt.Errorf("TUN mode is only supported on Linux")
+}
+
+func (d *Device) Name() string { return "" }
+
+func DefaultInterface() (string, error) {
+	return "", fmt.Errorf("TUN mode is only supported on Linux")
+}
+
+type Routes struct{}
+
+func SetupRoutes(dev string, exclude []string) (*Routes, error) {
+	return nil, fmt.Errorf("TUN mode is only supported on Linux")
+}
+
+func (r *Routes) Remove() {}
@@ -0,0 +1,184 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ipv4HeaderLen = 20
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// TCP flags
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagPSH = 0x08
+	flagACK = 0x10
+)
+
+// ipv4Packet is a parsed IPv4 header; payload is the transport segment
+type ipv4Packet struct {
+	src, dst net.IP
+	proto    byte
+	payload  []byte
+}
+
+// parseIPv4 parses an unfragmented IPv4 packet
+func parseIPv4(b []byte) (*ipv4Packet, bool) {
+	if len(b) < ipv4HeaderLen || b[0]>>4 != 4 {
+		return nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < ipv4HeaderLen || total < ihl || total > len(b) {
+		return nil, false
+	}
+	// Fragments are rare on a TUN device with a sane MTU; drop them
+	if flagsFrag := binary.BigEndian.Uint16(b[6:8]); flagsFrag&0x3fff != 0 {
+		return nil, false
+	}
+	return &ipv4Packet{
+		src:     net.IP(b[12:16]),
+		dst:     net.IP(b[16:20]),
+		proto:   b[9],
+		payload: b[ihl:total],
+	}, true
+}
+
+// tcpSegment is a parsed TCP header
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	window           uint16
+	mss              uint16
+	payload          []byte
+}
+
+func parseTCP(b []byte) (*tcpSegment, bool) {
+	if len(b) < tcpHeaderLen {
+		return nil, false
+	}
+	off := int(b[12]>>4) * 4
+	if off < tcpHeaderLen || off > len(b) {
+		return nil, false
+	}
+	seg := &tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		payload: b[off:],
+	}
+	// Only MSS matters to us; window scaling is never negotiated
+	opts := b[tcpHeaderLen:off]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of options
+			opts = nil
+		case 1: // NOP
+			opts = opts[1:]
+		default:
+			if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+				opts = nil
+				continue
+			}
+			if opts[0] == 2 && opts[1] == 4 {
+				seg.mss = binary.BigEndian.Uint16(opts[2:4])
+			}
+			opts = opts[opts[1]:]
+		}
+	}
+	return seg, true
+}
+
+// buildIPv4 wraps a transport segment in an IPv4 header
+func buildIPv4(src, dst net.IP, proto byte, id uint16, segment []byte) []byte {
+	pkt := make([]byte, ipv4HeaderLen+len(segment))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:6], id)
+	binary.BigEndian.PutUint16(pkt[6:8], 0x4000) // DF
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4HeaderLen], 0))
+	copy(pkt[ipv4HeaderLen:], segment)
+	return pkt
+}
+
+// buildTCP builds a TCP segment with its checksum filled in
+func buildTCP(src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, flags byte, window uint16, mss uint16, payload []byte) []byte {
+	hdrLen := tcpHeaderLen
+	if mss > 0 {
+		hdrLen += 4
+	}
+	seg := make([]byte, hdrLen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], srcPort)
+	binary.BigEndian.PutUint16(seg[2:4], dstPort)
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	binary.BigEndian.PutUint32(seg[8:12], ack)
+	seg[12] = byte(hdrLen/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:16], window)
+	if mss > 0 {
+		seg[20], seg[21] = 2, 4
+		binary.BigEndian.PutUint16(seg[22:24], mss)
+	}
+	copy(seg[hdrLen:], payload)
+	binary.BigEndian.PutUint16(seg[16:18], checksum(seg, pseudoHeaderSum(src, dst, protoTCP, len(seg))))
+	return seg
+}
+
+// buildUDP builds a UDP datagram with its checksum filled in
+func buildUDP(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	seg := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], srcPort)
+	binary.BigEndian.PutUint16(seg[2:4], dstPort)
+	binary.BigEndian.PutUint16(seg[4:6], uint16(len(seg)))
+	copy(seg[udpHeaderLen:], payload)
+	sum := checksum(seg, pseudoHeaderSum(src, dst, protoUDP, len(seg)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(seg[6:8], sum)
+	return seg
+}
+
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) uint32 {
+	var sum uint32
+	s, d := src.To4(), dst.To4()
+	sum += uint32(s[0])<<8 | uint32(s[1])
+	sum += uint32(s[2])<<8 | uint32(s[3])
+	sum += uint32(d[0])<<8 | uint32(d[1])
+	sum += uint32(d[2])<<8 | uint32(d[3])
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// checksum is the Internet checksum (RFC 1071) of b, seeded with initial
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
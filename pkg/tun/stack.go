@@ -0,0 +1,193 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Userspace IPv4 stack for TUN mode
+//
+// Packets read from the device are terminated here: every TCP connection
+// becomes a TCPConn handed to the Handler, every UDP datagram goes to
+// HandleUDP, and replies are written back to the device as if they came
+// from the original destination. IPv6 and ICMP are dropped.
+
+// Handler receives the flows terminated by the stack
+type Handler interface {
+	// HandleTCP is called in its own goroutine for every new connection
+	HandleTCP(conn *TCPConn)
+	// HandleUDP is called for every datagram; data is only valid during the call
+	HandleUDP(src, dst *net.UDPAddr, data []byte)
+}
+
+// Stack terminates TCP and UDP from a TUN device
+type Stack struct {
+	dev     io.ReadWriter
+	mtu     int
+	handler Handler
+	mu      sync.Mutex
+	conns   map[connKey]*TCPConn
+	ipID    atomic.Uint32
+	die     chan struct{}
+	once    sync.Once
+}
+
+type connKey struct {
+	src, dst         [4]byte
+	srcPort, dstPort uint16
+}
+
+func NewStack(dev io.ReadWriter, mtu int, handler Handler) *Stack {
+	return &Stack{
+		dev:     dev,
+		mtu:     mtu,
+		handler: handler,
+		conns:   make(map[connKey]*TCPConn),
+		die:     make(chan struct{}),
+	}
+}
+
+// Run reads packets from the device until it fails
+func (s *Stack) Run() error {
+	go s.timerLoop()
+	defer s.Close()
+
+	buf := make([]byte, s.mtu+64)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		pkt, ok := parseIPv4(buf[:n])
+		if !ok {
+			continue
+		}
+		switch pkt.proto {
+		case protoTCP:
+			s.handleTCP(pkt)
+		case protoUDP:
+			s.handleUDP(pkt)
+		}
+	}
+}
+
+// Close resets every open connection
+func (s *Stack) Close() {
+	s.once.Do(func() {
+		close(s.die)
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*TCPConn)
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.abort(false)
+			c.mu.Unlock()
+		}
+	})
+}
+
+// WriteUDP injects a datagram from src (the remote end) to dst (the local app)
+func (s *Stack) WriteUDP(src, dst *net.UDPAddr, data []byte) error {
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		return fmt.Errorf("IPv6 is not supported")
+	}
+	seg := buildUDP(src.IP, dst.IP, uint16(src.Port), uint16(dst.Port), data)
+	return s.writePacket(src.IP, dst.IP, protoUDP, seg)
+}
+
+func (s *Stack) writePacket(src, dst net.IP, proto byte, seg []byte) error {
+	pkt := buildIPv4(src, dst, proto, uint16(s.ipID.Add(1)), seg)
+	_, err := s.dev.Write(pkt)
+	return err
+}
+
+func (s *Stack) handleUDP(pkt *ipv4Packet) {
+	if len(pkt.payload) < udpHeaderLen {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(pkt.payload[4:6]))
+	if length < udpHeaderLen || length > len(pkt.payload) {
+		return
+	}
+	src := &net.UDPAddr{IP: append(net.IP(nil), pkt.src...), Port: int(binary.BigEndian.Uint16(pkt.payload[0:2]))}
+	dst := &net.UDPAddr{IP: append(net.IP(nil), pkt.dst...), Port: int(binary.BigEndian.Uint16(pkt.payload[2:4]))}
+	s.handler.HandleUDP(src, dst, pkt.payload[udpHeaderLen:length])
+}
+
+func (s *Stack) handleTCP(pkt *ipv4Packet) {
+	seg, ok := parseTCP(pkt.payload)
+	if !ok {
+		return
+	}
+	key := connKey{srcPort: seg.srcPort, dstPort: seg.dstPort}
+	copy(key.src[:], pkt.src)
+	copy(key.dst[:], pkt.dst)
+
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil && seg.flags&(flagSYN|flagACK|flagRST) == flagSYN {
+		c = newTCPConn(s, key, seg)
+		s.conns[key] = c
+		s.mu.Unlock()
+		go s.handler.HandleTCP(c)
+		return
+	}
+	s.mu.Unlock()
+
+	if c == nil {
+		// Not ours (e.g. from before a restart): reset it
+		if seg.flags&flagRST == 0 {
+			s.sendReset(pkt, seg)
+		}
+		return
+	}
+	c.input(seg)
+}
+
+func (s *Stack) sendReset(pkt *ipv4Packet, seg *tcpSegment) {
+	seq, ack, flags := seg.ack, uint32(0), byte(flagRST)
+	if seg.flags&flagACK == 0 {
+		seq = 0
+		ack = seg.seq + uint32(len(seg.payload))
+		if seg.flags&(flagSYN|flagFIN) != 0 {
+			ack++
+		}
+		flags |= flagACK
+	}
+	out := buildTCP(pkt.dst, pkt.src, seg.dstPort, seg.srcPort, seq, ack, flags, 0, 0, nil)
+	s.writePacket(pkt.dst, pkt.src, protoTCP, out)
+}
+
+func (s *Stack) remove(key connKey) {
+	s.mu.Lock()
+	delete(s.conns, key)
+	s.mu.Unlock()
+}
+
+// timerLoop drives retransmissions
+func (s *Stack) timerLoop() {
+	ticker := time.NewTicker(tcpTimerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*TCPConn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
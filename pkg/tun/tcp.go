@@ -0,0 +1,409 @@
+package tun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Minimal TCP endpoint for traffic arriving on the TUN device
+//
+// The peer is the local kernel, so the link never reorders and rarely
+// drops. That keeps this simple: no window scaling, SACK or congestion
+// control; out-of-order segments are dropped and re-ACKed, and lost data is
+// resent go-back-N from the oldest unacknowledged byte.
+
+const (
+	tcpTimerTick   = 100 * time.Millisecond
+	tcpRecvBufSize = 65535
+	tcpSendBufSize = 256 * 1024
+	tcpDefaultMSS  = 536
+	tcpInitialRTO  = time.Second
+	tcpMinRTO      = 200 * time.Millisecond
+	tcpMaxRTO      = 10 * time.Second
+	tcpMaxRetries  = 8
+	tcpFinTimeout  = 60 * time.Second
+)
+
+type tcpState int
+
+const (
+	stateSynReceived tcpState = iota
+	stateEstablished
+	stateClosed
+)
+
+// TCPConn is one TCP connection terminated by the stack. Reads return what
+// the local app sent; writes go back to the app as if from Destination.
+type TCPConn struct {
+	stack *Stack
+	key   connKey
+	src   *net.TCPAddr
+	dst   *net.TCPAddr
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state tcpState
+
+	// Send side: sendBuf[0] is the byte at sndUna, sent bytes are in flight
+	iss       uint32
+	sndUna    uint32
+	sndWnd    int
+	mss       int
+	sendBuf   []byte
+	sent      int
+	finQueued bool
+	finSent   bool
+	finAcked  bool
+
+	// Receive side
+	rcvNxt      uint32
+	recvBuf     []byte
+	advertised  int
+	peerFin     bool
+	closedLocal bool
+	reset       bool
+
+	rto         time.Duration
+	rtoDeadline time.Time
+	retries     int
+	finDeadline time.Time
+}
+
+func newTCPConn(s *Stack, key connKey, syn *tcpSegment) *TCPConn {
+	var issBuf [4]byte
+	rand.Read(issBuf[:])
+
+	mss := int(syn.mss)
+	if mss == 0 {
+		mss = tcpDefaultMSS
+	}
+	if maxMSS := s.mtu - ipv4HeaderLen - tcpHeaderLen; mss > maxMSS {
+		mss = maxMSS
+	}
+
+	c := &TCPConn{
+		stack:  s,
+		key:    key,
+		src:    &net.TCPAddr{IP: net.IP(append([]byte(nil), key.src[:]...)), Port: int(key.srcPort)},
+		dst:    &net.TCPAddr{IP: net.IP(append([]byte(nil), key.dst[:]...)), Port: int(key.dstPort)},
+		state:  stateSynReceived,
+		iss:    binary.BigEndian.Uint32(issBuf[:]),
+		sndWnd: int(syn.window),
+		mss:    mss,
+		rcvNxt: syn.seq + 1,
+		rto:    tcpInitialRTO,
+	}
+	c.sndUna = c.iss
+	c.cond = sync.NewCond(&c.mu)
+	c.mu.Lock()
+	c.sendSynAck()
+	c.mu.Unlock()
+	return c
+}
+
+// Source returns the local app's address
+func (c *TCPConn) Source() *net.TCPAddr { return c.src }
+
+// Destination returns the address the app connected to
+func (c *TCPConn) Destination() *net.TCPAddr { return c.dst }
+
+func (c *TCPConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.recvBuf) == 0 && !c.peerFin && !c.reset && !c.closedLocal {
+		c.cond.Wait()
+	}
+	switch {
+	case len(c.recvBuf) > 0:
+		n := copy(p, c.recvBuf)
+		c.recvBuf = c.recvBuf[n:]
+		if len(c.recvBuf) == 0 {
+			c.recvBuf = nil
+		}
+		// Tell the app the window reopened once it is worth it
+		if c.advertised < tcpRecvBufSize/2 && c.window() >= tcpRecvBufSize/2 {
+			c.sendAck()
+		}
+		return n, nil
+	case c.reset:
+		return 0, syscall.ECONNRESET
+	case c.closedLocal:
+		return 0, io.ErrClosedPipe
+	default:
+		return 0, io.EOF
+	}
+}
+
+func (c *TCPConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		for len(c.sendBuf) >= tcpSendBufSize && !c.reset && !c.finQueued && c.state != stateClosed {
+			c.cond.Wait()
+		}
+		if c.reset || c.finQueued || c.state == stateClosed {
+			return written, io.ErrClosedPipe
+		}
+		n := tcpSendBufSize - len(c.sendBuf)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.sendBuf = append(c.sendBuf, p[:n]...)
+		p = p[n:]
+		written += n
+		c.trySend()
+	}
+	return written, nil
+}
+
+// Close sends FIN once buffered data is delivered
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closedLocal {
+		return nil
+	}
+	c.closedLocal = true
+	c.recvBuf = nil
+	if c.state != stateClosed {
+		c.finQueued = true
+		c.finDeadline = time.Now().Add(tcpFinTimeout)
+		c.trySend()
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// Abort resets the connection, e.g. when the destination is unreachable
+func (c *TCPConn) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.abort(true)
+}
+
+// abort tears the connection down; c.mu must be held unless the stack is
+// shutting down
+func (c *TCPConn) abort(sendRST bool) {
+	if c.state == stateClosed {
+		return
+	}
+	if sendRST {
+		c.send(c.sndNxt(), flagRST|flagACK, nil)
+	}
+	c.state = stateClosed
+	c.reset = true
+	c.cond.Broadcast()
+	c.stack.remove(c.key)
+}
+
+// input processes a segment from the app
+func (c *TCPConn) input(seg *tcpSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if seg.flags&flagRST != 0 {
+		c.abort(false)
+		return
+	}
+	if seg.flags&flagSYN != 0 {
+		// Our SYN-ACK was lost
+		if c.state == stateSynReceived {
+			c.sendSynAck()
+		}
+		return
+	}
+	if seg.flags&flagACK == 0 {
+		return
+	}
+
+	if c.state == stateSynReceived {
+		if seg.ack != c.iss+1 {
+			return
+		}
+		c.state = stateEstablished
+		c.sndUna = c.iss + 1
+		c.resetTimer()
+		c.cond.Broadcast()
+	} else {
+		c.processAck(seg.ack)
+	}
+	c.sndWnd = int(seg.window)
+
+	if len(seg.payload) > 0 || seg.flags&flagFIN != 0 {
+		if seg.seq == c.rcvNxt && !c.peerFin {
+			take := len(seg.payload)
+			if !c.closedLocal {
+				if space := tcpRecvBufSize - len(c.recvBuf); take > space {
+					take = space
+				}
+				c.recvBuf = append(c.recvBuf, seg.payload[:take]...)
+			}
+			c.rcvNxt += uint32(take)
+			if seg.flags&flagFIN != 0 && take == len(seg.payload) {
+				c.peerFin = true
+				c.rcvNxt++
+			}
+			c.cond.Broadcast()
+		}
+		c.sendAck()
+	}
+
+	c.trySend()
+	if c.finAcked && c.peerFin {
+		c.state = stateClosed
+		c.cond.Broadcast()
+		c.stack.remove(c.key)
+	}
+}
+
+func (c *TCPConn) processAck(ack uint32) {
+	acked := int(int32(ack - c.sndUna))
+	maxAck := c.sent
+	if c.finSent {
+		maxAck++
+	}
+	if acked <= 0 || acked > maxAck {
+		return
+	}
+	data := acked
+	if data > c.sent {
+		data = c.sent
+		c.finAcked = true
+	}
+	c.sendBuf = c.sendBuf[data:]
+	c.sent -= data
+	c.sndUna = ack
+	c.resetTimer()
+	c.cond.Broadcast()
+}
+
+// trySend sends as much buffered data as the app's window allows, then
+// FIN if Close was called
+func (c *TCPConn) trySend() {
+	if c.state != stateEstablished {
+		return
+	}
+	for {
+		unsent := len(c.sendBuf) - c.sent
+		room := c.sndWnd - c.sent
+		if unsent > 0 && room > 0 {
+			n := unsent
+			if n > room {
+				n = room
+			}
+			if n > c.mss {
+				n = c.mss
+			}
+			c.send(c.sndUna+uint32(c.sent), flagACK|flagPSH, c.sendBuf[c.sent:c.sent+n])
+			c.sent += n
+			c.armTimer()
+			continue
+		}
+		if unsent > 0 {
+			// Zero window: the timer probes it
+			c.armTimer()
+		} else if c.finQueued && !c.finSent {
+			c.send(c.sndUna+uint32(c.sent), flagFIN|flagACK, nil)
+			c.finSent = true
+			c.armTimer()
+		}
+		return
+	}
+}
+
+// tick retransmits on timeout and expires half-closed connections
+func (c *TCPConn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if c.finQueued && now.After(c.finDeadline) {
+		c.abort(true)
+		return
+	}
+	if c.rtoDeadline.IsZero() || now.Before(c.rtoDeadline) {
+		return
+	}
+	c.retries++
+	if c.retries > tcpMaxRetries {
+		c.abort(true)
+		return
+	}
+	c.rto *= 2
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+	c.rtoDeadline = now.Add(c.rto)
+
+	if c.state == stateSynReceived {
+		c.sendSynAck()
+		return
+	}
+	// Go back to the oldest unacknowledged byte
+	c.sent = 0
+	c.finSent = false
+	if c.sndWnd == 0 && len(c.sendBuf) > 0 {
+		// Window probe: one byte past the closed window
+		c.send(c.sndUna, flagACK, c.sendBuf[:1])
+		c.sent = 1
+		return
+	}
+	c.trySend()
+}
+
+func (c *TCPConn) armTimer() {
+	if c.rtoDeadline.IsZero() {
+		c.rtoDeadline = time.Now().Add(c.rto)
+	}
+}
+
+// resetTimer restarts retransmission timing after progress
+func (c *TCPConn) resetTimer() {
+	c.retries = 0
+	c.rto = tcpMinRTO
+	c.rtoDeadline = time.Time{}
+	if c.sent > 0 || (c.finSent && !c.finAcked) {
+		c.rtoDeadline = time.Now().Add(c.rto)
+	}
+}
+
+func (c *TCPConn) window() int {
+	return tcpRecvBufSize - len(c.recvBuf)
+}
+
+func (c *TCPConn) sendSynAck() {
+	mss := c.stack.mtu - ipv4HeaderLen - tcpHeaderLen
+	seg := buildTCP(c.dst.IP, c.src.IP, uint16(c.dst.Port), uint16(c.src.Port),
+		c.iss, c.rcvNxt, flagSYN|flagACK, uint16(c.window()), uint16(mss), nil)
+	c.stack.writePacket(c.dst.IP, c.src.IP, protoTCP, seg)
+	c.armTimer()
+}
+
+func (c *TCPConn) sendAck() {
+	c.send(c.sndNxt(), flagACK, nil)
+}
+
+// sndNxt is the next sequence number to send
+func (c *TCPConn) sndNxt() uint32 {
+	nxt := c.sndUna + uint32(c.sent)
+	if c.finSent && !c.finAcked {
+		nxt++
+	}
+	return nxt
+}
+
+func (c *TCPConn) send(seq uint32, flags byte, payload []byte) {
+	c.advertised = c.window()
+	seg := buildTCP(c.dst.IP, c.src.IP, uint16(c.dst.Port), uint16(c.src.Port),
+		seq, c.rcvNxt, flags, uint16(c.advertised), 0, payload)
+	c.stack.writePacket(c.dst.IP, c.src.IP, protoTCP, seg)
+}
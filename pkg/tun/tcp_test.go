@@ -0,0 +1,389 @@
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testDevice collects what the stack writes; the tests feed segments to
+// the stack directly instead of through Read
+type testDevice struct {
+	out chan []byte
+}
+
+func (d *testDevice) Read(p []byte) (int, error) { select {} }
+
+func (d *testDevice) Write(p []byte) (int, error) {
+	d.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+type testHandler struct {
+	conns chan *TCPConn
+}
+
+func (h *testHandler) HandleTCP(conn *TCPConn)                      { h.conns <- conn }
+func (h *testHandler) HandleUDP(src, dst *net.UDPAddr, data []byte) {}
+
+// testApp plays the local app's kernel: it sends crafted segments from
+// 10.0.0.2:40000 to 203.0.113.5:443 and checks what comes back
+type testApp struct {
+	t     *testing.T
+	stack *Stack
+	dev   *testDevice
+	conns chan *TCPConn
+	seq   uint32 // next sequence number the app sends
+	ack   uint32 // the stack's next sequence number, once known
+}
+
+var (
+	appIP    = net.IPv4(10, 0, 0, 2).To4()
+	remoteIP = net.IPv4(203, 0, 113, 5).To4()
+)
+
+const (
+	appPort    = 40000
+	remotePort = 443
+	testMTU    = 1500
+)
+
+func newTestApp(t *testing.T) *testApp {
+	dev := &testDevice{out: make(chan []byte, 1024)}
+	h := &testHandler{conns: make(chan *TCPConn, 1)}
+	return &testApp{t: t, stack: NewStack(dev, testMTU, h), dev: dev, conns: h.conns, seq: 1000}
+}
+
+// send delivers a segment from the app to the stack
+func (a *testApp) send(seq, ack uint32, flags byte, window uint16, payload []byte) {
+	a.t.Helper()
+	seg := buildTCP(appIP, remoteIP, appPort, remotePort, seq, ack, flags, window, 0, payload)
+	pkt, ok := parseIPv4(buildIPv4(appIP, remoteIP, protoTCP, 1, seg))
+	if !ok {
+		a.t.Fatal("built an unparsable packet")
+	}
+	a.stack.handleTCP(pkt)
+}
+
+// recv returns the next segment the stack sent to the app
+func (a *testApp) recv() *tcpSegment {
+	a.t.Helper()
+	var raw []byte
+	select {
+	case raw = <-a.dev.out:
+	case <-time.After(time.Second):
+		a.t.Fatal("no segment from the stack")
+	}
+	pkt, ok := parseIPv4(raw)
+	if !ok || pkt.proto != protoTCP {
+		a.t.Fatalf("stack wrote a bad packet %x", raw)
+	}
+	if !pkt.src.Equal(remoteIP) || !pkt.dst.Equal(appIP) {
+		a.t.Fatalf("packet %s -> %s, want %s -> %s", pkt.src, pkt.dst, remoteIP, appIP)
+	}
+	if checksum(pkt.payload, pseudoHeaderSum(pkt.src, pkt.dst, protoTCP, len(pkt.payload))) != 0 {
+		a.t.Fatal("bad TCP checksum")
+	}
+	seg, ok := parseTCP(pkt.payload)
+	if !ok || seg.srcPort != remotePort || seg.dstPort != appPort {
+		a.t.Fatalf("bad TCP segment %x", pkt.payload)
+	}
+	return seg
+}
+
+// expect checks the next segment's flags, sequence numbers and payload
+func (a *testApp) expect(flags byte, seq uint32, payload []byte) *tcpSegment {
+	a.t.Helper()
+	seg := a.recv()
+	if seg.flags != flags || seg.seq != seq || seg.ack != a.seq || !bytes.Equal(seg.payload, payload) {
+		a.t.Fatalf("got flags %#x seq %d ack %d payload %q, want flags %#x seq %d ack %d payload %q",
+			seg.flags, seg.seq, seg.ack, seg.payload, flags, seq, a.seq, payload)
+	}
+	return seg
+}
+
+// quiet checks that the stack sent nothing
+func (a *testApp) quiet() {
+	a.t.Helper()
+	select {
+	case raw := <-a.dev.out:
+		pkt, _ := parseIPv4(raw)
+		seg, _ := parseTCP(pkt.payload)
+		a.t.Fatalf("unexpected segment flags %#x seq %d payload %q", seg.flags, seg.seq, seg.payload)
+	default:
+	}
+}
+
+// connect runs the three-way handshake and returns the accepted conn
+func (a *testApp) connect(window uint16) *TCPConn {
+	a.t.Helper()
+	syn := buildTCP(appIP, remoteIP, appPort, remotePort, a.seq, 0, flagSYN, window, 1200, nil)
+	pkt, _ := parseIPv4(buildIPv4(appIP, remoteIP, protoTCP, 1, syn))
+	a.stack.handleTCP(pkt)
+	a.seq++
+
+	synAck := a.recv()
+	if synAck.flags != flagSYN|flagACK || synAck.ack != a.seq {
+		a.t.Fatalf("SYN answered with flags %#x ack %d, want SYN-ACK ack %d", synAck.flags, synAck.ack, a.seq)
+	}
+	if want := uint16(testMTU - ipv4HeaderLen - tcpHeaderLen); synAck.mss != want {
+		a.t.Errorf("SYN-ACK MSS %d, want %d", synAck.mss, want)
+	}
+	a.ack = synAck.seq + 1
+
+	var conn *TCPConn
+	select {
+	case conn = <-a.conns:
+	case <-time.After(time.Second):
+		a.t.Fatal("connection not handed to the handler")
+	}
+	if conn.state != stateSynReceived {
+		a.t.Fatalf("state after SYN %d, want SYN received", conn.state)
+	}
+	if got := conn.Destination().String(); got != "203.0.113.5:443" {
+		a.t.Errorf("destination %s", got)
+	}
+
+	a.send(a.seq, a.ack, flagACK, window, nil)
+	if conn.state != stateEstablished {
+		a.t.Fatalf("state after ACK %d, want established", conn.state)
+	}
+	a.quiet()
+	return conn
+}
+
+func (a *testApp) registered() bool {
+	a.stack.mu.Lock()
+	defer a.stack.mu.Unlock()
+	return len(a.stack.conns) > 0
+}
+
+func TestTCPHandshakeAndData(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(65535)
+
+	// In-order data is buffered and acknowledged
+	a.send(a.seq, a.ack, flagACK|flagPSH, 65535, []byte("hello"))
+	a.seq += 5
+	a.expect(flagACK, a.ack, nil)
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+
+	// A segment past a gap is dropped and the expected byte re-ACKed
+	a.send(a.seq+10, a.ack, flagACK, 65535, []byte("later"))
+	a.expect(flagACK, a.ack, nil)
+	// So is a duplicate of data already received
+	a.send(a.seq-5, a.ack, flagACK, 65535, []byte("hello"))
+	a.expect(flagACK, a.ack, nil)
+
+	// Writes go out as segments from the destination
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(flagACK|flagPSH, a.ack, []byte("world"))
+	a.ack += 5
+	a.send(a.seq, a.ack, flagACK, 65535, nil)
+	if conn.sent != 0 || len(conn.sendBuf) != 0 || !conn.rtoDeadline.IsZero() {
+		t.Errorf("acknowledged data still in flight: sent %d buffered %d", conn.sent, len(conn.sendBuf))
+	}
+	a.quiet()
+}
+
+func TestTCPSegmentsToMSSAndWindow(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(2000)
+	if conn.mss != 1200 {
+		t.Fatalf("MSS %d, want the app's 1200", conn.mss)
+	}
+
+	data := bytes.Repeat([]byte("x"), 3000)
+	go conn.Write(data)
+
+	// 2000 bytes of window: one full segment and the rest of the window
+	a.expect(flagACK|flagPSH, a.ack, data[:1200])
+	a.expect(flagACK|flagPSH, a.ack+1200, data[1200:2000])
+	time.Sleep(20 * time.Millisecond)
+	a.quiet()
+
+	// Acknowledging opens the window for the remainder
+	a.send(a.seq, a.ack+2000, flagACK, 2000, nil)
+	a.expect(flagACK|flagPSH, a.ack+2000, data[2000:])
+}
+
+func TestTCPRetransmit(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(65535)
+
+	conn.Write([]byte("lost"))
+	a.expect(flagACK|flagPSH, a.ack, []byte("lost"))
+
+	// Nothing happens before the timeout
+	now := time.Now()
+	conn.tick(now)
+	a.quiet()
+
+	// After it the oldest unacknowledged byte is resent, with backoff
+	rto := conn.rto
+	conn.tick(now.Add(tcpMaxRTO))
+	a.expect(flagACK|flagPSH, a.ack, []byte("lost"))
+	if conn.rto != 2*rto || conn.retries != 1 {
+		t.Errorf("after a retransmission rto %v retries %d, want %v and 1", conn.rto, conn.retries, 2*rto)
+	}
+
+	// Progress resets the backoff
+	a.send(a.seq, a.ack+4, flagACK, 65535, nil)
+	a.ack += 4
+	if conn.retries != 0 || conn.rto != tcpMinRTO || !conn.rtoDeadline.IsZero() {
+		t.Errorf("after the ACK rto %v retries %d deadline %v", conn.rto, conn.retries, conn.rtoDeadline)
+	}
+
+	// An app that never answers gets a reset after the last retry
+	conn.Write([]byte("gone"))
+	a.expect(flagACK|flagPSH, a.ack, []byte("gone"))
+	for i := 1; i <= tcpMaxRetries; i++ {
+		conn.tick(now.Add(time.Duration(i) * time.Minute))
+		a.expect(flagACK|flagPSH, a.ack, []byte("gone"))
+	}
+	conn.tick(now.Add(time.Hour))
+	a.expect(flagRST|flagACK, a.ack+4, nil)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Read after giving up: %v, want ECONNRESET", err)
+	}
+	if a.registered() {
+		t.Error("connection still registered after the reset")
+	}
+}
+
+func TestTCPSynAckRetransmit(t *testing.T) {
+	a := newTestApp(t)
+	a.send(a.seq, 0, flagSYN, 65535, nil)
+	a.seq++
+	first := a.recv()
+	conn := <-a.conns
+
+	// A repeated SYN means the SYN-ACK was lost
+	a.send(a.seq-1, 0, flagSYN, 65535, nil)
+	if again := a.recv(); again.flags != flagSYN|flagACK || again.seq != first.seq {
+		t.Errorf("repeated SYN answered with flags %#x seq %d", again.flags, again.seq)
+	}
+	// So does the timer
+	conn.tick(time.Now().Add(tcpMaxRTO))
+	if again := a.recv(); again.flags != flagSYN|flagACK || again.seq != first.seq {
+		t.Errorf("SYN-ACK retransmission flags %#x seq %d", again.flags, again.seq)
+	}
+	// An ACK for anything else doesn't complete the handshake
+	a.send(a.seq, first.seq+2, flagACK, 65535, nil)
+	if conn.state != stateSynReceived {
+		t.Errorf("state after a wrong ACK %d, want SYN received", conn.state)
+	}
+}
+
+func TestTCPZeroWindowProbe(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(0)
+
+	conn.Write([]byte("wait"))
+	a.quiet()
+	conn.tick(time.Now().Add(tcpMaxRTO))
+	a.expect(flagACK, a.ack, []byte("w"))
+
+	// The window opens: the rest follows
+	a.send(a.seq, a.ack+1, flagACK, 65535, nil)
+	a.expect(flagACK|flagPSH, a.ack+1, []byte("ait"))
+}
+
+func TestTCPCloseByApp(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(65535)
+
+	// The app's FIN ends reads after the data before it
+	a.send(a.seq, a.ack, flagACK|flagFIN, 65535, []byte("bye"))
+	a.seq += 4
+	a.expect(flagACK, a.ack, nil)
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "bye" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+
+	// Writing still works on the half-closed connection
+	conn.Write([]byte("ok"))
+	a.expect(flagACK|flagPSH, a.ack, []byte("ok"))
+	conn.Close()
+	a.send(a.seq, a.ack+2, flagACK, 65535, nil)
+	a.expect(flagFIN|flagACK, a.ack+2, nil)
+	if !a.registered() {
+		t.Fatal("connection removed before its FIN was acknowledged")
+	}
+	a.send(a.seq, a.ack+3, flagACK, 65535, nil)
+	if conn.state != stateClosed || a.registered() {
+		t.Errorf("state %d registered %v after both FINs, want closed and removed", conn.state, a.registered())
+	}
+}
+
+func TestTCPCloseByStack(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(65535)
+
+	conn.Write([]byte("last"))
+	conn.Close()
+	a.expect(flagACK|flagPSH, a.ack, []byte("last"))
+	a.expect(flagFIN|flagACK, a.ack+4, nil)
+	if _, err := conn.Write([]byte("more")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+
+	// A lost FIN is resent with the data before it
+	conn.tick(time.Now().Add(tcpMaxRTO))
+	a.expect(flagACK|flagPSH, a.ack, []byte("last"))
+	a.expect(flagFIN|flagACK, a.ack+4, nil)
+
+	// The app acknowledges everything and closes its side
+	a.send(a.seq, a.ack+5, flagACK|flagFIN, 65535, nil)
+	a.seq++
+	a.expect(flagACK, a.ack+5, nil)
+	if conn.state != stateClosed || a.registered() {
+		t.Errorf("state %d registered %v after both FINs, want closed and removed", conn.state, a.registered())
+	}
+}
+
+func TestTCPReset(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(65535)
+
+	a.send(a.seq, a.ack, flagRST, 0, nil)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Read after RST: %v, want ECONNRESET", err)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("Write after RST succeeded")
+	}
+	if a.registered() {
+		t.Error("connection still registered after RST")
+	}
+	a.quiet()
+
+	// Segments for a connection the stack doesn't know are reset
+	a.send(a.seq, a.ack, flagACK, 65535, []byte("stale"))
+	a.seq = 0
+	a.expect(flagRST, a.ack, nil)
+}
+
+func TestTCPAbort(t *testing.T) {
+	a := newTestApp(t)
+	conn := a.connect(65535)
+
+	conn.Abort()
+	a.expect(flagRST|flagACK, a.ack, nil)
+	if a.registered() {
+		t.Error("connection still registered after Abort")
+	}
+	// A second abort sends nothing
+	conn.Abort()
+	a.quiet()
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// streamConn presents a TCP stream as a net.Conn for TLS and HTTP
+// clients. Deadlines are not supported; callers cancel by closing.
+type streamConn struct {
+	*Stream
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
+
+func (c streamConn) LocalAddr() net.Addr                { return streamAddr("tunnel") }
+func (c streamConn) RemoteAddr() net.Addr               { return streamAddr(c.target) }
+func (c streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// DialContext opens a TCP stream to addr as a net.Conn, for code that
+// expects a dialer
+func (s *Session) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return DialStream(ctx, s, network, addr)
+}
+
+// DialStream opens a TCP stream through o as a net.Conn
+func DialStream(ctx context.Context, o Opener, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("network %s is not supported through the tunnel", network)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stream, err := o.OpenStream(addr)
+	if err != nil {
+		return nil, err
+	}
+	return streamConn{stream}, nil
+}
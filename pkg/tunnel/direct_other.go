@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tunnel
+
+import "syscall"
+
+// bindControl is a no-op where TUN mode is unsupported
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,285 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+// hopHeaders are stripped when forwarding (RFC 7230 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// maxHeaderBytes bounds the request line and headers of each request
+const maxHeaderBytes = 64 << 10
+
+// HTTPProxyServer is a local HTTP proxy (CONNECT and absolute-URI requests)
+// that opens streams through the tunnel like the SOCKS5 server
+type HTTPProxyServer struct {
+	listenAddr string
+	session    Opener
+	users      map[string]string
+	router     *router.Router
+	direct     *Direct
+	listener   net.Listener
+	mu         sync.Mutex
+}
+
+func NewHTTPProxyServer(listenAddr string) *HTTPProxyServer {
+	return &HTTPProxyServer{listenAddr: listenAddr}
+}
+
+func (s *HTTPProxyServer) SetSession(session Opener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = session
+}
+
+// SetUsers requires Proxy-Authorization (Basic) with one of these users
+func (s *HTTPProxyServer) SetUsers(users map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+}
+
+// SetRouter applies routing rules to new requests
+func (s *HTTPProxyServer) SetRouter(r *router.Router) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.router = r
+}
+
+// SetDirect sets how connections the router sends direct are made
+func (s *HTTPProxyServer) SetDirect(d *Direct) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.direct = d
+}
+
+func (s *HTTPProxyServer) Start() error {
+	s.mu.Lock()
+	network := s.direct.Network("tcp")
+	s.mu.Unlock()
+	listener, err := net.Listen(network, s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP proxy: %w", err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	fmt.Printf("🌐 HTTP proxy listening on %s\n", s.listenAddr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *HTTPProxyServer) Stop() error {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
+
+func (s *HTTPProxyServer) openStream(target string) (io.ReadWriteCloser, error) {
+	s.mu.Lock()
+	session, rt, d := s.session, s.router, s.direct
+	s.mu.Unlock()
+	remote, _, err := openConn(session, rt, d, target)
+	return remote, err
+}
+
+func (s *HTTPProxyServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	// The limit covers the headers only; bodies and CONNECT data are lifted
+	// from it once a request has been read
+	limit := &io.LimitedReader{R: conn}
+	br := bufio.NewReader(limit)
+
+	// Plain HTTP keeps one stream per origin across keep-alive requests
+	var stream io.ReadWriteCloser
+	var streamReader *bufio.Reader
+	var streamTarget string
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+
+	for {
+		limit.N = maxHeaderBytes
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if limit.N == 0 {
+				writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge, "request header too large")
+			}
+			return
+		}
+		limit.N = math.MaxInt64
+
+		if !s.authorized(req) {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"xp\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			s.handleConnect(conn, br, req)
+			return
+		}
+
+		if req.URL.Host == "" {
+			writeHTTPError(conn, http.StatusBadRequest, "absolute URI required")
+			return
+		}
+		target := hostPort(req.URL.Host, "80")
+		if stream == nil || target != streamTarget {
+			if stream != nil {
+				stream.Close()
+			}
+			stream, err = s.openStream(target)
+			if err != nil {
+				stream = nil
+				writeHTTPError(conn, gatewayStatus(err), err.Error())
+				return
+			}
+			streamReader = bufio.NewReader(stream)
+			streamTarget = target
+		}
+
+		keepAlive := !req.Close
+		removeHopHeaders(req.Header)
+		req.RequestURI = ""
+		if err := req.Write(stream); err != nil {
+			writeHTTPError(conn, gatewayStatus(err), err.Error())
+			return
+		}
+
+		// With fast open a refused connect shows up here
+		resp, err := http.ReadResponse(streamReader, req)
+		if err != nil {
+			writeHTTPError(conn, gatewayStatus(err), err.Error())
+			return
+		}
+		removeHopHeaders(resp.Header)
+		if !keepAlive {
+			resp.Close = true
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || resp.Close || !keepAlive {
+			return
+		}
+	}
+}
+
+func (s *HTTPProxyServer) authorized(req *http.Request) bool {
+	s.mu.Lock()
+	users := s.users
+	s.mu.Unlock()
+	if len(users) == 0 {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, encoded, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	return ok && CheckUser(users, username, password)
+}
+
+// handleConnect tunnels raw bytes for HTTPS and other CONNECT clients
+func (s *HTTPProxyServer) handleConnect(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	target := hostPort(req.Host, "443")
+	stream, err := s.openStream(target)
+	if err != nil {
+		writeHTTPError(conn, gatewayStatus(err), err.Error())
+		return
+	}
+	defer stream.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	// Bytes the client sent right after CONNECT may already sit in br
+	Relay(&bufferedConn{Conn: conn, r: br}, stream)
+	resetIfRefused(conn, stream)
+}
+
+// bufferedConn reads through a bufio.Reader that wraps the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func hostPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// gatewayStatus picks the HTTP status for a connection that couldn't be opened
+func gatewayStatus(err error) int {
+	switch ReplyCode(err) {
+	case RepNotAllowed:
+		return http.StatusForbidden
+	case RepTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func writeHTTPError(conn net.Conn, code int, msg string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(msg), msg)
+}
@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+)
+
+func TestHTTPProxyListenFamily(t *testing.T) {
+	// Addresses of the family the strategy rules out are refused
+	tests := []struct {
+		strategy dns.Strategy
+		listen   string
+	}{
+		{dns.IPv6Only, "127.0.0.1:0"},
+		{dns.IPv4Only, "[::1]:0"},
+	}
+	for _, tt := range tests {
+		s := NewHTTPProxyServer(tt.listen)
+		s.SetDirect(NewDirect(tt.strategy))
+		if err := s.Start(); err == nil {
+			t.Errorf("%s: listening on %s, want an error", tt.strategy, tt.listen)
+		}
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	client, server := sessionPair(t)
+	go func() {
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		st.Reply(RepSuccess, nil)
+		io.Copy(st, st)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	proxy := NewHTTPProxyServer(ln.Addr().String())
+	proxy.SetSession(client)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			proxy.handleConnection(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status %s", resp.Status)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo through CONNECT = %q, %v", buf, err)
+	}
+}
+
+// startHTTPProxy serves one connection of an HTTP proxy over client
+func startHTTPProxy(t *testing.T, client *Session) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	proxy := NewHTTPProxyServer(ln.Addr().String())
+	proxy.SetSession(client)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			proxy.handleConnection(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestHTTPProxyHeaderLimit(t *testing.T) {
+	client, _ := sessionPair(t)
+	client.SetFastOpen(true)
+	conn := startHTTPProxy(t, client)
+
+	// A CONNECT target far longer than a frame must not reach the mux
+	go func() {
+		conn.Write([]byte("CONNECT " + strings.Repeat("a", 40<<10) + ":443 HTTP/1.1\r\n"))
+		conn.Write([]byte("X-Filler: " + strings.Repeat("b", maxHeaderBytes) + "\r\n\r\n"))
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized request: %s", resp.Status)
+	}
+
+	conn = startHTTPProxy(t, client)
+	conn.Write([]byte("CONNECT " + strings.Repeat("a", 1000) + ":443 HTTP/1.1\r\n\r\n"))
+	if resp, err = http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("CONNECT to a 1000 byte host: %s", resp.Status)
+	}
+}
+
+func TestHTTPProxyConnectRefused(t *testing.T) {
+	client, server := sessionPair(t)
+	client.SetFastOpen(true)
+	go func() {
+		st, err := server.Accept()
+		if err == nil {
+			st.Reply(RepConnRefused, nil)
+			st.Close()
+		}
+	}()
+	conn := startHTTPProxy(t, client)
+
+	// Fast open answers before the server, so the refusal resets the
+	// connection instead
+	conn.Write([]byte("CONNECT closed.example.com:25 HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	conn.Write([]byte("EHLO example.com\r\n"))
+	_, err = br.ReadByte()
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("read after a refused connect: %v, want a reset", err)
+	}
+}
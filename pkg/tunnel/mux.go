@@ -0,0 +1,407 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stream multiplexing over a single tunnel
+//
+// Every tunnel message is one frame:
+//
+//	[type 1][stream id 4][payload]
+//
+// The client opens streams (connect for TCP, associate for UDP), the server
+// answers a connect with a reply frame carrying a SOCKS5 reply code, and
+// either side ends a stream with a close frame. Ping and pong frames use
+// stream id 0 and check that the tunnel still carries traffic both ways.
+//
+// Each side may have streamWindow bytes of a TCP stream in flight; the
+// reader returns credit with window frames as the app consumes the data,
+// so a slow stream holds back only its own sender. A peer that sends past
+// the window gets the stream reset.
+//
+// With fast open the client sends the connect together with the first
+// bytes of the stream and doesn't wait for the reply; a failure reply then
+// resets the stream.
+
+const (
+	FrameConnect     = 0x01 // payload: target host:port
+	FrameReply       = 0x02 // payload: SOCKS5 reply code, optional bound address
+	FrameData        = 0x03 // payload: stream bytes
+	FrameClose       = 0x04 // no payload
+	FrameAssociate   = 0x05 // no payload, opens a UDP stream
+	FrameUDP         = 0x06 // payload: SOCKS5 address + datagram
+	FramePing        = 0x07 // payload: 8-byte sequence number
+	FramePong        = 0x08 // payload: the ping's sequence number
+	FrameConnectData = 0x09 // payload: target length 2, target host:port, early data
+	FrameWindow      = 0x0a // payload: 4-byte count of bytes read since the last update
+)
+
+const (
+	frameHeaderLen    = 5
+	maxFramePayload   = 32 * 1024
+	streamQueueLen    = 256     // datagrams queued per UDP stream
+	streamWindow      = 1 << 21 // bytes in flight per TCP stream
+	streamOpenTimeout = 30 * time.Second
+
+	// maxTargetLen is the longest host:port a stream may connect to: a
+	// domain as long as SOCKS allows and a port
+	maxTargetLen = 255 + len(":65535")
+
+	// earlyDataWait is how long a fast-open stream waits for the app's
+	// first bytes before sending its connect without them
+	earlyDataWait = 50 * time.Millisecond
+)
+
+// Opener opens streams through the tunnel. A Session is one; clients with
+// several servers or tunnels use one that picks a session per stream.
+type Opener interface {
+	OpenStream(target string) (*Stream, error)
+	OpenPacketStream() (*Stream, error)
+}
+
+// Session multiplexes streams over one tunnel
+type Session struct {
+	tun     *Tunnel
+	client  bool
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	accept  chan *Stream
+	die     chan struct{}
+	err     error
+	once    sync.Once
+	pingSeq uint64
+	pings   map[uint64]chan struct{}
+	fast    atomic.Bool
+}
+
+// NewClientSession starts a session on the side that opens streams
+func NewClientSession(tun *Tunnel) *Session {
+	return newSession(tun, true)
+}
+
+// NewServerSession starts a session on the side that accepts streams
+func NewServerSession(tun *Tunnel) *Session {
+	return newSession(tun, false)
+}
+
+func newSession(tun *Tunnel, client bool) *Session {
+	s := &Session{
+		tun:     tun,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		accept:  make(chan *Stream, 64),
+		die:     make(chan struct{}),
+		pings:   make(map[uint64]chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// SetFastOpen makes OpenStream return without waiting for the server: the
+// connect goes out with the first write and a refusal shows up as a
+// StreamError from Read. Saves a round trip per stream.
+func (s *Session) SetFastOpen(on bool) {
+	s.fast.Store(on)
+}
+
+// OpenStream asks the server to connect to target and waits for its reply
+func (s *Session) OpenStream(target string) (*Stream, error) {
+	if len(target) > maxTargetLen {
+		return nil, fmt.Errorf("target too long: %d bytes", len(target))
+	}
+	if s.fast.Load() {
+		return s.openFastStream(target)
+	}
+	st := s.newStream("tcp", target)
+	if err := s.writeFrame(FrameConnect, st.id, []byte(target)); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+
+	timer := time.NewTimer(streamOpenTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-st.reply:
+		if reply[0] != RepSuccess {
+			s.remove(st.id)
+			return nil, &StreamError{Target: target, Code: reply[0]}
+		}
+		if _, err := socksAddrLen(reply[1:]); err == nil {
+			st.bound = reply[1:]
+		}
+		return st, nil
+	case <-st.fin:
+		return nil, &StreamError{Target: target, Code: RepServerFail}
+	case <-s.die:
+		return nil, s.Err()
+	case <-timer.C:
+		st.Close()
+		return nil, fmt.Errorf("timed out opening stream to %s", target)
+	}
+}
+
+func (s *Session) openFastStream(target string) (*Stream, error) {
+	select {
+	case <-s.die:
+		return nil, s.Err()
+	default:
+	}
+	st := s.newStream("tcp", target)
+	st.ready = make(chan struct{})
+	// Protocols where the server talks first never write, so don't wait
+	// for early data forever
+	st.connectTimer = time.AfterFunc(earlyDataWait, func() { st.sendConnect(nil) })
+	return st, nil
+}
+
+// OpenPacketStream opens a UDP stream; datagrams go through
+// ReadPacket and WritePacket
+func (s *Session) OpenPacketStream() (*Stream, error) {
+	st := s.newStream("udp", "")
+	if err := s.writeFrame(FrameAssociate, st.id, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept returns the next stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, s.Err()
+	}
+}
+
+// Ping sends a ping frame and returns the round-trip time of its pong
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	s.pingSeq++
+	seq := s.pingSeq
+	pong := make(chan struct{})
+	s.pings[seq] = pong
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, seq)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	// The write itself can hang on a dead link, so it counts against timeout
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.writeFrame(FramePing, 0, binary.BigEndian.AppendUint64(nil, seq))
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-sent:
+			if err != nil {
+				return 0, err
+			}
+		case <-pong:
+			return time.Since(start), nil
+		case <-timer.C:
+			return 0, fmt.Errorf("no pong within %s", timeout)
+		case <-s.die:
+			return 0, s.Err()
+		}
+	}
+}
+
+// Done is closed when the underlying tunnel fails or the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// Err returns why the session ended
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return io.ErrClosedPipe
+	}
+	return s.err
+}
+
+// Close ends the session and every stream on it
+func (s *Session) Close() error {
+	s.shutdown(io.ErrClosedPipe)
+	return nil
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) shutdown(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		close(s.die)
+		s.tun.Close()
+		for _, st := range streams {
+			st.remoteClose()
+		}
+	})
+}
+
+func (s *Session) newStream(network, target string) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	st := newStream(s, s.nextID, network, target)
+	s.streams[st.id] = st
+	return st
+}
+
+func (s *Session) get(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.streams[id]
+	delete(s.streams, id)
+	return st
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	select {
+	case <-s.die:
+		return s.Err()
+	default:
+	}
+	frame := make([]byte, frameHeaderLen+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	copy(frame[frameHeaderLen:], payload)
+	if _, err := s.tun.Write(frame); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) readLoop() {
+	buf := make([]byte, 2*maxFramePayload)
+	for {
+		n, err := s.tun.Read(buf)
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+		if n < frameHeaderLen {
+			continue
+		}
+		typ := buf[0]
+		id := binary.BigEndian.Uint32(buf[1:5])
+		payload := buf[frameHeaderLen:n]
+
+		switch typ {
+		case FrameConnect, FrameConnectData, FrameAssociate:
+			if s.client {
+				continue
+			}
+			network, target := "tcp", string(payload)
+			var early []byte
+			switch typ {
+			case FrameAssociate:
+				network = "udp"
+			case FrameConnectData:
+				if len(payload) < 2 {
+					continue
+				}
+				n := int(binary.BigEndian.Uint16(payload))
+				if len(payload) < 2+n {
+					continue
+				}
+				target, early = string(payload[2:2+n]), payload[2+n:]
+			}
+			st := newStream(s, id, network, target)
+			if len(early) > 0 {
+				// The stream is new, so its window has room
+				st.deliver(append([]byte(nil), early...), false)
+			}
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			case <-s.die:
+				return
+			}
+
+		case FrameReply:
+			if st := s.get(id); st != nil && len(payload) > 0 {
+				if st.ready != nil {
+					st.confirm(payload[0])
+					continue
+				}
+				select {
+				case st.reply <- append([]byte(nil), payload...):
+				default:
+				}
+			}
+
+		case FrameData, FrameUDP:
+			st := s.get(id)
+			if st == nil {
+				// Stream is gone here, tell the peer to stop sending
+				s.writeFrame(FrameClose, id, nil)
+				continue
+			}
+			if !st.deliver(append([]byte(nil), payload...), typ == FrameUDP) {
+				s.remove(id)
+				st.resetOverrun()
+				s.writeFrame(FrameClose, id, nil)
+			}
+
+		case FrameWindow:
+			if st := s.get(id); st != nil && len(payload) == 4 {
+				st.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+
+		case FrameClose:
+			if st := s.remove(id); st != nil {
+				st.remoteClose()
+			}
+
+		case FramePing:
+			s.writeFrame(FramePong, 0, payload)
+
+		case FramePong:
+			if len(payload) != 8 {
+				continue
+			}
+			s.mu.Lock()
+			pong := s.pings[binary.BigEndian.Uint64(payload)]
+			delete(s.pings, binary.BigEndian.Uint64(payload))
+			s.mu.Unlock()
+			if pong != nil {
+				close(pong)
+			}
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionPair returns the two ends of a session over an in-memory tunnel
+func sessionPair(t *testing.T) (client, server *Session) {
+	t.Helper()
+	key := bytes.Repeat([]byte{7}, 32)
+	c1, c2 := net.Pipe()
+	ct, err := NewTunnel(c1, key, Obfuscation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewTunnel(c2, key, Obfuscation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server = NewClientSession(ct), NewServerSession(st)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// serveUDP is the server end of UDP streams: one NAT socket per stream
+func serveUDP(server *Session) {
+	for {
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			nat, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return
+			}
+			defer nat.Close()
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					n, from, err := nat.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					st.WritePacket(SOCKSAddr(from.IP, from.Port), buf[:n])
+				}
+			}()
+			for {
+				addr, data, err := st.ReadPacket()
+				if err != nil {
+					return
+				}
+				target, err := ParseSOCKSAddr(addr)
+				if err != nil {
+					continue
+				}
+				dst, err := net.ResolveUDPAddr("udp", target)
+				if err != nil {
+					continue
+				}
+				nat.WriteToUDP(data, dst)
+			}
+		}()
+	}
+}
+
+// udpEcho starts a UDP echo server on addr
+func udpEcho(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveEcho(t, echo)
+	return echo
+}
+
+// serveEcho sends every datagram on echo back to its sender
+func serveEcho(t *testing.T, echo *net.UDPConn) {
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+}
+
+// openPair opens a stream to target and returns both of its ends
+func openPair(t *testing.T, client, server *Session, target string) (local, remote *Stream) {
+	t.Helper()
+	accepted := make(chan *Stream, 1)
+	go func() {
+		st, err := server.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		st.Reply(RepSuccess, nil)
+		accepted <- st
+	}()
+	local, err := client.OpenStream(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local, <-accepted
+}
+
+func TestStalledStreamDoesNotBlockSession(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stalled, remote := openPair(t, client, server, "stalled:80")
+
+	// Nobody reads the stream, so the writer stops at the window
+	data := bytes.Repeat([]byte("x"), 2*streamWindow)
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := stalled.Write(data)
+		wrote <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-wrote:
+		t.Fatalf("write past the window returned %v, want it to wait", err)
+	default:
+	}
+
+	if _, err := client.Ping(time.Second); err != nil {
+		t.Fatalf("ping with a stalled stream: %v", err)
+	}
+	echo, other := openPair(t, client, server, "echo:80")
+	go io.Copy(other, other)
+	if _, err := echo.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(echo, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	// Reading the stalled stream returns credit and lets the writer finish
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(remote, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("stalled stream data corrupted")
+	}
+	if err := <-wrote; err != nil {
+		t.Errorf("write: %v", err)
+	}
+}
+
+func TestStreamOverrunResets(t *testing.T) {
+	client, server := sessionPair(t)
+
+	st, remote := openPair(t, client, server, "target:80")
+
+	// A peer that ignores the window
+	chunk := make([]byte, maxFramePayload)
+	for sent := 0; sent <= streamWindow; sent += len(chunk) {
+		if err := client.writeFrame(FrameData, st.id, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := io.Copy(io.Discard, remote)
+	if !errors.Is(err, errStreamOverrun) {
+		t.Errorf("read from overrun stream: %v, want %v", err, errStreamOverrun)
+	}
+	if _, err := client.Ping(time.Second); err != nil {
+		t.Errorf("session died with the stream: %v", err)
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	client, server := sessionPair(t)
+
+	echo := udpEcho(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	go serveUDP(server)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	socks := NewSOCKS5Server(ln.Addr().String())
+	socks.SetSession(client)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go socks.handleConnection(conn)
+		}
+	}()
+
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	ctrl.Write([]byte{SOCKS5Version, 1, AuthNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[1] != AuthNone {
+		t.Fatalf("method reply %v, %v", reply, err)
+	}
+	ctrl.Write(append([]byte{SOCKS5Version, CmdUDPAssoc, 0}, SOCKSAddr(net.IPv4zero, 0)...))
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, head); err != nil || head[1] != RepSuccess {
+		t.Fatalf("associate reply %v, %v", head, err)
+	}
+	boundAddr, err := readSOCKSAddr(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := ParseSOCKSAddr(boundAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	target := echo.LocalAddr().(*net.UDPAddr)
+	header := append([]byte{0, 0, 0}, SOCKSAddr(target.IP, target.Port)...)
+	for i, msg := range []string{"one", "two"} {
+		if _, err := app.WriteTo(append(header, msg...), relay); err != nil {
+			t.Fatal(err)
+		}
+		app.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := app.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], append(header, msg...)) {
+			t.Errorf("datagram %d = %q, want %q from the echo server", i, buf[:n], append(header, msg...))
+		}
+	}
+}
+
+func TestFastOpenEarlyData(t *testing.T) {
+	client, server := sessionPair(t)
+	client.SetFastOpen(true)
+
+	st, err := client.OpenStream("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More than fits in the connect frame: the rest waits for the reply
+	data := bytes.Repeat([]byte("hello"), maxFramePayload/4)
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		wrote <- err
+	}()
+
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Target() != "example.com:443" {
+		t.Errorf("target %q", remote.Target())
+	}
+	// The early data is queued before the server has replied
+	early := maxFramePayload - 2 - len("example.com:443")
+	got := make([]byte, early)
+	if _, err := io.ReadFull(remote, got); err != nil || !bytes.Equal(got, data[:early]) {
+		t.Fatalf("early data %d bytes, %v", len(got), err)
+	}
+	select {
+	case err := <-wrote:
+		t.Fatalf("write finished before the reply: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	remote.Reply(RepSuccess, nil)
+	rest := make([]byte, len(data)-early)
+	if _, err := io.ReadFull(remote, rest); err != nil || !bytes.Equal(rest, data[early:]) {
+		t.Fatalf("data after the reply: %v", err)
+	}
+	if err := <-wrote; err != nil {
+		t.Errorf("write: %v", err)
+	}
+}
+
+func TestFastOpenRefused(t *testing.T) {
+	client, server := sessionPair(t)
+	client.SetFastOpen(true)
+	go func() {
+		st, err := server.Accept()
+		if err == nil {
+			st.Reply(RepConnRefused, nil)
+			st.Close()
+		}
+	}()
+
+	st, err := client.OpenStream("closed.example.com:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("EHLO")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Read(make([]byte, 1))
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Code != RepConnRefused {
+		t.Fatalf("read from a refused stream: %v, want a StreamError", err)
+	}
+	if st.Refused() == nil {
+		t.Error("Refused() is nil after the refusal")
+	}
+	if _, err := st.Write(bytes.Repeat([]byte("x"), 2*maxFramePayload)); err == nil {
+		t.Error("write after the refusal succeeded")
+	}
+}
+
+func TestOpenStreamTargetTooLong(t *testing.T) {
+	client, server := sessionPair(t)
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			st.Reply(RepSuccess, nil)
+		}
+	}()
+
+	host := strings.Repeat("a", 255)
+	for _, fast := range []bool{false, true} {
+		client.SetFastOpen(fast)
+		for _, target := range []string{host + ":65535x", strings.Repeat("a", 40<<10) + ":443"} {
+			if _, err := client.OpenStream(target); err == nil {
+				t.Errorf("fast %v: opened a %d byte target", fast, len(target))
+			}
+		}
+		st, err := client.OpenStream(host + ":65535")
+		if err != nil {
+			t.Fatalf("fast %v: longest target: %v", fast, err)
+		}
+		if fast {
+			// The connect goes out with the first write
+			if _, err := st.Write([]byte("x")); err != nil {
+				t.Errorf("fast %v: write: %v", fast, err)
+			}
+		}
+		st.Close()
+	}
+	if _, err := client.Ping(time.Second); err != nil {
+		t.Errorf("session after long targets: %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+// ErrBlocked is returned for destinations the routing rules refuse
+var ErrBlocked = errors.New("blocked by routing rules")
+
+var errNotConnected = errors.New("tunnel not connected")
+
+const (
+	directDialTimeout = 10 * time.Second
+	directUDPTimeout  = 2 * time.Minute
+)
+
+type resolveFunc func(ctx context.Context, domain string) (net.IP, error)
+
+// Direct connects to the destinations the router sends around the tunnel.
+// The inbounds, the DNS server's direct upstream and the subscription
+// fetcher share one; nil dials IPv4 with the system resolver.
+type Direct struct {
+	strategy dns.Strategy
+	iface    atomic.Value // string
+	fakeIPs  atomic.Pointer[dns.FakeIPPool]
+	resolve  atomic.Pointer[resolveFunc]
+}
+
+// NewDirect returns a Direct that uses the IP families strategy allows
+func NewDirect(strategy dns.Strategy) *Direct {
+	return &Direct{strategy: strategy}
+}
+
+// Strategy returns the IP family policy of direct connections and of the
+// local listeners
+func (d *Direct) Strategy() dns.Strategy {
+	if d == nil {
+		return dns.IPv4Only
+	}
+	return d.strategy
+}
+
+// Network narrows "tcp" or "udp" to the configured family
+func (d *Direct) Network(base string) string {
+	return d.Strategy().Network(base)
+}
+
+// SetInterface binds later direct connections to iface, for while TUN
+// routing owns the default route; empty lets the kernel choose
+func (d *Direct) SetInterface(iface string) {
+	d.iface.Store(iface)
+}
+
+// SetFakeIPPool makes connections to fake addresses use their domain
+func (d *Direct) SetFakeIPPool(pool *dns.FakeIPPool) {
+	d.fakeIPs.Store(pool)
+}
+
+// SetResolver resolves domains of direct connections with fn, e.g. the
+// built-in DNS server, whose answers are real even in fake-IP mode
+func (d *Direct) SetResolver(fn func(ctx context.Context, domain string) (net.IP, error)) {
+	f := resolveFunc(fn)
+	d.resolve.Store(&f)
+}
+
+func (d *Direct) control() func(network, address string, c syscall.RawConn) error {
+	if d == nil {
+		return nil
+	}
+	if iface, _ := d.iface.Load().(string); iface != "" {
+		return bindControl(iface)
+	}
+	return nil
+}
+
+func (d *Direct) fakePool() *dns.FakeIPPool {
+	if d == nil {
+		return nil
+	}
+	return d.fakeIPs.Load()
+}
+
+// unfake returns the domain target behind a fake-IP target, or target
+func (d *Direct) unfake(target string) string {
+	pool := d.fakePool()
+	if pool == nil {
+		return target
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return target
+	}
+	if domain, ok := pool.Lookup(ip); ok {
+		return net.JoinHostPort(domain, port)
+	}
+	return target
+}
+
+// resolveHost replaces a domain in addr with the address the resolver set
+// with SetResolver gives; without one addr is left to the dialer
+func (d *Direct) resolveHost(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if d == nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	fn := d.resolve.Load()
+	if fn == nil {
+		return addr, nil
+	}
+	ip, err := (*fn)(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// LookupIP resolves domain to an address direct connections may use,
+// with the resolver set with SetResolver or the system one
+func (d *Direct) LookupIP(ctx context.Context, domain string) (net.IP, error) {
+	if d != nil {
+		if fn := d.resolve.Load(); fn != nil {
+			return (*fn)(ctx, domain)
+		}
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, d.Network("ip"), domain)
+	if err != nil {
+		return nil, err
+	}
+	if ips = d.Strategy().Sort(ips); len(ips) == 0 {
+		return nil, fmt.Errorf("no address for %s allowed by ip_strategy %s", domain, d.Strategy())
+	}
+	return ips[0], nil
+}
+
+// Dial connects from this machine, bypassing TUN routing
+func (d *Direct) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	addr, err := d.resolveHost(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "udp":
+		network = d.Network(network)
+	}
+	dialer := net.Dialer{Timeout: directDialTimeout, Control: d.control()}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// resolveUDP resolves a direct UDP destination like Dial does
+func (d *Direct) resolveUDP(target string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), directDialTimeout)
+	defer cancel()
+	target, err := d.resolveHost(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr(d.Network("udp"), target)
+}
+
+// listenUDP opens a socket for direct UDP
+func (d *Direct) listenUDP() (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: d.control()}
+	pc, err := lc.ListenPacket(context.Background(), d.Network("udp"), ":0")
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// openConn connects to target the way the router decides: through a
+// tunnel stream, directly, or not at all. bound is the SOCKS5-encoded
+// address the connection was made from.
+func openConn(session Opener, r *router.Router, d *Direct, target string) (io.ReadWriteCloser, []byte, error) {
+	target = d.unfake(target)
+	switch r.Route(target) {
+	case router.Block:
+		return nil, nil, ErrBlocked
+	case router.Direct:
+		conn, err := d.Dial(context.Background(), "tcp", target)
+		if err != nil {
+			return nil, nil, err
+		}
+		local := conn.LocalAddr().(*net.TCPAddr)
+		return conn, SOCKSAddr(local.IP, local.Port), nil
+	}
+	if session == nil {
+		return nil, nil, errNotConnected
+	}
+	stream, err := session.OpenStream(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, stream.BoundAddr(), nil
+}
+
+// resetIfRefused makes conn end with a reset instead of a clean close when
+// remote is a fast-open stream the server refused, as the app was already
+// told it had connected
+func resetIfRefused(conn net.Conn, remote io.ReadWriteCloser) {
+	st, ok := remote.(*Stream)
+	if !ok || st.Refused() == nil {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+}
+
+// packetConn carries the datagrams of one local UDP flow. Addresses are
+// SOCKS5-encoded.
+type packetConn interface {
+	WritePacket(addr []byte, data []byte) error
+	ReadPacket() ([]byte, []byte, error)
+	Close() error
+	writable() error
+}
+
+// openPacket starts a UDP flow. Without routing rules or fake IPs it is a
+// plain UDP stream; otherwise every datagram is routed by its destination.
+func openPacket(session Opener, r *router.Router, d *Direct) (packetConn, error) {
+	if r == nil && d.fakePool() == nil {
+		if session == nil {
+			return nil, errNotConnected
+		}
+		return session.OpenPacketStream()
+	}
+	return &routedPacketConn{
+		session:  session,
+		router:   r,
+		direct:   d,
+		routes:   make(map[string]router.Action),
+		fakes:    make(map[string][]byte),
+		reals:    make(map[string]bool),
+		incoming: make(chan routedPacket, streamQueueLen),
+		die:      make(chan struct{}),
+	}, nil
+}
+
+type routedPacket struct {
+	addr, data []byte
+}
+
+// routedPacketConn sends each datagram through a UDP stream or a direct
+// socket, both opened on first use, and merges what comes back
+type routedPacketConn struct {
+	session  Opener
+	router   *router.Router
+	direct   *Direct
+	routes   map[string]router.Action // per destination, so rules run once
+	fakes    map[string][]byte        // fake destination by real ip:port, for replies
+	reals    map[string]bool          // real destinations the app sent to
+	mu       sync.Mutex
+	stream   *Stream
+	udp      *net.UDPConn
+	incoming chan routedPacket
+	die      chan struct{}
+	once     sync.Once
+}
+
+func (c *routedPacketConn) WritePacket(addr []byte, data []byte) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	target, err := ParseSOCKSAddr(addr)
+	if err != nil {
+		return err
+	}
+	real := c.direct.unfake(target)
+	action := c.route(real)
+	if action == router.Block {
+		return nil
+	}
+	var dst *net.UDPAddr
+	if real != target || action == router.Direct {
+		// A fake destination is resolved here for the tunnel too, so its
+		// replies can be told apart by the address they come from
+		if dst, err = c.direct.resolveUDP(real); err != nil {
+			return nil
+		}
+	}
+	c.mu.Lock()
+	if real != target {
+		c.fakes[dst.String()] = addr
+	} else {
+		c.reals[target] = true
+	}
+	c.mu.Unlock()
+
+	if action == router.Direct {
+		direct, err := c.directConn()
+		if err != nil {
+			return err
+		}
+		direct.SetReadDeadline(time.Now().Add(directUDPTimeout))
+		_, err = direct.WriteToUDP(data, dst)
+		return err
+	}
+	stream, err := c.tunnelStream()
+	if err != nil {
+		return err
+	}
+	if dst != nil {
+		addr = SOCKSAddr(dst.IP, dst.Port)
+	}
+	return stream.WritePacket(addr, data)
+}
+
+func (c *routedPacketConn) route(target string) router.Action {
+	c.mu.Lock()
+	action, ok := c.routes[target]
+	c.mu.Unlock()
+	if !ok {
+		action = c.router.Route(target)
+		c.mu.Lock()
+		c.routes[target] = action
+		c.mu.Unlock()
+	}
+	return action
+}
+
+func (c *routedPacketConn) ReadPacket() ([]byte, []byte, error) {
+	select {
+	case p := <-c.incoming:
+		return p.addr, p.data, nil
+	case <-c.die:
+		return nil, nil, io.EOF
+	}
+}
+
+func (c *routedPacketConn) writable() error {
+	select {
+	case <-c.die:
+		return io.ErrClosedPipe
+	default:
+		return nil
+	}
+}
+
+// Close ends the flow; it also happens when the server expires the
+// stream or the direct socket idles out, and the caller opens a new one
+func (c *routedPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.die)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.stream != nil {
+			c.stream.Close()
+		}
+		if c.udp != nil {
+			c.udp.Close()
+		}
+	})
+	return nil
+}
+
+func (c *routedPacketConn) tunnelStream() (*Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	if err := c.writable(); err != nil {
+		return nil, err
+	}
+	if c.session == nil {
+		return nil, errNotConnected
+	}
+	stream, err := c.session.OpenPacketStream()
+	if err != nil {
+		return nil, err
+	}
+	c.stream = stream
+	go func() {
+		defer c.Close()
+		for {
+			addr, data, err := stream.ReadPacket()
+			if err != nil {
+				return
+			}
+			c.deliver(addr, data)
+		}
+	}()
+	return stream, nil
+}
+
+func (c *routedPacketConn) directConn() (*net.UDPConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.udp != nil {
+		return c.udp, nil
+	}
+	if err := c.writable(); err != nil {
+		return nil, err
+	}
+	direct, err := c.direct.listenUDP()
+	if err != nil {
+		return nil, err
+	}
+	c.udp = direct
+	go func() {
+		defer c.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := direct.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			c.deliver(SOCKSAddr(from.IP, from.Port), append([]byte(nil), buf[:n]...))
+		}
+	}()
+	return direct, nil
+}
+
+// deliver queues a datagram for ReadPacket, dropping it if the reader
+// falls behind
+func (c *routedPacketConn) deliver(addr, data []byte) {
+	if from, err := ParseSOCKSAddr(addr); err == nil {
+		// The app expects replies from the fake address it sent to,
+		// unless it also talks to the real one
+		c.mu.Lock()
+		if fake := c.fakes[from]; fake != nil && !c.reals[from] {
+			addr = fake
+		}
+		c.mu.Unlock()
+	}
+	select {
+	case c.incoming <- routedPacket{addr, data}:
+	case <-c.die:
+	default:
+	}
+}
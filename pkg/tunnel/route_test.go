@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+func TestRoutedPacketConnFakeIPReplies(t *testing.T) {
+	// Two destinations on the same port, so only the address tells their
+	// replies apart
+	first := udpEcho(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	port := first.LocalAddr().(*net.UDPAddr).Port
+	second, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	serveEcho(t, second)
+	real := map[string]net.IP{"a.test": net.IPv4(127, 0, 0, 1), "b.test": net.IPv4(127, 0, 0, 2)}
+
+	direct, err := router.FromConfig(config.RoutingConfig{Final: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		router *router.Router
+	}{
+		{"tunnel", nil},
+		{"direct", direct},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := sessionPair(t)
+			go serveUDP(server)
+
+			pool, err := dns.NewFakeIPPool("198.19.0.0/16")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := NewDirect(dns.IPv4Only)
+			d.SetFakeIPPool(pool)
+			d.SetResolver(func(ctx context.Context, domain string) (net.IP, error) {
+				if ip := real[domain]; ip != nil {
+					return ip, nil
+				}
+				return nil, fmt.Errorf("no such domain %s", domain)
+			})
+
+			pc, err := openPacket(client, tt.router, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			// a.test again once b.test shares its port
+			sent := []string{"a.test", "b.test", "a.test"}
+			for _, domain := range sent {
+				fake := SOCKSAddr(pool.Allocate(domain), port)
+				if err := pc.WritePacket(fake, []byte(domain)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for range sent {
+				addr, data := nextPacket(t, pc)
+				fake := SOCKSAddr(pool.Allocate(string(data)), port)
+				if !bytes.Equal(addr, fake) {
+					t.Errorf("reply from %s came from %x, want its fake %x", data, addr, fake)
+				}
+			}
+		})
+	}
+}
+
+// nextPacket waits for the next datagram of pc
+func nextPacket(t *testing.T, pc packetConn) ([]byte, []byte) {
+	t.Helper()
+	type packet struct{ addr, data []byte }
+	got := make(chan packet, 1)
+	go func() {
+		addr, data, err := pc.ReadPacket()
+		if err == nil {
+			got <- packet{addr, data}
+		}
+	}()
+	select {
+	case p := <-got:
+		return p.addr, p.data
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+		return nil, nil
+	}
+}
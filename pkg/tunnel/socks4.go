@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS4 and SOCKS4a (CONNECT only), served on the SOCKS5 port for old
+// clients that don't speak SOCKS5
+const (
+	SOCKS4Version  = 0x04
+	SOCKS4Granted  = 0x5A
+	SOCKS4Rejected = 0x5B
+)
+
+// handleSOCKS4 serves a SOCKS4/4a request; the version byte is already read
+func (s *SOCKS5Server) handleSOCKS4(conn net.Conn) {
+	var header [7]byte // CD, DSTPORT, DSTIP
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	if _, err := readNullTerminated(conn); err != nil { // USERID
+		return
+	}
+
+	s.mu.Lock()
+	session, rt, d := s.session, s.router, s.direct
+	authRequired := len(s.users) > 0
+	s.mu.Unlock()
+
+	if header[0] != CmdConnect || authRequired {
+		s.sendSOCKS4Reply(conn, SOCKS4Rejected)
+		return
+	}
+
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(header[1:3])))
+	ip := net.IP(header[3:7])
+	host := ip.String()
+	// SOCKS4a: 0.0.0.x with x != 0 means a domain name follows the user ID
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullTerminated(conn)
+		if err != nil || domain == "" {
+			s.sendSOCKS4Reply(conn, SOCKS4Rejected)
+			return
+		}
+		host = domain
+	}
+
+	remote, _, err := openConn(session, rt, d, net.JoinHostPort(host, port))
+	if err != nil {
+		s.sendSOCKS4Reply(conn, SOCKS4Rejected)
+		return
+	}
+	defer remote.Close()
+	s.sendSOCKS4Reply(conn, SOCKS4Granted)
+	Relay(conn, remote)
+	resetIfRefused(conn, remote)
+}
+
+func (s *SOCKS5Server) sendSOCKS4Reply(conn net.Conn, rep byte) {
+	conn.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+}
+
+// readNullTerminated reads a NUL-terminated string of at most 255 bytes
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf []byte
+	var b [1]byte
+	for len(buf) <= 255 {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", fmt.Errorf("string too long")
+}
@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// socks4Request builds a SOCKS4 CONNECT, or SOCKS4a when domain is set
+func socks4Request(cmd byte, ip net.IP, port uint16, user, domain string) []byte {
+	b := []byte{SOCKS4Version, cmd}
+	b = binary.BigEndian.AppendUint16(b, port)
+	b = append(b, ip.To4()...)
+	b = append(append(b, user...), 0)
+	if domain != "" {
+		b = append(append(b, domain...), 0)
+	}
+	return b
+}
+
+func TestSOCKS4(t *testing.T) {
+	client, server := sessionPair(t)
+	targets := echoTargets(server)
+	s := NewSOCKS5Server("127.0.0.1:0")
+	s.SetSession(client)
+	granted := []byte{0x00, SOCKS4Granted, 0, 0, 0, 0, 0, 0}
+	rejected := []byte{0x00, SOCKS4Rejected, 0, 0, 0, 0, 0, 0}
+
+	tests := []struct {
+		name   string
+		req    []byte
+		target string // empty when rejected
+	}{
+		{"socks4", socks4Request(CmdConnect, net.IPv4(192, 0, 2, 1), 80, "user", ""), "192.0.2.1:80"},
+		{"socks4a", socks4Request(CmdConnect, net.IPv4(0, 0, 0, 1), 443, "", "example.com"), "example.com:443"},
+		{"socks4a with an empty domain", append(socks4Request(CmdConnect, net.IPv4(0, 0, 0, 1), 443, "", ""), 0), ""},
+		{"bind", socks4Request(0x02, net.IPv4(192, 0, 2, 1), 80, "", ""), ""},
+	}
+	for _, tt := range tests {
+		conn := serveSOCKS(t, s)
+		conn.Write(tt.req)
+		if tt.target == "" {
+			expect(t, conn, rejected, tt.name)
+			continue
+		}
+		expect(t, conn, granted, tt.name)
+		if target := <-targets; target != tt.target {
+			t.Errorf("%s: stream opened to %s, want %s", tt.name, target, tt.target)
+		}
+		conn.Write([]byte("ping"))
+		expect(t, conn, []byte("ping"), tt.name+" echo")
+	}
+
+	// SOCKS4 has no passwords, so it is refused while users are set
+	s.SetUsers(map[string]string{"alice": "secret"})
+	conn := serveSOCKS(t, s)
+	conn.Write(socks4Request(CmdConnect, net.IPv4(192, 0, 2, 1), 80, "alice", ""))
+	expect(t, conn, rejected, "socks4 with users")
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection after a rejection: %v, want EOF", err)
+	}
+}
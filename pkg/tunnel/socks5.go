@@ -1,28 +1,45 @@
 package tunnel
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"syscall"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
 )
 
 const (
 	SOCKS5Version  = 0x05
 	AuthNone       = 0x00
+	AuthPassword   = 0x02
+	AuthNoAccept   = 0xFF
 	CmdConnect     = 0x01
+	CmdUDPAssoc    = 0x03
 	AddrIPv4       = 0x01
 	AddrDomain     = 0x03
 	AddrIPv6       = 0x04
 	RepSuccess     = 0x00
 	RepServerFail  = 0x01
+	RepNotAllowed  = 0x02
+	RepNetUnreach  = 0x03
+	RepHostUnreach = 0x04
+	RepConnRefused = 0x05
+	RepTTLExpired  = 0x06
 	RepCmdNotSupp  = 0x07
 	RepAddrNotSupp = 0x08
 )
 
 type SOCKS5Server struct {
 	listenAddr string
-	tunnel     *Tunnel
+	session    Opener
+	users      map[string]string
+	router     *router.Router
+	direct     *Direct
 	listener   net.Listener
 	mu         sync.Mutex
 }
@@ -31,23 +48,53 @@ func NewSOCKS5Server(listenAddr string) *SOCKS5Server {
 	return &SOCKS5Server{listenAddr: listenAddr}
 }
 
-func (s *SOCKS5Server) SetTunnel(tunnel *Tunnel) {
+func (s *SOCKS5Server) SetSession(session Opener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = session
+}
+
+// SetUsers enables username/password authentication (RFC 1929).
+// SOCKS4 has no passwords and is refused while users are set.
+func (s *SOCKS5Server) SetUsers(users map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+}
+
+// SetRouter applies routing rules to new connections; nil sends
+// everything through the tunnel
+func (s *SOCKS5Server) SetRouter(r *router.Router) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.router = r
+}
+
+// SetDirect sets how connections the router sends direct are made
+func (s *SOCKS5Server) SetDirect(d *Direct) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.tunnel = tunnel
+	s.direct = d
 }
 
 func (s *SOCKS5Server) Start() error {
-	// Force IPv4 - IPv6 doesn't work in Iran
-	listener, err := net.Listen("tcp4", s.listenAddr)
+	s.mu.Lock()
+	network := s.direct.Network("tcp")
+	s.mu.Unlock()
+	listener, err := net.Listen(network, s.listenAddr)
 	if err != nil {
 		return fmt.Errorf("failed to start SOCKS5 server: %w", err)
 	}
+	s.mu.Lock()
 	s.listener = listener
+	s.mu.Unlock()
 	fmt.Printf("🧦 SOCKS5 server listening on %s\n", s.listenAddr)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			continue
 		}
 		go s.handleConnection(conn)
@@ -56,135 +103,248 @@ func (s *SOCKS5Server) Start() error {
 
 func (s *SOCKS5Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return
+	}
+	switch version[0] {
+	case SOCKS4Version:
+		s.handleSOCKS4(conn)
+		return
+	case SOCKS5Version:
+	default:
+		return
+	}
 	if err := s.handshake(conn); err != nil {
 		return
 	}
-	target, err := s.readRequest(conn)
+	cmd, target, err := s.readRequest(conn)
 	if err != nil {
 		return
 	}
 	s.mu.Lock()
-	tun := s.tunnel
+	session, rt, d := s.session, s.router, s.direct
 	s.mu.Unlock()
-	if tun == nil {
-		s.sendReply(conn, RepServerFail)
+	if cmd == CmdUDPAssoc {
+		s.handleUDPAssociate(conn, session, rt, d)
 		return
 	}
-	connectReq := append([]byte{CmdConnect}, []byte(target)...)
-	if _, err := tun.Write(connectReq); err != nil {
-		s.sendReply(conn, RepServerFail)
+	remote, bound, err := openConn(session, rt, d, target)
+	if err != nil {
+		s.sendReply(conn, ReplyCode(err), nil)
 		return
 	}
-	respBuf := make([]byte, 1024)
-	n, err := tun.Read(respBuf)
-	if err != nil || n < 1 {
-		s.sendReply(conn, RepServerFail)
-		return
+	defer remote.Close()
+	s.sendReply(conn, RepSuccess, bound)
+	Relay(conn, remote)
+	resetIfRefused(conn, remote)
+}
+
+// handshake negotiates the auth method; the version byte is already read
+func (s *SOCKS5Server) handshake(conn net.Conn) error {
+	methods, err := readMethods(conn)
+	if err != nil {
+		return err
 	}
-	if respBuf[0] != RepSuccess {
-		s.sendReply(conn, respBuf[0])
-		return
+
+	s.mu.Lock()
+	users := s.users
+	s.mu.Unlock()
+	method := byte(AuthNone)
+	if len(users) > 0 {
+		method = AuthPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{SOCKS5Version, AuthNoAccept})
+		return fmt.Errorf("no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{SOCKS5Version, method}); err != nil {
+		return err
+	}
+	if method == AuthPassword {
+		return s.authenticate(conn, users)
+	}
+	return nil
+}
+
+// readMethods reads NMETHODS and the auth methods the client offers
+func readMethods(r io.Reader) ([]byte, error) {
+	var nmethods [1]byte
+	if _, err := io.ReadFull(r, nmethods[:]); err != nil {
+		return nil, fmt.Errorf("handshake read failed")
 	}
-	s.sendReply(conn, RepSuccess)
-	s.proxy(conn, tun)
+	methods := make([]byte, nmethods[0])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, fmt.Errorf("handshake read failed")
+	}
+	return methods, nil
 }
 
-func (s *SOCKS5Server) handshake(conn net.Conn) error {
-	buf := make([]byte, 258)
-	n, err := conn.Read(buf)
-	if err != nil || n < 2 {
-		return fmt.Errorf("handshake read failed")
+// authenticate runs the RFC 1929 username/password sub-negotiation
+func (s *SOCKS5Server) authenticate(conn net.Conn, users map[string]string) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("auth read failed")
 	}
-	if buf[0] != SOCKS5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", buf[0])
+	if header[0] != 0x01 {
+		return fmt.Errorf("unsupported auth version: %d", header[0])
 	}
-	_, err = conn.Write([]byte{SOCKS5Version, AuthNone})
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return fmt.Errorf("auth read failed")
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return fmt.Errorf("auth read failed")
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return fmt.Errorf("auth read failed")
+	}
+
+	if !CheckUser(users, string(username), string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		return fmt.Errorf("authentication failed for %q", username)
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
 	return err
 }
 
-func (s *SOCKS5Server) readRequest(conn net.Conn) (string, error) {
-	buf := make([]byte, 262)
-	n, err := conn.Read(buf)
-	if err != nil || n < 4 {
-		return "", fmt.Errorf("request read failed")
+// CheckUser reports whether username/password match a configured user
+func CheckUser(users map[string]string, username, password string) bool {
+	want, ok := users[username]
+	match := subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+	return ok && match
+}
+
+// readRequest reads the request that follows the greeting, replying with
+// the matching error code when it can't be served
+func (s *SOCKS5Server) readRequest(conn net.Conn) (byte, string, error) {
+	cmd, target, err := parseSOCKS5Request(conn)
+	if err != nil {
+		var re *RequestError
+		if errors.As(err, &re) {
+			s.sendReply(conn, re.Code, nil)
+		}
+		return 0, "", err
+	}
+	return cmd, target, nil
+}
+
+// RequestError is a malformed or unsupported request and the reply code
+// the client gets for it
+type RequestError struct {
+	Code byte
+	Msg  string
+}
+
+func (e *RequestError) Error() string { return e.Msg }
+
+// parseSOCKS5Request reads VER CMD RSV ATYP DST.ADDR DST.PORT with exact
+// length reads, so requests split across TCP segments parse the same
+func parseSOCKS5Request(r io.Reader) (byte, string, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", fmt.Errorf("request read failed: %w", err)
+	}
+	if header[0] != SOCKS5Version {
+		return 0, "", &RequestError{RepServerFail, fmt.Sprintf("unsupported version: %d", header[0])}
 	}
-	if buf[0] != SOCKS5Version {
-		return "", fmt.Errorf("unsupported version")
+	cmd := header[1]
+	if cmd != CmdConnect && cmd != CmdUDPAssoc {
+		return 0, "", &RequestError{RepCmdNotSupp, fmt.Sprintf("unsupported command: %d", cmd)}
 	}
-	if buf[1] != CmdConnect {
-		s.sendReply(conn, RepCmdNotSupp)
-		return "", fmt.Errorf("unsupported command: %d", buf[1])
+	addr, err := readSOCKSAddr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	target, err := ParseSOCKSAddr(addr)
+	if err != nil {
+		return 0, "", &RequestError{RepAddrNotSupp, err.Error()}
+	}
+	return cmd, target, nil
+}
+
+// readSOCKSAddr reads ATYP, address and port and returns them undecoded
+func readSOCKSAddr(r io.Reader) ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:1]); err != nil {
+		return nil, fmt.Errorf("address read failed: %w", err)
 	}
-	var host string
-	var port uint16
-	switch buf[3] {
+	var n int
+	switch head[0] {
 	case AddrIPv4:
-		if n < 10 {
-			return "", fmt.Errorf("invalid IPv4")
-		}
-		host = fmt.Sprintf("%d.%d.%d.%d", buf[4], buf[5], buf[6], buf[7])
-		port = uint16(buf[8])<<8 | uint16(buf[9])
+		n = 1 + net.IPv4len + 2
+	case AddrIPv6:
+		n = 1 + net.IPv6len + 2
 	case AddrDomain:
-		domainLen := int(buf[4])
-		if n < 5+domainLen+2 {
-			return "", fmt.Errorf("invalid domain")
+		if _, err := io.ReadFull(r, head[1:]); err != nil {
+			return nil, fmt.Errorf("address read failed: %w", err)
 		}
-		host = string(buf[5 : 5+domainLen])
-		port = uint16(buf[5+domainLen])<<8 | uint16(buf[6+domainLen])
-	case AddrIPv6:
-		if n < 22 {
-			return "", fmt.Errorf("invalid IPv6")
+		if head[1] == 0 {
+			return nil, &RequestError{RepAddrNotSupp, "empty domain name"}
 		}
-		ip := net.IP(buf[4:20])
-		host = ip.String()
-		port = uint16(buf[20])<<8 | uint16(buf[21])
+		n = 2 + int(head[1]) + 2
 	default:
-		s.sendReply(conn, RepAddrNotSupp)
-		return "", fmt.Errorf("unsupported address type: %d", buf[3])
+		return nil, &RequestError{RepAddrNotSupp, fmt.Sprintf("unsupported address type: %d", head[0])}
 	}
-	return fmt.Sprintf("%s:%d", host, port), nil
+	addr := make([]byte, n)
+	copy(addr, head[:])
+	start := 1
+	if head[0] == AddrDomain {
+		start = 2
+	}
+	if _, err := io.ReadFull(r, addr[start:]); err != nil {
+		return nil, fmt.Errorf("address read failed: %w", err)
+	}
+	return addr, nil
 }
 
-func (s *SOCKS5Server) sendReply(conn net.Conn, rep byte) {
-	reply := []byte{SOCKS5Version, rep, 0x00, AddrIPv4, 0, 0, 0, 0, 0, 0}
+// sendReply writes a reply with the SOCKS5-encoded bound address, or
+// 0.0.0.0:0 when bound is empty
+func (s *SOCKS5Server) sendReply(conn net.Conn, rep byte, bound []byte) {
+	if len(bound) == 0 {
+		bound = []byte{AddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	reply := append([]byte{SOCKS5Version, rep, 0x00}, bound...)
 	conn.Write(reply)
 }
 
-func (s *SOCKS5Server) proxy(client net.Conn, tun *Tunnel) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := client.Read(buf)
-			if err != nil {
-				return
-			}
-			if _, err := tun.Write(buf[:n]); err != nil {
-				return
-			}
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := tun.Read(buf)
-			if err != nil {
-				return
-			}
-			if _, err := client.Write(buf[:n]); err != nil {
-				return
-			}
-		}
-	}()
-	wg.Wait()
+// ReplyCode maps a dial error to the SOCKS5 reply code that describes it
+func ReplyCode(err error) byte {
+	var streamErr *StreamError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return RepSuccess
+	case errors.Is(err, ErrBlocked):
+		return RepNotAllowed
+	case errors.As(err, &streamErr):
+		return streamErr.Code
+	case errors.As(err, &dnsErr):
+		return RepHostUnreach
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetUnreach
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return RepHostUnreach
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return RepNotAllowed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return RepTTLExpired
+	default:
+		return RepServerFail
+	}
 }
 
 func (s *SOCKS5Server) Stop() error {
-	if s.listener != nil {
-		return s.listener.Close()
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener != nil {
+		return listener.Close()
 	}
 	return nil
 }
@@ -0,0 +1,305 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/dns"
+)
+
+// socks5Request builds VER CMD RSV followed by a SOCKS5 address
+func socks5Request(cmd byte, addr []byte) []byte {
+	return append([]byte{SOCKS5Version, cmd, 0}, addr...)
+}
+
+func domainAddr(host string, port uint16) []byte {
+	b := append([]byte{AddrDomain, byte(len(host))}, host...)
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+func TestParseSOCKS5Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     []byte
+		cmd     byte
+		target  string
+		wantErr bool
+		code    byte // reply code when the error is a RequestError
+	}{
+		{"ipv4", socks5Request(CmdConnect, SOCKSAddr(net.IPv4(1, 2, 3, 4), 443)), CmdConnect, "1.2.3.4:443", false, 0},
+		{"ipv6", socks5Request(CmdConnect, SOCKSAddr(net.ParseIP("2001:db8::1"), 80)), CmdConnect, "[2001:db8::1]:80", false, 0},
+		{"domain", socks5Request(CmdConnect, domainAddr("example.com", 8080)), CmdConnect, "example.com:8080", false, 0},
+		{"udp associate", socks5Request(CmdUDPAssoc, SOCKSAddr(net.IPv4zero, 0)), CmdUDPAssoc, "0.0.0.0:0", false, 0},
+		{"bind", socks5Request(0x02, SOCKSAddr(net.IPv4zero, 0)), 0, "", true, RepCmdNotSupp},
+		{"socks4 version", []byte{SOCKS4Version, CmdConnect, 0, AddrIPv4, 1, 2, 3, 4, 0, 80}, 0, "", true, RepServerFail},
+		{"unknown address type", socks5Request(CmdConnect, []byte{0x05, 1, 2}), 0, "", true, RepAddrNotSupp},
+		{"domain with colon", socks5Request(CmdConnect, domainAddr("a:1", 80)), 0, "", true, RepAddrNotSupp},
+		{"ipv6 literal as domain", socks5Request(CmdConnect, domainAddr("::1", 80)), CmdConnect, "[::1]:80", false, 0},
+		{"empty domain", socks5Request(CmdConnect, []byte{AddrDomain, 0, 0, 80}), 0, "", true, RepAddrNotSupp},
+		{"short ipv4", socks5Request(CmdConnect, []byte{AddrIPv4, 1, 2}), 0, "", true, 0},
+		{"short header", []byte{SOCKS5Version}, 0, "", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, target, err := parseSOCKS5Request(bytes.NewReader(tt.req))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				re, ok := err.(*RequestError)
+				if tt.code != 0 && (!ok || re.Code != tt.code) {
+					t.Errorf("error %v, want reply code %d", err, tt.code)
+				}
+				return
+			}
+			if cmd != tt.cmd || target != tt.target {
+				t.Errorf("got %d %q, want %d %q", cmd, target, tt.cmd, tt.target)
+			}
+		})
+	}
+}
+
+func FuzzParseSOCKS5Request(f *testing.F) {
+	f.Add(socks5Request(CmdConnect, SOCKSAddr(net.IPv4(1, 2, 3, 4), 443)))
+	f.Add(socks5Request(CmdConnect, SOCKSAddr(net.ParseIP("2001:db8::1"), 80)))
+	f.Add(socks5Request(CmdConnect, domainAddr("example.com", 8080)))
+	f.Add(socks5Request(CmdUDPAssoc, SOCKSAddr(net.IPv4zero, 0)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		cmd, target, err := parseSOCKS5Request(r)
+		if err != nil {
+			return
+		}
+		if cmd != CmdConnect && cmd != CmdUDPAssoc {
+			t.Fatalf("accepted command %d", cmd)
+		}
+		// Exactly the request is consumed, whatever follows it stays
+		n, err := socksAddrLen(data[3:])
+		if err != nil {
+			t.Fatalf("accepted %x with a bad address: %v", data, err)
+		}
+		if read := len(data) - r.Len(); read != 3+n {
+			t.Fatalf("read %d bytes of a %d byte request", read, 3+n)
+		}
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			t.Fatalf("target %q: %v", target, err)
+		}
+		if data[3] == AddrDomain {
+			if host != string(data[5:3+n-2]) {
+				t.Fatalf("host %q, want %q", host, data[5:3+n-2])
+			}
+			return
+		}
+		// Addresses survive a round trip through the encoder
+		addr, err := socksHostAddr(target)
+		if err != nil {
+			t.Fatalf("re-encoding %q: %v", target, err)
+		}
+		if again, err := ParseSOCKSAddr(addr); err != nil || again != target {
+			t.Fatalf("round trip of %q = %q, %v", target, again, err)
+		}
+	})
+}
+
+func FuzzReadMethods(f *testing.F) {
+	f.Add([]byte{1, AuthNone})
+	f.Add([]byte{2, AuthNone, AuthPassword})
+	f.Add([]byte{0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		methods, err := readMethods(r)
+		if err != nil {
+			if len(data) > 0 && len(data) > int(data[0]) {
+				t.Fatalf("complete greeting %x refused: %v", data, err)
+			}
+			return
+		}
+		if len(methods) != int(data[0]) || !bytes.Equal(methods, data[1:1+len(methods)]) {
+			t.Fatalf("methods %x from greeting %x", methods, data)
+		}
+		if r.Len() != len(data)-1-len(methods) {
+			t.Fatalf("read past the greeting: %d bytes left of %d", r.Len(), len(data))
+		}
+	})
+}
+
+func TestSOCKS5ListenFamily(t *testing.T) {
+	// Addresses of the family the strategy rules out are refused
+	tests := []struct {
+		strategy dns.Strategy
+		listen   string
+	}{
+		{dns.IPv6Only, "127.0.0.1:0"},
+		{dns.IPv4Only, "[::1]:0"},
+	}
+	for _, tt := range tests {
+		s := NewSOCKS5Server(tt.listen)
+		s.SetDirect(NewDirect(tt.strategy))
+		if err := s.Start(); err == nil {
+			t.Errorf("%s: listening on %s, want an error", tt.strategy, tt.listen)
+		}
+	}
+}
+
+// serveSOCKS hands one end of a pipe to s and returns the other
+func serveSOCKS(t *testing.T, s *SOCKS5Server) net.Conn {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	go s.handleConnection(c2)
+	t.Cleanup(func() { c1.Close() })
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	return c1
+}
+
+// echoTargets answers streams on server with success and echoes them,
+// sending each stream's target to the returned channel
+func echoTargets(server *Session) <-chan string {
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			targets <- st.Target()
+			st.Reply(RepSuccess, nil)
+			go io.Copy(st, st)
+		}
+	}()
+	return targets
+}
+
+// expect reads len(want) bytes from conn and compares them
+func expect(t *testing.T, conn net.Conn, want []byte, what string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: % x, want % x", what, got, want)
+	}
+}
+
+// userPass builds an RFC 1929 username/password request
+func userPass(user, pass string) []byte {
+	b := append([]byte{0x01, byte(len(user))}, user...)
+	b = append(b, byte(len(pass)))
+	return append(b, pass...)
+}
+
+func TestSOCKS5Handshake(t *testing.T) {
+	client, server := sessionPair(t)
+	targets := echoTargets(server)
+	s := NewSOCKS5Server("127.0.0.1:0")
+	s.SetSession(client)
+
+	// Without users only "no authentication" is acceptable
+	conn := serveSOCKS(t, s)
+	conn.Write([]byte{SOCKS5Version, 1, AuthPassword})
+	expect(t, conn, []byte{SOCKS5Version, AuthNoAccept}, "password only without users")
+
+	conn = serveSOCKS(t, s)
+	conn.Write([]byte{SOCKS5Version, 2, AuthPassword, AuthNone})
+	expect(t, conn, []byte{SOCKS5Version, AuthNone}, "method choice")
+	conn.Write(socks5Request(CmdConnect, domainAddr("example.com", 443)))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != RepSuccess {
+		t.Fatalf("connect reply % x %v", reply, err)
+	}
+	if target := <-targets; target != "example.com:443" {
+		t.Errorf("stream opened to %s", target)
+	}
+	conn.Write([]byte("ping"))
+	expect(t, conn, []byte("ping"), "echo")
+
+	s.SetUsers(map[string]string{"alice": "secret"})
+
+	// With users "no authentication" is no longer enough
+	conn = serveSOCKS(t, s)
+	conn.Write([]byte{SOCKS5Version, 1, AuthNone})
+	expect(t, conn, []byte{SOCKS5Version, AuthNoAccept}, "no auth with users")
+
+	for _, tt := range []struct {
+		user, pass string
+		status     byte
+	}{
+		{"alice", "wrong", 0x01},
+		{"bob", "secret", 0x01},
+		{"alice", "", 0x01},
+		{"alice", "secret", 0x00},
+	} {
+		conn = serveSOCKS(t, s)
+		conn.Write([]byte{SOCKS5Version, 2, AuthNone, AuthPassword})
+		expect(t, conn, []byte{SOCKS5Version, AuthPassword}, "method choice with users")
+		conn.Write(userPass(tt.user, tt.pass))
+		expect(t, conn, []byte{0x01, tt.status}, tt.user+"/"+tt.pass)
+		if tt.status != 0 {
+			// The connection is closed after a failure
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Errorf("%s/%s: connection still open", tt.user, tt.pass)
+			}
+			continue
+		}
+		conn.Write(socks5Request(CmdConnect, SOCKSAddr(net.IPv4(192, 0, 2, 1), 80)))
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != RepSuccess {
+			t.Fatalf("connect reply after auth % x %v", reply, err)
+		}
+		if target := <-targets; target != "192.0.2.1:80" {
+			t.Errorf("stream opened to %s", target)
+		}
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	users := map[string]string{"alice": "secret", "empty": ""}
+	for _, tt := range []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"alice", "secret2", false},
+		{"bob", "", false},
+		{"empty", "", true},
+	} {
+		if got := CheckUser(users, tt.user, tt.pass); got != tt.ok {
+			t.Errorf("CheckUser(%s, %s) = %v", tt.user, tt.pass, got)
+		}
+	}
+}
+
+func TestSOCKS5Stop(t *testing.T) {
+	// Start returns once Stop closes the listener rather than spinning on Accept
+	s := NewSOCKS5Server("127.0.0.1:0")
+	s.SetDirect(NewDirect(dns.IPv4Only))
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		listening := s.listener != nil
+		s.mu.Unlock()
+		if listening {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server never started listening")
+		}
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start after Stop = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+}
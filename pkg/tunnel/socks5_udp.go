@@ -0,0 +1,218 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+// handleUDPAssociate serves a SOCKS5 UDP ASSOCIATE (RFC 1928 section 7).
+// Datagrams from the app arrive on a relay socket and travel through a UDP
+// stream; the association lives as long as the TCP control connection.
+func (s *SOCKS5Server) handleUDPAssociate(conn net.Conn, session Opener, rt *router.Router, d *Direct) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+
+	relay, err := net.ListenUDP(d.Network("udp"), &net.UDPAddr{IP: localIP})
+	if err != nil {
+		s.sendReply(conn, RepServerFail, nil)
+		return
+	}
+	defer relay.Close()
+
+	assoc := &udpAssociation{session: session, router: rt, direct: d, relay: relay}
+	defer assoc.close()
+	if _, err := assoc.stream(); err != nil {
+		s.sendReply(conn, RepServerFail, nil)
+		return
+	}
+	bound := relay.LocalAddr().(*net.UDPAddr)
+	s.sendReply(conn, RepSuccess, SOCKSAddr(bound.IP, bound.Port))
+
+	go assoc.uplink(clientIP)
+
+	// The association ends when the app closes the control connection
+	io.Copy(io.Discard, conn)
+}
+
+// udpAssociation relays between the local relay socket and a UDP flow.
+// The server may expire an idle stream, so a new one is opened on demand.
+type udpAssociation struct {
+	session Opener
+	router  *router.Router
+	direct  *Direct
+	relay   *net.UDPConn
+	client  atomic.Pointer[net.UDPAddr]
+	mu      sync.Mutex
+	current packetConn
+	closed  bool
+}
+
+func (a *udpAssociation) stream() (packetConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, io.ErrClosedPipe
+	}
+	if a.current != nil && a.current.writable() == nil {
+		return a.current, nil
+	}
+	st, err := openPacket(a.session, a.router, a.direct)
+	if err != nil {
+		return nil, err
+	}
+	a.current = st
+	go a.downlink(st)
+	return st, nil
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.current != nil {
+		a.current.Close()
+	}
+}
+
+// uplink forwards datagrams from the app to the tunnel
+func (a *udpAssociation) uplink(clientIP net.IP) {
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Only the host that owns the control connection may use the relay
+		if !src.IP.Equal(clientIP) {
+			continue
+		}
+		// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA; fragments are not supported
+		pkt := buf[:n]
+		if len(pkt) < 4 || pkt[2] != 0 {
+			continue
+		}
+		addrLen, err := socksAddrLen(pkt[3:])
+		if err != nil {
+			continue
+		}
+		a.client.Store(src)
+
+		st, err := a.stream()
+		if err != nil {
+			return
+		}
+		if err := st.WritePacket(pkt[3:3+addrLen], pkt[3+addrLen:]); err != nil {
+			continue
+		}
+	}
+}
+
+// downlink forwards datagrams from one stream back to the app
+func (a *udpAssociation) downlink(st packetConn) {
+	for {
+		addr, data, err := st.ReadPacket()
+		if err != nil {
+			return
+		}
+		client := a.client.Load()
+		if client == nil {
+			continue
+		}
+		pkt := make([]byte, 0, 3+len(addr)+len(data))
+		pkt = append(pkt, 0, 0, 0)
+		pkt = append(pkt, addr...)
+		pkt = append(pkt, data...)
+		a.relay.WriteToUDP(pkt, client)
+	}
+}
+
+// socksAddrLen returns the length of the SOCKS5 address (ATYP, address,
+// port) at the start of b
+func socksAddrLen(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, fmt.Errorf("empty address")
+	}
+	var n int
+	switch b[0] {
+	case AddrIPv4:
+		n = 1 + net.IPv4len + 2
+	case AddrIPv6:
+		n = 1 + net.IPv6len + 2
+	case AddrDomain:
+		if len(b) < 2 {
+			return 0, fmt.Errorf("short domain address")
+		}
+		n = 2 + int(b[1]) + 2
+	default:
+		return 0, fmt.Errorf("unsupported address type: %d", b[0])
+	}
+	if len(b) < n {
+		return 0, fmt.Errorf("short address")
+	}
+	return n, nil
+}
+
+// ParseSOCKSAddr decodes a SOCKS5 address into host:port
+func ParseSOCKSAddr(b []byte) (string, error) {
+	n, err := socksAddrLen(b)
+	if err != nil {
+		return "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b[n-2 : n])))
+	switch b[0] {
+	case AddrIPv4, AddrIPv6:
+		return net.JoinHostPort(net.IP(b[1:n-2]).String(), port), nil
+	default:
+		host := string(b[2 : n-2])
+		if net.ParseIP(host) == nil && strings.ContainsFunc(host, badHostRune) {
+			return "", fmt.Errorf("invalid domain name %q", host)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+}
+
+// badHostRune reports characters that can't be in a domain name and would
+// make host:port ambiguous
+func badHostRune(r rune) bool {
+	return r <= ' ' || r == 0x7f || strings.ContainsRune(":[]/\\", r)
+}
+
+// socksHostAddr encodes host:port as a SOCKS5 address, using the domain
+// form for names
+func socksHostAddr(target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return SOCKSAddr(ip, port), nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("domain too long")
+	}
+	b := append([]byte{AddrDomain, byte(len(host))}, host...)
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// SOCKSAddr encodes an IP and port as a SOCKS5 address
+func SOCKSAddr(ip net.IP, port int) []byte {
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{AddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{AddrIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
@@ -0,0 +1,403 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// StreamError reports a connect the server refused, with its SOCKS5 reply code
+type StreamError struct {
+	Target string
+	Code   byte
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("server failed to connect to %s (reply %d)", e.Target, e.Code)
+}
+
+// errStreamOverrun resets a stream whose peer sent past its window
+var errStreamOverrun = errors.New("stream reset: peer sent more than the window allows")
+
+// Stream is one TCP connection or UDP association inside a Session
+type Stream struct {
+	id      uint32
+	session *Session
+	network string
+	target  string
+	buf     []byte
+	reply   chan []byte
+
+	// Receive side: frames waiting for Read, their size, and the bytes
+	// read since the last window update
+	mu       sync.Mutex
+	queue    [][]byte
+	queued   int
+	consumed int
+	readable chan struct{}
+	reset    error
+
+	// Send side: bytes the peer still has room for, and a signal when its
+	// window updates add more
+	credit   int
+	credited chan struct{}
+
+	bound     []byte
+	fin       chan struct{} // peer closed, no more frames
+	finOnce   sync.Once
+	die       chan struct{} // closed locally
+	closeOnce sync.Once
+
+	// Fast open: ready is closed when the server has connected, refused
+	// is set before fin when it couldn't
+	ready        chan struct{}
+	readyOnce    sync.Once
+	refused      error
+	connectOnce  sync.Once
+	connectTimer *time.Timer
+}
+
+func newStream(s *Session, id uint32, network, target string) *Stream {
+	return &Stream{
+		id:       id,
+		session:  s,
+		network:  network,
+		target:   target,
+		reply:    make(chan []byte, 1),
+		readable: make(chan struct{}, 1),
+		credit:   streamWindow,
+		credited: make(chan struct{}, 1),
+		fin:      make(chan struct{}),
+		die:      make(chan struct{}),
+	}
+}
+
+// Network returns "tcp" or "udp"
+func (st *Stream) Network() string { return st.network }
+
+// Target returns the address a TCP stream was opened to
+func (st *Stream) Target() string { return st.target }
+
+// deliver queues a frame from the session reader without ever blocking
+// it, so one slow stream can't stall the others. UDP frames are dropped
+// when the reader falls behind; TCP frames fit in the window the peer was
+// given, so it returns false only for a peer that ignored it.
+func (st *Stream) deliver(payload []byte, datagram bool) bool {
+	st.mu.Lock()
+	if datagram && len(st.queue) >= streamQueueLen {
+		st.mu.Unlock()
+		return true
+	}
+	if !datagram {
+		if st.queued+len(payload) > streamWindow {
+			st.mu.Unlock()
+			return false
+		}
+		st.queued += len(payload)
+	}
+	st.queue = append(st.queue, payload)
+	st.mu.Unlock()
+	signal(st.readable)
+	return true
+}
+
+// grant adds a window update from the peer to the send credit
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	signal(st.credited)
+}
+
+// signal wakes the waiter on a one-slot channel, if it isn't awake already
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// remoteClose marks the end of the stream from the peer
+func (st *Stream) remoteClose() {
+	st.finOnce.Do(func() { close(st.fin) })
+}
+
+// resetOverrun ends a stream whose peer overran the window
+func (st *Stream) resetOverrun() {
+	st.finOnce.Do(func() {
+		st.reset = errStreamOverrun
+		close(st.fin)
+	})
+}
+
+// sendConnect sends the connect of a fast-open stream with as much of p as
+// fits in the frame. n is how much of p went along, sent whether this call
+// was the one that sent the connect.
+func (st *Stream) sendConnect(p []byte) (n int, sent bool, err error) {
+	st.connectOnce.Do(func() {
+		sent = true
+		n = min(len(p), maxFramePayload-2-len(st.target))
+		st.mu.Lock()
+		st.credit -= n
+		st.mu.Unlock()
+		payload := make([]byte, 0, 2+len(st.target)+n)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(st.target)))
+		payload = append(payload, st.target...)
+		payload = append(payload, p[:n]...)
+		err = st.session.writeFrame(FrameConnectData, st.id, payload)
+	})
+	return n, sent, err
+}
+
+// confirm handles the server's reply to a fast-open connect
+func (st *Stream) confirm(code byte) {
+	if code == RepSuccess {
+		st.readyOnce.Do(func() { close(st.ready) })
+		return
+	}
+	st.finOnce.Do(func() {
+		st.refused = &StreamError{Target: st.target, Code: code}
+		close(st.fin)
+	})
+}
+
+// awaitReady blocks writes after the early data until the server has
+// connected, so it never has to buffer more than one frame per stream
+func (st *Stream) awaitReady() error {
+	select {
+	case <-st.ready:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(streamOpenTimeout)
+	defer timer.Stop()
+	select {
+	case <-st.ready:
+		return nil
+	case <-st.fin:
+		if err := st.Refused(); err != nil {
+			return err
+		}
+		return io.ErrClosedPipe
+	case <-st.die:
+		return io.ErrClosedPipe
+	case <-st.session.die:
+		return st.session.Err()
+	case <-timer.C:
+		return fmt.Errorf("timed out opening stream to %s", st.target)
+	}
+}
+
+// Refused returns the StreamError of a fast-open stream the server could
+// not connect, nil otherwise
+func (st *Stream) Refused() error {
+	select {
+	case <-st.fin:
+		return st.refused
+	default:
+		return nil
+	}
+}
+
+// Reply answers a connect on the accepting side. bound is the
+// SOCKS5-encoded address the server connected from, or nil.
+func (st *Stream) Reply(code byte, bound []byte) error {
+	return st.session.writeFrame(FrameReply, st.id, append([]byte{code}, bound...))
+}
+
+// BoundAddr returns the SOCKS5-encoded address the server reported for a
+// connected stream, or nil
+func (st *Stream) BoundAddr() []byte { return st.bound }
+
+func (st *Stream) Read(p []byte) (int, error) {
+	if len(st.buf) == 0 {
+		frame, err := st.next()
+		if err != nil {
+			return 0, err
+		}
+		st.buf = frame
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	return n, nil
+}
+
+// next returns the next queued frame, draining the queue before
+// reporting the peer's close. Once half the window has been read it goes
+// back to the peer as a window update.
+func (st *Stream) next() ([]byte, error) {
+	for {
+		if frame, ok := st.pop(); ok {
+			return frame, nil
+		}
+		select {
+		case <-st.readable:
+		case <-st.fin:
+			if frame, ok := st.pop(); ok {
+				return frame, nil
+			}
+			switch {
+			case st.refused != nil:
+				return nil, st.refused
+			case st.reset != nil:
+				return nil, st.reset
+			}
+			return nil, io.EOF
+		case <-st.die:
+			return nil, io.ErrClosedPipe
+		}
+	}
+}
+
+func (st *Stream) pop() ([]byte, bool) {
+	st.mu.Lock()
+	if len(st.queue) == 0 {
+		st.mu.Unlock()
+		return nil, false
+	}
+	frame := st.queue[0]
+	st.queue[0] = nil
+	st.queue = st.queue[1:]
+	update := 0
+	if st.network == "tcp" {
+		st.queued -= len(frame)
+		st.consumed += len(frame)
+		if st.consumed >= streamWindow/2 {
+			update, st.consumed = st.consumed, 0
+		}
+	}
+	st.mu.Unlock()
+	if update > 0 {
+		st.session.writeFrame(FrameWindow, st.id, binary.BigEndian.AppendUint32(nil, uint32(update)))
+	}
+	return frame, true
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	if st.ready != nil {
+		st.connectTimer.Stop()
+		n, sent, err := st.sendConnect(p)
+		if err != nil {
+			return 0, err
+		}
+		if sent {
+			written, p = n, p[n:]
+		}
+		if len(p) > 0 {
+			if err := st.awaitReady(); err != nil {
+				return written, err
+			}
+		}
+	}
+	for len(p) > 0 {
+		credit, err := st.awaitCredit()
+		if err != nil {
+			return written, err
+		}
+		chunk := p[:min(len(p), maxFramePayload, credit)]
+		st.mu.Lock()
+		st.credit -= len(chunk)
+		st.mu.Unlock()
+		if err := st.session.writeFrame(FrameData, st.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// ReadPacket returns the next datagram on a UDP stream. addr is the
+// SOCKS5-encoded peer address (ATYP, address, port).
+func (st *Stream) ReadPacket() (addr []byte, data []byte, err error) {
+	for {
+		frame, err := st.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		n, err := socksAddrLen(frame)
+		if err != nil {
+			continue
+		}
+		return frame[:n], frame[n:], nil
+	}
+}
+
+// WritePacket sends a datagram on a UDP stream. addr is SOCKS5-encoded.
+func (st *Stream) WritePacket(addr []byte, data []byte) error {
+	if err := st.writable(); err != nil {
+		return err
+	}
+	payload := make([]byte, 0, len(addr)+len(data))
+	payload = append(payload, addr...)
+	payload = append(payload, data...)
+	return st.session.writeFrame(FrameUDP, st.id, payload)
+}
+
+// awaitCredit blocks until the peer has room for more data on the stream
+func (st *Stream) awaitCredit() (int, error) {
+	for {
+		if err := st.writable(); err != nil {
+			return 0, err
+		}
+		st.mu.Lock()
+		credit := st.credit
+		st.mu.Unlock()
+		if credit > 0 {
+			return credit, nil
+		}
+		select {
+		case <-st.credited:
+		case <-st.die:
+		case <-st.fin:
+		case <-st.session.die:
+			return 0, st.session.Err()
+		}
+	}
+}
+
+func (st *Stream) writable() error {
+	select {
+	case <-st.die:
+		return io.ErrClosedPipe
+	case <-st.fin:
+		return io.ErrClosedPipe
+	default:
+		return nil
+	}
+}
+
+// Close ends the stream on both sides
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.die)
+		if st.ready != nil {
+			// A connect that hasn't gone out yet never will
+			st.connectTimer.Stop()
+			st.connectOnce.Do(func() {})
+		}
+		if st.session.remove(st.id) != nil {
+			st.session.writeFrame(FrameClose, st.id, nil)
+		}
+	})
+	return nil
+}
+
+// Relay copies data both ways between a local connection and a stream
+// until either side stops
+func Relay(local io.ReadWriter, stream io.ReadWriter) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stream, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, stream)
+		done <- struct{}{}
+	}()
+	<-done
+}
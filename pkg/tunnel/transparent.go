@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Transparent proxy modes
+const (
+	TransparentRedirect = "redirect" // nftables redirect, TCP only
+	TransparentTProxy   = "tproxy"   // nftables tproxy, TCP and UDP
+)
+
+// TransparentOptions configures the transparent proxy and its firewall rules
+type TransparentOptions struct {
+	Listen  string   // listen address, e.g. 0.0.0.0:12345
+	Mode    string   // redirect or tproxy
+	Mark    int      // tproxy fwmark
+	Table   int      // tproxy routing table
+	Exclude []string // extra CIDRs that never go through the proxy
+}
+
+// bypassRanges are never proxied: loopback, private LANs, link-local,
+// multicast and broadcast
+var bypassRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+}
+
+const transparentTable = "xp_transparent"
+
+// TransparentRules returns the commands that install and remove the
+// nftables (and, for tproxy, policy routing) rules sending traffic to the
+// transparent listener. serverIPs are excluded so the tunnel itself is
+// never captured.
+func TransparentRules(opts TransparentOptions, serverIPs []string) (install, remove []string, err error) {
+	_, portStr, err := net.SplitHostPort(opts.Listen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid transparent listen address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid transparent listen port: %s", portStr)
+	}
+
+	bypass := append([]string{}, bypassRanges...)
+	for _, cidr := range append(append([]string{}, serverIPs...), opts.Exclude...) {
+		if !strings.Contains(cidr, "/") {
+			cidr += "/32"
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, nil, fmt.Errorf("invalid exclude range %q", cidr)
+		}
+		bypass = append(bypass, cidr)
+	}
+	set := fmt.Sprintf("nft add element ip %s bypass '{ %s }'", transparentTable, strings.Join(bypass, ", "))
+
+	install = []string{
+		fmt.Sprintf("nft add table ip %s", transparentTable),
+		fmt.Sprintf("nft 'add set ip %s bypass { type ipv4_addr; flags interval; }'", transparentTable),
+		set,
+	}
+	remove = []string{fmt.Sprintf("nft delete table ip %s", transparentTable)}
+
+	switch opts.Mode {
+	case TransparentRedirect:
+		install = append(install,
+			fmt.Sprintf("nft 'add chain ip %s prerouting { type nat hook prerouting priority dstnat; }'", transparentTable),
+			fmt.Sprintf("nft add rule ip %s prerouting ip daddr @bypass return", transparentTable),
+			fmt.Sprintf("nft add rule ip %s prerouting meta l4proto tcp redirect to :%d", transparentTable, port),
+			fmt.Sprintf("nft 'add chain ip %s output { type nat hook output priority -100; }'", transparentTable),
+			fmt.Sprintf("nft add rule ip %s output ip daddr @bypass return", transparentTable),
+			fmt.Sprintf("nft add rule ip %s output meta l4proto tcp redirect to :%d", transparentTable, port),
+		)
+	case TransparentTProxy:
+		mark := fmt.Sprintf("0x%x", opts.Mark)
+		install = append(install,
+			fmt.Sprintf("nft 'add chain ip %s prerouting { type filter hook prerouting priority mangle; }'", transparentTable),
+			fmt.Sprintf("nft add rule ip %s prerouting ip daddr @bypass return", transparentTable),
+			fmt.Sprintf("nft add rule ip %s prerouting meta l4proto '{ tcp, udp }' meta mark set %s tproxy to :%d accept", transparentTable, mark, port),
+			// Locally generated traffic is marked and rerouted through lo,
+			// where prerouting hands it to the listener. Replies (including
+			// the proxy's own spoofed UDP replies) are left alone.
+			fmt.Sprintf("nft 'add chain ip %s output { type route hook output priority mangle; }'", transparentTable),
+			fmt.Sprintf("nft add rule ip %s output ct direction reply return", transparentTable),
+			fmt.Sprintf("nft add rule ip %s output ip daddr @bypass return", transparentTable),
+			fmt.Sprintf("nft add rule ip %s output meta l4proto '{ tcp, udp }' meta mark set %s", transparentTable, mark),
+			fmt.Sprintf("ip rule add fwmark %s lookup %d", mark, opts.Table),
+			fmt.Sprintf("ip route add local 0.0.0.0/0 dev lo table %d", opts.Table),
+		)
+		remove = append(remove,
+			fmt.Sprintf("ip rule del fwmark %s lookup %d", mark, opts.Table),
+			fmt.Sprintf("ip route del local 0.0.0.0/0 dev lo table %d", opts.Table),
+		)
+	default:
+		return nil, nil, fmt.Errorf("unsupported transparent mode: %s (use redirect or tproxy)", opts.Mode)
+	}
+	return install, remove, nil
+}
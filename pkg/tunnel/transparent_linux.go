@@ -0,0 +1,321 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+	"golang.org/x/sys/unix"
+)
+
+// TransparentProxy accepts traffic redirected by the firewall and sends it
+// through the tunnel to its original destination. Redirect mode recovers
+// the destination with SO_ORIGINAL_DST; tproxy mode reads it from the
+// socket itself and also handles UDP.
+type TransparentProxy struct {
+	opts     TransparentOptions
+	session  Opener
+	router   *router.Router
+	direct   *Direct
+	listener net.Listener
+	udp      *net.UDPConn
+	flows    map[string]*tproxyUDPFlow
+	mu       sync.Mutex
+}
+
+func NewTransparentProxy(opts TransparentOptions) *TransparentProxy {
+	return &TransparentProxy{opts: opts, flows: make(map[string]*tproxyUDPFlow)}
+}
+
+func (p *TransparentProxy) SetSession(session Opener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.session = session
+}
+
+func (p *TransparentProxy) SetRouter(r *router.Router) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.router = r
+}
+
+// SetDirect sets how connections the router sends direct are made
+func (p *TransparentProxy) SetDirect(d *Direct) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.direct = d
+}
+
+func (p *TransparentProxy) outbound() (Opener, *router.Router, *Direct) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.session, p.router, p.direct
+}
+
+func (p *TransparentProxy) Start() error {
+	_, _, d := p.outbound()
+	lc := net.ListenConfig{}
+	switch p.opts.Mode {
+	case TransparentRedirect:
+	case TransparentTProxy:
+		lc.Control = transparentControl
+		udpLC := net.ListenConfig{Control: transparentControl}
+		pc, err := udpLC.ListenPacket(context.Background(), d.Network("udp"), p.opts.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to start transparent UDP listener: %w", err)
+		}
+		p.udp = pc.(*net.UDPConn)
+		go p.serveUDP()
+	default:
+		return fmt.Errorf("unsupported transparent mode: %s (use redirect or tproxy)", p.opts.Mode)
+	}
+
+	listener, err := lc.Listen(context.Background(), d.Network("tcp"), p.opts.Listen)
+	if err != nil {
+		if p.udp != nil {
+			p.udp.Close()
+		}
+		return fmt.Errorf("failed to start transparent proxy: %w", err)
+	}
+	p.listener = listener
+	fmt.Printf("🪞 Transparent proxy (%s) listening on %s\n", p.opts.Mode, p.opts.Listen)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			continue
+		}
+		go p.handleTCP(conn.(*net.TCPConn))
+	}
+}
+
+func (p *TransparentProxy) Stop() error {
+	if p.udp != nil {
+		p.udp.Close()
+	}
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	return nil
+}
+
+func (p *TransparentProxy) handleTCP(conn *net.TCPConn) {
+	defer conn.Close()
+
+	var dst *net.TCPAddr
+	if p.opts.Mode == TransparentRedirect {
+		var err error
+		if dst, err = originalDst(conn); err != nil {
+			return
+		}
+	} else {
+		dst = conn.LocalAddr().(*net.TCPAddr)
+	}
+	// Connections made straight to the listener would loop forever
+	if dst.String() == p.listener.Addr().String() {
+		return
+	}
+
+	session, rt, d := p.outbound()
+	remote, _, err := openConn(session, rt, d, dst.String())
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	Relay(conn, remote)
+	resetIfRefused(conn, remote)
+}
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST, which x/sys/unix lacks
+const ip6tSoOriginalDst = 80
+
+// originalDst reads the pre-NAT destination of a redirected connection
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in the ip6_mtuinfo buffer
+			var info *unix.IPv6MTUInfo
+			if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst); sockErr == nil {
+				var port [2]byte
+				binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+				dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			}
+			return
+		}
+		// sockaddr_in fits in the ipv6_mreq buffer
+		var mreq *unix.IPv6Mreq
+		if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); sockErr == nil {
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST failed: %w", sockErr)
+	}
+	return dst, nil
+}
+
+// transparentControl lets a socket accept and send with foreign addresses.
+// An IPv6 socket may also carry IPv4 traffic, so it gets both options.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	ipv6 := strings.HasSuffix(network, "6")
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); sockErr != nil {
+			return
+		}
+		if ipv6 {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); sockErr != nil {
+				return
+			}
+		}
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		if strings.HasPrefix(network, "udp") {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); sockErr != nil || !ipv6 {
+				return
+			}
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// tproxyUDPFlow is one local UDP source and the stream carrying its
+// datagrams. Replies are sent from sockets bound to each remote address,
+// so the app sees them coming from where it sent to.
+type tproxyUDPFlow struct {
+	src     *net.UDPAddr
+	stream  packetConn
+	senders map[string]net.PacketConn
+}
+
+func (p *TransparentProxy) serveUDP() {
+	buf := make([]byte, 65535)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := p.udp.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		dst, err := origDstFromOOB(oob[:oobn])
+		if err != nil || dst.String() == p.udp.LocalAddr().String() {
+			continue
+		}
+		flow, err := p.udpFlow(src)
+		if err != nil {
+			continue
+		}
+		if err := flow.stream.WritePacket(SOCKSAddr(dst.IP, dst.Port), buf[:n]); err != nil {
+			// The server expired the association; the next packet opens a new one
+			p.endFlow(flow)
+		}
+	}
+}
+
+func (p *TransparentProxy) udpFlow(src *net.UDPAddr) (*tproxyUDPFlow, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if flow := p.flows[src.String()]; flow != nil {
+		return flow, nil
+	}
+	stream, err := openPacket(p.session, p.router, p.direct)
+	if err != nil {
+		return nil, err
+	}
+	flow := &tproxyUDPFlow{src: src, stream: stream, senders: make(map[string]net.PacketConn)}
+	p.flows[src.String()] = flow
+	go p.udpDownlink(flow)
+	return flow, nil
+}
+
+func (p *TransparentProxy) endFlow(flow *tproxyUDPFlow) {
+	p.mu.Lock()
+	if p.flows[flow.src.String()] == flow {
+		delete(p.flows, flow.src.String())
+	}
+	p.mu.Unlock()
+	flow.stream.Close()
+}
+
+func (p *TransparentProxy) udpDownlink(flow *tproxyUDPFlow) {
+	defer func() {
+		p.endFlow(flow)
+		for _, sender := range flow.senders {
+			sender.Close()
+		}
+	}()
+	for {
+		addr, data, err := flow.stream.ReadPacket()
+		if err != nil {
+			return
+		}
+		from, err := ParseSOCKSAddr(addr)
+		if err != nil {
+			continue
+		}
+		sender := flow.senders[from]
+		if sender == nil {
+			// from is an address literal, so it picks the socket's family
+			lc := net.ListenConfig{Control: transparentControl}
+			if sender, err = lc.ListenPacket(context.Background(), "udp", from); err != nil {
+				continue
+			}
+			flow.senders[from] = sender
+		}
+		sender.WriteTo(data, flow.src)
+	}
+}
+
+// origDstFromOOB extracts IP_ORIGDSTADDR or IPV6_ORIGDSTADDR from the
+// control messages
+func origDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		// struct sockaddr_in: family(2) port(2, network order) addr(4)
+		if msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= 8 {
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+		// struct sockaddr_in6: family(2) port(2) flowinfo(4) addr(16)
+		if msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= 24 {
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("original destination missing")
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// cmsg builds one control message as the kernel would deliver it
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
+
+func TestOrigDstFromOOB(t *testing.T) {
+	v4 := []byte{2, 0, 0x1f, 0x90, 203, 0, 113, 7, 0, 0, 0, 0, 0, 0, 0, 0}
+	v6 := make([]byte, 28)
+	v6[0], v6[2], v6[3] = 10, 0x01, 0xbb
+	copy(v6[8:24], net.ParseIP("2001:db8::7"))
+
+	tests := []struct {
+		name string
+		oob  []byte
+		want string
+	}{
+		{"ipv4", cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, v4), "203.0.113.7:8080"},
+		{"ipv6", cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, v6), "[2001:db8::7]:443"},
+		{"other first", append(cmsg(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0}), cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, v4)...), "203.0.113.7:8080"},
+		{"missing", cmsg(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0}), ""},
+		{"short", cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, v6[:16]), ""},
+	}
+	for _, tt := range tests {
+		dst, err := origDstFromOOB(tt.oob)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, dst)
+			}
+			continue
+		}
+		if err != nil || dst.String() != tt.want {
+			t.Errorf("%s: got %v, %v, want %s", tt.name, dst, err, tt.want)
+		}
+	}
+}
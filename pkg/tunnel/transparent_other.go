@@ -0,0 +1,28 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"fmt"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+)
+
+// TransparentProxy needs SO_ORIGINAL_DST / IP_TRANSPARENT and is Linux only
+type TransparentProxy struct{}
+
+func NewTransparentProxy(opts TransparentOptions) *TransparentProxy {
+	return &TransparentProxy{}
+}
+
+func (p *TransparentProxy) SetSession(session Opener) {}
+
+func (p *TransparentProxy) SetRouter(r *router.Router) {}
+
+func (p *TransparentProxy) SetDirect(d *Direct) {}
+
+func (p *TransparentProxy) Start() error {
+	return fmt.Errorf("transparent proxy is only supported on Linux")
+}
+
+func (p *TransparentProxy) Stop() error { return nil }
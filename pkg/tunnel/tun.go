@@ -0,0 +1,209 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/router"
+	"github.com/abbasnazari-0/xp-proto/pkg/tun"
+)
+
+// TUNOptions configures TUN mode
+type TUNOptions struct {
+	Name      string   // interface name
+	Address   string   // interface address in CIDR form
+	MTU       int      // interface MTU
+	AutoRoute bool     // route all IPv4 traffic through the device
+	Exclude   []string // ranges that keep their current route (server first)
+}
+
+// TUNProxy routes whole-system traffic: a TUN device feeds a userspace
+// stack, and every TCP connection and UDP flow it terminates becomes a
+// tunnel stream
+type TUNProxy struct {
+	opts    TUNOptions
+	session Opener
+	router  *router.Router
+	direct  *Direct
+	dev     *tun.Device
+	routes  *tun.Routes
+	stack   *tun.Stack
+	flows   map[string]*tunUDPFlow
+	dns     DNSHandler
+	mu      sync.Mutex
+}
+
+// DNSHandler answers DNS queries in wire format
+type DNSHandler interface {
+	Handle(query []byte, udp bool) []byte
+}
+
+func NewTUNProxy(opts TUNOptions) *TUNProxy {
+	return &TUNProxy{opts: opts, flows: make(map[string]*tunUDPFlow)}
+}
+
+func (p *TUNProxy) SetSession(session Opener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.session = session
+}
+
+func (p *TUNProxy) Start() error {
+	dev, err := tun.OpenDevice(p.opts.Name, p.opts.Address, p.opts.MTU)
+	if err != nil {
+		return err
+	}
+	p.dev = dev
+	if p.opts.AutoRoute {
+		// Direct connections must keep using the real uplink
+		_, _, d := p.outbound()
+		if iface, err := tun.DefaultInterface(); err == nil && d != nil {
+			d.SetInterface(iface)
+		}
+		routes, err := tun.SetupRoutes(dev.Name(), p.opts.Exclude)
+		if err != nil {
+			dev.Close()
+			return fmt.Errorf("failed to set up routes: %w", err)
+		}
+		p.routes = routes
+	}
+	fmt.Printf("🕳️  TUN device %s up (%s, mtu %d)\n", dev.Name(), p.opts.Address, p.opts.MTU)
+
+	p.stack = tun.NewStack(dev, p.opts.MTU, p)
+	if err := p.stack.Run(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("TUN device failed: %w", err)
+	}
+	return nil
+}
+
+func (p *TUNProxy) Stop() error {
+	if p.routes != nil {
+		p.routes.Remove()
+	}
+	if p.dev != nil {
+		return p.dev.Close()
+	}
+	return nil
+}
+
+func (p *TUNProxy) SetRouter(r *router.Router) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.router = r
+}
+
+// SetDirect sets how connections the router sends direct are made
+func (p *TUNProxy) SetDirect(d *Direct) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.direct = d
+}
+
+// SetDNS answers every DNS query (UDP port 53) leaving the device with h
+// instead of forwarding it, so fake-IP and split DNS apply system-wide
+func (p *TUNProxy) SetDNS(h DNSHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dns = h
+}
+
+func (p *TUNProxy) outbound() (Opener, *router.Router, *Direct) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.session, p.router, p.direct
+}
+
+// HandleTCP opens a stream for a connection terminated by the stack
+func (p *TUNProxy) HandleTCP(conn *tun.TCPConn) {
+	session, rt, d := p.outbound()
+	remote, _, err := openConn(session, rt, d, conn.Destination().String())
+	if err != nil {
+		conn.Abort()
+		return
+	}
+	defer remote.Close()
+	Relay(conn, remote)
+	if st, ok := remote.(*Stream); ok && st.Refused() != nil {
+		conn.Abort()
+		return
+	}
+	conn.Close()
+}
+
+// tunUDPFlow is one local UDP source and the stream carrying its datagrams
+type tunUDPFlow struct {
+	src    *net.UDPAddr
+	stream packetConn
+}
+
+// HandleUDP forwards a datagram through the flow of its source
+func (p *TUNProxy) HandleUDP(src, dst *net.UDPAddr, data []byte) {
+	p.mu.Lock()
+	dns := p.dns
+	p.mu.Unlock()
+	if dns != nil && dst.Port == 53 {
+		query := append([]byte(nil), data...)
+		go func() {
+			if resp := dns.Handle(query, true); resp != nil {
+				p.stack.WriteUDP(dst, src, resp)
+			}
+		}()
+		return
+	}
+	flow, err := p.udpFlow(src)
+	if err != nil {
+		return
+	}
+	if err := flow.stream.WritePacket(SOCKSAddr(dst.IP, dst.Port), data); err != nil {
+		// The server expired the association; the next datagram opens a new one
+		p.endFlow(flow)
+	}
+}
+
+func (p *TUNProxy) udpFlow(src *net.UDPAddr) (*tunUDPFlow, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if flow := p.flows[src.String()]; flow != nil {
+		return flow, nil
+	}
+	stream, err := openPacket(p.session, p.router, p.direct)
+	if err != nil {
+		return nil, err
+	}
+	flow := &tunUDPFlow{src: src, stream: stream}
+	p.flows[src.String()] = flow
+	go p.udpDownlink(flow)
+	return flow, nil
+}
+
+func (p *TUNProxy) endFlow(flow *tunUDPFlow) {
+	p.mu.Lock()
+	if p.flows[flow.src.String()] == flow {
+		delete(p.flows, flow.src.String())
+	}
+	p.mu.Unlock()
+	flow.stream.Close()
+}
+
+func (p *TUNProxy) udpDownlink(flow *tunUDPFlow) {
+	defer p.endFlow(flow)
+	for {
+		addr, data, err := flow.stream.ReadPacket()
+		if err != nil {
+			return
+		}
+		from, err := ParseSOCKSAddr(addr)
+		if err != nil {
+			continue
+		}
+		// Replies come from address literals; the stack refuses IPv6 ones
+		fromAddr, err := net.ResolveUDPAddr("udp", from)
+		if err != nil {
+			continue
+		}
+		p.stack.WriteUDP(fromAddr, flow.src, data)
+	}
+}
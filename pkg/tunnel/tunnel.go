@@ -2,12 +2,15 @@ package tunnel
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
 	"github.com/abbasnazari-0/xp-proto/pkg/crypto"
 	"github.com/abbasnazari-0/xp-proto/pkg/obfs"
 )
@@ -20,10 +23,49 @@ type Tunnel struct {
 	timing     *obfs.TimingObfuscator
 	readMu     sync.Mutex
 	writeMu    sync.Mutex
-	closed     bool
+	closed     atomic.Bool
+	// pending is the first payload, already decrypted by AcceptTunnel
+	pending []byte
 }
 
-func NewTunnel(conn net.Conn, key []byte) (*Tunnel, error) {
+// Obfuscation is the traffic shaping of a tunnel. Padding is understood
+// by the other side whether or not it pads itself.
+type Obfuscation struct {
+	Fragment obfs.FragmentConfig
+	Padding  obfs.PaddingConfig
+	Timing   obfs.TimingConfig
+}
+
+func DefaultObfuscation() Obfuscation {
+	return Obfuscation{
+		Fragment: obfs.DefaultFragmentConfig(),
+		Padding:  obfs.DefaultPaddingConfig(),
+		Timing:   obfs.DefaultTimingConfig(),
+	}
+}
+
+// ObfuscationFromConfig converts the obfuscation section of the config
+func ObfuscationFromConfig(oc config.ObfuscationConfig) Obfuscation {
+	o := DefaultObfuscation()
+	o.Fragment.Enabled = oc.FragmentEnabled()
+	if oc.FragmentMin > 0 {
+		o.Fragment.MinSize = oc.FragmentMin
+	}
+	if oc.FragmentMax > 0 {
+		o.Fragment.MaxSize = oc.FragmentMax
+	}
+	o.Padding.Enabled = oc.PaddingEnabled()
+	if oc.PaddingMin > 0 {
+		o.Padding.MinPad = oc.PaddingMin
+	}
+	if oc.PaddingMax > 0 {
+		o.Padding.MaxPad = oc.PaddingMax
+	}
+	o.Timing.Enabled = oc.TimingEnabled()
+	return o
+}
+
+func NewTunnel(conn net.Conn, key []byte, o Obfuscation) (*Tunnel, error) {
 	xpCrypto, err := crypto.NewXPCrypto(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create crypto: %w", err)
@@ -31,16 +73,46 @@ func NewTunnel(conn net.Conn, key []byte) (*Tunnel, error) {
 	return &Tunnel{
 		conn:       conn,
 		crypto:     xpCrypto,
-		fragmenter: obfs.NewFragmenter(obfs.DefaultFragmentConfig()),
-		padder:     obfs.NewPadder(obfs.DefaultPaddingConfig()),
-		timing:     obfs.NewTimingObfuscator(obfs.DefaultTimingConfig()),
+		fragmenter: obfs.NewFragmenter(o.Fragment),
+		padder:     obfs.NewPadder(o.Padding),
+		timing:     obfs.NewTimingObfuscator(o.Timing),
 	}, nil
 }
 
+// ErrAuthFailed means the first packet decrypted with none of the keys
+var ErrAuthFailed = errors.New("authentication failed")
+
+// AcceptTunnel is the server side of NewTunnel for several keys: it reads
+// the first packet and keeps the tunnel of the key that decrypts it. The
+// returned index tells which key (and so which user) connected.
+func AcceptTunnel(conn net.Conn, keys [][]byte, o Obfuscation) (*Tunnel, int, error) {
+	encrypted, err := readPacket(conn)
+	if err != nil {
+		return nil, -1, err
+	}
+	for i, key := range keys {
+		t, err := NewTunnel(conn, key, o)
+		if err != nil {
+			return nil, -1, err
+		}
+		padded, err := t.crypto.Decrypt(encrypted)
+		if err != nil {
+			continue
+		}
+		data, err := t.padder.Unpad(padded)
+		if err != nil {
+			return nil, -1, fmt.Errorf("unpad failed: %w", err)
+		}
+		t.pending = data
+		return t, i, nil
+	}
+	return nil, -1, ErrAuthFailed
+}
+
 func (t *Tunnel) Write(data []byte) (int, error) {
 	t.writeMu.Lock()
 	defer t.writeMu.Unlock()
-	if t.closed {
+	if t.closed.Load() {
 		return 0, io.ErrClosedPipe
 	}
 	padded := t.padder.Pad(data)
@@ -62,19 +134,16 @@ func (t *Tunnel) Write(data []byte) (int, error) {
 func (t *Tunnel) Read(buf []byte) (int, error) {
 	t.readMu.Lock()
 	defer t.readMu.Unlock()
-	if t.closed {
+	if t.closed.Load() {
 		return 0, io.ErrClosedPipe
 	}
-	lenBuf := make([]byte, 4)
-	if _, err := io.ReadFull(t.conn, lenBuf); err != nil {
-		return 0, err
-	}
-	packetLen := binary.BigEndian.Uint32(lenBuf)
-	if packetLen > 1024*1024 {
-		return 0, fmt.Errorf("packet too large: %d", packetLen)
+	if t.pending != nil {
+		n := copy(buf, t.pending)
+		t.pending = nil
+		return n, nil
 	}
-	encrypted := make([]byte, packetLen)
-	if _, err := io.ReadFull(t.conn, encrypted); err != nil {
+	encrypted, err := readPacket(t.conn)
+	if err != nil {
 		return 0, err
 	}
 	padded, err := t.crypto.Decrypt(encrypted)
@@ -89,8 +158,25 @@ func (t *Tunnel) Read(buf []byte) (int, error) {
 	return n, nil
 }
 
+// readPacket reads one length-prefixed encrypted packet
+func readPacket(conn net.Conn) ([]byte, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+	packetLen := binary.BigEndian.Uint32(lenBuf)
+	if packetLen > 1024*1024 {
+		return nil, fmt.Errorf("packet too large: %d", packetLen)
+	}
+	encrypted := make([]byte, packetLen)
+	if _, err := io.ReadFull(conn, encrypted); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
 func (t *Tunnel) Close() error {
-	t.closed = true
+	t.closed.Store(true)
 	return t.conn.Close()
 }
 
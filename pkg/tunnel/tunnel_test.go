@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+func TestObfuscationFromConfig(t *testing.T) {
+	on, off := true, false
+	def := DefaultObfuscation()
+
+	// Unset means the defaults, everything on
+	if got := ObfuscationFromConfig(config.ObfuscationConfig{}); got != def {
+		t.Errorf("empty section gives %+v, want %+v", got, def)
+	}
+
+	o := ObfuscationFromConfig(config.ObfuscationConfig{Fragment: &off, Padding: &off, TimingJitter: &off})
+	if o.Fragment.Enabled || o.Padding.Enabled || o.Timing.Enabled {
+		t.Errorf("switched off: %+v", o)
+	}
+	// Sizes stay at the defaults while switched off
+	if o.Fragment.MinSize != def.Fragment.MinSize || o.Padding.MaxPad != def.Padding.MaxPad {
+		t.Errorf("sizes changed: %+v", o)
+	}
+
+	o = ObfuscationFromConfig(config.ObfuscationConfig{
+		Fragment: &on, FragmentMin: 20, FragmentMax: 80,
+		Padding: &on, PaddingMin: 32, PaddingMax: 512,
+	})
+	if !o.Fragment.Enabled || o.Fragment.MinSize != 20 || o.Fragment.MaxSize != 80 {
+		t.Errorf("fragment %+v", o.Fragment)
+	}
+	if !o.Padding.Enabled || o.Padding.MinPad != 32 || o.Padding.MaxPad != 512 {
+		t.Errorf("padding %+v", o.Padding)
+	}
+	// Delays and jitter aren't configurable and keep their defaults
+	if o.Fragment.MinDelay != def.Fragment.MinDelay || o.Timing != def.Timing {
+		t.Errorf("defaults lost: fragment %+v timing %+v", o.Fragment, o.Timing)
+	}
+
+	// One size set keeps the other's default
+	o = ObfuscationFromConfig(config.ObfuscationConfig{FragmentMax: 80, PaddingMin: 32})
+	if o.Fragment.MinSize != def.Fragment.MinSize || o.Fragment.MaxSize != 80 || o.Padding.MinPad != 32 || o.Padding.MaxPad != def.Padding.MaxPad {
+		t.Errorf("partial sizes: fragment %+v padding %+v", o.Fragment, o.Padding)
+	}
+}
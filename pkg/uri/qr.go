@@ -0,0 +1,50 @@
+package uri
+
+import (
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// quietZone is the white border around terminal QR codes, in modules
+const quietZone = 2
+
+// TerminalQR renders link as a QR code for a terminal. Each character
+// holds two modules with explicit colors, so it scans on dark and light
+// themes alike.
+func TerminalQR(link string) (string, error) {
+	code, err := qr.Encode(link, qr.M)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		last := ""
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			color := "\033[" + qrColor(code.Black(x, y), "30", "97") + ";" + qrColor(code.Black(x, y+1), "40", "107") + "m"
+			if color != last {
+				b.WriteString(color)
+				last = color
+			}
+			b.WriteString("▀")
+		}
+		b.WriteString("\033[0m\n")
+	}
+	return b.String(), nil
+}
+
+// PNG renders link as a QR code image
+func PNG(link string) ([]byte, error) {
+	code, err := qr.Encode(link, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
+
+func qrColor(black bool, dark, light string) string {
+	if black {
+		return dark
+	}
+	return light
+}
@@ -0,0 +1,310 @@
+package uri
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+// Version is the link format written by Link.String. Links without a
+// version come from older servers, where fragment and padding are off
+// unless set.
+const Version = 1
+
+const defaultPort = "443"
+
+// Link is one server as an xp:// link, with the client obfuscation
+// settings that travel along:
+//
+//	xp://KEY@HOST:PORT?v=1&transport=kcp&sni=...&kcp.mode=fast3#Name
+//
+// Transport settings are named by their path in the transport section
+// (kcp.obfs.mimic, raw.tcp_flags=PA,A) and left out when they have the
+// default value.
+type Link struct {
+	Server       config.ServerEndpoint // Transport is always set after Parse
+	Fragment     bool
+	Padding      bool
+	TimingJitter bool
+	Fingerprint  string
+
+	// Version the link was written with, 0 for links of older servers
+	// that only carry the transport mode. String always writes Version.
+	Version int
+}
+
+// Parse decodes an xp:// link
+func Parse(link string) (*Link, error) {
+	if !strings.HasPrefix(link, "xp://") {
+		return nil, fmt.Errorf("invalid URI scheme, expected xp://")
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI: %w", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("key not found in URI")
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("server not found in URI")
+	}
+	// Only bracketed IPv6 addresses may hold a colon
+	if host := u.Hostname(); strings.ContainsAny(host, "[]") || strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid server %q in URI", u.Hostname())
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	q := u.Query()
+	version := 0
+	if v := q.Get("v"); v != "" {
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid link version %q", v)
+		}
+		if version > Version {
+			return nil, fmt.Errorf("link version %d needs a newer client", version)
+		}
+	}
+
+	defaults := config.DefaultClientConfig()
+	l := &Link{
+		Server: config.ServerEndpoint{
+			Name:    u.Fragment,
+			Address: net.JoinHostPort(u.Hostname(), port),
+			Key:     u.User.Username(),
+			FakeSNI: defaults.Client.FakeSNI,
+		},
+		Fragment:     defaults.Obfuscation.FragmentEnabled(),
+		Padding:      defaults.Obfuscation.PaddingEnabled(),
+		TimingJitter: defaults.Obfuscation.TimingEnabled(),
+		Fingerprint:  defaults.Client.Fingerprint,
+		Version:      version,
+	}
+	if version == 0 {
+		l.Fragment, l.Padding = false, false
+	}
+
+	client := map[string]any{
+		"sni":           &l.Server.FakeSNI,
+		"fragment":      &l.Fragment,
+		"padding":       &l.Padding,
+		"timing_jitter": &l.TimingJitter,
+		"fingerprint":   &l.Fingerprint,
+	}
+	tc := defaults.Transport
+	fields := map[string]reflect.Value{}
+	walk(reflect.ValueOf(&tc).Elem(), "", func(name string, f reflect.Value) {
+		fields[name] = f
+	})
+	for name, values := range q {
+		value := values[0]
+		var f reflect.Value
+		if p, ok := client[name]; ok {
+			f = reflect.ValueOf(p).Elem()
+		} else if f, ok = fields[name]; !ok {
+			continue // from a newer server, or not ours
+		}
+		if err := setValue(f, value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q in URI", name, value)
+		}
+	}
+	l.Server.Transport = &tc
+	return l, nil
+}
+
+// String encodes the link. The fields older clients read (transport,
+// sni, fragment and padding) are always written.
+func (l *Link) String() string {
+	defaults := config.DefaultClientConfig()
+	tc := defaults.Transport
+	if l.Server.Transport != nil {
+		tc = *l.Server.Transport
+	}
+	if tc.Mode == "" {
+		tc.Mode = defaults.Transport.Mode
+	}
+
+	q := url.Values{}
+	q.Set("v", strconv.Itoa(Version))
+	q.Set("sni", l.Server.FakeSNI)
+	q.Set("fragment", strconv.FormatBool(l.Fragment))
+	q.Set("padding", strconv.FormatBool(l.Padding))
+	if l.TimingJitter != defaults.Obfuscation.TimingEnabled() {
+		q.Set("timing_jitter", strconv.FormatBool(l.TimingJitter))
+	}
+	if l.Fingerprint != "" && l.Fingerprint != defaults.Client.Fingerprint {
+		q.Set("fingerprint", l.Fingerprint)
+	}
+
+	fields := map[string]reflect.Value{}
+	walk(reflect.ValueOf(defaults.Transport), "", func(name string, f reflect.Value) {
+		fields[name] = f
+	})
+	walk(reflect.ValueOf(tc), "", func(name string, f reflect.Value) {
+		if name == "transport" || !reflect.DeepEqual(f.Interface(), fields[name].Interface()) {
+			q.Set(name, formatValue(f))
+		}
+	})
+
+	host, port, err := net.SplitHostPort(l.Server.Address)
+	if err != nil {
+		host, port = l.Server.Address, defaultPort
+	}
+	u := url.URL{
+		Scheme:   "xp",
+		User:     url.User(l.Server.Key),
+		Host:     net.JoinHostPort(host, port),
+		RawQuery: q.Encode(),
+	}
+	if l.Server.Name != l.Server.Address {
+		u.Fragment = l.Server.Name
+	}
+	return u.String()
+}
+
+// Encode returns a link for each server of the client config
+func Encode(cfg *config.Config) []string {
+	var links []string
+	for _, server := range cfg.Client.Endpoints() {
+		if server.Transport == nil {
+			tc := cfg.Transport
+			server.Transport = &tc
+		}
+		l := Link{
+			Server:       server,
+			Fragment:     cfg.Obfuscation.FragmentEnabled(),
+			Padding:      cfg.Obfuscation.PaddingEnabled(),
+			TimingJitter: cfg.Obfuscation.TimingEnabled(),
+			Fingerprint:  cfg.Client.Fingerprint,
+		}
+		links = append(links, l.String())
+	}
+	return links
+}
+
+// Decode builds a client config from one or more links, one per line.
+// The first link gives the transport and obfuscation settings; servers
+// whose transport differs keep their own.
+func Decode(text string) (*config.Config, error) {
+	var links []*Link
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		l, err := Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no xp:// link found")
+	}
+
+	cfg := config.DefaultClientConfig()
+	first := links[0]
+	cfg.Transport = *first.Server.Transport
+	cfg.Client.ServerAddr = first.Server.Address
+	cfg.Client.Key = first.Server.Key
+	cfg.Client.FakeSNI = first.Server.FakeSNI
+	cfg.Obfuscation.Fragment = &first.Fragment
+	cfg.Obfuscation.Padding = &first.Padding
+	cfg.Obfuscation.TimingJitter = &first.TimingJitter
+	cfg.Client.Fingerprint = first.Fingerprint
+	if len(links) == 1 && first.Server.Name == "" {
+		return &cfg, nil
+	}
+	for _, l := range links {
+		server := l.Server
+		if reflect.DeepEqual(*server.Transport, cfg.Transport) {
+			server.Transport = nil
+		}
+		cfg.Client.Servers = append(cfg.Client.Servers, server)
+	}
+	return &cfg, nil
+}
+
+// walk calls fn with every field of the struct v, named by its yaml path.
+// The mode is named transport, as in the first links. Bool pointers are
+// the deprecated transport.tls keys, which config.LoadConfig moves out.
+func walk(v reflect.Value, prefix string, fn func(name string, f reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if ft := t.Field(i).Type; ft.Kind() == reflect.Pointer && ft.Elem().Kind() == reflect.Bool {
+			continue
+		}
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if prefix == "" && name == "mode" {
+			name = "transport"
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if f := v.Field(i); f.Kind() == reflect.Struct {
+			walk(f, name, fn)
+		} else {
+			fn(name, f)
+		}
+	}
+}
+
+func formatValue(f reflect.Value) string {
+	switch f.Kind() {
+	case reflect.Pointer:
+		return formatValue(f.Elem())
+	case reflect.Slice:
+		return strings.Join(f.Interface().([]string), ",")
+	case reflect.Float64:
+		return strconv.FormatFloat(f.Float(), 'g', -1, 64)
+	default:
+		return fmt.Sprint(f.Interface())
+	}
+}
+
+func setValue(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(x)
+	case reflect.Slice:
+		var items []string
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		f.Set(reflect.ValueOf(items))
+	case reflect.Pointer:
+		v := reflect.New(f.Type().Elem())
+		if err := setValue(v.Elem(), value); err != nil {
+			return err
+		}
+		f.Set(v)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package uri
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/abbasnazari-0/xp-proto/pkg/config"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+func TestLinkRoundTrip(t *testing.T) {
+	defaults := config.DefaultClientConfig()
+	padding := 0
+
+	tests := []struct {
+		name   string
+		edit   func(l *Link)
+		expect string // a query parameter the link must carry
+	}{
+		{"defaults", func(l *Link) {}, "transport=tls"},
+		{"named", func(l *Link) { l.Server.Name = "Frankfurt #1" }, "#Frankfurt"},
+		{"ipv6 host", func(l *Link) { l.Server.Address = "[2001:db8::1]:8443" }, "@[2001:db8::1]:8443"},
+		{"client settings", func(l *Link) {
+			l.Server.FakeSNI = "cdn.example.com"
+			l.Fragment, l.Padding, l.TimingJitter = false, false, !l.TimingJitter
+			l.Fingerprint = "firefox"
+		}, "fingerprint=firefox"},
+		{"kcp tuning", func(l *Link) {
+			l.Server.Transport.Mode = "kcp"
+			l.Server.Transport.KCP.Mode = "fast3"
+			l.Server.Transport.KCP.Obfs = config.UDPObfsConfig{Enabled: true, Mimic: "quic", MaxPadding: &padding}
+			l.Server.Transport.KCP.PortHop.Ports = "20000-20100"
+			l.Server.Transport.KCP.PortHop.LossThreshold = 0.25
+		}, "kcp.obfs.max_padding=0"},
+		{"raw flags", func(l *Link) {
+			l.Server.Transport.Mode = "raw"
+			l.Server.Transport.Raw.TCPFlags = []string{"S", "PA"}
+		}, "raw.tcp_flags=S%2CPA"},
+		{"raw without flags", func(l *Link) {
+			l.Server.Transport.Mode = "raw"
+			l.Server.Transport.Raw.TCPFlags = nil
+		}, "raw.tcp_flags="},
+	}
+	for _, tt := range tests {
+		tc := defaults.Transport
+		l := &Link{
+			Server:       config.ServerEndpoint{Address: "vpn.example.com:443", Key: testKey, FakeSNI: defaults.Client.FakeSNI, Transport: &tc},
+			Fragment:     true,
+			Padding:      true,
+			TimingJitter: defaults.Obfuscation.TimingEnabled(),
+			Fingerprint:  defaults.Client.Fingerprint,
+			Version:      Version,
+		}
+		tt.edit(l)
+		if l.Server.Name == "" {
+			l.Server.Name = l.Server.Address
+		}
+
+		s := l.String()
+		if !strings.Contains(s, tt.expect) {
+			t.Errorf("%s: %s lacks %s", tt.name, s, tt.expect)
+		}
+		got, err := Parse(s)
+		if err != nil {
+			t.Errorf("%s: Parse(%s): %v", tt.name, s, err)
+			continue
+		}
+		if got.Server.Name == "" {
+			got.Server.Name = got.Server.Address
+		}
+		if !reflect.DeepEqual(got, l) {
+			t.Errorf("%s: round trip of %s\n got %+v %+v\nwant %+v %+v", tt.name, s, got, got.Server.Transport, l, l.Server.Transport)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		link    string
+		addr    string
+		mode    string
+		version int
+		err     bool
+	}{
+		// Links of older servers: no version, fragment and padding off
+		{"xp://" + testKey + "@vpn.example.com?transport=kcp", "vpn.example.com:443", "kcp", 0, false},
+		{"xp://" + testKey + "@1.2.3.4:8443?v=1", "1.2.3.4:8443", "tls", 1, false},
+		{"xp://" + testKey + "@[::1]:443?v=1&from_newer_server=1", "[::1]:443", "tls", 1, false},
+		{"vless://" + testKey + "@vpn.example.com", "", "", 0, true},
+		{"xp://vpn.example.com:443", "", "", 0, true},
+		{"xp://" + testKey + "@:443", "", "", 0, true},
+		{"xp://" + testKey + "@vpn.example.com?v=2", "", "", 0, true},
+		{"xp://" + testKey + "@vpn.example.com?v=0", "", "", 0, true},
+		{"xp://" + testKey + "@vpn.example.com?kcp.mtu=big", "", "", 0, true},
+		{"xp://" + testKey + "@vpn.example.com?fragment=maybe", "", "", 0, true},
+		{"xp://" + testKey + "@vpn.example.com:%zz", "", "", 0, true},
+		{"xp://" + testKey + "@]", "", "", 0, true},
+		{"xp://" + testKey + "@::", "", "", 0, true},
+	}
+	for _, tt := range tests {
+		l, err := Parse(tt.link)
+		if (err != nil) != tt.err {
+			t.Errorf("Parse(%s): error %v, want error %v", tt.link, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if l.Server.Address != tt.addr || l.Server.Transport.Mode != tt.mode || l.Version != tt.version {
+			t.Errorf("Parse(%s) = %s %s v%d, want %s %s v%d", tt.link, l.Server.Address, l.Server.Transport.Mode, l.Version, tt.addr, tt.mode, tt.version)
+		}
+		if l.Version == 0 && (l.Fragment || l.Padding) {
+			t.Errorf("Parse(%s): old link has fragment or padding on", tt.link)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	cfg := config.DefaultClientConfig()
+	cfg.Transport.Mode = "kcp"
+	kcp := cfg.Transport
+	kcp.KCP.Mode = "fast3"
+	cfg.Client.Servers = []config.ServerEndpoint{
+		{Name: "A", Address: "a.example.com:443", Key: testKey, FakeSNI: cfg.Client.FakeSNI},
+		{Name: "B", Address: "b.example.com:443", Key: testKey, FakeSNI: cfg.Client.FakeSNI, Transport: &kcp},
+	}
+
+	links := Encode(&cfg)
+	if len(links) != 2 {
+		t.Fatalf("Encode gave %d links, want 2", len(links))
+	}
+	got, err := Decode(strings.Join(links, "\n") + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Transport.Mode != "kcp" || len(got.Client.Servers) != 2 {
+		t.Fatalf("Decode: transport %s, %d servers", got.Transport.Mode, len(got.Client.Servers))
+	}
+	// Servers sharing the first transport use the global one
+	if got.Client.Servers[0].Transport != nil {
+		t.Error("first server kept its own transport")
+	}
+	if tc := got.Client.Servers[1].Transport; tc == nil || tc.KCP.Mode != "fast3" {
+		t.Errorf("second server transport %+v", tc)
+	}
+
+	if _, err := Decode("\n \n"); err == nil {
+		t.Error("Decode of no links succeeded")
+	}
+	if _, err := Decode(links[0] + "\nnot a link"); err == nil {
+		t.Error("Decode with an invalid line succeeded")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("xp://" + testKey + "@vpn.example.com:443?v=1&transport=kcp&kcp.obfs.max_padding=0&raw.tcp_flags=PA,A#Name")
+	f.Add("xp://" + testKey + "@[::1]?transport=raw")
+	f.Fuzz(func(t *testing.T, link string) {
+		l, err := Parse(link)
+		if err != nil {
+			return
+		}
+		// What parses must survive being written again
+		again, err := Parse(l.String())
+		if err != nil {
+			t.Fatalf("Parse(%q) gave %s, which does not parse: %v", link, l.String(), err)
+		}
+		if again.Server.Address != l.Server.Address || again.Server.Key != l.Server.Key {
+			t.Fatalf("round trip of %q: %s@%s, want %s@%s", link, again.Server.Key, again.Server.Address, l.Server.Key, l.Server.Address)
+		}
+	})
+}